@@ -23,6 +23,15 @@ type API struct {
 	sync.RWMutex
 	*bridge.Config
 	mrouter *melody.Melody
+	tokens  []*token
+
+	events      []event
+	eventRun    string
+	lastEventID uint64
+	subscribers map[chan event]struct{}
+
+	pushQueues  map[string]chan delivery
+	deadLetters sync.Mutex
 }
 
 type Message struct {
@@ -34,67 +43,73 @@ type Message struct {
 }
 
 func New(cfg *bridge.Config) bridge.Bridger {
-	b := &API{Config: cfg}
-	e := echo.New()
-	e.HideBanner = true
-	e.HidePort = true
-
-	b.mrouter = melody.New()
-	b.mrouter.HandleMessage(func(s *melody.Session, msg []byte) {
-		message := config.Message{}
-		err := json.Unmarshal(msg, &message)
-		if err != nil {
-			b.Log.Errorf("failed to decode message from byte[] '%s'", string(msg))
-			return
-		}
-		b.handleWebsocketMessage(message, s)
-	})
-	b.mrouter.HandleConnect(func(session *melody.Session) {
-		greet := b.getGreeting()
-		data, err := json.Marshal(greet)
-		if err != nil {
-			b.Log.Errorf("failed to encode message '%v'", greet)
-			return
-		}
-		err = session.Write(data)
-		if err != nil {
-			b.Log.Errorf("failed to write message '%s'", string(data))
-			return
-		}
-		// TODO: send message history buffer from `b.Messages` here
-	})
+	b := &API{
+		Config:      cfg,
+		eventRun:    newEventRun(),
+		subscribers: make(map[chan event]struct{}),
+	}
+	b.mrouter = b.newWebsocketRouter()
 
 	b.Messages = ring.Ring{}
 	if b.GetInt("Buffer") != 0 {
 		b.Messages.SetCapacity(b.GetInt("Buffer"))
 	}
-	if b.GetString("Token") != "" {
-		e.Use(middleware.KeyAuth(func(key string, c echo.Context) (bool, error) {
-			return key == b.GetString("Token"), nil
-		}))
+	if err := b.loadTokens(); err != nil {
+		b.Log.Fatalf("Invalid token configuration: %s", err)
 	}
 
+	b.startPush()
+
 	// Set RemoteNickFormat to a sane default
 	if !b.IsKeySet("RemoteNickFormat") {
 		b.Log.Debugln("RemoteNickFormat is unset, defaulting to \"{NICK}\"")
 		b.Config.Config.Viper().Set(b.GetConfigKey("RemoteNickFormat"), "{NICK}")
 	}
 
-	e.GET("/api/health", b.handleHealthcheck)
-	e.GET("/api/messages", b.handleMessages)
-	e.GET("/api/stream", b.handleStream)
-	e.GET("/api/websocket", b.handleWebsocket)
-	e.POST("/api/message", b.handlePostMessage)
+	e := b.newServer()
 	go func() {
 		if b.GetString("BindAddress") == "" {
 			b.Log.Fatalf("No BindAddress configured.")
 		}
-		b.Log.Infof("Listening on %s", b.GetString("BindAddress"))
-		b.Log.Fatal(e.Start(b.GetString("BindAddress")))
+		b.Log.Fatal(b.listen(e))
 	}()
 	return b
 }
 
+// listen serves the API on BindAddress, using TLS when a certificate or key is configured.
+func (b *API) listen(e *echo.Echo) error {
+	if cert, key := b.GetString("TLSCertificate"), b.GetString("TLSKey"); cert != "" || key != "" {
+		b.Log.Infof("Listening on %s (TLS)", b.GetString("BindAddress"))
+		return e.StartTLS(b.GetString("BindAddress"), cert, key)
+	}
+	b.Log.Infof("Listening on %s", b.GetString("BindAddress"))
+	return e.Start(b.GetString("BindAddress"))
+}
+
+// newServer sets up the echo server with the middlewares and the routes.
+func (b *API) newServer() *echo.Echo {
+	e := echo.New()
+	e.HideBanner = true
+	e.HidePort = true
+
+	// CORS needs to be handled before authentication, preflight requests don't carry a token
+	if origins := b.GetStringSlice("CORSAllowOrigins"); len(origins) > 0 {
+		e.Use(middleware.CORSWithConfig(middleware.CORSConfig{
+			AllowOrigins:  origins,
+			AllowHeaders:  []string{echo.HeaderAuthorization, echo.HeaderContentType, "Last-Event-ID"},
+			ExposeHeaders: []string{echo.HeaderContentType},
+		}))
+	}
+	if len(b.tokens) > 0 {
+		e.Use(b.authMiddleware())
+	}
+
+	for _, r := range b.routes() {
+		e.Add(r.method, r.path, r.handler)
+	}
+	return e
+}
+
 func (b *API) Connect() error {
 	return nil
 }
@@ -108,20 +123,25 @@ func (b *API) JoinChannel(channel config.ChannelInfo) error {
 }
 
 func (b *API) Send(msg config.Message) (string, error) {
-	b.Lock()
-	defer b.Unlock()
 	// ignore delete messages
 	if msg.Event == config.EventMsgDelete {
 		return "", nil
 	}
 	b.Log.Debugf("enqueueing message from %s on ring buffer", msg.Username)
+	b.Lock()
 	b.Messages.Enqueue(msg)
+	b.publishEvent(msg)
+	b.Unlock()
+	// push can write to the dead letter file, don't hold the lock for it
+	b.push(msg)
 
 	data, err := json.Marshal(msg)
 	if err != nil {
 		b.Log.Errorf("failed to encode message  '%s'", msg)
 	}
-	_ = b.mrouter.Broadcast(data)
+	_ = b.mrouter.BroadcastFilter(data, func(s *melody.Session) bool {
+		return b.allowed(sessionToken(s), scopeRead, msg.Gateway)
+	})
 	return "", nil
 }
 
@@ -134,6 +154,9 @@ func (b *API) handlePostMessage(c echo.Context) error {
 	if err := c.Bind(&message); err != nil {
 		return err
 	}
+	if err := b.checkScope(c, scopeWrite, message.Gateway); err != nil {
+		return err
+	}
 	// these values are fixed
 	message.Channel = "api"
 	message.Protocol = "api"
@@ -176,13 +199,39 @@ func (b *API) handlePostMessage(c echo.Context) error {
 }
 
 func (b *API) handleMessages(c echo.Context) error {
+	if err := b.checkReadable(c); err != nil {
+		return err
+	}
 	b.Lock()
 	defer b.Unlock()
-	c.JSONPretty(http.StatusOK, b.Messages.Values(), " ")
-	b.Messages = ring.Ring{}
+	c.JSONPretty(http.StatusOK, b.takeMessages(getToken(c)), " ")
 	return nil
 }
 
+// takeMessages removes the messages the token is allowed to read from the buffer and returns them.
+// Messages for other gateways are kept for other consumers.
+func (b *API) takeMessages(t *token) []interface{} {
+	var (
+		taken []interface{}
+		kept  []interface{}
+	)
+	for _, v := range b.Messages.Values() {
+		if msg, ok := v.(config.Message); ok && !b.allowed(t, scopeRead, msg.Gateway) {
+			kept = append(kept, v)
+			continue
+		}
+		taken = append(taken, v)
+	}
+	b.Messages = ring.Ring{}
+	if b.GetInt("Buffer") != 0 {
+		b.Messages.SetCapacity(b.GetInt("Buffer"))
+	}
+	for _, v := range kept {
+		b.Messages.Enqueue(v)
+	}
+	return taken
+}
+
 func (b *API) getGreeting() config.Message {
 	return config.Message{
 		Event:     config.EventAPIConnected,
@@ -191,6 +240,10 @@ func (b *API) getGreeting() config.Message {
 }
 
 func (b *API) handleStream(c echo.Context) error {
+	if err := b.checkReadable(c); err != nil {
+		return err
+	}
+	t := getToken(c)
 	c.Response().Header().Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
 	c.Response().WriteHeader(http.StatusOK)
 	greet := b.getGreeting()
@@ -202,11 +255,16 @@ func (b *API) handleStream(c echo.Context) error {
 		select {
 		// TODO: this causes issues, messages should be broadcasted to all connected clients
 		default:
-			msg := b.Messages.Dequeue()
-			if msg != nil {
+			// messages for gateways the token can't read stay in the buffer for other consumers
+			b.Lock()
+			msgs := b.takeMessages(t)
+			b.Unlock()
+			for _, msg := range msgs {
 				if err := json.NewEncoder(c.Response()).Encode(msg); err != nil {
 					return err
 				}
+			}
+			if len(msgs) > 0 {
 				c.Response().Flush()
 			}
 			time.Sleep(100 * time.Millisecond)
@@ -216,6 +274,39 @@ func (b *API) handleStream(c echo.Context) error {
 	}
 }
 
+// newWebsocketRouter returns the melody router that handles the websocket sessions.
+func (b *API) newWebsocketRouter() *melody.Melody {
+	m := melody.New()
+	m.HandleMessage(func(s *melody.Session, msg []byte) {
+		message := config.Message{}
+		err := json.Unmarshal(msg, &message)
+		if err != nil {
+			b.Log.Errorf("failed to decode message from byte[] '%s'", string(msg))
+			return
+		}
+		if !b.allowed(sessionToken(s), scopeWrite, message.Gateway) {
+			b.Log.Warnf("websocket session from %s denied write access to gateway %q", s.RemoteAddr(), message.Gateway)
+			return
+		}
+		b.handleWebsocketMessage(message, s)
+	})
+	m.HandleConnect(func(session *melody.Session) {
+		greet := b.getGreeting()
+		data, err := json.Marshal(greet)
+		if err != nil {
+			b.Log.Errorf("failed to encode message '%v'", greet)
+			return
+		}
+		err = session.Write(data)
+		if err != nil {
+			b.Log.Errorf("failed to write message '%s'", string(data))
+			return
+		}
+		// TODO: send message history buffer from `b.Messages` here
+	})
+	return m
+}
+
 func (b *API) handleWebsocketMessage(message config.Message, s *melody.Session) {
 	message.Channel = "api"
 	message.Protocol = "api"
@@ -228,14 +319,20 @@ func (b *API) handleWebsocketMessage(message config.Message, s *melody.Session)
 		b.Log.Errorf("failed to encode message for loopback '%v'", message)
 		return
 	}
-	_ = b.mrouter.BroadcastOthers(data, s)
+	_ = b.mrouter.BroadcastFilter(data, func(other *melody.Session) bool {
+		return other != s && b.allowed(sessionToken(other), scopeRead, message.Gateway)
+	})
 
 	b.Log.Debugf("Sending websocket message from %s on %s to gateway", message.Username, "api")
 	b.Remote <- message
 }
 
 func (b *API) handleWebsocket(c echo.Context) error {
-	err := b.mrouter.HandleRequest(c.Response(), c.Request())
+	keys := map[string]interface{}{}
+	if t := getToken(c); t != nil {
+		keys[tokenContextKey] = t
+	}
+	err := b.mrouter.HandleRequestWithKeys(c.Response(), c.Request(), keys)
 	if err != nil {
 		b.Log.Errorf("error in websocket handling  '%v'", err)
 		return err
@@ -0,0 +1,152 @@
+package api
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+
+	"github.com/42wim/matterbridge/bridge/config"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+	"github.com/olahol/melody"
+)
+
+const (
+	scopeRead  = "read"
+	scopeWrite = "write"
+	scopeAdmin = "admin"
+
+	// tokenContextKey is used to store the authenticated token in the echo context and melody session.
+	tokenContextKey = "apitoken"
+)
+
+// token is an authenticated API token with its allowed gateways and scopes.
+type token struct {
+	name     string
+	secret   string
+	gateways map[string]bool
+	scopes   map[string]bool
+}
+
+// can returns true if the token has the scope for the specified gateway.
+// A token without gateways is allowed on every gateway, an admin token can read and write to every gateway.
+func (t *token) can(scope, gateway string) bool {
+	if t.scopes[scopeAdmin] {
+		return true
+	}
+	if !t.scopes[scope] {
+		return false
+	}
+	return len(t.gateways) == 0 || t.gateways[gateway]
+}
+
+// loadTokens reads the Token and Tokens settings.
+// The legacy Token setting is converted to a token with admin scope.
+func (b *API) loadTokens() error {
+	var tokens []config.APIToken
+	if err := b.Config.Config.Viper().UnmarshalKey(b.GetConfigKey("Tokens"), &tokens); err != nil {
+		return err
+	}
+	if b.GetString("Token") != "" {
+		tokens = append(tokens, config.APIToken{
+			Name:   "default",
+			Token:  b.GetString("Token"),
+			Scopes: []string{scopeAdmin},
+		})
+	}
+
+	b.tokens = nil
+	for _, t := range tokens {
+		if t.Token == "" {
+			return errors.New("api token " + t.Name + " has an empty Token")
+		}
+		tok := &token{
+			name:     t.Name,
+			secret:   t.Token,
+			gateways: make(map[string]bool),
+			scopes:   make(map[string]bool),
+		}
+		for _, gw := range t.Gateways {
+			tok.gateways[gw] = true
+		}
+		for _, scope := range t.Scopes {
+			switch scope {
+			case scopeRead, scopeWrite, scopeAdmin:
+				tok.scopes[scope] = true
+			default:
+				return errors.New("api token " + t.Name + " has an unknown scope " + scope)
+			}
+		}
+		b.tokens = append(b.tokens, tok)
+	}
+	return nil
+}
+
+// authMiddleware returns the middleware validating the bearer token when tokens are configured.
+func (b *API) authMiddleware() echo.MiddlewareFunc {
+	return middleware.KeyAuthWithConfig(middleware.KeyAuthConfig{
+		// browsers can't set headers on EventSource and WebSocket connections
+		KeyLookup: "header:" + echo.HeaderAuthorization + ",query:token",
+		Validator: func(key string, c echo.Context) (bool, error) {
+			for _, t := range b.tokens {
+				if subtle.ConstantTimeCompare([]byte(key), []byte(t.secret)) == 1 {
+					c.Set(tokenContextKey, t)
+					return true, nil
+				}
+			}
+			return false, nil
+		},
+		ErrorHandler: func(err error, c echo.Context) error {
+			b.Log.Warnf("failed authentication from %s for %s: %s", c.RealIP(), c.Request().URL.Path, err)
+			return echo.NewHTTPError(http.StatusUnauthorized, "invalid or missing token")
+		},
+	})
+}
+
+// getToken returns the token used by the request, nil when authentication is disabled.
+func getToken(c echo.Context) *token {
+	t, _ := c.Get(tokenContextKey).(*token)
+	return t
+}
+
+// allowed returns true if the token has the scope for the gateway.
+// All access is allowed when no tokens are configured.
+func (b *API) allowed(t *token, scope, gateway string) bool {
+	if len(b.tokens) == 0 {
+		return true
+	}
+	return t != nil && t.can(scope, gateway)
+}
+
+// checkScope returns an error (and logs it) if the request isn't allowed to use the scope for the gateway.
+func (b *API) checkScope(c echo.Context, scope, gateway string) error {
+	t := getToken(c)
+	if b.allowed(t, scope, gateway) {
+		return nil
+	}
+	name := ""
+	if t != nil {
+		name = t.name
+	}
+	b.Log.Warnf("token %q from %s denied %s access to gateway %q", name, c.RealIP(), scope, gateway)
+	return echo.NewHTTPError(http.StatusForbidden, "token not allowed to "+scope+" gateway "+gateway)
+}
+
+// checkReadable returns an error (and logs it) if the request has no read access at all.
+func (b *API) checkReadable(c echo.Context) error {
+	t := getToken(c)
+	if len(b.tokens) == 0 || t != nil && (t.scopes[scopeRead] || t.scopes[scopeAdmin]) {
+		return nil
+	}
+	return b.checkScope(c, scopeRead, "")
+}
+
+// sessionToken returns the token stored in the websocket session.
+func sessionToken(s *melody.Session) *token {
+	v, ok := s.Get(tokenContextKey)
+	if !ok {
+		return nil
+	}
+	t, _ := v.(*token)
+	return t
+}
@@ -0,0 +1,204 @@
+package api
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/42wim/matterbridge/bridge/config"
+	"github.com/gorilla/websocket"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const tokensConfig = `
+[api.test]
+BindAddress="127.0.0.1:0"
+
+[[api.test.Tokens]]
+Name="admin"
+Token="admin-secret"
+Scopes=["admin"]
+
+[[api.test.Tokens]]
+Name="reader"
+Token="reader-secret"
+Gateways=["gw1"]
+Scopes=["read"]
+
+[[api.test.Tokens]]
+Name="reader2"
+Token="reader2-secret"
+Gateways=["gw2"]
+Scopes=["read"]
+
+[[api.test.Tokens]]
+Name="writer"
+Token="writer-secret"
+Gateways=["gw1"]
+Scopes=["write"]
+`
+
+func request(e http.Handler, method, path, secret, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	if secret != "" {
+		req.Header.Set("Authorization", "Bearer "+secret)
+	}
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestTokenCan(t *testing.T) {
+	b := newTestAPI(t, tokensConfig)
+	tokens := map[string]*token{}
+	for _, tok := range b.tokens {
+		tokens[tok.name] = tok
+	}
+
+	assert.True(t, tokens["admin"].can(scopeRead, "gw2"))
+	assert.True(t, tokens["admin"].can(scopeWrite, "gw2"))
+	assert.True(t, tokens["reader"].can(scopeRead, "gw1"))
+	assert.False(t, tokens["reader"].can(scopeRead, "gw2"))
+	assert.False(t, tokens["reader"].can(scopeWrite, "gw1"))
+	assert.True(t, tokens["writer"].can(scopeWrite, "gw1"))
+	assert.False(t, tokens["writer"].can(scopeRead, "gw1"))
+
+	// a token without gateways can use every gateway
+	all := &token{scopes: map[string]bool{scopeRead: true}}
+	assert.True(t, all.can(scopeRead, "gw2"))
+}
+
+func TestLoadTokensInvalid(t *testing.T) {
+	b := newTestAPI(t, "[api.test]\n")
+	for cfg, msg := range map[string]string{
+		"Name=\"bad\"\nToken=\"secret\"\nScopes=[\"delete\"]\n": "api token bad has an unknown scope delete",
+		"Name=\"empty\"\nScopes=[\"read\"]\n":                   "api token empty has an empty Token",
+	} {
+		b.Config.Config = config.NewConfigFromString(logrus.New(), []byte("[api.test]\n[[api.test.Tokens]]\n"+cfg))
+		assert.EqualError(t, b.loadTokens(), msg)
+	}
+}
+
+func TestPostMessageScopes(t *testing.T) {
+	b := newTestAPI(t, tokensConfig)
+	e := b.newServer()
+
+	for _, tc := range []struct {
+		secret  string
+		gateway string
+		status  int
+	}{
+		{"", "gw1", http.StatusUnauthorized},
+		{"wrong", "gw1", http.StatusUnauthorized},
+		{"reader-secret", "gw1", http.StatusForbidden},
+		{"writer-secret", "gw2", http.StatusForbidden},
+		{"writer-secret", "gw1", http.StatusOK},
+		{"admin-secret", "gw2", http.StatusOK},
+	} {
+		rec := request(e, http.MethodPost, "/api/message", tc.secret, `{"text":"hello","gateway":"`+tc.gateway+`"}`)
+		assert.Equal(t, tc.status, rec.Code, "token %q on %s", tc.secret, tc.gateway)
+	}
+	require.Len(t, b.Remote, 2)
+	assert.Equal(t, "gw1", (<-b.Remote).Gateway)
+	assert.Equal(t, "gw2", (<-b.Remote).Gateway)
+}
+
+func TestMessagesScopes(t *testing.T) {
+	b := newTestAPI(t, tokensConfig)
+	e := b.newServer()
+	for _, gw := range []string{"gw1", "gw2", "gw1"} {
+		_, err := b.Send(config.Message{Text: "hello " + gw, Gateway: gw})
+		require.NoError(t, err)
+	}
+
+	assert.Equal(t, http.StatusForbidden, request(e, http.MethodGet, "/api/messages", "writer-secret", "").Code)
+
+	var msgs []config.Message
+	rec := request(e, http.MethodGet, "/api/messages", "reader-secret", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &msgs))
+	require.Len(t, msgs, 2)
+	for _, msg := range msgs {
+		assert.Equal(t, "gw1", msg.Gateway)
+	}
+
+	// the message the reader can't read is kept for the admin
+	msgs = nil
+	rec = request(e, http.MethodGet, "/api/messages", "admin-secret", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &msgs))
+	require.Len(t, msgs, 1)
+	assert.Equal(t, "gw2", msgs[0].Gateway)
+}
+
+func TestStreamScopes(t *testing.T) {
+	b := newTestAPI(t, tokensConfig)
+	srv := httptest.NewServer(b.newServer())
+	t.Cleanup(srv.Close)
+	for _, gw := range []string{"gw2", "gw1"} {
+		_, err := b.Send(config.Message{Text: "hello " + gw, Gateway: gw})
+		require.NoError(t, err)
+	}
+
+	req, err := http.NewRequest(http.MethodGet, srv.URL+"/api/stream", nil)
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer reader-secret")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	scanner := bufio.NewScanner(resp.Body)
+	var msg config.Message
+	require.True(t, scanner.Scan())
+	require.NoError(t, json.Unmarshal(scanner.Bytes(), &msg))
+	assert.Equal(t, config.EventAPIConnected, msg.Event)
+	require.True(t, scanner.Scan())
+	require.NoError(t, json.Unmarshal(scanner.Bytes(), &msg))
+	assert.Equal(t, "hello gw1", msg.Text)
+
+	// the stream doesn't consume the message for the other gateway
+	b.Lock()
+	defer b.Unlock()
+	values := b.Messages.Values()
+	require.Len(t, values, 1)
+	assert.Equal(t, "gw2", values[0].(config.Message).Gateway)
+}
+
+func TestWebsocketScopes(t *testing.T) {
+	b := newTestAPI(t, tokensConfig)
+	srv := httptest.NewServer(b.newServer())
+	t.Cleanup(srv.Close)
+
+	dial := func(secret string) *websocket.Conn {
+		header := http.Header{}
+		header.Set("Authorization", "Bearer "+secret)
+		conn, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/api/websocket", header)
+		require.NoError(t, err)
+		resp.Body.Close()
+		t.Cleanup(func() { conn.Close() })
+		var greet config.Message
+		require.NoError(t, conn.ReadJSON(&greet))
+		assert.Equal(t, config.EventAPIConnected, greet.Event)
+		return conn
+	}
+	admin := dial("admin-secret")
+	reader := dial("reader-secret")
+	reader2 := dial("reader2-secret")
+
+	// the messages of other sessions only go to the sessions that can read their gateway
+	require.NoError(t, admin.WriteJSON(config.Message{Text: "hello gw1", Gateway: "gw1"}))
+	require.NoError(t, admin.WriteJSON(config.Message{Text: "hello gw2", Gateway: "gw2"}))
+	var msg config.Message
+	require.NoError(t, reader.ReadJSON(&msg))
+	assert.Equal(t, "hello gw1", msg.Text)
+	require.NoError(t, reader2.ReadJSON(&msg))
+	assert.Equal(t, "hello gw2", msg.Text)
+	assert.Len(t, b.Remote, 2)
+}
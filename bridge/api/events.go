@@ -0,0 +1,181 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/42wim/matterbridge/bridge/config"
+	"github.com/labstack/echo/v4"
+	"github.com/rs/xid"
+)
+
+const (
+	// defaultEventBuffer is the amount of events kept for resuming when Buffer isn't set.
+	defaultEventBuffer = 10
+	// eventKeepAlive is the interval between keepalive comments on idle streams.
+	eventKeepAlive = 30 * time.Second
+)
+
+// event is a message with the ID it has on the /api/events stream.
+type event struct {
+	id  uint64
+	msg config.Message
+}
+
+// newEventRun returns the prefix of the event IDs of this run.
+// Event IDs restart at 1 after a restart, the prefix keeps clients from resuming after an ID of another run.
+func newEventRun() string {
+	return xid.New().String()
+}
+
+// eventID returns the ID of the event as sent to clients, "<run>-<id>".
+func (b *API) eventID(ev event) string {
+	return b.eventRun + "-" + strconv.FormatUint(ev.id, 10)
+}
+
+// parseEventID returns the run and ID of an event ID sent by a client.
+func parseEventID(s string) (string, uint64, error) {
+	i := strings.LastIndex(s, "-")
+	if i < 0 {
+		return "", 0, errors.New("invalid event ID " + s)
+	}
+	id, err := strconv.ParseUint(s[i+1:], 10, 64)
+	if err != nil {
+		return "", 0, err
+	}
+	return s[:i], id, nil
+}
+
+// publishEvent adds the message to the event history and sends it to all subscribers.
+// The caller must hold the lock.
+func (b *API) publishEvent(msg config.Message) {
+	b.lastEventID++
+	ev := event{id: b.lastEventID, msg: msg}
+
+	size := b.GetInt("Buffer")
+	if size == 0 {
+		size = defaultEventBuffer
+	}
+	b.events = append(b.events, ev)
+	if len(b.events) > size {
+		b.events = b.events[len(b.events)-size:]
+	}
+
+	for ch := range b.subscribers {
+		select {
+		case ch <- ev:
+		default:
+			b.Log.Warnf("event subscriber too slow, dropping event %d", ev.id)
+		}
+	}
+}
+
+// subscribe registers a new subscriber and returns the events after lastID of run that it missed.
+func (b *API) subscribe(run string, lastID uint64) (chan event, []event) {
+	b.Lock()
+	defer b.Unlock()
+	ch := make(chan event, 100)
+	b.subscribers[ch] = struct{}{}
+
+	// an ID of another run (eg before a restart) replays everything we have
+	if run != b.eventRun || lastID > b.lastEventID {
+		lastID = 0
+	}
+	var missed []event
+	for _, ev := range b.events {
+		if ev.id > lastID {
+			missed = append(missed, ev)
+		}
+	}
+	return ch, missed
+}
+
+func (b *API) unsubscribe(ch chan event) {
+	b.Lock()
+	defer b.Unlock()
+	delete(b.subscribers, ch)
+}
+
+// handleEvents streams messages as Server-Sent Events.
+// Clients can resume using the Last-Event-ID header or the lastEventId query parameter.
+func (b *API) handleEvents(c echo.Context) error {
+	if err := b.checkReadable(c); err != nil {
+		return err
+	}
+	t := getToken(c)
+
+	lastID := c.Request().Header.Get("Last-Event-ID")
+	if lastID == "" {
+		lastID = c.QueryParam("lastEventId")
+	}
+	var (
+		run  string
+		last uint64
+	)
+	if lastID != "" {
+		var err error
+		if run, last, err = parseEventID(lastID); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "invalid Last-Event-ID")
+		}
+	}
+
+	ch, missed := b.subscribe(run, last)
+	defer b.unsubscribe(ch)
+
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, "text/event-stream")
+	res.Header().Set(echo.HeaderCacheControl, "no-cache")
+	res.Header().Set(echo.HeaderConnection, "keep-alive")
+	res.WriteHeader(http.StatusOK)
+
+	greet, err := json.Marshal(b.getGreeting())
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(res, "event: %s\ndata: %s\n\n", config.EventAPIConnected, greet); err != nil {
+		return err
+	}
+	for _, ev := range missed {
+		if err := b.writeEvent(c, t, ev); err != nil {
+			return err
+		}
+	}
+	res.Flush()
+
+	ticker := time.NewTicker(eventKeepAlive)
+	defer ticker.Stop()
+	for {
+		select {
+		case ev := <-ch:
+			if err := b.writeEvent(c, t, ev); err != nil {
+				return err
+			}
+		case <-ticker.C:
+			if _, err := fmt.Fprint(res, ": keepalive\n\n"); err != nil {
+				return err
+			}
+		case <-c.Request().Context().Done():
+			return nil
+		}
+		res.Flush()
+	}
+}
+
+// writeEvent writes the event if the token is allowed to read it.
+func (b *API) writeEvent(c echo.Context, t *token, ev event) error {
+	if !b.allowed(t, scopeRead, ev.msg.Gateway) {
+		return nil
+	}
+	data, err := json.Marshal(ev.msg)
+	if err != nil {
+		b.Log.Errorf("failed to encode event %d: %s", ev.id, err)
+		return nil
+	}
+	_, err = fmt.Fprintf(c.Response(), "id: %s\nevent: message\ndata: %s\n\n", b.eventID(ev), data)
+	return err
+}
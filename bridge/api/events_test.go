@@ -0,0 +1,142 @@
+package api
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/42wim/matterbridge/bridge/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// sseEvent is an event read from a Server-Sent Events stream.
+type sseEvent struct {
+	id   string
+	name string
+	msg  config.Message
+}
+
+// readEvent reads the next event, skipping comments.
+func readEvent(t *testing.T, r *bufio.Reader) sseEvent {
+	var ev sseEvent
+	for {
+		line, err := r.ReadString('\n')
+		require.NoError(t, err)
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "" && ev.name != "":
+			return ev
+		case strings.HasPrefix(line, "id: "):
+			ev.id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "event: "):
+			ev.name = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			require.NoError(t, json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &ev.msg))
+		}
+	}
+}
+
+// openEvents connects to /api/events with the token and Last-Event-ID and reads the api_connected event.
+func openEvents(t *testing.T, url, secret, lastID string) *bufio.Reader {
+	req, err := http.NewRequest(http.MethodGet, url+"/api/events", nil)
+	require.NoError(t, err)
+	if secret != "" {
+		req.Header.Set("Authorization", "Bearer "+secret)
+	}
+	if lastID != "" {
+		req.Header.Set("Last-Event-ID", lastID)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	t.Cleanup(func() { resp.Body.Close() })
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	r := bufio.NewReader(resp.Body)
+	assert.Equal(t, config.EventAPIConnected, readEvent(t, r).name)
+	return r
+}
+
+func TestEvents(t *testing.T) {
+	b := newTestAPI(t, "[api.test]\n")
+	srv := httptest.NewServer(b.newServer())
+	t.Cleanup(srv.Close)
+	for _, text := range []string{"one", "two"} {
+		_, err := b.Send(config.Message{Text: text, Gateway: "gw1"})
+		require.NoError(t, err)
+	}
+
+	r := openEvents(t, srv.URL, "", "")
+	first := readEvent(t, r)
+	assert.Equal(t, "message", first.name)
+	assert.Equal(t, "one", first.msg.Text)
+	assert.Equal(t, "two", readEvent(t, r).msg.Text)
+
+	// new messages are streamed
+	_, err := b.Send(config.Message{Text: "three", Gateway: "gw1"})
+	require.NoError(t, err)
+	assert.Equal(t, "three", readEvent(t, r).msg.Text)
+
+	// a client resumes after the last event it has seen
+	r = openEvents(t, srv.URL, "", first.id)
+	assert.Equal(t, "two", readEvent(t, r).msg.Text)
+	assert.Equal(t, "three", readEvent(t, r).msg.Text)
+}
+
+func TestEventsOtherRun(t *testing.T) {
+	b := newTestAPI(t, "[api.test]\n")
+	srv := httptest.NewServer(b.newServer())
+	t.Cleanup(srv.Close)
+	for _, text := range []string{"one", "two"} {
+		_, err := b.Send(config.Message{Text: text, Gateway: "gw1"})
+		require.NoError(t, err)
+	}
+
+	// an ID from before a restart replays all messages instead of skipping the ones with a lower ID
+	r := openEvents(t, srv.URL, "", newEventRun()+"-1")
+	assert.Equal(t, "one", readEvent(t, r).msg.Text)
+	assert.Equal(t, "two", readEvent(t, r).msg.Text)
+
+	req := httptest.NewRequest(http.MethodGet, "/api/events", nil)
+	req.Header.Set("Last-Event-ID", "1")
+	rec := httptest.NewRecorder()
+	b.newServer().ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+func TestEventsScopes(t *testing.T) {
+	b := newTestAPI(t, tokensConfig)
+	srv := httptest.NewServer(b.newServer())
+	t.Cleanup(srv.Close)
+	for _, gw := range []string{"gw2", "gw1"} {
+		_, err := b.Send(config.Message{Text: "hello " + gw, Gateway: gw})
+		require.NoError(t, err)
+	}
+
+	assert.Equal(t, http.StatusForbidden, request(b.newServer(), http.MethodGet, "/api/events", "writer-secret", "").Code)
+
+	r := openEvents(t, srv.URL, "reader-secret", "")
+	assert.Equal(t, "hello gw1", readEvent(t, r).msg.Text)
+	_, err := b.Send(config.Message{Text: "bye gw2", Gateway: "gw2"})
+	require.NoError(t, err)
+	_, err = b.Send(config.Message{Text: "bye gw1", Gateway: "gw1"})
+	require.NoError(t, err)
+	assert.Equal(t, "bye gw1", readEvent(t, r).msg.Text)
+}
+
+func TestParseEventID(t *testing.T) {
+	b := newTestAPI(t, "[api.test]\n")
+	run, id, err := parseEventID(b.eventID(event{id: 42}))
+	require.NoError(t, err)
+	assert.Equal(t, b.eventRun, run)
+	assert.Equal(t, uint64(42), id)
+
+	_, _, err = parseEventID("42")
+	assert.Error(t, err)
+	_, _, err = parseEventID("run-x")
+	assert.Error(t, err)
+}
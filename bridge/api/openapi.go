@@ -0,0 +1,275 @@
+package api
+
+import (
+	"net/http"
+	"path"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/42wim/matterbridge/bridge/config"
+	"github.com/42wim/matterbridge/version"
+	"github.com/labstack/echo/v4"
+)
+
+const openAPIVersion = "3.0.3"
+
+// route describes an API endpoint.
+// The routes are used both to register the handlers and to generate the OpenAPI spec, so they can't drift apart.
+type route struct {
+	method      string
+	path        string
+	summary     string
+	description string
+	handler     echo.HandlerFunc
+	// request is a value of the JSON request body type, nil if there's no body.
+	request interface{}
+	// status is the HTTP status code on success.
+	status int
+	// contentType and response describe the response body, a nil response is a plain string.
+	contentType string
+	response    interface{}
+}
+
+// routes returns all endpoints of the API.
+func (b *API) routes() []route {
+	return []route{
+		{
+			method:      http.MethodGet,
+			path:        "/api/health",
+			summary:     "Checks if the server is alive",
+			handler:     b.handleHealthcheck,
+			status:      http.StatusOK,
+			contentType: echo.MIMETextPlainCharsetUTF8,
+		},
+		{
+			method:      http.MethodGet,
+			path:        "/api/messages",
+			summary:     "List new messages",
+			description: "Returns the buffered messages the token can read and removes them from the buffer.",
+			handler:     b.handleMessages,
+			status:      http.StatusOK,
+			contentType: echo.MIMEApplicationJSON,
+			response:    []config.Message{},
+		},
+		{
+			method:      http.MethodGet,
+			path:        "/api/stream",
+			summary:     "Stream realtime messages",
+			description: "Streams newline separated JSON messages, starting with an api_connected event.",
+			handler:     b.handleStream,
+			status:      http.StatusOK,
+			contentType: "application/x-json-stream",
+			response:    config.Message{},
+		},
+		{
+			method:  http.MethodGet,
+			path:    "/api/events",
+			summary: "Stream realtime messages as Server-Sent Events",
+			description: "Every message is sent as a `message` event with an ID that is unique per run. " +
+				"Clients resume after the Last-Event-ID header or lastEventId query parameter.",
+			handler:     b.handleEvents,
+			status:      http.StatusOK,
+			contentType: "text/event-stream",
+			response:    config.Message{},
+		},
+		{
+			method:  http.MethodGet,
+			path:    "/api/websocket",
+			summary: "Send and receive messages over a websocket",
+			description: "After the upgrade the server sends an api_connected event followed by every message as JSON. " +
+				"Messages sent by the client are JSON encoded messages.",
+			handler: b.handleWebsocket,
+			request: config.Message{},
+			status:  http.StatusSwitchingProtocols,
+		},
+		{
+			method:      http.MethodPost,
+			path:        "/api/message",
+			summary:     "Create a message",
+			description: "Channel, protocol, account, ID and timestamp are set by the API.",
+			handler:     b.handlePostMessage,
+			request:     config.Message{},
+			status:      http.StatusOK,
+			contentType: echo.MIMEApplicationJSON,
+			response:    config.Message{},
+		},
+		{
+			method:      http.MethodGet,
+			path:        "/api/openapi.json",
+			summary:     "OpenAPI specification of this API",
+			handler:     b.handleOpenAPI,
+			status:      http.StatusOK,
+			contentType: echo.MIMEApplicationJSON,
+			response:    map[string]interface{}{},
+		},
+	}
+}
+
+func (b *API) handleOpenAPI(c echo.Context) error {
+	return c.JSONPretty(http.StatusOK, b.openAPISpec(), " ")
+}
+
+// openAPISpec generates the OpenAPI document from the routes and the message types.
+func (b *API) openAPISpec() map[string]interface{} {
+	schemas := map[string]interface{}{}
+	paths := map[string]interface{}{}
+
+	for _, r := range b.routes() {
+		op := map[string]interface{}{
+			"summary":     r.summary,
+			"operationId": operationID(r),
+			"responses":   b.openAPIResponses(r, schemas),
+		}
+		if r.description != "" {
+			op["description"] = r.description
+		}
+		if r.request != nil {
+			op["requestBody"] = map[string]interface{}{
+				"required": true,
+				"content": map[string]interface{}{
+					echo.MIMEApplicationJSON: map[string]interface{}{
+						"schema": schemaFor(reflect.TypeOf(r.request), schemas),
+					},
+				},
+			}
+		}
+		item, ok := paths[r.path].(map[string]interface{})
+		if !ok {
+			item = map[string]interface{}{}
+			paths[r.path] = item
+		}
+		item[strings.ToLower(r.method)] = op
+	}
+
+	spec := map[string]interface{}{
+		"openapi": openAPIVersion,
+		"info": map[string]interface{}{
+			"title":       "Matterbridge API",
+			"description": "A read/write API for the Matterbridge chat bridge.",
+			"version":     version.Release,
+			"license": map[string]interface{}{
+				"name": "Apache 2.0",
+				"url":  "https://github.com/42wim/matterbridge/blob/master/LICENSE",
+			},
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas": schemas,
+			"securitySchemes": map[string]interface{}{
+				"bearerAuth": map[string]interface{}{
+					"type":   "http",
+					"scheme": "bearer",
+				},
+				"tokenQuery": map[string]interface{}{
+					"type": "apiKey",
+					"in":   "query",
+					"name": "token",
+				},
+			},
+		},
+	}
+	if len(b.tokens) > 0 {
+		spec["security"] = []interface{}{
+			map[string]interface{}{"bearerAuth": []string{}},
+			map[string]interface{}{"tokenQuery": []string{}},
+		}
+	}
+	return spec
+}
+
+func (b *API) openAPIResponses(r route, schemas map[string]interface{}) map[string]interface{} {
+	ok := map[string]interface{}{
+		"description": http.StatusText(r.status),
+	}
+	if r.contentType != "" {
+		schema := map[string]interface{}{"type": "string"}
+		if r.response != nil {
+			schema = schemaFor(reflect.TypeOf(r.response), schemas)
+		}
+		ok["content"] = map[string]interface{}{
+			r.contentType: map[string]interface{}{"schema": schema},
+		}
+	}
+	responses := map[string]interface{}{
+		strconv.Itoa(r.status): ok,
+	}
+	if len(b.tokens) > 0 {
+		responses[strconv.Itoa(http.StatusUnauthorized)] = map[string]interface{}{"description": "Invalid or missing token"}
+		responses[strconv.Itoa(http.StatusForbidden)] = map[string]interface{}{"description": "Token not allowed on this gateway"}
+	}
+	return responses
+}
+
+// operationID returns an identifier like getApiMessages for a route.
+func operationID(r route) string {
+	id := strings.ToLower(r.method)
+	for _, part := range strings.FieldsFunc(strings.TrimSuffix(r.path, path.Ext(r.path)), func(c rune) bool {
+		return c == '/'
+	}) {
+		id += strings.ToUpper(part[:1]) + part[1:]
+	}
+	return id
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// schemaFor returns the JSON schema of the type, structs are added to schemas and referenced.
+func schemaFor(t reflect.Type, schemas map[string]interface{}) map[string]interface{} {
+	if t == timeType {
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	}
+	switch t.Kind() {
+	case reflect.Ptr:
+		return schemaFor(t.Elem(), schemas)
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]interface{}{"type": "string", "format": "byte"}
+		}
+		return map[string]interface{}{"type": "array", "items": schemaFor(t.Elem(), schemas)}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": schemaFor(t.Elem(), schemas)}
+	case reflect.Struct:
+		name := path.Base(t.PkgPath()) + "." + t.Name()
+		if _, ok := schemas[name]; !ok {
+			// register first to handle recursive types
+			schemas[name] = nil
+			schemas[name] = structSchema(t, schemas)
+		}
+		return map[string]interface{}{"$ref": "#/components/schemas/" + name}
+	}
+	// interface{} can be anything
+	return map[string]interface{}{}
+}
+
+func structSchema(t reflect.Type, schemas map[string]interface{}) map[string]interface{} {
+	props := map[string]interface{}{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+		name := f.Name
+		if tag, ok := f.Tag.Lookup("json"); ok {
+			tagName := strings.Split(tag, ",")[0]
+			if tagName == "-" {
+				continue
+			}
+			if tagName != "" {
+				name = tagName
+			}
+		}
+		props[name] = schemaFor(f.Type, schemas)
+	}
+	return map[string]interface{}{"type": "object", "properties": props}
+}
@@ -0,0 +1,94 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/42wim/matterbridge/bridge/bridgetest"
+	"github.com/42wim/matterbridge/bridge/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestAPI(t *testing.T, cfg string) *API {
+	b := &API{
+		Config:      bridgetest.Config("api.test", cfg),
+		eventRun:    newEventRun(),
+		subscribers: make(map[chan event]struct{}),
+	}
+	b.mrouter = b.newWebsocketRouter()
+	require.NoError(t, b.loadTokens())
+	return b
+}
+
+// endpoints are the endpoints of the API, kept by hand so the test doesn't compare the route table with itself.
+var endpoints = []string{
+	"get /api/health",
+	"get /api/messages",
+	"get /api/stream",
+	"get /api/events",
+	"get /api/websocket",
+	"post /api/message",
+	"get /api/openapi.json",
+}
+
+func TestOpenAPIMatchesRoutes(t *testing.T) {
+	b := newTestAPI(t, "[api.test]\nBindAddress=\"127.0.0.1:0\"\n")
+	e := b.newServer()
+
+	var registered []string
+	for _, r := range e.Routes() {
+		registered = append(registered, strings.ToLower(r.Method)+" "+r.Path)
+	}
+	assert.ElementsMatch(t, endpoints, registered, "routes registered on the server")
+
+	var documented []string
+	for p, item := range b.openAPISpec()["paths"].(map[string]interface{}) {
+		for method := range item.(map[string]interface{}) {
+			documented = append(documented, method+" "+p)
+			// the documented operation is routed to a handler by the server
+			c := e.NewContext(httptest.NewRequest(strings.ToUpper(method), p, nil), httptest.NewRecorder())
+			e.Router().Find(strings.ToUpper(method), p, c)
+			assert.Equal(t, p, c.Path(), "OpenAPI spec documents %s %s which isn't routed", method, p)
+		}
+	}
+	assert.ElementsMatch(t, endpoints, documented, "operations in the OpenAPI spec")
+}
+
+func TestOpenAPIMessageSchema(t *testing.T) {
+	b := newTestAPI(t, "[api.test]\nBindAddress=\"127.0.0.1:0\"\n")
+	spec := b.openAPISpec()
+	schemas := spec["components"].(map[string]interface{})["schemas"].(map[string]interface{})
+	props := schemas["config.Message"].(map[string]interface{})["properties"].(map[string]interface{})
+
+	data, err := json.Marshal(config.Message{})
+	require.NoError(t, err)
+	fields := map[string]interface{}{}
+	require.NoError(t, json.Unmarshal(data, &fields))
+
+	for name := range fields {
+		assert.Contains(t, props, name, "config.Message field %s is missing from the OpenAPI spec", name)
+	}
+	for name := range props {
+		assert.Contains(t, fields, name, "OpenAPI spec documents config.Message field %s which doesn't exist", name)
+	}
+}
+
+func TestOpenAPIServed(t *testing.T) {
+	b := newTestAPI(t, "[api.test]\nBindAddress=\"127.0.0.1:0\"\nToken=\"secret\"\n")
+	e := b.newServer()
+
+	req := httptest.NewRequest(http.MethodGet, "/api/openapi.json", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	spec := map[string]interface{}{}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &spec))
+	assert.Equal(t, openAPIVersion, spec["openapi"])
+	assert.Contains(t, spec, "security")
+}
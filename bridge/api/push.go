@@ -0,0 +1,182 @@
+package api
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/42wim/matterbridge/bridge/config"
+	"github.com/jpillora/backoff"
+	"github.com/rs/xid"
+)
+
+const (
+	// defaultPushRetries is the amount of retries for a delivery when PushRetries isn't set.
+	defaultPushRetries = 5
+	// pushQueueSize is the amount of deliveries queued per URL before we start dropping them.
+	pushQueueSize = 1000
+
+	headerPushSignature = "X-Matterbridge-Signature"
+	headerPushDelivery  = "X-Matterbridge-Delivery"
+	headerPushTimestamp = "X-Matterbridge-Timestamp"
+)
+
+// pushRetryMin is the wait before the first retry of a delivery, doubling on every retry.
+var pushRetryMin = time.Second
+
+// delivery is a message POSTed to a push URL.
+type delivery struct {
+	id   string
+	url  string
+	body []byte
+}
+
+// deadLetter is what we write to the PushDeadLetterFile for failed deliveries.
+type deadLetter struct {
+	Delivery  string          `json:"delivery"`
+	URL       string          `json:"url"`
+	Error     string          `json:"error"`
+	Timestamp time.Time       `json:"timestamp"`
+	Message   json.RawMessage `json:"message"`
+}
+
+// startPush starts a delivery worker for every configured PushURLs entry.
+// Every URL has its own queue so a slow endpoint doesn't hold up the others.
+func (b *API) startPush() {
+	b.pushQueues = make(map[string]chan delivery)
+	for _, url := range b.GetStringSlice("PushURLs") {
+		if _, ok := b.pushQueues[url]; ok {
+			continue
+		}
+		queue := make(chan delivery, pushQueueSize)
+		b.pushQueues[url] = queue
+		go b.pushWorker(queue)
+		b.Log.Infof("Pushing messages to %s", url)
+	}
+}
+
+// push queues the message for delivery to every push URL.
+func (b *API) push(msg config.Message) {
+	if len(b.pushQueues) == 0 {
+		return
+	}
+	body, err := json.Marshal(msg)
+	if err != nil {
+		b.Log.Errorf("failed to encode message for push '%v': %s", msg, err)
+		return
+	}
+	for url, queue := range b.pushQueues {
+		d := delivery{id: xid.New().String(), url: url, body: body}
+		select {
+		case queue <- d:
+		default:
+			b.deadLetter(d, fmt.Errorf("queue full"))
+		}
+	}
+}
+
+func (b *API) pushWorker(queue chan delivery) {
+	client := &http.Client{Timeout: 10 * time.Second}
+	for d := range queue {
+		b.deliver(client, d)
+	}
+}
+
+// deliver POSTs the delivery, retrying with an exponential backoff.
+func (b *API) deliver(client *http.Client, d delivery) {
+	retries := defaultPushRetries
+	if b.IsKeySet("PushRetries") {
+		retries = b.GetInt("PushRetries")
+	}
+	bf := &backoff.Backoff{
+		Min:    pushRetryMin,
+		Max:    5 * time.Minute,
+		Jitter: true,
+	}
+
+	var err error
+	for attempt := 0; attempt <= retries; attempt++ {
+		if attempt > 0 {
+			wait := bf.Duration()
+			b.Log.Debugf("retrying delivery %s to %s in %s: %s", d.id, d.url, wait, err)
+			time.Sleep(wait)
+		}
+		if err = b.post(client, d); err == nil {
+			b.Log.Debugf("delivered %s to %s", d.id, d.url)
+			return
+		}
+	}
+	b.deadLetter(d, err)
+}
+
+func (b *API) post(client *http.Client, d delivery) error {
+	req, err := http.NewRequest(http.MethodPost, d.url, bytes.NewReader(d.body))
+	if err != nil {
+		return err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(headerPushDelivery, d.id)
+	req.Header.Set(headerPushTimestamp, timestamp)
+	if secret := b.GetString("PushSecret"); secret != "" {
+		req.Header.Set(headerPushSignature, "sha256="+sign(secret, timestamp, d.body))
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// sign returns the hex encoded HMAC-SHA256 of "<timestamp>.<body>".
+// Including the timestamp allows receivers to reject replayed deliveries.
+func sign(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// deadLetter logs a failed delivery and appends it to the PushDeadLetterFile if configured.
+// The workers of all push URLs share the file, so the writes are serialized.
+func (b *API) deadLetter(d delivery, err error) {
+	b.Log.Errorf("delivery %s to %s failed: %s", d.id, d.url, err)
+	path := b.GetString("PushDeadLetterFile")
+	if path == "" {
+		return
+	}
+	data, jerr := json.Marshal(deadLetter{
+		Delivery:  d.id,
+		URL:       d.url,
+		Error:     err.Error(),
+		Timestamp: time.Now(),
+		Message:   d.body,
+	})
+	if jerr != nil {
+		b.Log.Errorf("failed to encode dead letter %s: %s", d.id, jerr)
+		return
+	}
+	b.deadLetters.Lock()
+	defer b.deadLetters.Unlock()
+	f, ferr := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if ferr != nil {
+		b.Log.Errorf("failed to open dead letter file %s: %s", path, ferr)
+		return
+	}
+	defer f.Close()
+	if _, ferr = f.Write(append(data, '\n')); ferr != nil {
+		b.Log.Errorf("failed to write dead letter %s: %s", d.id, ferr)
+	}
+}
@@ -0,0 +1,130 @@
+package api
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/42wim/matterbridge/bridge/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// pushReceiver is a push endpoint recording the deliveries with a valid signature.
+// It fails the first failures requests.
+type pushReceiver struct {
+	*httptest.Server
+	t        *testing.T
+	secret   string
+	failures int
+
+	mutex    sync.Mutex
+	requests int
+	received []config.Message
+}
+
+func newPushReceiver(t *testing.T, secret string, failures int) *pushReceiver {
+	r := &pushReceiver{t: t, secret: secret, failures: failures}
+	r.Server = httptest.NewServer(http.HandlerFunc(r.handle))
+	t.Cleanup(r.Close)
+	return r
+}
+
+func (r *pushReceiver) handle(w http.ResponseWriter, req *http.Request) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.requests++
+	if r.requests <= r.failures {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	body, err := ioutil.ReadAll(req.Body)
+	require.NoError(r.t, err)
+	timestamp := req.Header.Get(headerPushTimestamp)
+	if req.Header.Get(headerPushSignature) != "sha256="+sign(r.secret, timestamp, body) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	assert.NotEmpty(r.t, req.Header.Get(headerPushDelivery))
+	var msg config.Message
+	require.NoError(r.t, json.Unmarshal(body, &msg))
+	r.received = append(r.received, msg)
+}
+
+func (r *pushReceiver) messages() []config.Message {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return append([]config.Message(nil), r.received...)
+}
+
+func (r *pushReceiver) count() int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.requests
+}
+
+func init() {
+	pushRetryMin = 10 * time.Millisecond
+}
+
+func TestSign(t *testing.T) {
+	// echo -n '1700000000.{}' | openssl dgst -sha256 -hmac secret
+	assert.Equal(t, "b8569b78799ff9e3cbff0fc2d63a33a2b57f3282abd07c37ae5e8e7d79a5f163", sign("secret", "1700000000", []byte("{}")))
+}
+
+func TestPush(t *testing.T) {
+	receiver := newPushReceiver(t, "secret", 0)
+	b := newTestAPI(t, "[api.test]\nPushSecret=\"secret\"\nPushURLs=[\""+receiver.URL+"\"]\n")
+	b.startPush()
+
+	_, err := b.Send(config.Message{Text: "hello", Gateway: "gw1"})
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool { return len(receiver.messages()) == 1 }, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, "hello", receiver.messages()[0].Text)
+}
+
+func TestPushRetries(t *testing.T) {
+	receiver := newPushReceiver(t, "secret", 2)
+	b := newTestAPI(t, "[api.test]\nPushSecret=\"secret\"\nPushRetries=2\n")
+
+	b.deliver(http.DefaultClient, delivery{id: "1", url: receiver.URL, body: []byte(`{"text":"hello"}`)})
+	require.Len(t, receiver.messages(), 1)
+	assert.Equal(t, 3, receiver.count())
+}
+
+func TestPushDeadLetter(t *testing.T) {
+	// the receiver has another secret and rejects the signature
+	receiver := newPushReceiver(t, "other", 0)
+	path := filepath.Join(t.TempDir(), "deadletters.jsonl")
+	b := newTestAPI(t, "[api.test]\nPushSecret=\"secret\"\nPushRetries=1\nPushDeadLetterFile=\""+path+"\"\n")
+
+	b.deliver(http.DefaultClient, delivery{id: "1", url: receiver.URL, body: []byte(`{"text":"hello"}`)})
+	b.deliver(http.DefaultClient, delivery{id: "2", url: receiver.URL, body: []byte(`{"text":"world"}`)})
+	assert.Empty(t, receiver.messages())
+	assert.Equal(t, 4, receiver.count())
+
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+	var letters []deadLetter
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var letter deadLetter
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &letter))
+		letters = append(letters, letter)
+	}
+	require.Len(t, letters, 2)
+	assert.Equal(t, "1", letters[0].Delivery)
+	assert.Equal(t, receiver.URL, letters[0].URL)
+	assert.Equal(t, "unexpected status 401 Unauthorized", letters[0].Error)
+	assert.JSONEq(t, `{"text":"hello"}`, string(letters[0].Message))
+	assert.Equal(t, "2", letters[1].Delivery)
+}
@@ -0,0 +1,23 @@
+// Package bridgetest sets up bridges for the tests of the bridge packages.
+package bridgetest
+
+import (
+	"github.com/42wim/matterbridge/bridge"
+	"github.com/42wim/matterbridge/bridge/config"
+	"github.com/sirupsen/logrus"
+)
+
+// Config returns the bridge configuration of the account, parsed from cfg, to pass to the New of a bridge.
+// The configuration is global, the last parsed one applies to all bridges.
+func Config(account, cfg string) *bridge.Config {
+	return ConfigFrom(account, config.NewConfigFromString(logrus.New(), []byte(cfg)))
+}
+
+// ConfigFrom is Config for an already parsed configuration, for bridges sharing one.
+func ConfigFrom(account string, cfg config.Config) *bridge.Config {
+	br := bridge.New(&config.Bridge{Account: account})
+	br.Config = cfg
+	br.Log = logrus.NewEntry(logrus.New())
+	br.General = &config.Protocol{}
+	return &bridge.Config{Bridge: br, Remote: make(chan config.Message, 10)}
+}
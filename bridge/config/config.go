@@ -27,6 +27,9 @@ const (
 	EventAPIConnected      = "api_connected"
 	EventUserTyping        = "user_typing"
 	EventGetChannelMembers = "get_channel_members"
+	EventGetStatus         = "get_status"
+	EventPauseRelay        = "pause_relay"
+	EventResumeRelay       = "resume_relay"
 	EventNoticeIRC         = "notice_irc"
 )
 
@@ -46,6 +49,10 @@ type Message struct {
 	Timestamp time.Time `json:"timestamp"`
 	ID        string    `json:"id"`
 	Extra     map[string][]interface{}
+
+	// SubChannel is the channel within a channel with SubChannels, eg a room of a Matrix space
+	// or a topic of a Telegram forum.
+	SubChannel string `json:"sub_channel"`
 }
 
 func (m Message) ParentNotFound() bool {
@@ -56,6 +63,16 @@ func (m Message) ParentValid() bool {
 	return m.ParentID != "" && !m.ParentNotFound()
 }
 
+// SameChannelName returns true if the channel names are the same across protocols,
+// ignoring case, a leading # and the difference between spaces, dashes and underscores.
+func SameChannelName(a, b string) bool {
+	normalize := func(name string) string {
+		name = strings.ToLower(strings.TrimLeft(strings.TrimSpace(name), "#"))
+		return strings.NewReplacer(" ", "-", "_", "-").Replace(name)
+	}
+	return normalize(a) == normalize(b)
+}
+
 type FileInfo struct {
 	Name     string
 	Data     *[]byte
@@ -86,19 +103,51 @@ type ChannelMember struct {
 
 type ChannelMembers []ChannelMember
 
+// GatewayStatus is the status of a gateway, the router answers EventGetStatus with the
+// statuses of the gateways of the channel in Extra[EventGetStatus].
+type GatewayStatus struct {
+	Name    string
+	Paused  bool
+	Bridges []BridgeStatus
+}
+
+// BridgeStatus is the status of a bridge of a gateway, Members are only known for the
+// bridges that send EventGetChannelMembers.
+type BridgeStatus struct {
+	Account   string
+	Connected bool
+	Channels  []string
+	Members   ChannelMembers
+}
+
 type Protocol struct {
+	AcceptInvitesFrom      []string // matrix
+	AdminRoles             []string // discord
 	AllowMention           []string // discord
+	AppService             bool     // matrix
+	AppServiceURL          string   // matrix
 	AuthCode               string   // steam
+	Backfill               bool     // IRC, xmpp
+	BackfillLimit          int      // IRC, xmpp
 	BindAddress            string   // mattermost, slack // DEPRECATED
 	Buffer                 int      // api
 	Charset                string   // irc
 	ClientID               string   // msteams
 	ColorNicks             bool     // only irc for now
+	CommandRoles           []string // discord
+	ComponentDomain        string   // xmpp
+	ComponentSecret        string   // xmpp
+	ComponentServer        string   // xmpp
+	CORSAllowOrigins       []string // api
+	CryptoStore            string   // matrix
 	Debug                  bool     // general
 	DebugLevel             int      // only for irc now
 	DisableWebPagePreview  bool     // telegram
+	DownloadStickers       bool     // discord
 	EditSuffix             string   // mattermost, slack, discord, telegram, gitter
 	EditDisable            bool     // mattermost, slack, discord, telegram, gitter
+	Encryption             bool     // matrix
+	HSToken                string   // matrix
 	HTMLDisable            bool     // matrix
 	IconURL                string   // mattermost, slack
 	IgnoreFailureOnStart   bool     // general
@@ -117,7 +166,7 @@ type Protocol struct {
 	MediaConvertTgs        string     // telegram
 	MediaConvertWebPToPNG  bool       // telegram
 	MessageDelay           int        // IRC, time in millisecond to wait between messages
-	MessageFormat          string     // telegram
+	MessageFormat          string     // telegram, irc
 	MessageLength          int        // IRC, max length of a message allowed
 	MessageQueue           int        // IRC, size of message queue for flood control
 	MessageSplit           bool       // IRC, split long messages with newlines on MessageLength instead of clipping
@@ -132,57 +181,97 @@ type Protocol struct {
 	NickServPassword       string     // IRC
 	NicksPerRow            int        // mattermost, slack
 	NoHomeServerSuffix     bool       // matrix
+	NoHTTPUpload           bool       // xmpp
 	NoSendJoinPart         bool       // all protocols
 	NoTLS                  bool       // mattermost, xmpp
 	Password               string     // IRC,mattermost,XMPP,matrix
 	PrefixMessagesWithNick bool       // mattemost, slack
 	PreserveThreading      bool       // slack
 	Protocol               string     // all protocols
+	PuppetConnectDelay     int        // IRC, time in milliseconds between puppet connections
+	PuppetIdleTimeout      string     // IRC, xmpp
+	PuppetMaxClients       int        // IRC
+	PuppetPrefix           string     // matrix
+	PuppetSuffix           string     // IRC
 	QuoteDisable           bool       // telegram
 	QuoteFormat            string     // telegram
 	QuoteLengthLimit       int        // telegram
 	RealName               string     // IRC
+	ReceiveFormat          string     // IRC
+	RegistrationFile       string     // matrix
 	RejoinDelay            int        // IRC
 	ReplaceMessages        [][]string // all protocols
 	ReplaceNicks           [][]string // all protocols
 	RemoteNickFormat       string     // all protocols
 	RunCommands            []string   // IRC
 	Server                 string     // IRC,mattermost,XMPP,discord,matrix
+	SASLMechanism          string     // IRC
+	SendEmbeds             bool       // discord
 	SessionFile            string     // msteams,whatsapp
 	ShowJoinPart           bool       // all protocols
 	ShowTopicChange        bool       // slack
-	ShowUserTyping         bool       // slack
+	ShowUserTyping         bool       // slack, discord, irc
 	ShowEmbeds             bool       // discord
 	SkipTLSVerify          bool       // IRC, mattermost
 	SkipVersionCheck       bool       // mattermost
+	SlashCommands          bool       // discord
 	StripNick              bool       // all protocols
-	StripMarkdown          bool       // irc
+	StripMarkdown          bool       // irc // DEPRECATED
+	SyncTokenFile          string     // matrix
 	SyncTopic              bool       // slack
 	TengoModifyMessage     string     // general
 	Team                   string     // mattermost, keybase
 	TeamID                 string     // msteams
 	TenantID               string     // msteams
 	Token                  string     // gitter, slack, discord, api, matrix
+	Tokens                 []APIToken // api
 	Topic                  string     // zulip
+	TopicsFile             string     // telegram
+	TrustedDevices         []string   // matrix
+	TrustPolicy            string     // matrix
 	URL                    string     // mattermost, slack // DEPRECATED
 	UseAPI                 bool       // mattermost, slack
 	UseLocalAvatar         []string   // discord
+	UseThreads             bool       // discord, matrix
 	UseSASL                bool       // IRC
 	UseTLS                 bool       // IRC
 	UseDiscriminator       bool       // discord
 	UseFirstName           bool       // telegram
+	UsePuppets             bool       // IRC
 	UseUserName            bool       // discord, matrix, mattermost
 	UseInsecureURL         bool       // telegram
 	UserName               string     // IRC
+	Users                  []IRCDUser // ircd
 	VerboseJoinPart        bool       // IRC
-	WebhookBindAddress     string     // mattermost, slack
-	WebhookURL             string     // mattermost, slack
+	WebhookBindAddress     string     // mattermost, slack, telegram
+	WebhookSecret          string     // telegram
+	WebhookURL             string     // mattermost, slack, telegram
+}
+
+// APIToken is a named token for the api bridge, restricted to a set of
+// gateways and scopes (read, write, admin).
+type APIToken struct {
+	Name     string
+	Token    string
+	Gateways []string
+	Scopes   []string
+}
+
+// IRCDUser is a user allowed to connect to the ircd bridge, authenticated
+// by password or by the SHA-256 fingerprint of its TLS client certificate.
+type IRCDUser struct {
+	Nick     string
+	Password string
+	CertFP   string
 }
 
 type ChannelOptions struct {
 	Key        string // irc, xmpp
 	WebhookURL string // discord
 	Topic      string // zulip
+	// SubChannels relays every channel within the channel, eg the rooms of a Matrix space
+	// or the topics of a Telegram forum, to the channels with the same name.
+	SubChannels bool // matrix, telegram
 }
 
 type Bridge struct {
@@ -217,6 +306,7 @@ type SameChannelGateway struct {
 type BridgeValues struct {
 	API                map[string]Protocol
 	IRC                map[string]Protocol
+	IRCd               map[string]Protocol
 	Mattermost         map[string]Protocol
 	Matrix             map[string]Protocol
 	Slack              map[string]Protocol
@@ -225,6 +315,7 @@ type BridgeValues struct {
 	Gitter             map[string]Protocol
 	XMPP               map[string]Protocol
 	Discord            map[string]Protocol
+	Federation         map[string]Protocol
 	Telegram           map[string]Protocol
 	Rocketchat         map[string]Protocol
 	SSHChat            map[string]Protocol
@@ -0,0 +1,259 @@
+package bdiscord
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/42wim/matterbridge/bridge/config"
+	"github.com/42wim/matterbridge/bridge/helper"
+	"github.com/bwmarrin/discordgo"
+)
+
+// pendingCommand is a command waiting for the status of the gateways to answer.
+type pendingCommand struct {
+	interaction *discordgo.Interaction
+	name        string
+	network     string
+}
+
+var networkOption = &discordgo.ApplicationCommandOption{
+	Type:        discordgo.ApplicationCommandOptionString,
+	Name:        "network",
+	Description: "The bridged network, eg irc or irc.libera",
+	Required:    true,
+}
+
+// commands are the slash commands we register with SlashCommands.
+var commands = []*discordgo.ApplicationCommand{
+	{
+		Name:        "bridge",
+		Description: "The bridge of this channel",
+		Options: []*discordgo.ApplicationCommandOption{
+			{
+				Type:        discordgo.ApplicationCommandOptionSubCommand,
+				Name:        "status",
+				Description: "Show the networks bridged to this channel",
+			},
+			{
+				Type:        discordgo.ApplicationCommandOptionSubCommand,
+				Name:        "pause",
+				Description: "Pause relaying the messages of this channel (admins only)",
+			},
+			{
+				Type:        discordgo.ApplicationCommandOptionSubCommand,
+				Name:        "resume",
+				Description: "Resume relaying the messages of this channel (admins only)",
+			},
+			{
+				Type:        discordgo.ApplicationCommandOptionSubCommand,
+				Name:        "rejoin",
+				Description: "Rejoin the channels of a network (admins only)",
+				Options:     []*discordgo.ApplicationCommandOption{networkOption},
+			},
+		},
+	},
+	{
+		Name:        "who",
+		Description: "List the members of a network bridged to this channel",
+		Options:     []*discordgo.ApplicationCommandOption{networkOption},
+	},
+}
+
+func isAdminCommand(name string) bool {
+	return name == "pause" || name == "resume" || name == "rejoin"
+}
+
+func (b *Bdiscord) registerCommands() error {
+	_, err := b.c.ApplicationCommandBulkOverwrite(b.userID, b.guildID, commands)
+	return err
+}
+
+func (b *Bdiscord) interactionCreate(s *discordgo.Session, i *discordgo.InteractionCreate) { //nolint:unparam
+	if i.Type != discordgo.InteractionApplicationCommand || i.GuildID != b.guildID || i.Member == nil {
+		return
+	}
+	data := i.ApplicationCommandData()
+	name, options := data.Name, data.Options
+	if name == "bridge" && len(options) > 0 {
+		name, options = options[0].Name, options[0].Options
+	}
+	var network string
+	if len(options) > 0 && options[0].Type == discordgo.ApplicationCommandOptionString {
+		network = options[0].StringValue()
+	}
+	b.Log.Debugf("<= Command %s %s from %s in %s", name, network, i.Member.User.Username, i.ChannelID)
+
+	channel, _ := b.getThreadChannelName(i.ChannelID)
+	b.channelsMutex.RLock()
+	_, bridged := b.channelInfoMap[channel+b.Account]
+	b.channelsMutex.RUnlock()
+
+	switch {
+	case !bridged:
+		b.respond(i.Interaction, "This channel isn't bridged.")
+	case !b.hasRole(i.Member, "CommandRoles", true):
+		b.respond(i.Interaction, "You aren't allowed to use the bridge commands.")
+	case isAdminCommand(name) && !b.hasRole(i.Member, "AdminRoles", false):
+		b.respond(i.Interaction, "Only the admins of the bridge can "+name+" it.")
+	case name == "pause":
+		b.Remote <- config.Message{Account: b.Account, Channel: channel, Event: config.EventPauseRelay}
+		b.respond(i.Interaction, "Relaying is paused, /bridge resume resumes it.")
+	case name == "resume":
+		b.Remote <- config.Message{Account: b.Account, Channel: channel, Event: config.EventResumeRelay}
+		b.respond(i.Interaction, "Relaying is resumed.")
+	default:
+		// the other commands are answered when we get the status of our gateways
+		err := b.c.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+			Type: discordgo.InteractionResponseDeferredChannelMessageWithSource,
+			Data: &discordgo.InteractionResponseData{Flags: discordgo.MessageFlagsEphemeral},
+		})
+		if err != nil {
+			b.Log.WithError(err).Warnf("Answering command %s failed", name)
+			return
+		}
+		b.commandsMutex.Lock()
+		b.pendingCommands[i.ID] = &pendingCommand{interaction: i.Interaction, name: name, network: network}
+		b.commandsMutex.Unlock()
+		b.Remote <- config.Message{Account: b.Account, Channel: channel, Event: config.EventGetStatus, ID: i.ID}
+	}
+}
+
+// respond answers the command with a message only its user sees.
+func (b *Bdiscord) respond(i *discordgo.Interaction, text string) {
+	err := b.c.InteractionRespond(i, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseChannelMessageWithSource,
+		Data: &discordgo.InteractionResponseData{Content: text, Flags: discordgo.MessageFlagsEphemeral},
+	})
+	if err != nil {
+		b.Log.WithError(err).Warn("Answering a command failed")
+	}
+}
+
+// hasRole returns true if the member has one of the roles of the setting, or if the setting is empty and open.
+func (b *Bdiscord) hasRole(member *discordgo.Member, setting string, open bool) bool {
+	roles := b.GetStringSlice(setting)
+	if len(roles) == 0 {
+		return open
+	}
+	for _, role := range roles {
+		for _, memberRole := range member.Roles {
+			if role == memberRole {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// handleStatus answers the command waiting for the status of the gateways.
+func (b *Bdiscord) handleStatus(msg *config.Message) error {
+	b.commandsMutex.Lock()
+	cmd, ok := b.pendingCommands[msg.ID]
+	delete(b.pendingCommands, msg.ID)
+	b.commandsMutex.Unlock()
+	if !ok {
+		return nil
+	}
+
+	var gateways []config.GatewayStatus
+	for _, v := range msg.Extra[config.EventGetStatus] {
+		if gw, ok := v.(config.GatewayStatus); ok {
+			gateways = append(gateways, gw)
+		}
+	}
+
+	var text string
+	switch cmd.name {
+	case "who":
+		text = b.whoText(gateways, cmd.network)
+	case "rejoin":
+		text = b.rejoin(gateways, cmd.network)
+	default:
+		text = statusText(gateways)
+	}
+	text = helper.ClipMessage(text, MessageLength, b.GetString("MessageClipped"))
+	_, err := b.c.InteractionResponseEdit(cmd.interaction, &discordgo.WebhookEdit{Content: &text})
+	return err
+}
+
+func statusText(gateways []config.GatewayStatus) string {
+	if len(gateways) == 0 {
+		return "This channel isn't on a gateway."
+	}
+	var sb strings.Builder
+	for _, gw := range gateways {
+		sb.WriteString("**" + gw.Name + "**")
+		if gw.Paused {
+			sb.WriteString(" (paused)")
+		}
+		sb.WriteString("\n")
+		for _, br := range gw.Bridges {
+			state := "connected"
+			if !br.Connected {
+				state = "not connected"
+			}
+			fmt.Fprintf(&sb, "- %s, %s: %s\n", br.Account, state, strings.Join(br.Channels, ", "))
+		}
+	}
+	return strings.TrimSpace(sb.String())
+}
+
+func (b *Bdiscord) whoText(gateways []config.GatewayStatus, network string) string {
+	var sb strings.Builder
+	found := false
+	for _, gw := range gateways {
+		for _, br := range gw.Bridges {
+			if br.Account == b.Account || !matchNetwork(br.Account, network) {
+				continue
+			}
+			found = true
+			if len(br.Members) == 0 {
+				fmt.Fprintf(&sb, "%s doesn't share its members.\n", br.Account)
+				continue
+			}
+			members := make(map[string][]string)
+			for _, member := range br.Members {
+				members[member.ChannelName] = append(members[member.ChannelName], member.Nick)
+			}
+			for _, channel := range br.Channels {
+				if len(members[channel]) > 0 {
+					fmt.Fprintf(&sb, "**%s %s**: %s\n", br.Account, channel, strings.Join(members[channel], ", "))
+				}
+			}
+		}
+	}
+	if !found {
+		return fmt.Sprintf("No network bridged to this channel matches %q.", network)
+	}
+	return strings.TrimSpace(sb.String())
+}
+
+// rejoin asks the gateway to rejoin the channels of the bridges of the network.
+func (b *Bdiscord) rejoin(gateways []config.GatewayStatus, network string) string {
+	var accounts []string
+	seen := make(map[string]bool)
+	for _, gw := range gateways {
+		for _, br := range gw.Bridges {
+			if matchNetwork(br.Account, network) && !seen[br.Account] {
+				seen[br.Account] = true
+				accounts = append(accounts, br.Account)
+			}
+		}
+	}
+	if len(accounts) == 0 {
+		return fmt.Sprintf("No network bridged to this channel matches %q.", network)
+	}
+	// we get the status from the gateway, it waits for us
+	go func() {
+		for _, account := range accounts {
+			b.Remote <- config.Message{Account: account, Event: config.EventRejoinChannels}
+		}
+	}()
+	return "Rejoining the channels of " + strings.Join(accounts, ", ") + "."
+}
+
+// matchNetwork returns true if the network is the account, its protocol or its name.
+func matchNetwork(account, network string) bool {
+	protocol, name, _ := strings.Cut(account, ".")
+	return strings.EqualFold(network, account) || strings.EqualFold(network, protocol) || strings.EqualFold(network, name)
+}
@@ -0,0 +1,110 @@
+package bdiscord
+
+import (
+	"testing"
+
+	"github.com/42wim/matterbridge/bridge/config"
+	"github.com/bwmarrin/discordgo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func command(id string, roles []string, name string, options ...*discordgo.ApplicationCommandInteractionDataOption) *discordgo.InteractionCreate {
+	return &discordgo.InteractionCreate{Interaction: &discordgo.Interaction{
+		ID:        id,
+		AppID:     "app",
+		Token:     "token" + id,
+		Type:      discordgo.InteractionApplicationCommand,
+		GuildID:   "guild",
+		ChannelID: "100",
+		Member:    &discordgo.Member{User: &discordgo.User{Username: "alice"}, Roles: roles},
+		Data:      discordgo.ApplicationCommandInteractionData{Name: name, Options: options},
+	}}
+}
+
+func subCommand(name string, network string) *discordgo.ApplicationCommandInteractionDataOption {
+	option := &discordgo.ApplicationCommandInteractionDataOption{Name: name, Type: discordgo.ApplicationCommandOptionSubCommand}
+	if network != "" {
+		option.Options = append(option.Options, networkValue(network))
+	}
+	return option
+}
+
+func networkValue(network string) *discordgo.ApplicationCommandInteractionDataOption {
+	return &discordgo.ApplicationCommandInteractionDataOption{Name: "network", Type: discordgo.ApplicationCommandOptionString, Value: network}
+}
+
+func TestSlashCommands(t *testing.T) {
+	b, api := newTestDiscord(t, "[discord.test]\nAdminRoles=[\"admins\"]\n")
+	require.NoError(t, b.JoinChannel(config.ChannelInfo{ID: "generaldiscord.test", Name: "general"}))
+	status := config.GatewayStatus{
+		Name: "gateway1",
+		Bridges: []config.BridgeStatus{
+			{Account: "discord.test", Connected: true, Channels: []string{"general"}},
+			{Account: "irc.libera", Connected: true, Channels: []string{"#general"}},
+			{Account: "slack.work", Channels: []string{"general"}, Members: config.ChannelMembers{
+				{Nick: "bob", ChannelName: "general"}, {Nick: "carol", ChannelName: "general"},
+			}},
+		},
+	}
+	answer := func(id string) string {
+		msg := <-b.Remote
+		assert.Equal(t, config.EventGetStatus, msg.Event)
+		assert.Equal(t, "general", msg.Channel)
+		assert.Equal(t, id, msg.ID)
+		msg.Extra = map[string][]interface{}{config.EventGetStatus: {status}}
+		_, err := b.Send(msg)
+		require.NoError(t, err)
+		return api.Body("PATCH /webhooks/app/token" + id + "/messages/@original")
+	}
+
+	b.interactionCreate(b.c, command("1", nil, "bridge", subCommand("status", "")))
+	assert.Contains(t, api.Body("POST /interactions/1/token1/callback"), `"flags":64`)
+	text := answer("1")
+	assert.Contains(t, text, "gateway1")
+	assert.Contains(t, text, "irc.libera, connected: #general")
+	assert.Contains(t, text, "slack.work, not connected: general")
+
+	b.interactionCreate(b.c, command("2", nil, "who", networkValue("slack")))
+	assert.Contains(t, answer("2"), "slack.work general**: bob, carol")
+	b.interactionCreate(b.c, command("3", nil, "who", networkValue("libera")))
+	assert.Contains(t, answer("3"), "irc.libera doesn't share its members.")
+	b.interactionCreate(b.c, command("4", nil, "who", networkValue("xmpp")))
+	assert.Contains(t, answer("4"), `No network bridged to this channel matches \"xmpp\".`)
+
+	// admin commands need one of the AdminRoles
+	b.interactionCreate(b.c, command("5", []string{"users"}, "bridge", subCommand("pause", "")))
+	assert.Contains(t, api.Body("POST /interactions/5/token5/callback"), "Only the admins of the bridge can pause it.")
+	assert.Empty(t, b.Remote)
+
+	b.interactionCreate(b.c, command("6", []string{"admins"}, "bridge", subCommand("pause", "")))
+	msg := <-b.Remote
+	assert.Equal(t, config.Message{Account: "discord.test", Channel: "general", Event: config.EventPauseRelay}, msg)
+	assert.Contains(t, api.Body("POST /interactions/6/token6/callback"), "Relaying is paused")
+
+	b.interactionCreate(b.c, command("7", []string{"admins"}, "bridge", subCommand("rejoin", "irc")))
+	assert.Contains(t, answer("7"), "Rejoining the channels of irc.libera.")
+	msg = <-b.Remote
+	assert.Equal(t, config.Message{Account: "irc.libera", Event: config.EventRejoinChannels}, msg)
+
+	// commands only work in bridged channels
+	cmd := command("8", nil, "bridge", subCommand("status", ""))
+	cmd.ChannelID = "200"
+	b.interactionCreate(b.c, cmd)
+	assert.Contains(t, api.Body("POST /interactions/8/token8/callback"), "This channel isn't bridged.")
+}
+
+func TestCommandRoles(t *testing.T) {
+	b, api := newTestDiscord(t, "[discord.test]\nCommandRoles=[\"bridgers\"]\n")
+	require.NoError(t, b.JoinChannel(config.ChannelInfo{ID: "generaldiscord.test", Name: "general"}))
+
+	b.interactionCreate(b.c, command("1", []string{"users"}, "bridge", subCommand("status", "")))
+	assert.Contains(t, api.Body("POST /interactions/1/token1/callback"), "You aren't allowed to use the bridge commands.")
+
+	b.interactionCreate(b.c, command("2", []string{"users", "bridgers"}, "bridge", subCommand("status", "")))
+	assert.Equal(t, "2", (<-b.Remote).ID)
+
+	// without AdminRoles nobody can use the admin commands
+	b.interactionCreate(b.c, command("3", []string{"bridgers"}, "bridge", subCommand("resume", "")))
+	assert.Contains(t, api.Body("POST /interactions/3/token3/callback"), "Only the admins of the bridge can resume it.")
+}
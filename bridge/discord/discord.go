@@ -15,8 +15,9 @@ import (
 )
 
 const (
-	MessageLength = 1950
-	cFileUpload   = "file_upload"
+	MessageLength  = 1950
+	cFileUpload    = "file_upload"
+	cThreadMessage = "thread_message"
 )
 
 type Bdiscord struct {
@@ -36,6 +37,9 @@ type Bdiscord struct {
 	userMemberMap map[string]*discordgo.Member
 	nickMemberMap map[string]*discordgo.Member
 
+	commandsMutex   sync.Mutex
+	pendingCommands map[string]*pendingCommand
+
 	// Webhook specific logic
 	useAutoWebhooks bool
 	transmitter     *transmitter.Transmitter
@@ -56,6 +60,7 @@ func New(cfg *bridge.Config) bridge.Bridger {
 	b.userMemberMap = make(map[string]*discordgo.Member)
 	b.nickMemberMap = make(map[string]*discordgo.Member)
 	b.channelInfoMap = make(map[string]*config.ChannelInfo)
+	b.pendingCommands = make(map[string]*pendingCommand)
 
 	b.useAutoWebhooks = b.GetBool("AutoWebhooks")
 	if b.useAutoWebhooks {
@@ -234,6 +239,12 @@ func (b *Bdiscord) Connect() error {
 	if b.GetInt("debuglevel") == 1 {
 		b.c.AddHandler(b.messageEvent)
 	}
+	if b.GetBool("SlashCommands") {
+		b.c.AddHandler(b.interactionCreate)
+		if err := b.registerCommands(); err != nil {
+			b.Log.WithError(err).Error("Registering the slash commands failed, the bot needs the applications.commands scope")
+		}
+	}
 
 	return nil
 }
@@ -253,6 +264,10 @@ func (b *Bdiscord) JoinChannel(channel config.ChannelInfo) error {
 func (b *Bdiscord) Send(msg config.Message) (string, error) {
 	b.Log.Debugf("=> Receiving %#v", msg)
 
+	if msg.Event == config.EventGetStatus {
+		return "", b.handleStatus(&msg)
+	}
+
 	channelID := b.getChannelID(msg.Channel)
 	if channelID == "" {
 		return "", fmt.Errorf("Could not find channelID for %v", msg.Channel)
@@ -276,13 +291,52 @@ func (b *Bdiscord) Send(msg config.Message) (string, error) {
 		msg.ParentID = ""
 	}
 
+	threadID, err := b.getThreadID(&msg, channelID)
+	if err != nil {
+		return "", err
+	}
+
 	// Use webhook to send the message
 	useWebhooks := b.shouldMessageUseWebhooks(&msg)
-	if useWebhooks && msg.Event != config.EventMsgDelete && msg.ParentID == "" {
-		return b.handleEventWebhook(&msg, channelID)
+
+	// Forums only have posts, new messages start one
+	if threadID == "" && b.isForum(channelID) {
+		if msg.ID != "" || (msg.Event != "" && msg.Event != config.EventUserAction) {
+			return "", nil
+		}
+		return b.startForumPost(&msg, channelID, useWebhooks)
 	}
 
-	return b.handleEventBotUser(&msg, channelID)
+	// Slack style attachments follow the message as embeds
+	embeds := b.attachmentEmbeds(&msg)
+	useWebhook := useWebhooks && msg.Event != config.EventMsgDelete && msg.ParentID == ""
+
+	var msgID string
+	switch {
+	case len(embeds) > 0 && msg.Text == "" && len(msg.Extra["file"]) == 0:
+		// the embeds are all there is to send
+	case useWebhook:
+		msgID, err = b.handleEventWebhook(&msg, channelID, threadID)
+	case threadID != "":
+		msgID, err = b.handleEventBotUser(&msg, threadID)
+	default:
+		msgID, err = b.handleEventBotUser(&msg, channelID)
+	}
+	if err == nil && len(embeds) > 0 {
+		var embedsID string
+		embedsID, err = b.sendEmbeds(&msg, channelID, threadID, embeds, useWebhook)
+		if msgID == "" {
+			msgID = embedsID
+		}
+	}
+
+	// remember the thread of the messages we sent, for their edits and answers
+	if err == nil && threadID != "" && msgID != "" {
+		for _, id := range strings.Split(msgID, ";") {
+			b.cache.Add(cThreadMessage+id, threadID)
+		}
+	}
+	return msgID, err
 }
 
 // handleEventDirect handles events via the bot user
@@ -0,0 +1,249 @@
+package bdiscord
+
+import (
+	"encoding/json"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/42wim/matterbridge/bridge/config"
+	"github.com/bwmarrin/discordgo"
+)
+
+// The limits Discord has for the embeds of a message.
+const (
+	maxEmbeds           = 10
+	maxEmbedsLength     = 6000
+	maxEmbedTitle       = 256
+	maxEmbedDescription = 4096
+	maxEmbedFields      = 25
+	maxEmbedFieldName   = 256
+	maxEmbedFieldValue  = 1024
+	maxEmbedFooter      = 2048
+	maxEmbedAuthor      = 256
+)
+
+// attachment is a Slack style attachment, mattermost and the API send them in Extra["attachments"],
+// slack in Extra["slack_attachment"].
+type attachment struct {
+	Fallback   string            `json:"fallback"`
+	Color      string            `json:"color"`
+	Pretext    string            `json:"pretext"`
+	AuthorName string            `json:"author_name"`
+	AuthorLink string            `json:"author_link"`
+	AuthorIcon string            `json:"author_icon"`
+	Title      string            `json:"title"`
+	TitleLink  string            `json:"title_link"`
+	Text       string            `json:"text"`
+	ImageURL   string            `json:"image_url"`
+	ThumbURL   string            `json:"thumb_url"`
+	Footer     string            `json:"footer"`
+	FooterIcon string            `json:"footer_icon"`
+	Fields     []attachmentField `json:"fields"`
+}
+
+type attachmentField struct {
+	Title string `json:"title"`
+	Value string `json:"value"`
+	Short bool   `json:"short"`
+}
+
+// getAttachments returns the Slack style attachments of the message.
+func (b *Bdiscord) getAttachments(msg *config.Message) []attachment {
+	var attachments []attachment
+	for _, key := range []string{"attachments", "slack_attachment"} {
+		for _, v := range msg.Extra[key] {
+			data, err := json.Marshal(v)
+			if err != nil {
+				continue
+			}
+			var list []attachment
+			if strings.HasPrefix(string(data), "[") {
+				err = json.Unmarshal(data, &list)
+			} else {
+				var a attachment
+				err = json.Unmarshal(data, &a)
+				list = append(list, a)
+			}
+			if err != nil {
+				b.Log.Debugf("Skipping attachment %s: %s", data, err)
+				continue
+			}
+			attachments = append(attachments, list...)
+		}
+	}
+	return attachments
+}
+
+// attachmentEmbeds returns the embeds of the attachments of the message with SendEmbeds. The text the
+// other bridges made of the attachments is removed from the message, the embeds show it.
+func (b *Bdiscord) attachmentEmbeds(msg *config.Message) []*discordgo.MessageEmbed {
+	if !b.GetBool("SendEmbeds") || msg.ID != "" || (msg.Event != "" && msg.Event != config.EventUserAction) {
+		return nil
+	}
+	attachments := b.getAttachments(msg)
+	embeds := toEmbeds(attachments)
+	if len(embeds) > 0 && coveredByAttachments(msg.Text, attachments) {
+		msg.Text = ""
+	}
+	return embeds
+}
+
+// sendEmbeds sends the embeds in a message of their own, after the text and files of the message.
+func (b *Bdiscord) sendEmbeds(msg *config.Message, channelID, threadID string, embeds []*discordgo.MessageEmbed, useWebhook bool) (string, error) {
+	if useWebhook {
+		username := msg.Username
+		if len(username) > 32 {
+			username = username[0:32]
+		}
+		res, err := b.transmitter.Send(channelID, threadID, &discordgo.WebhookParams{
+			Username:        username,
+			AvatarURL:       msg.Avatar,
+			Embeds:          embeds,
+			AllowedMentions: b.getAllowedMentions(),
+		})
+		if err != nil {
+			return "", err
+		}
+		return res.ID, nil
+	}
+
+	m := &discordgo.MessageSend{Embeds: embeds, AllowedMentions: b.getAllowedMentions()}
+	// without text nothing says who sent the embeds
+	if msg.Text == "" {
+		m.Content = msg.Username
+	}
+	if threadID != "" {
+		channelID = threadID
+	}
+	res, err := b.c.ChannelMessageSendComplex(channelID, m)
+	if err != nil {
+		return "", err
+	}
+	return res.ID, nil
+}
+
+// toEmbeds returns the embeds of the attachments, within the limits of Discord.
+func toEmbeds(attachments []attachment) []*discordgo.MessageEmbed {
+	var embeds []*discordgo.MessageEmbed
+	length := 0
+	for i := range attachments {
+		embed, size := toEmbed(&attachments[i])
+		if embed == nil {
+			continue
+		}
+		if len(embeds) == maxEmbeds || length+size > maxEmbedsLength {
+			break
+		}
+		length += size
+		embeds = append(embeds, embed)
+	}
+	return embeds
+}
+
+// toEmbed returns the embed of the attachment and the length Discord counts for it, or nil if it's empty.
+func toEmbed(a *attachment) (*discordgo.MessageEmbed, int) {
+	description := strings.TrimSpace(a.Pretext + "\n" + a.Text)
+	if description == "" && a.Title == "" {
+		description = a.Fallback
+	}
+	embed := &discordgo.MessageEmbed{
+		Title:       clipText(a.Title, maxEmbedTitle),
+		URL:         a.TitleLink,
+		Description: clipText(description, maxEmbedDescription),
+		Color:       embedColor(a.Color),
+	}
+	if a.AuthorName != "" {
+		embed.Author = &discordgo.MessageEmbedAuthor{Name: clipText(a.AuthorName, maxEmbedAuthor), URL: a.AuthorLink, IconURL: a.AuthorIcon}
+	}
+	if a.ImageURL != "" {
+		embed.Image = &discordgo.MessageEmbedImage{URL: a.ImageURL}
+	}
+	if a.ThumbURL != "" {
+		embed.Thumbnail = &discordgo.MessageEmbedThumbnail{URL: a.ThumbURL}
+	}
+	if a.Footer != "" {
+		embed.Footer = &discordgo.MessageEmbedFooter{Text: clipText(a.Footer, maxEmbedFooter), IconURL: a.FooterIcon}
+	}
+	for _, field := range a.Fields {
+		if len(embed.Fields) == maxEmbedFields {
+			break
+		}
+		if field.Value == "" {
+			continue
+		}
+		name := field.Title
+		if name == "" {
+			// fields need a name, this is a zero width space
+			name = "\u200b"
+		}
+		embed.Fields = append(embed.Fields, &discordgo.MessageEmbedField{
+			Name:   clipText(name, maxEmbedFieldName),
+			Value:  clipText(field.Value, maxEmbedFieldValue),
+			Inline: field.Short,
+		})
+	}
+	if embed.Title == "" && embed.Description == "" && embed.Image == nil && embed.Thumbnail == nil && len(embed.Fields) == 0 {
+		return nil, 0
+	}
+
+	size := len([]rune(embed.Title)) + len([]rune(embed.Description))
+	if embed.Author != nil {
+		size += len([]rune(embed.Author.Name))
+	}
+	if embed.Footer != nil {
+		size += len([]rune(embed.Footer.Text))
+	}
+	for _, field := range embed.Fields {
+		size += len([]rune(field.Name)) + len([]rune(field.Value))
+	}
+	return embed, size
+}
+
+// embedColor returns the color of the Slack attachment color, a hex color or good, warning or danger.
+func embedColor(color string) int {
+	switch color {
+	case "good":
+		return 0x2eb886
+	case "warning":
+		return 0xdaa038
+	case "danger":
+		return 0xa30200
+	}
+	color = strings.TrimPrefix(color, "#")
+	if len(color) == 3 {
+		color = string([]byte{color[0], color[0], color[1], color[1], color[2], color[2]})
+	}
+	c, err := strconv.ParseUint(color, 16, 24)
+	if err != nil {
+		return 0
+	}
+	return int(c)
+}
+
+// coveredByAttachments returns true if the text only has what's in the attachments, as the
+// bridges make it of them for the bridges without attachments.
+func coveredByAttachments(text string, attachments []attachment) bool {
+	var parts []string
+	for _, a := range attachments {
+		parts = append(parts, a.Fallback, a.Pretext, a.Title, a.TitleLink, a.Text, a.Footer)
+	}
+	// the longest first, titles are often in the text too
+	sort.Slice(parts, func(i, j int) bool {
+		return len(parts[i]) > len(parts[j])
+	})
+	for _, part := range parts {
+		if part != "" {
+			text = strings.ReplaceAll(text, part, "")
+		}
+	}
+	return strings.Trim(text, " \n[]()") == ""
+}
+
+// clipText shortens the text to length characters.
+func clipText(text string, length int) string {
+	if runes := []rune(text); len(runes) > length {
+		return string(runes[:length-1]) + "…"
+	}
+	return text
+}
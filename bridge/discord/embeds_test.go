@@ -0,0 +1,148 @@
+package bdiscord
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/42wim/matterbridge/bridge/config"
+	"github.com/bwmarrin/discordgo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestToEmbeds(t *testing.T) {
+	b, _ := newTestDiscord(t, "[discord.test]\n")
+	msg := &config.Message{Extra: map[string][]interface{}{
+		"attachments": {map[string]interface{}{
+			"fallback":    "Build failed",
+			"color":       "danger",
+			"author_name": "ci",
+			"title":       "Build #42",
+			"title_link":  "https://ci.example.com/42",
+			"text":        "The tests failed",
+			"image_url":   "https://ci.example.com/42.png",
+			"footer":      "ci.example.com",
+			"fields": []interface{}{
+				map[string]interface{}{"title": "Branch", "value": "main", "short": true},
+				map[string]interface{}{"title": "Empty", "value": ""},
+			},
+		}},
+	}}
+
+	embeds := toEmbeds(b.getAttachments(msg))
+	require.Len(t, embeds, 1)
+	assert.Equal(t, &discordgo.MessageEmbed{
+		URL:         "https://ci.example.com/42",
+		Title:       "Build #42",
+		Description: "The tests failed",
+		Color:       0xa30200,
+		Footer:      &discordgo.MessageEmbedFooter{Text: "ci.example.com"},
+		Image:       &discordgo.MessageEmbedImage{URL: "https://ci.example.com/42.png"},
+		Author:      &discordgo.MessageEmbedAuthor{Name: "ci"},
+		Fields:      []*discordgo.MessageEmbedField{{Name: "Branch", Value: "main", Inline: true}},
+	}, embeds[0])
+
+	// the limits of discord
+	var attachments []attachment
+	for i := 0; i < 12; i++ {
+		a := attachment{Title: fmt.Sprint(i)}
+		for j := 0; j < 30; j++ {
+			a.Fields = append(a.Fields, attachmentField{Value: fmt.Sprint(j)})
+		}
+		attachments = append(attachments, a)
+	}
+	attachments[0].Text = strings.Repeat("a", 5000)
+	attachments[0].Title = strings.Repeat("b", 300)
+	embeds = toEmbeds(attachments)
+	assert.Len(t, embeds, 10)
+	assert.Len(t, []rune(embeds[0].Title), maxEmbedTitle)
+	assert.Len(t, []rune(embeds[0].Description), maxEmbedDescription)
+	assert.Len(t, embeds[0].Fields, maxEmbedFields)
+
+	attachments[1].Text = strings.Repeat("c", 2000)
+	embeds = toEmbeds(attachments)
+	assert.Len(t, embeds, 1)
+}
+
+func TestEmbedColor(t *testing.T) {
+	assert.Equal(t, 0x2eb886, embedColor("good"))
+	assert.Equal(t, 0x36a64f, embedColor("#36a64f"))
+	assert.Equal(t, 0xaabbcc, embedColor("#abc"))
+	assert.Equal(t, 0, embedColor("blue"))
+	assert.Equal(t, 0, embedColor(""))
+}
+
+func TestCoveredByAttachments(t *testing.T) {
+	attachments := []attachment{{Title: "Build #42", TitleLink: "https://ci.example.com/42", Text: "The tests failed", Footer: "ci"}}
+	assert.True(t, coveredByAttachments("[Build #42](https://ci.example.com/42)\nThe tests failed\n\nci", attachments))
+	assert.True(t, coveredByAttachments("", attachments))
+	assert.False(t, coveredByAttachments("Look at this: The tests failed", attachments))
+}
+
+func TestSendEmbeds(t *testing.T) {
+	b, api := newTestDiscord(t, "[discord.test]\nSendEmbeds=true\n")
+	extra := map[string][]interface{}{"attachments": {map[string]interface{}{"title": "Build #42", "text": "The tests failed"}}}
+
+	// the text is the attachment, the embed replaces it
+	id, err := b.Send(config.Message{Channel: "general", Username: "ci: ", Text: "Build #42\nThe tests failed", Extra: extra})
+	require.NoError(t, err)
+	assert.Equal(t, "1001", id)
+	calls := api.Calls()
+	require.Len(t, calls, 1)
+	body := api.Body("POST /channels/100/messages")
+	assert.Contains(t, body, `"content":"ci: "`)
+	assert.Contains(t, body, `"title":"Build #42"`)
+
+	// other text is sent before the embeds
+	id, err = b.Send(config.Message{Channel: "general", Username: "ci: ", Text: "look", Extra: extra})
+	require.NoError(t, err)
+	assert.Equal(t, "1002", id)
+	assert.Len(t, api.Calls(), 3)
+
+	// edits don't get embeds
+	_, err = b.Send(config.Message{Channel: "general", ID: id, Username: "ci: ", Text: "look again", Extra: extra})
+	require.NoError(t, err)
+	assert.Len(t, api.Calls(), 4)
+
+	// webhooks send them too
+	b.useAutoWebhooks = true
+	_, err = b.Send(config.Message{Channel: "general", Username: "ci", Text: "The tests failed", Extra: extra})
+	require.NoError(t, err)
+	calls = api.Calls()
+	assert.Equal(t, []string{"POST /webhooks/wh/tok?wait=true"}, calls[4:])
+	assert.Contains(t, api.Body(calls[4]), `"embeds":[{`)
+}
+
+func TestDownloadStickers(t *testing.T) {
+	b, api := newTestDiscord(t, "[discord.test]\nDownloadStickers=true\n")
+	b.General = &config.Protocol{MediaDownloadSize: 1000}
+	cdn := discordgo.EndpointCDN
+	discordgo.EndpointCDN = api.URL + "/"
+	t.Cleanup(func() { discordgo.EndpointCDN = cdn })
+	author := &discordgo.User{ID: "7", Username: "alice"}
+
+	b.messageCreate(b.c, &discordgo.MessageCreate{Message: &discordgo.Message{
+		ID: "1", ChannelID: "100", GuildID: "guild", Author: author,
+		StickerItems: []*discordgo.StickerItem{
+			{ID: "11", Name: "wave", FormatType: discordgo.StickerFormatTypePNG},
+			{ID: "12", Name: "dance", FormatType: discordgo.StickerFormatTypeLottie},
+		},
+	}})
+	msg := <-b.Remote
+	assert.Equal(t, ":dance:", msg.Text)
+	require.Len(t, msg.Extra["file"], 1)
+	file := msg.Extra["file"][0].(config.FileInfo)
+	assert.Equal(t, "wave.png", file.Name)
+	assert.Equal(t, "image 11.png", string(*file.Data))
+
+	b.messageCreate(b.c, &discordgo.MessageCreate{Message: &discordgo.Message{
+		ID: "2", ChannelID: "100", GuildID: "guild", Author: author, Content: "hi <:blob:21> <a:party:22> <:blob:21>",
+	}})
+	msg = <-b.Remote
+	assert.Equal(t, "hi :blob: :party: :blob:", msg.Text)
+	require.Len(t, msg.Extra["file"], 2)
+	assert.Equal(t, "blob.png", msg.Extra["file"][0].(config.FileInfo).Name)
+	assert.Equal(t, "party.gif", msg.Extra["file"][1].(config.FileInfo).Name)
+	assert.Contains(t, api.Calls(), "GET /emojis/22.gif")
+}
@@ -12,7 +12,7 @@ func (b *Bdiscord) messageDelete(s *discordgo.Session, m *discordgo.MessageDelet
 		return
 	}
 	rmsg := config.Message{Account: b.Account, ID: m.ID, Event: config.EventMsgDelete, Text: config.EventMsgDelete}
-	rmsg.Channel = b.getChannelName(m.ChannelID)
+	rmsg.Channel, _ = b.getThreadChannelName(m.ChannelID)
 
 	b.Log.Debugf("<= Sending message from %s to gateway", b.Account)
 	b.Log.Debugf("<= Message is %#v", rmsg)
@@ -25,13 +25,14 @@ func (b *Bdiscord) messageDeleteBulk(s *discordgo.Session, m *discordgo.MessageD
 		b.Log.Debugf("Ignoring messageDeleteBulk because it originates from a different guild")
 		return
 	}
+	channel, _ := b.getThreadChannelName(m.ChannelID)
 	for _, msgID := range m.Messages {
 		rmsg := config.Message{
 			Account: b.Account,
 			ID:      msgID,
 			Event:   config.EventMsgDelete,
 			Text:    config.EventMsgDelete,
-			Channel: b.getChannelName(m.ChannelID),
+			Channel: channel,
 		}
 
 		b.Log.Debugf("<= Sending message from %s to gateway", b.Account)
@@ -118,8 +119,18 @@ func (b *Bdiscord) messageCreate(s *discordgo.Session, m *discordgo.MessageCreat
 		}
 	}
 
-	// set channel name
-	rmsg.Channel = b.getChannelName(m.ChannelID)
+	// set channel name, the messages of a thread answer the message it started on
+	var thread *discordgo.Channel
+	rmsg.Channel, thread = b.getThreadChannelName(m.ChannelID)
+	if thread != nil {
+		b.cache.Add(cThreadMessage+m.ID, thread.ID)
+		if m.ID != thread.ID {
+			rmsg.ParentID = thread.ID
+		} else if rmsg.Text != "" {
+			// the first message of a forum post has the ID of the post
+			rmsg.Text = thread.Name + "\n" + rmsg.Text
+		}
+	}
 
 	fromWebhook := m.WebhookID != ""
 	if !fromWebhook && !b.GetBool("UseUserName") {
@@ -138,8 +149,12 @@ func (b *Bdiscord) messageCreate(s *discordgo.Session, m *discordgo.MessageCreat
 		}
 	}
 
+	// stickers and custom emoji are images, with DownloadStickers the other bridges get them
+	b.handleStickers(&rmsg, m.StickerItems)
+	b.handleEmotes(&rmsg, rmsg.Text)
+
 	// no empty messages
-	if rmsg.Text == "" {
+	if rmsg.Text == "" && len(rmsg.Extra["file"]) == 0 {
 		return
 	}
 
@@ -154,7 +169,7 @@ func (b *Bdiscord) messageCreate(s *discordgo.Session, m *discordgo.MessageCreat
 	rmsg.Text = replaceEmotes(rmsg.Text)
 
 	// Add our parent id if it exists, and if it's not referring to a message in another channel
-	if ref := m.MessageReference; ref != nil && ref.ChannelID == m.ChannelID {
+	if ref := m.MessageReference; ref != nil && ref.ChannelID == m.ChannelID && thread == nil {
 		rmsg.ParentID = ref.MessageID
 	}
 
@@ -86,7 +86,7 @@ func (b *Bdiscord) getChannelID(name string) string {
 		return idcheck[1]
 	}
 	for _, channel := range b.channels {
-		if channel.Name == name && channel.Type == discordgo.ChannelTypeGuildText {
+		if channel.Name == name && (channel.Type == discordgo.ChannelTypeGuildText || channel.Type == discordgo.ChannelTypeGuildForum) {
 			return channel.ID
 		}
 	}
@@ -0,0 +1,75 @@
+package bdiscord
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/42wim/matterbridge/bridge/config"
+	"github.com/42wim/matterbridge/bridge/helper"
+	"github.com/bwmarrin/discordgo"
+)
+
+// emoteIDRE matches custom emoji, <:name:id> or <a:name:id> when they are animated.
+var emoteIDRE = regexp.MustCompile(`<(a?):(\w+):(\d+)>`)
+
+// handleStickers relays the stickers of the message as images with DownloadStickers, otherwise as their :name:.
+func (b *Bdiscord) handleStickers(rmsg *config.Message, stickers []*discordgo.StickerItem) {
+	for _, sticker := range stickers {
+		ext := ".png"
+		switch sticker.FormatType {
+		case discordgo.StickerFormatTypeGIF:
+			ext = ".gif"
+		case discordgo.StickerFormatTypeLottie:
+			// lottie stickers are animations, not images
+			ext = ""
+		}
+		if ext != "" && b.GetBool("DownloadStickers") {
+			err := b.downloadImage(rmsg, sticker.Name+ext, discordgo.EndpointCDN+"stickers/"+sticker.ID+ext)
+			if err == nil {
+				continue
+			}
+			b.Log.WithError(err).Warnf("Downloading sticker %s failed", sticker.Name)
+		}
+		rmsg.Text = strings.TrimSpace(rmsg.Text + " :" + sticker.Name + ":")
+	}
+}
+
+// handleEmotes adds the images of the custom emoji of the text to the message with DownloadStickers,
+// the text keeps their :name:.
+func (b *Bdiscord) handleEmotes(rmsg *config.Message, text string) {
+	if !b.GetBool("DownloadStickers") {
+		return
+	}
+	downloaded := make(map[string]bool)
+	for _, match := range emoteIDRE.FindAllStringSubmatch(text, -1) {
+		animated, name, id := match[1] == "a", match[2], match[3]
+		if downloaded[id] {
+			continue
+		}
+		downloaded[id] = true
+		url, ext := discordgo.EndpointEmoji(id), ".png"
+		if animated {
+			url, ext = discordgo.EndpointEmojiAnimated(id), ".gif"
+		}
+		if err := b.downloadImage(rmsg, name+ext, url); err != nil {
+			b.Log.WithError(err).Warnf("Downloading emoji %s failed", name)
+		}
+	}
+}
+
+// downloadImage adds the image to the files of the message.
+func (b *Bdiscord) downloadImage(rmsg *config.Message, name, url string) error {
+	data, err := helper.DownloadFile(url)
+	if err != nil {
+		return err
+	}
+	if rmsg.Extra == nil {
+		rmsg.Extra = make(map[string][]interface{})
+	}
+	// we only know the size when we have it
+	if err := helper.HandleDownloadSize(b.Log, rmsg, name, int64(len(*data)), b.General); err != nil {
+		return err
+	}
+	helper.HandleDownloadData(b.Log, rmsg, name, "", url, data, b.General)
+	return nil
+}
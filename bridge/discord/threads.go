@@ -0,0 +1,193 @@
+package bdiscord
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/42wim/matterbridge/bridge/config"
+	"github.com/42wim/matterbridge/bridge/helper"
+	"github.com/bwmarrin/discordgo"
+)
+
+// maxThreadName is the length Discord allows for the name of a thread.
+const maxThreadName = 100
+
+// getThread returns the thread of one of our channels with the ID, or nil if it isn't one.
+func (b *Bdiscord) getThread(id string) *discordgo.Channel {
+	thread, err := b.c.State.Channel(id)
+	if err != nil {
+		// archived threads aren't in the state
+		if thread, err = b.c.Channel(id); err != nil {
+			return nil
+		}
+	}
+	if !thread.IsThread() || b.getChannelName(thread.ParentID) == "" {
+		return nil
+	}
+	return thread
+}
+
+// getThreadChannelName returns the name of the channel, for a thread the name of its channel and the thread.
+func (b *Bdiscord) getThreadChannelName(channelID string) (string, *discordgo.Channel) {
+	if name := b.getChannelName(channelID); name != "" {
+		return name, nil
+	}
+	thread := b.getThread(channelID)
+	if thread == nil {
+		return "", nil
+	}
+	return b.getChannelName(thread.ParentID), thread
+}
+
+func (b *Bdiscord) isForum(channelID string) bool {
+	b.channelsMutex.RLock()
+	defer b.channelsMutex.RUnlock()
+	for _, channel := range b.channels {
+		if channel.ID == channelID {
+			return channel.Type == discordgo.ChannelTypeGuildForum
+		}
+	}
+	return false
+}
+
+// getThreadID returns the thread the message goes to, or "" if it goes to the channel. Answers to messages
+// of a thread go to the thread, with UseThreads other answers start a thread on their parent.
+func (b *Bdiscord) getThreadID(msg *config.Message, channelID string) (string, error) {
+	// edits and deletes go to the thread of their message
+	if msg.ID != "" {
+		if threadID, ok := b.cache.Get(cThreadMessage + strings.Split(msg.ID, ";")[0]); ok {
+			return threadID.(string), nil //nolint:forcetypeassert
+		}
+		return "", nil
+	}
+	if !msg.ParentValid() {
+		return "", nil
+	}
+	forum := b.isForum(channelID)
+
+	var threadID string
+	if cached, ok := b.cache.Get(cThreadMessage + msg.ParentID); ok {
+		threadID = cached.(string) //nolint:forcetypeassert
+	} else if !forum && !b.GetBool("UseThreads") {
+		return "", nil
+	} else if thread := b.getThread(msg.ParentID); thread != nil {
+		threadID = thread.ID
+	} else if forum {
+		// we don't know the post, the message starts a new one
+		msg.ParentID = ""
+		return "", nil
+	} else {
+		var err error
+		if threadID, err = b.startThread(channelID, msg.ParentID); err != nil {
+			return "", err
+		}
+	}
+
+	if !b.openThread(threadID) {
+		b.Log.Debugf("Thread %s is locked, answering in the channel", threadID)
+		return "", nil
+	}
+	// threads are the threading of the other bridges, we don't reply within them
+	msg.ParentID = ""
+	return threadID, nil
+}
+
+// startThread starts a thread on the message, named after its text. The thread of a message has the ID of the message.
+func (b *Bdiscord) startThread(channelID, messageID string) (string, error) {
+	name := "Thread"
+	if parent, err := b.c.ChannelMessage(channelID, messageID); err == nil {
+		name = threadName(parent.Content, name)
+	}
+	thread, err := b.c.MessageThreadStartComplex(channelID, messageID, &discordgo.ThreadStart{Name: name})
+	var restErr *discordgo.RESTError
+	if errors.As(err, &restErr) && restErr.Message != nil && restErr.Message.Code == discordgo.ErrCodeThreadAlreadyCreatedForThisMessage {
+		return messageID, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	b.Log.Debugf("Started thread %s on %s", thread.Name, messageID)
+	return thread.ID, nil
+}
+
+// openThread unarchives the thread, it returns false if the thread is locked.
+func (b *Bdiscord) openThread(threadID string) bool {
+	thread := b.getThread(threadID)
+	if thread == nil || thread.ThreadMetadata == nil || !thread.ThreadMetadata.Archived {
+		return true
+	}
+	if thread.ThreadMetadata.Locked {
+		return false
+	}
+	archived := false
+	if _, err := b.c.ChannelEdit(threadID, &discordgo.ChannelEdit{Archived: &archived}); err != nil {
+		b.Log.WithError(err).Warnf("Unarchiving thread %s failed", threadID)
+	}
+	return true
+}
+
+// startForumPost starts a post in the forum with the message, its files follow in the thread of the post.
+func (b *Bdiscord) startForumPost(msg *config.Message, channelID string, useWebhooks bool) (string, error) {
+	text := helper.ClipMessage(b.replaceUserMentions(msg.Text), MessageLength, b.GetString("MessageClipped"))
+	title := "Message from " + strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(msg.Username), ":"))
+	if msg.Text == "" && len(msg.Extra["file"]) > 0 {
+		title = msg.Extra["file"][0].(config.FileInfo).Name //nolint:forcetypeassert
+	}
+	title = threadName(msg.Text, title)
+	if text == "" {
+		text = title
+	}
+
+	var threadID string
+	if useWebhooks {
+		username := msg.Username
+		if len(username) > 32 {
+			username = username[0:32]
+		}
+		res, err := b.transmitter.Send(channelID, "", &discordgo.WebhookParams{
+			ThreadName:      title,
+			Content:         text,
+			Username:        username,
+			AvatarURL:       msg.Avatar,
+			AllowedMentions: b.getAllowedMentions(),
+		})
+		if err != nil {
+			return "", err
+		}
+		threadID = res.ChannelID
+	} else {
+		thread, err := b.c.ForumThreadStartComplex(channelID, &discordgo.ThreadStart{Name: title}, &discordgo.MessageSend{
+			Content:         msg.Username + text,
+			AllowedMentions: b.getAllowedMentions(),
+		})
+		if err != nil {
+			return "", err
+		}
+		threadID = thread.ID
+	}
+	// the first message of a post has the ID of its thread
+	b.cache.Add(cThreadMessage+threadID, threadID)
+
+	if len(msg.Extra["file"]) > 0 {
+		var err error
+		if useWebhooks {
+			err = b.webhookSendFilesOnly(msg, channelID, threadID)
+		} else {
+			_, err = b.handleUploadFile(msg, threadID)
+		}
+		if err != nil {
+			return threadID, err
+		}
+	}
+	return threadID, nil
+}
+
+// threadName returns the first line of the text, shortened to the length of a thread name.
+func threadName(text, fallback string) string {
+	name, _, _ := strings.Cut(strings.TrimSpace(text), "\n")
+	name = strings.TrimSpace(name)
+	if name == "" {
+		name = fallback
+	}
+	return clipText(name, maxThreadName)
+}
@@ -0,0 +1,298 @@
+package bdiscord
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/42wim/matterbridge/bridge/bridgetest"
+	"github.com/42wim/matterbridge/bridge/config"
+	"github.com/42wim/matterbridge/bridge/discord/transmitter"
+	"github.com/bwmarrin/discordgo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeDiscord answers the REST calls of the tests and records them.
+type fakeDiscord struct {
+	sync.Mutex
+	calls   []string
+	bodies  map[string]string
+	threads map[string]*discordgo.Channel
+	nextID  int
+	URL     string
+}
+
+func (f *fakeDiscord) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+	path := strings.TrimPrefix(r.URL.Path, "/api/v"+discordgo.APIVersion)
+	call := r.Method + " " + path
+	if r.URL.RawQuery != "" {
+		call += "?" + r.URL.RawQuery
+	}
+	f.calls = append(f.calls, call)
+	body, _ := io.ReadAll(r.Body)
+	f.bodies[call] = string(body)
+
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	reply := func(v interface{}) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(v)
+	}
+	fail := func(status, code int) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		fmt.Fprintf(w, `{"code":%d,"message":"error"}`, code)
+	}
+	newMessage := func(channelID string) *discordgo.Message {
+		f.nextID++
+		return &discordgo.Message{ID: fmt.Sprint(f.nextID), ChannelID: channelID}
+	}
+
+	switch {
+	case r.Method == "GET" && len(parts) == 2 && parts[0] == "channels":
+		if thread, ok := f.threads[parts[1]]; ok {
+			reply(thread)
+			return
+		}
+		fail(http.StatusNotFound, discordgo.ErrCodeUnknownChannel)
+	case r.Method == "PATCH" && len(parts) == 2 && parts[0] == "channels":
+		reply(f.threads[parts[1]])
+	case r.Method == "GET" && len(parts) == 4 && parts[2] == "messages":
+		reply(&discordgo.Message{ID: parts[3], ChannelID: parts[1], Content: "hello world\nsecond line"})
+	case r.Method == "POST" && len(parts) == 5 && parts[4] == "threads":
+		if parts[3] == "77" {
+			fail(http.StatusBadRequest, discordgo.ErrCodeThreadAlreadyCreatedForThisMessage)
+			return
+		}
+		var start discordgo.ThreadStart
+		_ = json.Unmarshal(body, &start)
+		thread := &discordgo.Channel{ID: parts[3], ParentID: parts[1], Name: start.Name, Type: discordgo.ChannelTypeGuildPublicThread}
+		f.threads[thread.ID] = thread
+		reply(thread)
+	case r.Method == "POST" && len(parts) == 3 && parts[2] == "threads":
+		thread := &discordgo.Channel{ID: "700", ParentID: parts[1], Type: discordgo.ChannelTypeGuildPublicThread}
+		f.threads[thread.ID] = thread
+		reply(thread)
+	case r.Method == "POST" && len(parts) == 3 && parts[2] == "messages":
+		reply(newMessage(parts[1]))
+	case r.Method == "PATCH" && len(parts) == 4 && parts[2] == "messages":
+		reply(&discordgo.Message{ID: parts[3], ChannelID: parts[1]})
+	case r.Method == "POST" && parts[0] == "interactions":
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == "PATCH" && parts[0] == "webhooks":
+		reply(&discordgo.Message{ID: parts[len(parts)-1]})
+	case r.Method == "POST" && parts[0] == "webhooks":
+		channelID := "100"
+		if threadID := r.URL.Query().Get("thread_id"); threadID != "" {
+			channelID = threadID
+		}
+		if strings.Contains(string(body), "thread_name") {
+			channelID = "800"
+		}
+		reply(newMessage(channelID))
+	case r.Method == "GET" && (parts[0] == "stickers" || parts[0] == "emojis"):
+		_, _ = w.Write([]byte("image " + parts[1]))
+	default:
+		fail(http.StatusNotFound, 0)
+	}
+}
+
+func (f *fakeDiscord) Calls() []string {
+	f.Lock()
+	defer f.Unlock()
+	return append([]string(nil), f.calls...)
+}
+
+func (f *fakeDiscord) Body(call string) string {
+	f.Lock()
+	defer f.Unlock()
+	return f.bodies[call]
+}
+
+type rewriteTransport struct {
+	target *url.URL
+}
+
+func (t rewriteTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	r.URL.Scheme = t.target.Scheme
+	r.URL.Host = t.target.Host
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+func newTestDiscord(t *testing.T, cfg string) (*Bdiscord, *fakeDiscord) {
+	api := &fakeDiscord{bodies: make(map[string]string), threads: make(map[string]*discordgo.Channel), nextID: 1000}
+	server := httptest.NewServer(api)
+	t.Cleanup(server.Close)
+	api.URL = server.URL
+	target, err := url.Parse(server.URL)
+	require.NoError(t, err)
+
+	b := New(bridgetest.Config("discord.test", cfg)).(*Bdiscord) //nolint:forcetypeassert
+
+	b.c, err = discordgo.New("Bot token")
+	require.NoError(t, err)
+	b.c.Client = &http.Client{Transport: rewriteTransport{target}}
+	b.c.MaxRestRetries = 0
+	require.NoError(t, b.c.State.GuildAdd(&discordgo.Guild{ID: "guild"}))
+	b.guildID = "guild"
+	b.channels = []*discordgo.Channel{
+		{ID: "100", Name: "general", Type: discordgo.ChannelTypeGuildText},
+		{ID: "200", Name: "forum", Type: discordgo.ChannelTypeGuildForum},
+	}
+	b.transmitter = transmitter.New(b.c, "guild", "matterbridge", false)
+	b.transmitter.AddWebhook("100", &discordgo.Webhook{ID: "wh", Token: "tok"})
+	b.transmitter.AddWebhook("200", &discordgo.Webhook{ID: "wh", Token: "tok"})
+	return b, api
+}
+
+func TestThreadMessages(t *testing.T) {
+	b, api := newTestDiscord(t, "[discord.test]\n")
+	require.NoError(t, b.c.State.ChannelAdd(&discordgo.Channel{
+		ID: "500", GuildID: "guild", ParentID: "100", Name: "a thread", Type: discordgo.ChannelTypeGuildPublicThread,
+	}))
+	require.NoError(t, b.c.State.ChannelAdd(&discordgo.Channel{
+		ID: "600", GuildID: "guild", ParentID: "200", Name: "A post", Type: discordgo.ChannelTypeGuildPublicThread,
+	}))
+	author := &discordgo.User{ID: "7", Username: "alice"}
+
+	b.messageCreate(b.c, &discordgo.MessageCreate{Message: &discordgo.Message{
+		ID: "501", ChannelID: "500", GuildID: "guild", Content: "in thread", Author: author,
+	}})
+	msg := <-b.Remote
+	assert.Equal(t, "general", msg.Channel)
+	assert.Equal(t, "500", msg.ParentID)
+	assert.Equal(t, "in thread", msg.Text)
+
+	b.messageCreate(b.c, &discordgo.MessageCreate{Message: &discordgo.Message{
+		ID: "600", ChannelID: "600", GuildID: "guild", Content: "first post", Author: author,
+	}})
+	msg = <-b.Remote
+	assert.Equal(t, "forum", msg.Channel)
+	assert.Equal(t, "", msg.ParentID)
+	assert.Equal(t, "A post\nfirst post", msg.Text)
+
+	b.messageDelete(b.c, &discordgo.MessageDelete{Message: &discordgo.Message{ID: "501", ChannelID: "500", GuildID: "guild"}})
+	msg = <-b.Remote
+	assert.Equal(t, "general", msg.Channel)
+	assert.Equal(t, config.EventMsgDelete, msg.Event)
+
+	// answers to messages of the thread go to the thread
+	id, err := b.Send(config.Message{Channel: "general", ParentID: "501", Username: "bob: ", Text: "answer"})
+	require.NoError(t, err)
+	assert.Equal(t, "1001", id)
+	calls := api.Calls()
+	assert.Equal(t, "POST /channels/500/messages", calls[len(calls)-1])
+	assert.NotContains(t, api.Body(calls[len(calls)-1]), "message_reference")
+}
+
+func TestUseThreads(t *testing.T) {
+	b, api := newTestDiscord(t, "[discord.test]\nUseThreads=true\n")
+
+	id, err := b.Send(config.Message{Channel: "general", ParentID: "42", Username: "bob: ", Text: "answer"})
+	require.NoError(t, err)
+	assert.Equal(t, "1001", id)
+	assert.Equal(t, []string{
+		"GET /channels/42",
+		"GET /channels/100/messages/42",
+		"POST /channels/100/messages/42/threads",
+		"GET /channels/42",
+		"POST /channels/42/messages",
+	}, api.Calls())
+	assert.Contains(t, api.Body("POST /channels/100/messages/42/threads"), `"name":"hello world"`)
+	assert.NotContains(t, api.Body("POST /channels/42/messages"), "message_reference")
+
+	// answers to the answer and edits stay in the thread
+	id, err = b.Send(config.Message{Channel: "general", ParentID: id, Username: "bob: ", Text: "more"})
+	require.NoError(t, err)
+	assert.Equal(t, "1002", id)
+	_, err = b.Send(config.Message{Channel: "general", ID: id, Username: "bob: ", Text: "edited"})
+	require.NoError(t, err)
+	calls := api.Calls()
+	assert.Equal(t, "POST /channels/42/messages", calls[len(calls)-2])
+	assert.Equal(t, "PATCH /channels/42/messages/1002", calls[len(calls)-1])
+
+	// a thread somebody else started is reused
+	_, err = b.Send(config.Message{Channel: "general", ParentID: "77", Username: "bob: ", Text: "answer"})
+	require.NoError(t, err)
+	calls = api.Calls()
+	assert.Equal(t, "POST /channels/77/messages", calls[len(calls)-1])
+
+	// archived threads are unarchived first
+	api.Lock()
+	api.threads["88"] = &discordgo.Channel{
+		ID: "88", ParentID: "100", Type: discordgo.ChannelTypeGuildPublicThread,
+		ThreadMetadata: &discordgo.ThreadMetadata{Archived: true},
+	}
+	api.Unlock()
+	_, err = b.Send(config.Message{Channel: "general", ParentID: "88", Username: "bob: ", Text: "answer"})
+	require.NoError(t, err)
+	calls = api.Calls()
+	assert.Equal(t, []string{"PATCH /channels/88", "POST /channels/88/messages"}, calls[len(calls)-2:])
+	assert.Contains(t, api.Body("PATCH /channels/88"), `"archived":false`)
+
+	// locked threads aren't, we answer in the channel
+	api.Lock()
+	api.threads["89"] = &discordgo.Channel{
+		ID: "89", ParentID: "100", Type: discordgo.ChannelTypeGuildPublicThread,
+		ThreadMetadata: &discordgo.ThreadMetadata{Archived: true, Locked: true},
+	}
+	api.Unlock()
+	_, err = b.Send(config.Message{Channel: "general", ParentID: "89", Username: "bob: ", Text: "answer"})
+	require.NoError(t, err)
+	calls = api.Calls()
+	assert.Equal(t, "POST /channels/100/messages", calls[len(calls)-1])
+}
+
+func TestForumPosts(t *testing.T) {
+	b, api := newTestDiscord(t, "[discord.test]\n")
+
+	id, err := b.Send(config.Message{Channel: "forum", Username: "bob: ", Text: "a question\nwith details"})
+	require.NoError(t, err)
+	assert.Equal(t, "700", id)
+	assert.Equal(t, "POST /channels/200/threads", api.Calls()[0])
+	assert.Contains(t, api.Body("POST /channels/200/threads"), `"name":"a question"`)
+
+	// answers go to the post
+	_, err = b.Send(config.Message{Channel: "forum", ParentID: id, Username: "bob: ", Text: "an answer"})
+	require.NoError(t, err)
+	calls := api.Calls()
+	assert.Equal(t, "POST /channels/700/messages", calls[len(calls)-1])
+
+	// events don't start posts
+	_, err = b.Send(config.Message{Channel: "forum", Event: config.EventJoinLeave, Text: "joined"})
+	require.NoError(t, err)
+	assert.Len(t, api.Calls(), len(calls))
+}
+
+func TestThreadWebhooks(t *testing.T) {
+	b, api := newTestDiscord(t, "[discord.test]\nAutoWebhooks=true\nUseThreads=true\n")
+	require.NoError(t, b.c.State.ChannelAdd(&discordgo.Channel{
+		ID: "500", GuildID: "guild", ParentID: "100", Name: "a thread", Type: discordgo.ChannelTypeGuildPublicThread,
+	}))
+
+	id, err := b.Send(config.Message{Channel: "general", ParentID: "500", Username: "bob", Text: "answer"})
+	require.NoError(t, err)
+	calls := api.Calls()
+	assert.Equal(t, "POST /webhooks/wh/tok?thread_id=500&wait=true", calls[len(calls)-1])
+
+	_, err = b.Send(config.Message{Channel: "general", ID: id, Username: "bob", Text: "edited"})
+	require.NoError(t, err)
+	calls = api.Calls()
+	assert.Equal(t, "PATCH /webhooks/wh/tok/messages/"+id+"?thread_id=500", calls[len(calls)-1])
+
+	// forum posts are started by the webhook
+	id, err = b.Send(config.Message{Channel: "forum", Username: "bob", Text: "a question"})
+	require.NoError(t, err)
+	assert.Equal(t, "800", id)
+	calls = api.Calls()
+	assert.Equal(t, "POST /webhooks/wh/tok?wait=true", calls[len(calls)-1])
+	assert.Contains(t, api.Body(calls[len(calls)-1]), `"thread_name":"a question"`)
+}
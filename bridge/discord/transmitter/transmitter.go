@@ -63,13 +63,14 @@ func New(session *discordgo.Session, guild string, title string, autoCreate bool
 }
 
 // Send transmits a message to the given channel with the provided webhook data, and waits until Discord responds with message data.
-func (t *Transmitter) Send(channelID string, params *discordgo.WebhookParams) (*discordgo.Message, error) {
+// The message goes to the thread of the channel with threadID, unless it's empty.
+func (t *Transmitter) Send(channelID string, threadID string, params *discordgo.WebhookParams) (*discordgo.Message, error) {
 	wh, err := t.getOrCreateWebhook(channelID)
 	if err != nil {
 		return nil, err
 	}
 
-	msg, err := t.session.WebhookExecute(wh.ID, wh.Token, true, params)
+	msg, err := t.session.WebhookThreadExecute(wh.ID, wh.Token, true, threadID, params)
 	if err != nil {
 		return nil, fmt.Errorf("execute failed: %w", err)
 	}
@@ -77,8 +78,8 @@ func (t *Transmitter) Send(channelID string, params *discordgo.WebhookParams) (*
 	return msg, nil
 }
 
-// Edit will edit a message in a channel, if possible.
-func (t *Transmitter) Edit(channelID string, messageID string, params *discordgo.WebhookParams) error {
+// Edit will edit a message in a channel, or in the thread of the channel with threadID, if possible.
+func (t *Transmitter) Edit(channelID string, threadID string, messageID string, params *discordgo.WebhookParams) error {
 	wh := t.getWebhook(channelID)
 
 	if wh == nil {
@@ -86,6 +87,9 @@ func (t *Transmitter) Edit(channelID string, messageID string, params *discordgo
 	}
 
 	uri := discordgo.EndpointWebhookToken(wh.ID, wh.Token) + "/messages/" + messageID
+	if threadID != "" {
+		uri += "?thread_id=" + threadID
+	}
 	_, err := t.session.RequestWithBucketID("PATCH", uri, params, discordgo.EndpointWebhookToken("", ""))
 	if err != nil {
 		return err
@@ -0,0 +1,191 @@
+package bfederation
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/42wim/matterbridge/bridge"
+	"github.com/42wim/matterbridge/bridge/config"
+	"github.com/gorilla/websocket"
+	"github.com/rs/xid"
+)
+
+const (
+	// defaultBuffer is the amount of unacknowledged messages kept for resending after a reconnect.
+	defaultBuffer = 1000
+	// federationPath is the websocket endpoint when listening for a peer.
+	federationPath = "/federation"
+	// writeTimeout is how long a write to the peer may take before the connection is considered dead.
+	writeTimeout = 30 * time.Second
+)
+
+type Bfederation struct {
+	*bridge.Config
+
+	// instanceID identifies this matterbridge instance for loop prevention.
+	instanceID string
+	// session changes every time we start so the peer knows our sequence numbers restarted.
+	session string
+
+	sync.RWMutex
+	conn         *websocket.Conn
+	writeMutex   sync.Mutex
+	peerInstance string
+	// peerSession and lastSeq track the messages we received from the peer, to drop duplicates after a resume.
+	peerSession string
+	lastSeq     uint64
+	// seq is the sequence number of the last message we sent, unacked the messages the peer didn't confirm yet.
+	seq     uint64
+	unacked []*frame
+
+	server *http.Server
+	done   chan struct{}
+}
+
+func New(cfg *bridge.Config) bridge.Bridger {
+	b := &Bfederation{
+		Config:  cfg,
+		session: xid.New().String(),
+		done:    make(chan struct{}),
+	}
+	// the peer applies its own RemoteNickFormat, send the nick as is
+	if !b.IsKeySet("RemoteNickFormat") {
+		b.Config.Config.Viper().Set(b.GetConfigKey("RemoteNickFormat"), "{NICK}")
+	}
+	// threads need the parent IDs
+	if !b.IsKeySet("PreserveThreading") {
+		b.Config.Config.Viper().Set(b.GetConfigKey("PreserveThreading"), true)
+	}
+	return b
+}
+
+func (b *Bfederation) Connect() error {
+	b.instanceID = b.GetString("InstanceID")
+	if b.instanceID == "" {
+		return errors.New("InstanceID is required")
+	}
+	if b.GetString("Token") == "" {
+		return errors.New("Token is required")
+	}
+
+	switch {
+	case b.GetString("BindAddress") != "":
+		return b.listen()
+	case b.GetString("Server") != "":
+		conn, err := b.dial()
+		if err != nil {
+			return err
+		}
+		go b.manageConnection(conn)
+		return nil
+	}
+	return errors.New("either BindAddress or Server needs to be configured")
+}
+
+func (b *Bfederation) Disconnect() error {
+	close(b.done)
+	b.Lock()
+	conn := b.conn
+	b.Unlock()
+	if conn != nil {
+		conn.Close()
+	}
+	if b.server != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		return b.server.Shutdown(ctx)
+	}
+	return nil
+}
+
+func (b *Bfederation) JoinChannel(channel config.ChannelInfo) error {
+	return nil
+}
+
+func (b *Bfederation) Send(msg config.Message) (string, error) {
+	b.Log.Debugf("=> Receiving %#v", msg)
+
+	// these are only meaningful on this instance
+	switch msg.Event {
+	case config.EventAvatarDownload, config.EventFileFailureSize:
+		return "", nil
+	}
+
+	origins := getOrigins(&msg)
+	b.RLock()
+	peer := b.peerInstance
+	b.RUnlock()
+	for _, origin := range origins {
+		if origin == peer {
+			b.Log.Debugf("not sending message back to %s, it originates from there", peer)
+			return "", nil
+		}
+	}
+
+	// new messages get an ID that is unique across instances, edits and deletes reuse it
+	if msg.ID == "" && msg.Event != config.EventUserTyping {
+		msg.ID = b.instanceID + ":" + xid.New().String()
+	}
+
+	wm := newWireMessage(&msg, append(origins, b.instanceID))
+	b.queue(wm)
+	return msg.ID, nil
+}
+
+// queue adds the message to the unacked list and writes it to the peer if connected.
+// The write lock is taken before releasing the lock so the messages are sent in sequence order.
+func (b *Bfederation) queue(wm *wireMessage) {
+	b.Lock()
+	b.seq++
+	f := &frame{Type: frameMessage, Seq: b.seq, Message: wm}
+
+	size := b.GetInt("Buffer")
+	if size == 0 {
+		size = defaultBuffer
+	}
+	// typing notifications aren't worth resending
+	if wm.Event != config.EventUserTyping {
+		b.unacked = append(b.unacked, f)
+		if len(b.unacked) > size {
+			b.Log.Warnf("buffer full, dropping unacknowledged message %d", b.unacked[0].Seq)
+			b.unacked = b.unacked[1:]
+		}
+	}
+	conn := b.conn
+	if conn == nil {
+		b.Unlock()
+		b.Log.Debugf("not connected, message %d will be sent on reconnect", f.Seq)
+		return
+	}
+	b.writeMutex.Lock()
+	b.Unlock()
+	defer b.writeMutex.Unlock()
+	if err := writeFrame(conn, f); err != nil {
+		b.Log.Errorf("failed to send message %d: %s", f.Seq, err)
+	}
+}
+
+// write sends a frame, websocket connections don't support concurrent writers.
+func (b *Bfederation) write(conn *websocket.Conn, f *frame) error {
+	b.writeMutex.Lock()
+	defer b.writeMutex.Unlock()
+	return writeFrame(conn, f)
+}
+
+// writeFrame sends a frame within writeTimeout. The caller holds the writeMutex.
+func writeFrame(conn *websocket.Conn, f *frame) error {
+	if err := conn.SetWriteDeadline(time.Now().Add(writeTimeout)); err != nil {
+		return err
+	}
+	return conn.WriteJSON(f)
+}
+
+func (b *Bfederation) tlsConfig() *tls.Config {
+	return &tls.Config{
+		InsecureSkipVerify: b.GetBool("SkipTLSVerify"), //nolint:gosec
+	}
+}
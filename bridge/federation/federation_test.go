@@ -0,0 +1,143 @@
+package bfederation
+
+import (
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/42wim/matterbridge/bridge/bridgetest"
+	"github.com/42wim/matterbridge/bridge/config"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestFederation(t *testing.T, cfg config.Config, account string) *Bfederation {
+	return New(bridgetest.ConfigFrom(account, cfg)).(*Bfederation)
+}
+
+func connect(t *testing.T, b *Bfederation) {
+	require.NoError(t, b.Connect())
+	t.Cleanup(func() { b.Disconnect() }) //nolint:errcheck
+}
+
+// newTestPeers returns two connected instances, teama listening and teamb connecting to it.
+func newTestPeers(t *testing.T) (*Bfederation, *Bfederation) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := l.Addr().String()
+	l.Close()
+
+	// the configuration is global, both instances share it
+	cfg := config.NewConfigFromString(logrus.New(), []byte(`
+[federation.teama]
+InstanceID="teama"
+Token="secret"
+BindAddress="`+addr+`"
+
+[federation.teamb]
+InstanceID="teamb"
+Token="secret"
+Server="ws://`+addr+`/federation"
+`))
+	a := newTestFederation(t, cfg, "federation.teama")
+	b := newTestFederation(t, cfg, "federation.teamb")
+	connect(t, a)
+	require.Eventually(t, func() bool {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			conn.Close()
+		}
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond)
+	connect(t, b)
+	require.Eventually(t, func() bool {
+		a.RLock()
+		defer a.RUnlock()
+		return a.peerInstance == "teamb"
+	}, 5*time.Second, 10*time.Millisecond)
+	return a, b
+}
+
+func receive(t *testing.T, remote chan config.Message) config.Message {
+	select {
+	case msg := <-remote:
+		return msg
+	case <-time.After(5 * time.Second):
+		t.Fatal("no message received")
+	}
+	return config.Message{}
+}
+
+func TestWireMessage(t *testing.T) {
+	msg := &config.Message{
+		Text:     "hello",
+		Username: "alice",
+		Protocol: "discord",
+		Account:  "discord.test",
+		Extra: map[string][]interface{}{
+			"file":       {config.FileInfo{Name: "a.png", Comment: "image"}},
+			extraOrigins: {"teama"},
+		},
+	}
+	data, err := json.Marshal(newWireMessage(msg, []string{"teama", "teamb"}))
+	require.NoError(t, err)
+	var wm wireMessage
+	require.NoError(t, json.Unmarshal(data, &wm))
+
+	rmsg := wm.toMessage()
+	assert.Equal(t, "hello", rmsg.Text)
+	assert.Equal(t, []string{"teama", "teamb"}, getOrigins(&rmsg))
+	assert.Equal(t, []interface{}{"discord"}, rmsg.Extra[extraOriginProtocol])
+	assert.Equal(t, []interface{}{"discord.test"}, rmsg.Extra[extraOriginAccount])
+	require.Len(t, rmsg.Extra["file"], 1)
+	assert.Equal(t, "a.png", rmsg.Extra["file"][0].(config.FileInfo).Name)
+
+	// the origin of the first instance is kept on the next hop
+	rmsg.Protocol = "federation"
+	rmsg.Account = "federation.teamb"
+	wm2 := newWireMessage(&rmsg, []string{"teama", "teamb", "teamc"})
+	assert.Equal(t, "discord", wm2.OriginProtocol)
+	assert.Equal(t, "discord.test", wm2.OriginAccount)
+	assert.NotContains(t, wm2.Extra, extraOriginProtocol)
+}
+
+func TestFederation(t *testing.T) {
+	a, b := newTestPeers(t)
+
+	id, err := a.Send(config.Message{Text: "hello", Username: "alice", Channel: "general", Protocol: "slack", Account: "slack.test"})
+	require.NoError(t, err)
+	assert.Contains(t, id, "teama:")
+
+	msg := receive(t, b.Remote)
+	assert.Equal(t, "hello", msg.Text)
+	assert.Equal(t, "alice", msg.Username)
+	assert.Equal(t, "federation.teamb", msg.Account)
+	assert.Equal(t, id, msg.ID)
+	assert.Equal(t, []string{"teama"}, getOrigins(&msg))
+	assert.Equal(t, []interface{}{"slack"}, msg.Extra[extraOriginProtocol])
+	assert.Equal(t, []interface{}{"slack.test"}, msg.Extra[extraOriginAccount])
+}
+
+func TestFederationLoops(t *testing.T) {
+	a, b := newTestPeers(t)
+
+	// teamb doesn't send a message from teama back to it
+	_, err := b.Send(config.Message{
+		Text: "from a", Channel: "general", Protocol: "federation", Account: "federation.teamb",
+		Extra: map[string][]interface{}{extraOrigins: {"teama"}},
+	})
+	require.NoError(t, err)
+	b.RLock()
+	assert.Zero(t, b.seq)
+	b.RUnlock()
+
+	// teama drops messages that passed through it before
+	b.queue(newWireMessage(&config.Message{Text: "looped", Channel: "general"}, []string{"teama", "teamb"}))
+	_, err = b.Send(config.Message{Text: "hello", Channel: "general", Protocol: "irc", Account: "irc.test"})
+	require.NoError(t, err)
+	msg := receive(t, a.Remote)
+	assert.Equal(t, "hello", msg.Text)
+	assert.Empty(t, a.Remote)
+}
@@ -0,0 +1,253 @@
+package bfederation
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/jpillora/backoff"
+)
+
+// listen starts the websocket server the peer connects to.
+func (b *Bfederation) listen() error {
+	upgrader := websocket.Upgrader{}
+	mux := http.NewServeMux()
+	mux.HandleFunc(federationPath, func(w http.ResponseWriter, r *http.Request) {
+		if !b.validToken(r.Header.Get("Authorization")) {
+			b.Log.Warnf("failed authentication from %s", r.RemoteAddr)
+			http.Error(w, "invalid token", http.StatusUnauthorized)
+			return
+		}
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			b.Log.Errorf("websocket upgrade from %s failed: %s", r.RemoteAddr, err)
+			return
+		}
+		b.Log.Infof("Peer connected from %s", r.RemoteAddr)
+		if err := b.handleConn(conn); err != nil {
+			b.Log.Errorf("connection with %s closed: %s", r.RemoteAddr, err)
+		}
+	})
+
+	b.server = &http.Server{
+		Addr:              b.GetString("BindAddress"),
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		var err error
+		if cert, key := b.GetString("TLSCertificate"), b.GetString("TLSKey"); cert != "" || key != "" {
+			b.Log.Infof("Listening on %s (TLS)", b.server.Addr)
+			err = b.server.ListenAndServeTLS(cert, key)
+		} else {
+			b.Log.Infof("Listening on %s", b.server.Addr)
+			err = b.server.ListenAndServe()
+		}
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			b.Log.Fatal(err)
+		}
+	}()
+	return nil
+}
+
+func (b *Bfederation) validToken(header string) bool {
+	token := strings.TrimPrefix(header, "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(b.GetString("Token"))) == 1
+}
+
+// dial connects to the peer configured in Server.
+func (b *Bfederation) dial() (*websocket.Conn, error) {
+	dialer := websocket.Dialer{
+		HandshakeTimeout: 30 * time.Second,
+		TLSClientConfig:  b.tlsConfig(),
+	}
+	header := http.Header{}
+	header.Set("Authorization", "Bearer "+b.GetString("Token"))
+	b.Log.Infof("Connecting %s", b.GetString("Server"))
+	conn, resp, err := dialer.Dial(b.GetString("Server"), header)
+	if err != nil {
+		if resp != nil {
+			return nil, fmt.Errorf("%s: %s", err, resp.Status)
+		}
+		return nil, err
+	}
+	b.Log.Info("Connection succeeded")
+	return conn, nil
+}
+
+// manageConnection handles the connection to the peer and reconnects when it's lost.
+func (b *Bfederation) manageConnection(conn *websocket.Conn) {
+	bf := &backoff.Backoff{
+		Min:    time.Second,
+		Max:    5 * time.Minute,
+		Jitter: true,
+	}
+	for {
+		if err := b.handleConn(conn); err != nil {
+			b.Log.WithError(err).Error("Disconnected.")
+		}
+
+		for {
+			select {
+			case <-b.done:
+				return
+			default:
+			}
+			d := bf.Duration()
+			b.Log.Infof("Reconnecting in %s.", d)
+			time.Sleep(d)
+
+			var err error
+			if conn, err = b.dial(); err == nil {
+				bf.Reset()
+				break
+			}
+			b.Log.WithError(err).Error("Reconnect failed.")
+		}
+	}
+}
+
+// handleConn runs the hello handshake, resends unacknowledged messages and reads
+// from the connection until it fails.
+func (b *Bfederation) handleConn(conn *websocket.Conn) error {
+	defer conn.Close()
+
+	b.RLock()
+	hello := &frame{
+		Type:        frameHello,
+		Instance:    b.instanceID,
+		Session:     b.session,
+		PeerSession: b.peerSession,
+		Seq:         b.lastSeq,
+	}
+	b.RUnlock()
+	if err := b.write(conn, hello); err != nil {
+		return err
+	}
+
+	var peer frame
+	if err := conn.ReadJSON(&peer); err != nil {
+		return err
+	}
+	if peer.Type != frameHello || peer.Instance == "" {
+		return errors.New("peer didn't send a hello")
+	}
+	if peer.Instance == b.instanceID {
+		return fmt.Errorf("peer uses our own InstanceID %s", b.instanceID)
+	}
+
+	if err := b.resume(&peer, conn); err != nil {
+		return err
+	}
+
+	defer func() {
+		b.Lock()
+		if b.conn == conn {
+			b.conn = nil
+		}
+		b.Unlock()
+	}()
+
+	for {
+		var f frame
+		if err := conn.ReadJSON(&f); err != nil {
+			return err
+		}
+		switch f.Type {
+		case frameMessage:
+			b.handleMessage(conn, &f)
+		case frameAck:
+			b.handleAck(f.Seq)
+		default:
+			b.Log.Debugf("ignoring unknown frame %s", f.Type)
+		}
+	}
+}
+
+// resume updates the state with the hello of the peer, makes conn the current
+// connection and sends the messages the peer didn't receive yet.
+// The lock is held while sending so new messages can't overtake the resent ones.
+func (b *Bfederation) resume(peer *frame, conn *websocket.Conn) error {
+	b.Lock()
+	defer b.Unlock()
+
+	// the peer restarted, its sequence numbers start again
+	if peer.Session != b.peerSession {
+		b.peerSession = peer.Session
+		b.lastSeq = 0
+	}
+	b.peerInstance = peer.Instance
+
+	// the peer tells us what it got from our current session
+	if peer.PeerSession == b.session {
+		b.dropAcked(peer.Seq)
+	}
+
+	if b.conn != nil && b.conn != conn {
+		b.Log.Info("Replacing existing peer connection")
+		b.conn.Close()
+	}
+	b.conn = conn
+
+	b.Log.Infof("Federated with %s, resending %d messages", peer.Instance, len(b.unacked))
+	for _, f := range b.unacked {
+		if err := b.write(conn, f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *Bfederation) handleMessage(conn *websocket.Conn, f *frame) {
+	if err := b.write(conn, &frame{Type: frameAck, Seq: f.Seq}); err != nil {
+		b.Log.Errorf("failed to ack message %d: %s", f.Seq, err)
+	}
+
+	b.Lock()
+	if f.Seq <= b.lastSeq {
+		b.Unlock()
+		b.Log.Debugf("ignoring duplicate message %d", f.Seq)
+		return
+	}
+	b.lastSeq = f.Seq
+	b.Unlock()
+
+	if f.Message == nil {
+		return
+	}
+	for _, origin := range f.Message.Origins {
+		if origin == b.instanceID {
+			b.Log.Debugf("ignoring message %s, it originates from us", f.Message.ID)
+			return
+		}
+	}
+
+	rmsg := f.Message.toMessage()
+	rmsg.Account = b.Account
+	if rmsg.Timestamp.IsZero() {
+		rmsg.Timestamp = time.Now()
+	}
+	b.Log.Debugf("<= Sending message from %s (%s via %s) on %s to gateway",
+		rmsg.Username, f.Message.OriginProtocol, strings.Join(f.Message.Origins, ","), b.Account)
+	b.Log.Debugf("<= Message is %#v", rmsg)
+	b.Remote <- rmsg
+}
+
+func (b *Bfederation) handleAck(seq uint64) {
+	b.Lock()
+	defer b.Unlock()
+	b.dropAcked(seq)
+}
+
+// dropAcked removes the messages up to seq from the unacked list, the caller must hold the lock.
+func (b *Bfederation) dropAcked(seq uint64) {
+	i := 0
+	for i < len(b.unacked) && b.unacked[i].Seq <= seq {
+		i++
+	}
+	b.unacked = b.unacked[i:]
+}
@@ -0,0 +1,108 @@
+package bfederation
+
+import (
+	"github.com/42wim/matterbridge/bridge/config"
+)
+
+const (
+	frameHello   = "hello"
+	frameMessage = "message"
+	frameAck     = "ack"
+
+	// extraOrigins is the msg.Extra key holding the instances a message already passed through.
+	extraOrigins = "federation_origins"
+	// extraOriginProtocol and extraOriginAccount are the msg.Extra keys holding the protocol and
+	// account the message was first received on.
+	extraOriginProtocol = "federation_origin_protocol"
+	extraOriginAccount  = "federation_origin_account"
+)
+
+// frame is the unit sent over the websocket between two instances.
+//
+// A connection starts with both sides sending a hello frame, with Seq set to the last
+// message received from PeerSession. Messages are acknowledged by an ack frame with the
+// same Seq, unacknowledged messages are sent again after a reconnect.
+type frame struct {
+	Type        string       `json:"type"`
+	Instance    string       `json:"instance,omitempty"`
+	Session     string       `json:"session,omitempty"`
+	PeerSession string       `json:"peer_session,omitempty"`
+	Seq         uint64       `json:"seq,omitempty"`
+	Message     *wireMessage `json:"message,omitempty"`
+}
+
+// wireMessage is a config.Message with the files and the origin information split out,
+// so they survive the JSON roundtrip.
+type wireMessage struct {
+	config.Message
+	Files          []config.FileInfo `json:"files,omitempty"`
+	Origins        []string          `json:"origins"`
+	OriginProtocol string            `json:"origin_protocol"`
+	OriginAccount  string            `json:"origin_account"`
+}
+
+func newWireMessage(msg *config.Message, origins []string) *wireMessage {
+	wm := &wireMessage{
+		Message:        *msg,
+		Origins:        origins,
+		OriginProtocol: getExtraString(msg, extraOriginProtocol, msg.Protocol),
+		OriginAccount:  getExtraString(msg, extraOriginAccount, msg.Account),
+	}
+	wm.Extra = make(map[string][]interface{})
+	for k, v := range msg.Extra {
+		switch k {
+		case "file":
+			for _, f := range v {
+				if fi, ok := f.(config.FileInfo); ok {
+					wm.Files = append(wm.Files, fi)
+				}
+			}
+		case extraOrigins, extraOriginProtocol, extraOriginAccount:
+		default:
+			wm.Extra[k] = v
+		}
+	}
+	return wm
+}
+
+// toMessage converts the wire message back into a config.Message for the gateway.
+func (wm *wireMessage) toMessage() config.Message {
+	msg := wm.Message
+	if msg.Extra == nil {
+		msg.Extra = make(map[string][]interface{})
+	}
+	for _, fi := range wm.Files {
+		msg.Extra["file"] = append(msg.Extra["file"], fi)
+	}
+	for _, origin := range wm.Origins {
+		msg.Extra[extraOrigins] = append(msg.Extra[extraOrigins], origin)
+	}
+	if wm.OriginProtocol != "" {
+		msg.Extra[extraOriginProtocol] = []interface{}{wm.OriginProtocol}
+	}
+	if wm.OriginAccount != "" {
+		msg.Extra[extraOriginAccount] = []interface{}{wm.OriginAccount}
+	}
+	return msg
+}
+
+// getExtraString returns the string in msg.Extra[key], or fallback if there is none.
+func getExtraString(msg *config.Message, key, fallback string) string {
+	for _, v := range msg.Extra[key] {
+		if s, ok := v.(string); ok && s != "" {
+			return s
+		}
+	}
+	return fallback
+}
+
+// getOrigins returns the instances the message passed through.
+func getOrigins(msg *config.Message) []string {
+	var origins []string
+	for _, o := range msg.Extra[extraOrigins] {
+		if origin, ok := o.(string); ok {
+			origins = append(origins, origin)
+		}
+	}
+	return origins
+}
@@ -0,0 +1,348 @@
+package birc
+
+import (
+	"fmt"
+	"html"
+	"strconv"
+	"strings"
+
+	"github.com/gomarkdown/markdown"
+	"github.com/gomarkdown/markdown/ast"
+	"github.com/gomarkdown/markdown/parser"
+)
+
+// mIRC formatting codes, see https://modern.ircdocs.horse/formatting.html
+const (
+	ircBold          = '\x02'
+	ircColor         = '\x03'
+	ircHexColor      = '\x04'
+	ircReset         = '\x0f'
+	ircMonospace     = '\x11'
+	ircItalic        = '\x1d'
+	ircStrikethrough = '\x1e'
+	ircUnderline     = '\x1f'
+)
+
+// Values of the MessageFormat and ReceiveFormat settings.
+const (
+	formatPlain    = "plain"
+	formatIRC      = "irc"
+	formatMarkdown = "markdown"
+	formatHTML     = "html"
+)
+
+// ircColors are the hex values of the 16 standard mIRC colors.
+var ircColors = []string{
+	"#ffffff", "#000000", "#00007f", "#009300", "#ff0000", "#7f0000", "#9c009c", "#fc7f00",
+	"#ffff00", "#00fc00", "#009393", "#00ffff", "#0000fc", "#ff00ff", "#7f7f7f", "#d2d2d2",
+}
+
+type ircStyle struct {
+	bold, italic, underline, strikethrough, monospace bool
+	// color is the hex foreground color, empty if not set.
+	color string
+}
+
+// ircSpan is a piece of text with the same formatting.
+type ircSpan struct {
+	text  string
+	style ircStyle
+}
+
+// messageFormat returns how markdown is converted when sending, StripMarkdown is the old name of "plain".
+func (b *Birc) messageFormat() string {
+	if format := strings.ToLower(b.GetString("MessageFormat")); format != "" {
+		return format
+	}
+	if b.GetBool("StripMarkdown") {
+		return formatPlain
+	}
+	return ""
+}
+
+// parseIRCFormatting splits the text in spans of the same formatting and drops the other control codes.
+func parseIRCFormatting(text string) []ircSpan {
+	var (
+		spans []ircSpan
+		style ircStyle
+		buf   strings.Builder
+	)
+	flush := func() {
+		if buf.Len() > 0 {
+			spans = append(spans, ircSpan{text: buf.String(), style: style})
+			buf.Reset()
+		}
+	}
+
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		switch c {
+		case ircBold, ircItalic, ircUnderline, ircStrikethrough, ircMonospace, ircReset:
+			flush()
+			switch c {
+			case ircBold:
+				style.bold = !style.bold
+			case ircItalic:
+				style.italic = !style.italic
+			case ircUnderline:
+				style.underline = !style.underline
+			case ircStrikethrough:
+				style.strikethrough = !style.strikethrough
+			case ircMonospace:
+				style.monospace = !style.monospace
+			case ircReset:
+				style = ircStyle{}
+			}
+		case ircColor:
+			flush()
+			fg, n := parseColorCode(text[i+1:], 2, isDigit)
+			i += n
+			// skip the background color, we only convert the foreground
+			if fg != "" && i+2 < len(text) && text[i+1] == ',' && isDigit(text[i+2]) {
+				_, n = parseColorCode(text[i+2:], 2, isDigit)
+				i += n + 1
+			}
+			style.color = ""
+			if code, err := strconv.Atoi(fg); err == nil && code < len(ircColors) {
+				style.color = ircColors[code]
+			}
+		case ircHexColor:
+			flush()
+			fg, n := parseColorCode(text[i+1:], 6, isHexDigit)
+			i += n
+			if len(fg) == 6 && i+2 < len(text) && text[i+1] == ',' && isHexDigit(text[i+2]) {
+				_, n = parseColorCode(text[i+2:], 6, isHexDigit)
+				i += n + 1
+			}
+			style.color = ""
+			if len(fg) == 6 {
+				style.color = "#" + strings.ToLower(fg)
+			}
+		case '\n', '\t':
+			buf.WriteByte(c)
+		default:
+			// drop the other control codes, like reverse (\x16)
+			if c < 0x20 || c == 0x7f {
+				continue
+			}
+			buf.WriteByte(c)
+		}
+	}
+	flush()
+	return spans
+}
+
+// parseColorCode returns the color code at the start of s, at most max characters long.
+func parseColorCode(s string, max int, valid func(byte) bool) (string, int) {
+	n := 0
+	for n < max && n < len(s) && valid(s[n]) {
+		n++
+	}
+	return s[:n], n
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isHexDigit(c byte) bool {
+	return isDigit(c) || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
+
+// ircToMarkdown converts the mIRC formatting of text into markdown.
+// Markdown has no underline and colors, these are dropped.
+func ircToMarkdown(text string) string {
+	var res strings.Builder
+	for _, span := range mergeSpans(parseIRCFormatting(text)) {
+		var open, close string
+		switch {
+		case span.style.monospace:
+			open, close = "`", "`"
+		default:
+			if span.style.bold {
+				open, close = open+"**", "**"+close
+			}
+			if span.style.italic {
+				open, close = open+"_", "_"+close
+			}
+			if span.style.strikethrough {
+				open, close = open+"~~", "~~"+close
+			}
+		}
+		res.WriteString(wrapSpan(span.text, open, close))
+	}
+	return res.String()
+}
+
+// mergeSpans merges consecutive spans that only differ in formatting markdown can't show.
+func mergeSpans(spans []ircSpan) []ircSpan {
+	var res []ircSpan
+	for _, span := range spans {
+		span.style.underline = false
+		span.style.color = ""
+		if n := len(res); n > 0 && res[n-1].style == span.style {
+			res[n-1].text += span.text
+			continue
+		}
+		res = append(res, span)
+	}
+	return res
+}
+
+// ircToHTML converts the mIRC formatting of text into HTML.
+func ircToHTML(text string) string {
+	var res strings.Builder
+	for _, span := range parseIRCFormatting(text) {
+		var open, close string
+		add := func(tag, attrs string) {
+			open += "<" + tag + attrs + ">"
+			close = "</" + tag + ">" + close
+		}
+		if span.style.color != "" {
+			add("font", fmt.Sprintf(` color="%s" data-mx-color="%s"`, span.style.color, span.style.color))
+		}
+		if span.style.bold {
+			add("b", "")
+		}
+		if span.style.italic {
+			add("i", "")
+		}
+		if span.style.underline {
+			add("u", "")
+		}
+		if span.style.strikethrough {
+			add("s", "")
+		}
+		if span.style.monospace {
+			add("code", "")
+		}
+		res.WriteString(wrapSpan(html.EscapeString(span.text), open, close))
+	}
+	return res.String()
+}
+
+// wrapSpan puts text between open and close, keeping the surrounding whitespace outside
+// because markdown doesn't allow emphasis starting or ending with a space.
+func wrapSpan(text, open, close string) string {
+	if open == "" {
+		return text
+	}
+	trimmed := strings.TrimSpace(text)
+	if trimmed == "" {
+		return text
+	}
+	start := strings.Index(text, trimmed)
+	return text[:start] + open + trimmed + close + text[start+len(trimmed):]
+}
+
+// markdownToIRC converts markdown into text with mIRC formatting codes.
+func markdownToIRC(text string) string {
+	extensions := parser.HardLineBreak | parser.NoIntraEmphasis | parser.FencedCode | parser.Strikethrough
+	doc := markdown.Parse([]byte(text), parser.NewWithExtensions(extensions))
+	var res strings.Builder
+	renderIRC(&res, doc, "")
+	return strings.TrimRight(res.String(), "\n")
+}
+
+// renderIRC writes node and its children to w, prefixing new lines with indent.
+func renderIRC(w *strings.Builder, node ast.Node, indent string) {
+	children := func(indent string) {
+		for _, child := range node.GetChildren() {
+			renderIRC(w, child, indent)
+		}
+	}
+	wrap := func(code byte) {
+		w.WriteByte(code)
+		children(indent)
+		w.WriteByte(code)
+	}
+
+	switch n := node.(type) {
+	case *ast.Text:
+		w.WriteString(strings.ReplaceAll(string(n.Literal), "\n", "\n"+indent))
+	case *ast.Strong:
+		wrap(ircBold)
+	case *ast.Emph:
+		wrap(ircItalic)
+	case *ast.Del:
+		wrap(ircStrikethrough)
+	case *ast.Code:
+		w.WriteByte(ircMonospace)
+		w.Write(n.Literal)
+		w.WriteByte(ircMonospace)
+	case *ast.CodeBlock:
+		for _, line := range strings.Split(strings.TrimRight(string(n.Literal), "\n"), "\n") {
+			w.WriteString(indent + string(ircMonospace) + line + string(ircMonospace) + "\n")
+		}
+	case *ast.Heading:
+		w.WriteString(indent)
+		wrap(ircBold)
+		w.WriteString("\n")
+	case *ast.Paragraph:
+		if _, ok := n.Parent.(*ast.ListItem); !ok {
+			w.WriteString(indent)
+		}
+		children(indent)
+		w.WriteString("\n")
+	case *ast.BlockQuote:
+		children(indent + "> ")
+	case *ast.List:
+		for i, item := range n.Children {
+			bullet := "- "
+			if n.ListFlags&ast.ListTypeOrdered != 0 {
+				bullet = strconv.Itoa(n.Start+i) + ". "
+				if n.Start == 0 {
+					bullet = strconv.Itoa(i+1) + ". "
+				}
+			}
+			w.WriteString(indent + bullet)
+			renderIRC(w, item, indent+"  ")
+		}
+	case *ast.ListItem:
+		for i, child := range n.Children {
+			// nested lists and following paragraphs start on their own line
+			if i > 0 {
+				if _, ok := child.(*ast.Paragraph); ok {
+					w.WriteString(indent)
+				}
+			}
+			renderIRC(w, child, indent)
+		}
+	case *ast.Link:
+		text := renderLabel(n.Children)
+		w.WriteString(text)
+		if dest := string(n.Destination); dest != text && dest != "" {
+			w.WriteString(" (" + dest + ")")
+		}
+	case *ast.Image:
+		if text := renderLabel(n.Children); text != "" {
+			w.WriteString(text + " ")
+		}
+		w.Write(n.Destination)
+	case *ast.Hardbreak, *ast.Softbreak:
+		// the paragraph ends with a newline already
+		if ast.GetNextNode(n) != nil {
+			w.WriteString("\n" + indent)
+		}
+	case *ast.HorizontalRule:
+		w.WriteString(indent + "---\n")
+	case *ast.HTMLSpan:
+		w.Write(n.Literal)
+	case *ast.HTMLBlock:
+		w.WriteString(indent + string(n.Literal) + "\n")
+	default:
+		if leaf := node.AsLeaf(); leaf != nil {
+			w.Write(leaf.Literal)
+		}
+		children(indent)
+	}
+}
+
+// renderLabel returns the text of a link or image.
+func renderLabel(nodes []ast.Node) string {
+	var label strings.Builder
+	for _, node := range nodes {
+		renderIRC(&label, node, "")
+	}
+	return label.String()
+}
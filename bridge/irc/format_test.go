@@ -0,0 +1,55 @@
+package birc
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIRCToMarkdown(t *testing.T) {
+	for input, expected := range map[string]string{
+		"plain text":                         "plain text",
+		"\x02bold\x02 text":                  "**bold** text",
+		"\x1ditalic\x1d and \x1estrike\x1e":  "_italic_ and ~~strike~~",
+		"\x11code\x11":                       "`code`",
+		"\x02bold \x1dboth\x0f reset":        "**bold** **_both_** reset",
+		"\x0304,12red\x03 and \x1funder\x1f": "red and under",
+		"\x02 spaced \x02":                   " **spaced** ",
+		"\x16reversed\x16":                   "reversed",
+		"\x0312,4\x02blue bold":              "**blue bold**",
+	} {
+		assert.Equal(t, expected, ircToMarkdown(input), input)
+	}
+}
+
+func TestIRCToHTML(t *testing.T) {
+	for input, expected := range map[string]string{
+		"a < b":                  "a &lt; b",
+		"\x02bold\x02":           "<b>bold</b>",
+		"\x1funder\x1f":          "<u>under</u>",
+		"\x0304red\x03 plain":    `<font color="#ff0000" data-mx-color="#ff0000">red</font> plain`,
+		"\x04FF8800,000000hex":   `<font color="#ff8800" data-mx-color="#ff8800">hex</font>`,
+		"\x0304,01\x1dred\x0f x": `<font color="#ff0000" data-mx-color="#ff0000"><i>red</i></font> x`,
+	} {
+		assert.Equal(t, expected, ircToHTML(input), input)
+	}
+}
+
+func TestMarkdownToIRC(t *testing.T) {
+	for input, expected := range map[string]string{
+		"plain text":                    "plain text",
+		"**bold** and _italic_":         "\x02bold\x02 and \x1ditalic\x1d",
+		"~~strike~~ `code`":             "\x1estrike\x1e \x11code\x11",
+		"snake_case_name":               "snake_case_name",
+		"[link](https://example.com)":   "link (https://example.com)",
+		"https://example.com":           "https://example.com",
+		"line one\nline two":            "line one\nline two",
+		"- one\n- two":                  "- one\n- two",
+		"> quoted":                      "> quoted",
+		"```\ncode block\n```":          "\x11code block\x11",
+		"# Title":                       "\x02Title\x02",
+		"first paragraph\n\nsecond one": "first paragraph\nsecond one",
+	} {
+		assert.Equal(t, expected, markdownToIRC(input), input)
+	}
+}
@@ -100,7 +100,7 @@ func (b *Birc) handleJoinPart(client *girc.Client, event girc.Event) {
 		}
 	}
 	if event.Source.Name != b.Nick {
-		if b.GetBool("nosendjoinpart") {
+		if b.GetBool("nosendjoinpart") || (b.GetBool("UsePuppets") && b.isPuppet(event.Source.Name)) {
 			return
 		}
 		msg := config.Message{Username: "system", Text: event.Source.Name + " " + strings.ToLower(event.Command) + "s", Channel: channel, Account: b.Account, Event: config.EventJoinLeave}
@@ -121,6 +121,7 @@ func (b *Birc) handleNewConnection(client *girc.Client, event girc.Event) {
 	b.Log.Debug("Registering callbacks")
 	i := b.i
 	b.Nick = event.Params[0]
+	b.checkSASL(client)
 
 	b.Log.Debug("Clearing handlers before adding in case of BNC reconnect")
 	i.Handlers.Clear("PRIVMSG")
@@ -132,6 +133,7 @@ func (b *Birc) handleNewConnection(client *girc.Client, event girc.Event) {
 	i.Handlers.Clear("QUIT")
 	i.Handlers.Clear("KICK")
 	i.Handlers.Clear("INVITE")
+	i.Handlers.Clear(girc.CAP_TAGMSG)
 
 	i.Handlers.AddBg("PRIVMSG", b.handlePrivMsg)
 	i.Handlers.Add(girc.RPL_TOPICWHOTIME, b.handleTopicWhoTime)
@@ -141,6 +143,10 @@ func (b *Birc) handleNewConnection(client *girc.Client, event girc.Event) {
 	i.Handlers.AddBg("QUIT", b.handleJoinPart)
 	i.Handlers.AddBg("KICK", b.handleJoinPart)
 	i.Handlers.Add("INVITE", b.handleInvite)
+	i.Handlers.AddBg(girc.CAP_TAGMSG, b.handleTagMsg)
+	if b.GetBool("Backfill") {
+		i.Handlers.Add("JOIN", b.handleBackfillJoin)
+	}
 }
 
 func (b *Birc) handleNickServ() {
@@ -201,6 +207,12 @@ func (b *Birc) handlePrivMsg(client *girc.Client, event girc.Event) {
 		Account:  b.Account,
 		UserID:   event.Source.Ident + "@" + event.Source.Host,
 	}
+	b.setReceiveTags(&rmsg, &event)
+
+	if b.GetBool("Backfill") && !b.markSeen(rmsg.Channel, &event) {
+		b.Log.Debugf("dropping message %s on %s, already relayed", rmsg.ID, rmsg.Channel)
+		return
+	}
 
 	b.Log.Debugf("== Receiving PRIVMSG: %s %s %#v", event.Source.Name, event.Last(), event)
 
@@ -251,6 +263,13 @@ func (b *Birc) handlePrivMsg(client *girc.Client, event girc.Event) {
 		rmsg.Text = string(output)
 	}
 
+	switch strings.ToLower(b.GetString("ReceiveFormat")) {
+	case formatMarkdown:
+		rmsg.Text = ircToMarkdown(rmsg.Text)
+	case formatHTML:
+		rmsg.Text = ircToHTML(rmsg.Text)
+	}
+
 	b.Log.Debugf("<= Sending message from %s on %s to gateway", event.Params[0], b.Account)
 	b.Remote <- rmsg
 }
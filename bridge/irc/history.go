@@ -0,0 +1,96 @@
+package birc
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lrstanley/girc"
+)
+
+const (
+	defaultBackfillLimit = 100
+	// seenSize is the amount of msgids remembered to drop messages we already relayed.
+	seenSize = 1000
+
+	capChatHistory = "draft/chathistory"
+	capZNCPlayback = "znc.in/playback"
+)
+
+// enableBackfill requests the capabilities needed to fetch the missed messages after a reconnect.
+func (b *Birc) enableBackfill(i *girc.Client) {
+	i.Config.SupportedCaps[capChatHistory] = nil
+	i.Config.SupportedCaps[capZNCPlayback] = nil
+}
+
+// markSeen remembers the message so it's not relayed again when the history is fetched.
+// Returns false if the message was already relayed.
+func (b *Birc) markSeen(channel string, event *girc.Event) bool {
+	b.historyMutex.Lock()
+	defer b.historyMutex.Unlock()
+
+	msgid, hasID := event.Tags.Get("msgid")
+	if hasID {
+		if _, ok := b.seen.Get(msgid); ok {
+			return false
+		}
+	}
+	// without a msgid we only know the server-time of what was relayed before the reconnect
+	if _, ok := event.Tags.Get("time"); ok && !hasID {
+		if from, ok := b.backfillFrom[channel]; ok && !event.Timestamp.After(from) {
+			return false
+		}
+	}
+
+	if hasID {
+		b.seen.Add(msgid, struct{}{})
+	}
+	if event.Timestamp.After(b.lastSeen[channel]) {
+		b.lastSeen[channel] = event.Timestamp
+	}
+	return true
+}
+
+// backfill fetches the messages of the channel we missed while disconnected,
+// using draft/chathistory or the ZNC playback module.
+func (b *Birc) backfill(channel string) {
+	b.historyMutex.Lock()
+	since, ok := b.lastSeen[channel]
+	if ok {
+		b.backfillFrom[channel] = since
+	} else {
+		// this is our first join, there's nothing to fetch yet
+		b.lastSeen[channel] = time.Now()
+	}
+	b.historyMutex.Unlock()
+	if !ok {
+		return
+	}
+
+	switch {
+	case b.i.HasCapability(capChatHistory):
+		limit := b.GetInt("BackfillLimit")
+		if limit == 0 {
+			limit = defaultBackfillLimit
+		}
+		if max, ok := b.i.GetServerOptionInt("CHATHISTORY"); ok && max > 0 && max < limit {
+			limit = max
+		}
+		b.Log.Debugf("requesting history of %s since %s", channel, since)
+		b.i.Cmd.SendRawf("CHATHISTORY AFTER %s timestamp=%s %d", //nolint:errcheck
+			channel, since.UTC().Format("2006-01-02T15:04:05.000Z"), limit)
+	case b.i.HasCapability(capZNCPlayback):
+		b.Log.Debugf("requesting playback of %s since %s", channel, since)
+		b.i.Cmd.Message("*playback", fmt.Sprintf("PLAY %s %d.%03d", channel, since.Unix(), since.Nanosecond()/int(time.Millisecond)))
+	default:
+		b.Log.Debugf("server doesn't support %s or %s, can't backfill %s", capChatHistory, capZNCPlayback, channel)
+	}
+}
+
+// handleBackfillJoin starts the backfill when we join a channel again after a reconnect.
+func (b *Birc) handleBackfillJoin(client *girc.Client, event girc.Event) {
+	if len(event.Params) == 0 || event.Source == nil || event.Source.Name != client.GetNick() {
+		return
+	}
+	b.backfill(strings.ToLower(event.Params[0]))
+}
@@ -0,0 +1,43 @@
+package birc
+
+import (
+	"testing"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru"
+	"github.com/lrstanley/girc"
+	"github.com/stretchr/testify/assert"
+)
+
+func newHistoryBridge() *Birc {
+	b := &Birc{
+		lastSeen:     make(map[string]time.Time),
+		backfillFrom: make(map[string]time.Time),
+	}
+	b.seen, _ = lru.New(seenSize)
+	return b
+}
+
+func TestMarkSeenMsgID(t *testing.T) {
+	b := newHistoryBridge()
+	event := girc.ParseEvent("@msgid=abc;time=2024-01-02T03:04:05.000Z :nick!user@host PRIVMSG #test :hello")
+
+	assert.True(t, b.markSeen("#test", event))
+	assert.False(t, b.markSeen("#test", event), "replayed message with the same msgid")
+	assert.Equal(t, time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC), b.lastSeen["#test"].UTC())
+}
+
+func TestMarkSeenTimestamp(t *testing.T) {
+	b := newHistoryBridge()
+	b.backfillFrom["#test"] = time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	old := girc.ParseEvent("@time=2024-01-02T03:04:05.000Z :nick!user@host PRIVMSG #test :hello")
+	assert.False(t, b.markSeen("#test", old), "replayed message before the reconnect")
+
+	missed := girc.ParseEvent("@time=2024-01-02T03:05:00.000Z :nick!user@host PRIVMSG #test :missed")
+	assert.True(t, b.markSeen("#test", missed))
+
+	// live messages without server-time are always relayed
+	live := girc.ParseEvent(":nick!user@host PRIVMSG #test :live")
+	assert.True(t, b.markSeen("#test", live))
+}
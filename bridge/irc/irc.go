@@ -2,7 +2,6 @@ package birc
 
 import (
 	"crypto/tls"
-	"errors"
 	"fmt"
 	"hash/crc32"
 	"io/ioutil"
@@ -10,11 +9,13 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/42wim/matterbridge/bridge"
 	"github.com/42wim/matterbridge/bridge/config"
 	"github.com/42wim/matterbridge/bridge/helper"
+	lru "github.com/hashicorp/golang-lru"
 	"github.com/lrstanley/girc"
 	stripmd "github.com/writeas/go-strip-markdown"
 
@@ -33,6 +34,28 @@ type Birc struct {
 	MessageDelay, MessageQueue, MessageLength int
 	channels                                  map[string]bool
 
+	// msgids maps the labels we returned as the ID of sent messages to the msgid of their echo, labels
+	// maps them back.
+	msgids, labels *lru.Cache
+
+	// puppets are the connections of remote users when UsePuppets is enabled, keyed by account and user.
+	puppets           map[string]*puppet
+	removedPuppets    map[string]time.Time
+	puppetsMutex      sync.Mutex
+	nextPuppetConnect time.Time
+	// puppetsDone stops expirePuppets, Disconnect closes it.
+	puppetsDone chan struct{}
+
+	// lastSeen and seen track the relayed messages, to fetch and deduplicate the history after a reconnect.
+	lastSeen     map[string]time.Time
+	backfillFrom map[string]time.Time
+	seen         *lru.Cache
+	historyMutex sync.Mutex
+
+	// saslError is the reason the SASL authentication failed.
+	saslError error
+	saslMutex sync.Mutex
+
 	*bridge.Config
 }
 
@@ -43,6 +66,13 @@ func New(cfg *bridge.Config) bridge.Bridger {
 	b.names = make(map[string][]string)
 	b.connected = make(chan error)
 	b.channels = make(map[string]bool)
+	b.msgids, _ = lru.New(labelsSize)
+	b.labels, _ = lru.New(labelsSize)
+	b.puppets = make(map[string]*puppet)
+	b.removedPuppets = make(map[string]time.Time)
+	b.lastSeen = make(map[string]time.Time)
+	b.backfillFrom = make(map[string]time.Time)
+	b.seen, _ = lru.New(seenSize)
 
 	if b.GetInt("MessageDelay") == 0 {
 		b.MessageDelay = 1300
@@ -73,10 +103,6 @@ func (b *Birc) Command(msg *config.Message) string {
 }
 
 func (b *Birc) Connect() error {
-	if b.GetBool("UseSASL") && b.GetString("TLSClientCertificate") != "" {
-		return errors.New("you can't enable SASL and TLSClientCertificate at the same time")
-	}
-
 	b.Local = make(chan config.Message, b.MessageQueue+10)
 	b.Log.Infof("Connecting %s", b.GetString("Server"))
 
@@ -86,16 +112,21 @@ func (b *Birc) Connect() error {
 	}
 
 	if b.GetBool("UseSASL") {
-		i.Config.SASL = &girc.SASLPlain{
-			User: b.GetString("NickServNick"),
-			Pass: b.GetString("NickServPassword"),
+		if i.Config.SASL, err = b.getSASL(); err != nil {
+			return err
 		}
+		i.Handlers.Add(girc.RPL_SASLMECHS, b.handleSASLMechs)
+	}
+
+	if b.GetBool("Backfill") {
+		b.enableBackfill(i)
 	}
 
 	i.Handlers.Add(girc.RPL_WELCOME, b.handleNewConnection)
 	i.Handlers.Add(girc.RPL_ENDOFMOTD, b.handleOtherAuth)
 	i.Handlers.Add(girc.ERR_NOMOTD, b.handleOtherAuth)
-	i.Handlers.Add(girc.ALL_EVENTS, b.handleOther)
+	debugHandler := i.Handlers.Add(girc.ALL_EVENTS, b.handleOther)
+	i.Handlers.Add(girc.ALL_EVENTS, b.handleEcho)
 	b.i = i
 
 	go b.doConnect()
@@ -107,13 +138,22 @@ func (b *Birc) Connect() error {
 	b.Log.Info("Connection succeeded")
 	b.FirstConnection = false
 	if b.GetInt("DebugLevel") == 0 {
-		i.Handlers.Clear(girc.ALL_EVENTS)
+		i.Handlers.Remove(debugHandler)
 	}
 	go b.doSend()
+	if b.GetBool("UsePuppets") {
+		b.puppetsDone = make(chan struct{})
+		go b.expirePuppets(b.puppetsDone)
+	}
 	return nil
 }
 
 func (b *Birc) Disconnect() error {
+	if b.puppetsDone != nil {
+		close(b.puppetsDone)
+		b.puppetsDone = nil
+	}
+	b.closePuppets()
 	b.i.Close()
 	close(b.Local)
 	return nil
@@ -151,6 +191,11 @@ func (b *Birc) Send(msg config.Message) (string, error) {
 		return "", nil
 	}
 
+	if msg.Event == config.EventUserTyping {
+		b.sendTyping(&msg)
+		return "", nil
+	}
+
 	// Execute a command
 	if strings.HasPrefix(msg.Text, "!") {
 		b.Command(&msg)
@@ -167,8 +212,11 @@ func (b *Birc) Send(msg config.Message) (string, error) {
 	}
 
 	var msgLines []string
-	if b.GetBool("StripMarkdown") {
+	switch b.messageFormat() {
+	case formatPlain:
 		msg.Text = stripmd.Strip(msg.Text)
+	case formatIRC:
+		msg.Text = markdownToIRC(msg.Text)
 	}
 
 	if b.GetBool("MessageSplit") {
@@ -176,21 +224,37 @@ func (b *Birc) Send(msg config.Message) (string, error) {
 	} else {
 		msgLines = helper.GetSubLines(msg.Text, 0, b.GetString("MessageClipped"))
 	}
+	// send the message from the nick of the remote user
+	if b.GetBool("UsePuppets") && b.sendPuppet(&msg, msgLines) {
+		return "", nil
+	}
+	var label string
 	for i := range msgLines {
 		if len(b.Local) >= b.MessageQueue {
 			b.Log.Debugf("flooding, dropping message (queue at %d)", len(b.Local))
-			return "", nil
+			return label, nil
 		}
 
 		msg.Text = msgLines[i]
+		// the ID of a queued message is the label used to get the msgid of the first line back
+		msg.ID = ""
+		if i == 0 && b.canLabel() {
+			label = b.newLabel()
+			msg.ID = label
+		}
 		b.Local <- msg
 	}
-	return "", nil
+	return label, nil
 }
 
 func (b *Birc) doConnect() {
 	for {
-		if err := b.i.Connect(); err != nil {
+		err := b.i.Connect()
+		// the error girc returns doesn't tell why the authentication failed
+		if saslErr := b.takeSASLError(); saslErr != nil {
+			err = saslErr
+		}
+		if err != nil {
 			b.Log.Errorf("disconnect: error: %s", err)
 			if b.FirstConnection {
 				b.connected <- err
@@ -227,6 +291,7 @@ func (b *Birc) doSend() {
 	for msg := range b.Local {
 		<-throttle.C
 		username := msg.Username
+		tags := b.sendTags(&msg)
 		// Optional support for the proposed RELAYMSG extension, described at
 		// https://github.com/jlu5/ircv3-specifications/blob/master/extensions/relaymsg.md
 		// nolint:nestif
@@ -240,11 +305,15 @@ func (b *Birc) doSend() {
 				text = ":" + text
 			}
 
+			prefix := ""
+			if len(tags) > 0 {
+				prefix = string(tags.Bytes()) + " "
+			}
 			if msg.Event == config.EventUserAction {
-				b.i.Cmd.SendRawf("RELAYMSG %s %s :\x01ACTION %s\x01", msg.Channel, username, text) //nolint:errcheck
+				b.i.Cmd.SendRawf("%sRELAYMSG %s %s :\x01ACTION %s\x01", prefix, msg.Channel, username, text) //nolint:errcheck
 			} else {
 				b.Log.Debugf("Sending RELAYMSG to channel %s: nick=%s", msg.Channel, username)
-				b.i.Cmd.SendRawf("RELAYMSG %s %s :%s", msg.Channel, username, text) //nolint:errcheck
+				b.i.Cmd.SendRawf("%sRELAYMSG %s %s :%s", prefix, msg.Channel, username, text) //nolint:errcheck
 			}
 		} else {
 			if b.GetBool("Colornicks") {
@@ -254,13 +323,17 @@ func (b *Birc) doSend() {
 			}
 			switch msg.Event {
 			case config.EventUserAction:
-				b.i.Cmd.Action(msg.Channel, username+msg.Text)
+				b.i.Send(&girc.Event{
+					Command: girc.PRIVMSG,
+					Params:  []string{msg.Channel, girc.EncodeCTCPRaw(girc.CTCP_ACTION, username+msg.Text)},
+					Tags:    tags,
+				})
 			case config.EventNoticeIRC:
 				b.Log.Debugf("Sending notice to channel %s", msg.Channel)
-				b.i.Cmd.Notice(msg.Channel, username+msg.Text)
+				b.i.Send(&girc.Event{Command: girc.NOTICE, Params: []string{msg.Channel, username + msg.Text}, Tags: tags})
 			default:
 				b.Log.Debugf("Sending to channel %s", msg.Channel)
-				b.i.Cmd.Message(msg.Channel, username+msg.Text)
+				b.i.Send(&girc.Event{Command: girc.PRIVMSG, Params: []string{msg.Channel, username + msg.Text}, Tags: tags})
 			}
 		}
 	}
@@ -268,14 +341,15 @@ func (b *Birc) doSend() {
 
 // validateInput validates the server/port/nick configuration. Returns a *girc.Client if successful
 func (b *Birc) getClient() (*girc.Client, error) {
-	server, portstr, err := net.SplitHostPort(b.GetString("Server"))
-	if err != nil {
-		return nil, err
-	}
-	port, err := strconv.Atoi(portstr)
-	if err != nil {
-		return nil, err
+	realName := b.GetString("RealName")
+	if realName == "" {
+		realName = b.GetString("Nick")
 	}
+	return b.newClient(b.GetString("Nick"), b.getUser(), realName)
+}
+
+// getUser returns the configured username, made valid for girc.
+func (b *Birc) getUser() string {
 	user := b.GetString("UserName")
 	if user == "" {
 		user = b.GetString("Nick")
@@ -288,9 +362,18 @@ func (b *Birc) getClient() (*girc.Client, error) {
 		}
 		user = user[1:]
 	}
-	realName := b.GetString("RealName")
-	if realName == "" {
-		realName = b.GetString("Nick")
+	return user
+}
+
+// newClient returns a *girc.Client for the configured server with the specified identity.
+func (b *Birc) newClient(nick, user, realName string) (*girc.Client, error) {
+	server, portstr, err := net.SplitHostPort(b.GetString("Server"))
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portstr)
+	if err != nil {
+		return nil, err
 	}
 
 	debug := ioutil.Discard
@@ -314,7 +397,7 @@ func (b *Birc) getClient() (*girc.Client, error) {
 		Server:     server,
 		ServerPass: b.GetString("Password"),
 		Port:       port,
-		Nick:       b.GetString("Nick"),
+		Nick:       nick,
 		User:       user,
 		Name:       realName,
 		SSL:        b.GetBool("UseTLS"),
@@ -322,9 +405,14 @@ func (b *Birc) getClient() (*girc.Client, error) {
 		TLSConfig:  tlsConfig,
 		PingDelay:  pingDelay,
 		// skip gIRC internal rate limiting, since we have our own throttling
-		AllowFlood:    true,
-		Debug:         debug,
-		SupportedCaps: map[string][]string{"overdrivenetworks.com/relaymsg": nil, "draft/relaymsg": nil},
+		AllowFlood: true,
+		Debug:      debug,
+		SupportedCaps: map[string][]string{
+			"overdrivenetworks.com/relaymsg": nil,
+			"draft/relaymsg":                 nil,
+			"echo-message":                   nil,
+			"labeled-response":               nil,
+		},
 	})
 	return i, nil
 }
@@ -367,6 +455,10 @@ func (b *Birc) skipPrivMsg(event girc.Event) bool {
 			return true
 		}
 	}
+	// don't forward messages of our puppets
+	if event.Source != nil && b.GetBool("UsePuppets") && b.isPuppet(event.Source.Name) {
+		return true
+	}
 	// don't forward messages we sent via RELAYMSG
 	if relayedNick, ok := event.Tags.Get("draft/relaymsg"); ok && relayedNick == b.Nick {
 		return true
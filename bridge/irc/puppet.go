@@ -0,0 +1,332 @@
+package birc
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/42wim/matterbridge/bridge/config"
+	"github.com/lrstanley/girc"
+)
+
+const (
+	defaultPuppetMaxClients   = 10
+	defaultPuppetIdleTimeout  = 30 * time.Minute
+	defaultPuppetConnectDelay = 2 * time.Second
+	defaultPuppetNickLen      = 30
+	// puppetReadyTimeout is how long we wait for a puppet to be registered on the server.
+	puppetReadyTimeout = time.Minute
+	// puppetQueueSize is the amount of lines queued per puppet before we start dropping them.
+	puppetQueueSize = 30
+	// puppetQuitTimeout is how long the events of a removed puppet, like its quit, are still ignored.
+	puppetQuitTimeout = time.Minute
+)
+
+// puppet is an IRC connection for a single remote user.
+type puppet struct {
+	key       string
+	nick      string
+	client    *girc.Client
+	channels  map[string]bool
+	queue     chan config.Message
+	ready     chan struct{}
+	readyOnce sync.Once
+	closeOnce sync.Once
+	lastUsed  time.Time
+}
+
+// Nick returns the current nick of the puppet, the server can change the one we asked for.
+func (p *puppet) Nick() string {
+	if p.client.IsConnected() {
+		return p.client.GetNick()
+	}
+	return p.nick
+}
+
+// close closes the queue, which makes runPuppet quit the connection.
+func (p *puppet) close() {
+	p.closeOnce.Do(func() {
+		close(p.queue)
+	})
+}
+
+// sendPuppet sends the lines of the message using the puppet of the remote user.
+// Returns false if the message needs to be sent by the bot.
+func (b *Birc) sendPuppet(msg *config.Message, lines []string) bool {
+	if msg.Event != "" && msg.Event != config.EventUserAction {
+		return false
+	}
+	username := strings.TrimSpace(msg.Username)
+	if username == "" {
+		return false
+	}
+
+	b.puppetsMutex.Lock()
+	defer b.puppetsMutex.Unlock()
+
+	userID := msg.UserID
+	if userID == "" {
+		userID = username
+	}
+	key := msg.Account + "/" + userID
+	p, ok := b.puppets[key]
+	if !ok {
+		if p = b.newPuppet(key, username); p == nil {
+			return false
+		}
+	}
+	p.lastUsed = time.Now()
+
+	for _, line := range lines {
+		m := *msg
+		m.Text = line
+		select {
+		case p.queue <- m:
+		default:
+			b.Log.Debugf("flooding, dropping message for puppet %s", p.nick)
+			return true
+		}
+	}
+	return true
+}
+
+// newPuppet creates and starts a puppet, evicting the least recently used puppet if the pool is full.
+// Returns nil if the pool is full of active puppets. The caller must hold the puppetsMutex.
+func (b *Birc) newPuppet(key, username string) *puppet {
+	maxClients := b.GetInt("PuppetMaxClients")
+	if maxClients == 0 {
+		maxClients = defaultPuppetMaxClients
+	}
+	if len(b.puppets) >= maxClients {
+		var lru *puppet
+		for _, p := range b.puppets {
+			if lru == nil || p.lastUsed.Before(lru.lastUsed) {
+				lru = p
+			}
+		}
+		if time.Since(lru.lastUsed) < time.Minute {
+			b.Log.Debugf("puppet pool full (%d), sending message from %s as bot", maxClients, username)
+			return nil
+		}
+		b.Log.Debugf("puppet pool full, disconnecting least recently used puppet %s", lru.nick)
+		b.dropPuppet(lru)
+	}
+
+	nick := b.puppetNick(username)
+	client, err := b.newClient(nick, b.getUser(), username)
+	if err != nil {
+		b.Log.Errorf("creating puppet %s failed: %s", nick, err)
+		return nil
+	}
+	p := &puppet{
+		key:      key,
+		nick:     nick,
+		client:   client,
+		channels: make(map[string]bool),
+		queue:    make(chan config.Message, puppetQueueSize),
+		ready:    make(chan struct{}),
+	}
+	client.Handlers.Add(girc.RPL_WELCOME, func(c *girc.Client, e girc.Event) {
+		p.readyOnce.Do(func() { close(p.ready) })
+	})
+	// join the channel again on the next message after a kick
+	client.Handlers.Add(girc.KICK, func(c *girc.Client, e girc.Event) {
+		if len(e.Params) > 1 && e.Params[1] == c.GetNick() {
+			b.puppetsMutex.Lock()
+			delete(p.channels, strings.ToLower(e.Params[0]))
+			b.puppetsMutex.Unlock()
+		}
+	})
+	b.puppets[key] = p
+
+	// connections are rate limited, wait for our slot
+	wait := time.Until(b.nextPuppetConnect)
+	if wait < 0 {
+		wait = 0
+	}
+	delay := defaultPuppetConnectDelay
+	if b.IsKeySet("PuppetConnectDelay") {
+		delay = time.Duration(b.GetInt("PuppetConnectDelay")) * time.Millisecond
+	}
+	b.nextPuppetConnect = time.Now().Add(wait + delay)
+
+	go b.runPuppet(p, wait)
+	return p
+}
+
+// runPuppet connects the puppet and sends its queued messages until it's closed.
+func (b *Birc) runPuppet(p *puppet, wait time.Duration) {
+	time.Sleep(wait)
+	b.Log.Infof("Connecting puppet %s", p.nick)
+
+	go func() {
+		if err := p.client.Connect(); err != nil {
+			b.Log.Errorf("puppet %s disconnected: %s", p.nick, err)
+		}
+		b.removePuppet(p)
+	}()
+
+	select {
+	case <-p.ready:
+	case <-time.After(puppetReadyTimeout):
+		b.Log.Errorf("puppet %s didn't connect in time", p.nick)
+		b.removePuppet(p)
+	}
+
+	rate := time.Millisecond * time.Duration(b.MessageDelay)
+	throttle := time.NewTicker(rate)
+	defer throttle.Stop()
+	for msg := range p.queue {
+		if !p.client.IsConnected() {
+			b.Log.Errorf("puppet %s not connected, dropping message", p.nick)
+			continue
+		}
+		<-throttle.C
+		b.puppetsMutex.Lock()
+		joined := p.channels[strings.ToLower(msg.Channel)]
+		p.channels[strings.ToLower(msg.Channel)] = true
+		b.puppetsMutex.Unlock()
+		if !joined {
+			if key := b.channelKey(msg.Channel); key != "" {
+				p.client.Cmd.JoinKey(msg.Channel, key)
+			} else {
+				p.client.Cmd.Join(msg.Channel)
+			}
+		}
+		if msg.Event == config.EventUserAction {
+			p.client.Cmd.Action(msg.Channel, msg.Text)
+			continue
+		}
+		p.client.Send(&girc.Event{Command: girc.PRIVMSG, Params: []string{msg.Channel, msg.Text}, Tags: b.puppetTags(&msg)})
+	}
+	if p.client.IsConnected() {
+		p.client.Quit("idle")
+	}
+	p.client.Close()
+}
+
+// puppetTags returns the reply tag for a message sent by a puppet.
+func (b *Birc) puppetTags(msg *config.Message) girc.Tags {
+	tags := girc.Tags{}
+	b.setReplyTag(tags, msg)
+	return tags
+}
+
+// removePuppet removes the puppet from the pool and stops it.
+func (b *Birc) removePuppet(p *puppet) {
+	b.puppetsMutex.Lock()
+	defer b.puppetsMutex.Unlock()
+	if b.puppets[p.key] == p {
+		b.dropPuppet(p)
+	}
+	p.close()
+}
+
+// dropPuppet removes the puppet from the pool and stops it, its nick is remembered so its quit
+// isn't relayed. The caller must hold the puppetsMutex.
+func (b *Birc) dropPuppet(p *puppet) {
+	delete(b.puppets, p.key)
+	b.removedPuppets[strings.ToLower(p.Nick())] = time.Now()
+	p.close()
+}
+
+// expirePuppets disconnects puppets that have been idle for PuppetIdleTimeout, until done is closed.
+func (b *Birc) expirePuppets(done chan struct{}) {
+	timeout := defaultPuppetIdleTimeout
+	if d, err := time.ParseDuration(b.GetString("PuppetIdleTimeout")); err == nil && d > 0 {
+		timeout = d
+	}
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		b.puppetsMutex.Lock()
+		for _, p := range b.puppets {
+			if time.Since(p.lastUsed) > timeout {
+				b.Log.Debugf("puppet %s idle for %s, disconnecting", p.nick, timeout)
+				b.dropPuppet(p)
+			}
+		}
+		for nick, removed := range b.removedPuppets {
+			if time.Since(removed) > puppetQuitTimeout {
+				delete(b.removedPuppets, nick)
+			}
+		}
+		b.puppetsMutex.Unlock()
+	}
+}
+
+// closePuppets disconnects all puppets.
+func (b *Birc) closePuppets() {
+	b.puppetsMutex.Lock()
+	defer b.puppetsMutex.Unlock()
+	for _, p := range b.puppets {
+		b.dropPuppet(p)
+	}
+}
+
+// isPuppet returns true if nick belongs to one of the puppets we opened.
+// Puppets removed less than puppetQuitTimeout ago are included, so their quits are ignored too.
+func (b *Birc) isPuppet(nick string) bool {
+	b.puppetsMutex.Lock()
+	defer b.puppetsMutex.Unlock()
+	if removed, ok := b.removedPuppets[strings.ToLower(nick)]; ok && time.Since(removed) < puppetQuitTimeout {
+		return true
+	}
+	for _, p := range b.puppets {
+		if strings.EqualFold(p.Nick(), nick) {
+			return true
+		}
+	}
+	return false
+}
+
+// channelKey returns the configured key of the channel.
+func (b *Birc) channelKey(channel string) string {
+	for _, info := range b.Channels {
+		if strings.EqualFold(info.Name, channel) {
+			return info.Options.Key
+		}
+	}
+	return ""
+}
+
+// puppetNick turns the username into a valid IRC nick with the PuppetSuffix.
+func (b *Birc) puppetNick(username string) string {
+	suffix := b.puppetSuffix()
+	nick := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		case strings.ContainsRune("[]\\`_^{|}-", r):
+			return r
+		}
+		return -1
+	}, username)
+	if nick == "" {
+		nick = "user"
+	}
+	if strings.ContainsAny(nick[:1], "0123456789-") {
+		nick = "_" + nick
+	}
+
+	nickLen := defaultPuppetNickLen
+	if n, ok := b.i.GetServerOptionInt("NICKLEN"); ok && n > 0 {
+		nickLen = n
+	}
+	if max := nickLen - len(suffix); max > 0 && len(nick) > max {
+		nick = nick[:max]
+	}
+	return nick + suffix
+}
+
+func (b *Birc) puppetSuffix() string {
+	if !b.IsKeySet("PuppetSuffix") {
+		return "[m]"
+	}
+	return b.GetString("PuppetSuffix")
+}
@@ -0,0 +1,192 @@
+package birc
+
+import (
+	"bufio"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/42wim/matterbridge/bridge/bridgetest"
+	"github.com/42wim/matterbridge/bridge/config"
+	"github.com/lrstanley/girc"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeIRC is an IRC server registering every client and recording the lines they send, by nick.
+type fakeIRC struct {
+	listener net.Listener
+	mutex    sync.Mutex
+	lines    map[string][]string
+	msgids   int
+}
+
+func newFakeIRC(t *testing.T) *fakeIRC {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s := &fakeIRC{listener: l, lines: make(map[string][]string)}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *fakeIRC) serve(conn net.Conn) {
+	defer conn.Close()
+	var nick string
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		event := girc.ParseEvent(scanner.Text())
+		if event == nil {
+			continue
+		}
+		switch event.Command {
+		case girc.NICK:
+			nick = event.Params[0]
+		case girc.USER:
+			conn.Write([]byte(":fake 001 " + nick + " :Welcome\r\n")) //nolint:errcheck
+		case girc.PING:
+			conn.Write([]byte(":fake PONG fake :" + event.Last() + "\r\n")) //nolint:errcheck
+		case girc.CAP:
+			s.handleCap(conn, event)
+		case girc.PRIVMSG:
+			s.echo(conn, nick, event)
+		}
+		s.mutex.Lock()
+		s.lines[nick] = append(s.lines[nick], event.Command+" "+strings.Join(event.Params, " "))
+		s.mutex.Unlock()
+	}
+}
+
+// handleCap offers and acknowledges the IRCv3 capabilities for the msgid of our messages.
+func (s *fakeIRC) handleCap(conn net.Conn, event *girc.Event) {
+	switch event.Params[0] {
+	case girc.CAP_LS:
+		conn.Write([]byte(":fake CAP * LS :echo-message labeled-response message-tags server-time\r\n")) //nolint:errcheck
+	case girc.CAP_REQ:
+		conn.Write([]byte(":fake CAP * ACK :" + event.Last() + "\r\n")) //nolint:errcheck
+	}
+}
+
+// echo sends the message back with a msgid and its label.
+func (s *fakeIRC) echo(conn net.Conn, nick string, event *girc.Event) {
+	s.mutex.Lock()
+	s.msgids++
+	echo := &girc.Event{
+		Source:  &girc.Source{Name: nick, Ident: nick, Host: "host"},
+		Command: girc.PRIVMSG,
+		Params:  event.Params,
+		Tags:    girc.Tags{"msgid": "msgid" + strconv.Itoa(s.msgids)},
+	}
+	s.mutex.Unlock()
+	if label, ok := event.Tags.Get("label"); ok {
+		echo.Tags["label"] = label
+	}
+	conn.Write(append(echo.Bytes(), '\r', '\n')) //nolint:errcheck
+}
+
+func (s *fakeIRC) sent(nick string) []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]string(nil), s.lines[nick]...)
+}
+
+// newTestBridge returns a bridge connected to the server, with the extra settings.
+func newTestBridge(t *testing.T, server, extra string) *Birc {
+	b := New(bridgetest.Config("irc.test", `
+[irc.test]
+Server="`+server+`"
+Nick="bot"
+MessageDelay=10
+`+extra)).(*Birc)
+
+	i, err := b.getClient()
+	require.NoError(t, err)
+	i.Handlers.Add(girc.ALL_EVENTS, b.handleEcho)
+	b.i = i
+	b.Local = make(chan config.Message, b.MessageQueue+10)
+	go i.Connect() //nolint:errcheck
+	t.Cleanup(func() {
+		b.closePuppets()
+		i.Close()
+	})
+	require.Eventually(t, i.IsConnected, 5*time.Second, 10*time.Millisecond)
+	return b
+}
+
+const puppetConfig = `
+UsePuppets=true
+PuppetConnectDelay=0
+`
+
+func TestSendPuppet(t *testing.T) {
+	server := newFakeIRC(t)
+	b := newTestBridge(t, server.listener.Addr().String(), puppetConfig)
+
+	_, err := b.Send(config.Message{Username: "alice", UserID: "1", Text: "hello", Channel: "#test", Account: "discord.test"})
+	require.NoError(t, err)
+
+	assert.Eventually(t, func() bool {
+		lines := server.sent("alice[m]")
+		return len(lines) > 0 && lines[len(lines)-1] == "PRIVMSG #test hello"
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Contains(t, server.sent("alice[m]"), "JOIN #test")
+	for _, line := range server.sent("bot") {
+		assert.NotContains(t, line, "hello", "message sent by the bot")
+	}
+	assert.True(t, b.isPuppet("alice[m]"))
+}
+
+func TestIgnorePuppets(t *testing.T) {
+	server := newFakeIRC(t)
+	b := newTestBridge(t, server.listener.Addr().String(), puppetConfig)
+	b.puppetsMutex.Lock()
+	p := b.newPuppet("discord.test/1", "alice")
+	b.puppetsMutex.Unlock()
+	require.NotNil(t, p)
+
+	puppetMsg := girc.ParseEvent(":alice[m]!alice@host PRIVMSG #test :hello")
+	assert.True(t, b.skipPrivMsg(*puppetMsg))
+
+	// users of other bridges can have the same suffix
+	userMsg := girc.ParseEvent(":bob[m]!bob@host PRIVMSG #test :hello")
+	assert.False(t, b.skipPrivMsg(*userMsg))
+
+	b.handleJoinPart(b.i, *girc.ParseEvent(":alice[m]!alice@host JOIN #test"))
+	b.handleJoinPart(b.i, *girc.ParseEvent(":bob[m]!bob@host JOIN #test"))
+	msg := <-b.Remote
+	assert.Equal(t, "bob[m] joins", msg.Text)
+
+	// the quit of a removed puppet is ignored too
+	b.removePuppet(p)
+	b.handleJoinPart(b.i, *girc.ParseEvent(":alice[m]!alice@host QUIT :idle"))
+	assert.Empty(t, b.Remote)
+}
+
+func TestExpirePuppetsStops(t *testing.T) {
+	server := newFakeIRC(t)
+	b := newTestBridge(t, server.listener.Addr().String(), puppetConfig)
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		b.expirePuppets(done)
+		close(stopped)
+	}()
+	close(done)
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expirePuppets didn't return after done was closed")
+	}
+}
@@ -0,0 +1,214 @@
+package birc
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/lrstanley/girc"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+const (
+	saslPlain       = "PLAIN"
+	saslExternal    = "EXTERNAL"
+	saslScramSHA256 = "SCRAM-SHA-256"
+)
+
+// getSASL returns the SASL mechanism configured in SASLMechanism.
+func (b *Birc) getSASL() (girc.SASLMech, error) {
+	mechanism := strings.ToUpper(b.GetString("SASLMechanism"))
+	switch mechanism {
+	case "", saslPlain:
+		return &girc.SASLPlain{
+			User: b.GetString("NickServNick"),
+			Pass: b.GetString("NickServPassword"),
+		}, nil
+	case saslExternal:
+		if b.GetString("TLSClientCertificate") == "" {
+			return nil, errors.New("SASL EXTERNAL needs a TLSClientCertificate")
+		}
+		if !b.GetBool("UseTLS") {
+			return nil, errors.New("SASL EXTERNAL needs UseTLS=true")
+		}
+		return &girc.SASLExternal{}, nil
+	case saslScramSHA256:
+		return &saslScram{
+			user: b.GetString("NickServNick"),
+			pass: b.GetString("NickServPassword"),
+			fail: b.setSASLError,
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown SASLMechanism %s, use %s, %s or %s", mechanism, saslPlain, saslExternal, saslScramSHA256)
+}
+
+func (b *Birc) setSASLError(err error) {
+	b.Log.Error(err)
+	b.saslMutex.Lock()
+	b.saslError = err
+	b.saslMutex.Unlock()
+}
+
+// takeSASLError returns and clears the reason the SASL authentication failed, if any.
+func (b *Birc) takeSASLError() error {
+	b.saslMutex.Lock()
+	defer b.saslMutex.Unlock()
+	err := b.saslError
+	b.saslError = nil
+	return err
+}
+
+// handleSASLMechs is called when the server doesn't support our mechanism.
+func (b *Birc) handleSASLMechs(client *girc.Client, event girc.Event) {
+	available := ""
+	if len(event.Params) > 1 {
+		available = event.Params[1]
+	}
+	b.setSASLError(fmt.Errorf("server doesn't support SASL mechanism %s, available mechanisms: %s",
+		client.Config.SASL.Method(), available))
+}
+
+// checkSASL makes sure we authenticated, girc continues without SASL if the server doesn't offer it.
+func (b *Birc) checkSASL(client *girc.Client) {
+	if !b.GetBool("UseSASL") || client.HasCapability("sasl") {
+		return
+	}
+	b.setSASLError(errors.New("server doesn't support SASL, disable UseSASL to connect without it"))
+	client.Close()
+}
+
+// saslScram implements the SCRAM-SHA-256 SASL mechanism, see RFC 5802 and RFC 7677.
+type saslScram struct {
+	user, pass string
+	// fail is called with the reason when the authentication can't continue.
+	fail func(error)
+
+	// nonce is the client nonce, generated when empty.
+	nonce           string
+	clientFirstBare string
+	authMessage     string
+	saltedPassword  []byte
+}
+
+func (s *saslScram) Method() string {
+	return saslScramSHA256
+}
+
+// Encode returns the response to the AUTHENTICATE message of the server.
+func (s *saslScram) Encode(params []string) string {
+	if len(params) != 1 {
+		return ""
+	}
+	// the server starts a new exchange
+	if params[0] == "+" {
+		return s.clientFirst()
+	}
+
+	data, err := base64.StdEncoding.DecodeString(params[0])
+	if err != nil {
+		s.fail(fmt.Errorf("SASL %s: invalid server message: %s", saslScramSHA256, err))
+		return ""
+	}
+	if s.authMessage == "" {
+		res, err := s.clientFinal(string(data))
+		if err != nil {
+			s.fail(fmt.Errorf("SASL %s: %s", saslScramSHA256, err))
+			return ""
+		}
+		return res
+	}
+	if err := s.verifyServer(string(data)); err != nil {
+		s.fail(fmt.Errorf("SASL %s: %s", saslScramSHA256, err))
+		return ""
+	}
+	return "+"
+}
+
+func (s *saslScram) clientFirst() string {
+	// only the first exchange uses a configured nonce
+	if s.nonce == "" || s.clientFirstBare != "" {
+		buf := make([]byte, 24)
+		if _, err := rand.Read(buf); err != nil {
+			s.fail(err)
+			return ""
+		}
+		s.nonce = base64.RawStdEncoding.EncodeToString(buf)
+	}
+	s.authMessage = ""
+	s.clientFirstBare = "n=" + scramEscape(s.user) + ",r=" + s.nonce
+	return base64.StdEncoding.EncodeToString([]byte("n,," + s.clientFirstBare))
+}
+
+// clientFinal computes the proof for the server-first message.
+func (s *saslScram) clientFinal(serverFirst string) (string, error) {
+	attrs := scramAttributes(serverFirst)
+	nonce, salt64, iterations := attrs["r"], attrs["s"], attrs["i"]
+	if !strings.HasPrefix(nonce, s.nonce) || len(nonce) == len(s.nonce) {
+		return "", errors.New("server sent an invalid nonce")
+	}
+	salt, err := base64.StdEncoding.DecodeString(salt64)
+	if err != nil {
+		return "", fmt.Errorf("server sent an invalid salt: %s", err)
+	}
+	iter, err := strconv.Atoi(iterations)
+	if err != nil || iter < 1 {
+		return "", fmt.Errorf("server sent an invalid iteration count %q", iterations)
+	}
+
+	s.saltedPassword = pbkdf2.Key([]byte(s.pass), salt, iter, sha256.Size, sha256.New)
+	clientKey := scramHMAC(s.saltedPassword, "Client Key")
+	storedKey := sha256.Sum256(clientKey)
+
+	// biws is the base64 of the "n,," gs2 header
+	clientFinal := "c=biws,r=" + nonce
+	s.authMessage = s.clientFirstBare + "," + serverFirst + "," + clientFinal
+	proof := scramHMAC(storedKey[:], s.authMessage)
+	for i := range proof {
+		proof[i] ^= clientKey[i]
+	}
+	clientFinal += ",p=" + base64.StdEncoding.EncodeToString(proof)
+	return base64.StdEncoding.EncodeToString([]byte(clientFinal)), nil
+}
+
+// verifyServer checks the signature of the server, proving it knows our password too.
+func (s *saslScram) verifyServer(serverFinal string) error {
+	attrs := scramAttributes(serverFinal)
+	if e, ok := attrs["e"]; ok {
+		return fmt.Errorf("server error: %s", e)
+	}
+	signature, err := base64.StdEncoding.DecodeString(attrs["v"])
+	if err != nil {
+		return fmt.Errorf("server sent an invalid signature: %s", err)
+	}
+	serverKey := scramHMAC(s.saltedPassword, "Server Key")
+	if !hmac.Equal(signature, scramHMAC(serverKey, s.authMessage)) {
+		return errors.New("server signature doesn't match, wrong server or password")
+	}
+	return nil
+}
+
+func scramHMAC(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// scramAttributes parses the comma separated key=value attributes of a SCRAM message.
+func scramAttributes(msg string) map[string]string {
+	attrs := make(map[string]string)
+	for _, attr := range strings.Split(msg, ",") {
+		if len(attr) > 1 && attr[1] == '=' {
+			attrs[attr[:1]] = attr[2:]
+		}
+	}
+	return attrs
+}
+
+func scramEscape(name string) string {
+	return strings.NewReplacer("=", "=3D", ",", "=2C").Replace(name)
+}
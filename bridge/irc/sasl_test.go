@@ -0,0 +1,54 @@
+package birc
+
+import (
+	"encoding/base64"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func b64(s string) string {
+	return base64.StdEncoding.EncodeToString([]byte(s))
+}
+
+// TestSASLScram uses the example exchange of RFC 7677.
+func TestSASLScram(t *testing.T) {
+	var failure error
+	s := &saslScram{
+		user:  "user",
+		pass:  "pencil",
+		nonce: "rOprNGfwEbeRWgbNEkqO",
+		fail:  func(err error) { failure = err },
+	}
+
+	assert.Equal(t, b64("n,,n=user,r=rOprNGfwEbeRWgbNEkqO"), s.Encode([]string{"+"}))
+
+	serverFirst := "r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096"
+	assert.Equal(t,
+		b64("c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ="),
+		s.Encode([]string{b64(serverFirst)}))
+
+	assert.Equal(t, "+", s.Encode([]string{b64("v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4=")}))
+	require.NoError(t, failure)
+}
+
+func TestSASLScramInvalidServer(t *testing.T) {
+	var failure error
+	s := &saslScram{
+		user:  "user",
+		pass:  "pencil",
+		nonce: "rOprNGfwEbeRWgbNEkqO",
+		fail:  func(err error) { failure = err },
+	}
+	s.Encode([]string{"+"})
+	s.Encode([]string{b64("r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096")})
+
+	assert.Equal(t, "", s.Encode([]string{b64("v=" + b64("wrong signature"))}))
+	assert.EqualError(t, failure, "SASL SCRAM-SHA-256: server signature doesn't match, wrong server or password")
+
+	// a nonce that isn't ours
+	s.Encode([]string{"+"})
+	assert.Equal(t, "", s.Encode([]string{b64("r=someoneelse,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096")}))
+	assert.EqualError(t, failure, "SASL SCRAM-SHA-256: server sent an invalid nonce")
+}
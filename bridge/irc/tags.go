@@ -0,0 +1,130 @@
+package birc
+
+import (
+	"github.com/42wim/matterbridge/bridge/config"
+	"github.com/lrstanley/girc"
+	"github.com/rs/xid"
+)
+
+// labelsSize is the amount of labels of sent messages remembered with their msgid.
+const labelsSize = 1000
+
+// canLabel returns true if the server echoes our messages with their msgid and our label.
+func (b *Birc) canLabel() bool {
+	return b.i.HasCapability("echo-message") && b.i.HasCapability("labeled-response")
+}
+
+// hasTags returns true if the server supports client-only (+) message tags.
+func (b *Birc) hasTags() bool {
+	return b.i.HasCapability("message-tags")
+}
+
+// newLabel returns a new label for a message we send. The label is the ID of the message for the
+// gateway, the msgid of the echo is mapped to it when the server sends the echo.
+func (b *Birc) newLabel() string {
+	label := xid.New().String()
+	b.msgids.Add(label, "")
+	return label
+}
+
+// handleEcho maps the label of our echoed messages to their msgid.
+func (b *Birc) handleEcho(client *girc.Client, event girc.Event) {
+	if !event.Echo {
+		return
+	}
+	label, ok := event.Tags.Get("label")
+	if !ok || !b.msgids.Contains(label) {
+		return
+	}
+	msgid, ok := event.Tags.Get("msgid")
+	if !ok {
+		return
+	}
+	b.msgids.Add(label, msgid)
+	b.labels.Add(msgid, label)
+}
+
+// msgID returns the msgid for the ID of a message, which is a label for the messages we sent.
+// Returns "" if the echo of the labeled message didn't arrive yet.
+func (b *Birc) msgID(id string) string {
+	if msgid, ok := b.msgids.Get(id); ok {
+		return msgid.(string)
+	}
+	return id
+}
+
+// messageID returns the ID the gateway knows for the msgid, the label for the messages we sent.
+func (b *Birc) messageID(msgid string) string {
+	if label, ok := b.labels.Get(msgid); ok {
+		return label.(string)
+	}
+	return msgid
+}
+
+// sendTags returns the tags for the message we send: our label and the message it replies to.
+func (b *Birc) sendTags(msg *config.Message) girc.Tags {
+	tags := girc.Tags{}
+	// the label is passed in the ID of the queued message, see Send
+	if msg.ID != "" {
+		tags["label"] = msg.ID
+	}
+	b.setReplyTag(tags, msg)
+	return tags
+}
+
+// setReplyTag sets the tag with the msgid of the message msg replies to.
+func (b *Birc) setReplyTag(tags girc.Tags, msg *config.Message) {
+	if !msg.ParentValid() || !b.hasTags() {
+		return
+	}
+	parent := b.msgID(msg.ParentID)
+	if parent == "" {
+		b.Log.Debugf("no msgid for %s yet, sending without reply tag", msg.ParentID)
+		return
+	}
+	if err := tags.Set("+draft/reply", parent); err != nil {
+		b.Log.Debugf("can't set reply tag: %s", err)
+	}
+}
+
+// setReceiveTags sets the ID, parent and timestamp of a received message from its tags.
+func (b *Birc) setReceiveTags(rmsg *config.Message, event *girc.Event) {
+	if msgid, ok := event.Tags.Get("msgid"); ok {
+		rmsg.ID = msgid
+	}
+	if parent, ok := event.Tags.Get("+draft/reply"); ok {
+		rmsg.ParentID = b.messageID(parent)
+	} else if parent, ok := event.Tags.Get("+reply"); ok {
+		rmsg.ParentID = b.messageID(parent)
+	}
+	// girc uses server-time if available
+	rmsg.Timestamp = event.Timestamp
+}
+
+// sendTyping sends a typing notification, if the server supports message tags.
+func (b *Birc) sendTyping(msg *config.Message) {
+	if !b.GetBool("ShowUserTyping") || !b.hasTags() {
+		return
+	}
+	b.i.Send(&girc.Event{
+		Command: girc.CAP_TAGMSG,
+		Params:  []string{msg.Channel},
+		Tags:    girc.Tags{"+typing": "active"},
+	})
+}
+
+func (b *Birc) handleTagMsg(client *girc.Client, event girc.Event) {
+	if !b.GetBool("ShowUserTyping") || len(event.Params) == 0 || b.skipPrivMsg(event) {
+		return
+	}
+	if typing, ok := event.Tags.Get("+typing"); !ok || typing != "active" {
+		return
+	}
+	b.Log.Debugf("<= Sending typing from %s on %s to gateway", event.Source.Name, b.Account)
+	b.Remote <- config.Message{
+		Username: event.Source.Name,
+		Channel:  event.Params[0],
+		Account:  b.Account,
+		Event:    config.EventUserTyping,
+	}
+}
@@ -0,0 +1,51 @@
+package birc
+
+import (
+	"testing"
+	"time"
+
+	"github.com/42wim/matterbridge/bridge/config"
+	"github.com/lrstanley/girc"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSetReceiveTags(t *testing.T) {
+	server := newFakeIRC(t)
+	b := newTestBridge(t, server.listener.Addr().String(), "")
+	b.labels.Add("msgid1", "label1")
+
+	event := girc.ParseEvent("@msgid=abc;+draft/reply=msgid1;time=2024-01-02T03:04:05.000Z :nick!user@host PRIVMSG #test :hello")
+	var rmsg config.Message
+	b.setReceiveTags(&rmsg, event)
+	assert.Equal(t, "abc", rmsg.ID)
+	assert.Equal(t, "label1", rmsg.ParentID, "reply to a message we sent")
+	assert.Equal(t, time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC), rmsg.Timestamp.UTC())
+
+	event = girc.ParseEvent("@+reply=def :nick!user@host PRIVMSG #test :hello")
+	rmsg = config.Message{}
+	b.setReceiveTags(&rmsg, event)
+	assert.Equal(t, "", rmsg.ID)
+	assert.Equal(t, "def", rmsg.ParentID)
+}
+
+func TestSendLabeled(t *testing.T) {
+	server := newFakeIRC(t)
+	b := newTestBridge(t, server.listener.Addr().String(), "")
+	require.Eventually(t, b.canLabel, 5*time.Second, 10*time.Millisecond)
+	go b.doSend()
+
+	// the label is returned right away, the msgid of the echo is mapped to it
+	label, err := b.Send(config.Message{Username: "alice: ", Text: "hello", Channel: "#test"})
+	require.NoError(t, err)
+	require.NotEmpty(t, label)
+	assert.Eventually(t, func() bool {
+		return b.msgID(label) == "msgid1"
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, label, b.messageID("msgid1"))
+
+	tags := b.sendTags(&config.Message{ParentID: label})
+	reply, _ := tags.Get("+draft/reply")
+	assert.Equal(t, "msgid1", reply)
+	assert.Equal(t, "", b.msgID(b.newLabel()), "label without echo")
+}
@@ -0,0 +1,260 @@
+package bircd
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/hex"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lrstanley/girc"
+)
+
+const (
+	// pingInterval is how often we ping idle clients, they're disconnected after pingTimeout.
+	pingInterval = time.Minute
+	pingTimeout  = 3 * time.Minute
+	// queueSize is the amount of lines queued for a client before it's disconnected as too slow.
+	queueSize = 512
+	// maxLineLength is the longest line we accept, including message tags.
+	maxLineLength = 8191 + 512
+)
+
+// client is an IRC client connected to the bridge.
+type client struct {
+	conn net.Conn
+	host string
+	out  chan []byte
+	done chan struct{}
+	once sync.Once
+
+	// these are only used by the goroutine reading from the connection, until the client registered.
+	pass, user, realName string
+	// nick is protected by the lock of the bridge once registered.
+	nick       string
+	registered bool
+	quit       bool
+	channels   map[*channel]struct{}
+}
+
+func newClient(conn net.Conn) *client {
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		host = conn.RemoteAddr().String()
+	}
+	return &client{
+		conn:     conn,
+		host:     host,
+		out:      make(chan []byte, queueSize),
+		done:     make(chan struct{}),
+		channels: make(map[*channel]struct{}),
+	}
+}
+
+// send queues the event, clients that can't keep up are disconnected.
+func (c *client) send(event *girc.Event) {
+	select {
+	case <-c.done:
+	case c.out <- append(event.Bytes(), '\r', '\n'):
+	default:
+		c.close()
+	}
+}
+
+// flush waits a bit for the queued lines to be sent, so the client gets the reason it's disconnected.
+func (c *client) flush() {
+	deadline := time.Now().Add(time.Second)
+	for len(c.out) > 0 && time.Now().Before(deadline) {
+		select {
+		case <-c.done:
+			return
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+func (c *client) close() {
+	c.once.Do(func() {
+		close(c.done)
+		c.conn.Close()
+	})
+}
+
+// source returns the hostmask of the client.
+func (c *client) source() *girc.Source {
+	return &girc.Source{Name: c.nick, Ident: c.user, Host: c.host}
+}
+
+// certFP returns the SHA-256 fingerprint of the TLS client certificate, if any.
+func (c *client) certFP() string {
+	conn, ok := c.conn.(*tls.Conn)
+	if !ok {
+		return ""
+	}
+	certs := conn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return ""
+	}
+	sum := sha256.Sum256(certs[0].Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// writer sends the queued lines and pings the client.
+func (b *Bircd) writer(c *client) {
+	ping := time.NewTicker(pingInterval)
+	defer ping.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case line := <-c.out:
+			if err := c.conn.SetWriteDeadline(time.Now().Add(pingTimeout)); err != nil {
+				c.close()
+				return
+			}
+			if _, err := c.conn.Write(line); err != nil {
+				b.Log.Debugf("write to %s failed: %s", c.host, err)
+				c.close()
+				return
+			}
+		case <-ping.C:
+			c.send(&girc.Event{Command: girc.PING, Params: []string{b.serverName}})
+		}
+	}
+}
+
+// serve reads the commands of the client until it disconnects.
+func (b *Bircd) serve(c *client) {
+	b.Lock()
+	b.pending[c] = struct{}{}
+	b.Unlock()
+	defer b.quit(c, "Connection closed")
+
+	if tlsConn, ok := c.conn.(*tls.Conn); ok {
+		if err := tlsConn.SetDeadline(time.Now().Add(pingTimeout)); err == nil {
+			if err := tlsConn.Handshake(); err != nil {
+				b.Log.Debugf("TLS handshake with %s failed: %s", c.host, err)
+				return
+			}
+		}
+	}
+	b.Log.Debugf("client connected from %s", c.host)
+	go b.writer(c)
+
+	scanner := bufio.NewScanner(c.conn)
+	scanner.Buffer(make([]byte, 512), maxLineLength)
+	for {
+		if err := c.conn.SetReadDeadline(time.Now().Add(pingTimeout)); err != nil {
+			return
+		}
+		if !scanner.Scan() {
+			if err := scanner.Err(); err != nil {
+				b.Log.Debugf("read from %s failed: %s", c.host, err)
+			}
+			return
+		}
+		event := girc.ParseEvent(scanner.Text())
+		if event == nil {
+			continue
+		}
+		if !b.handleCommand(c, event) {
+			return
+		}
+	}
+}
+
+// register completes the registration once the client sent its NICK and USER.
+// Returns false if the client failed to authenticate.
+func (b *Bircd) register(c *client) bool {
+	if c.registered || c.nick == "" || c.user == "" {
+		return true
+	}
+
+	user, ok := b.users[strings.ToLower(c.nick)]
+	authenticated := false
+	if ok {
+		if user.CertFP != "" {
+			authenticated = subtle.ConstantTimeCompare([]byte(user.CertFP), []byte(c.certFP())) == 1
+		}
+		if !authenticated && user.Password != "" {
+			authenticated = subtle.ConstantTimeCompare([]byte(user.Password), []byte(c.pass)) == 1
+		}
+	}
+	if !authenticated {
+		b.Log.Warnf("failed authentication for %s from %s", c.nick, c.host)
+		b.reply(c, girc.ERR_PASSWDMISMATCH, "Password incorrect")
+		c.send(&girc.Event{Command: girc.ERROR, Params: []string{"Closing link: authentication failed"}})
+		return false
+	}
+
+	b.Lock()
+	if b.nickInUse(c.nick) {
+		b.Unlock()
+		b.reply(c, girc.ERR_NICKNAMEINUSE, c.nick, "Nickname is already in use")
+		return true
+	}
+	c.registered = true
+	delete(b.pending, c)
+	b.clients[strings.ToLower(c.nick)] = c
+	b.Unlock()
+
+	b.Log.Infof("%s logged in from %s", c.nick, c.host)
+	b.reply(c, girc.RPL_WELCOME, "Welcome to the "+b.serverName+" bridge "+c.source().String())
+	b.reply(c, girc.RPL_YOURHOST, "Your host is "+b.serverName+", running matterbridge")
+	b.reply(c, girc.RPL_CREATED, "This server was created "+b.created.Format(time.RFC1123))
+	b.reply(c, girc.RPL_MYINFO, b.serverName, "matterbridge", "i", "nt")
+	b.reply(c, girc.RPL_ISUPPORT, "CHANTYPES=#", "CHANMODES=,,,nt", "PREFIX=()", "CASEMAPPING=ascii",
+		"NETWORK="+b.serverName, "are supported by this server")
+	b.reply(c, girc.ERR_NOMOTD, "MOTD File is missing")
+	return true
+}
+
+// nickInUse returns true if a local client uses the nick. Remote users never get the nick of a
+// local user. The caller must hold the lock.
+func (b *Bircd) nickInUse(nick string) bool {
+	_, ok := b.clients[strings.ToLower(nick)]
+	return ok
+}
+
+// quit removes the client from its channels and closes the connection.
+func (b *Bircd) quit(c *client, reason string) {
+	b.Lock()
+	if c.quit {
+		b.Unlock()
+		return
+	}
+	c.quit = true
+	delete(b.pending, c)
+	if c.registered && b.clients[strings.ToLower(c.nick)] == c {
+		delete(b.clients, strings.ToLower(c.nick))
+	}
+	quit := &girc.Event{Source: c.source(), Command: girc.QUIT, Params: []string{reason}}
+	for ch := range c.channels {
+		delete(ch.members, c)
+		b.broadcast(ch, c, quit)
+	}
+	c.channels = make(map[*channel]struct{})
+	b.Unlock()
+	c.flush()
+	c.close()
+	if c.registered {
+		b.Log.Infof("%s disconnected: %s", c.nick, reason)
+	}
+}
+
+// reply sends a numeric reply to the client.
+func (b *Bircd) reply(c *client, numeric string, params ...string) {
+	nick := c.nick
+	if nick == "" {
+		nick = "*"
+	}
+	c.send(&girc.Event{
+		Source:  &girc.Source{Name: b.serverName},
+		Command: numeric,
+		Params:  append([]string{nick}, params...),
+	})
+}
@@ -0,0 +1,358 @@
+package bircd
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/42wim/matterbridge/bridge/config"
+	"github.com/lrstanley/girc"
+)
+
+// handleCommand handles a command of the client, returns false if the connection needs to be closed.
+func (b *Bircd) handleCommand(c *client, event *girc.Event) bool {
+	switch event.Command {
+	case girc.CAP:
+		b.handleCap(c, event)
+		return true
+	case girc.PASS:
+		if c.registered {
+			b.reply(c, girc.ERR_ALREADYREGISTRED, "You may not reregister")
+		} else if len(event.Params) > 0 {
+			c.pass = event.Params[0]
+		}
+		return true
+	case girc.NICK:
+		return b.handleNick(c, event)
+	case girc.USER:
+		if c.registered {
+			b.reply(c, girc.ERR_ALREADYREGISTRED, "You may not reregister")
+			return true
+		}
+		if len(event.Params) < 4 {
+			b.reply(c, girc.ERR_NEEDMOREPARAMS, event.Command, "Not enough parameters")
+			return true
+		}
+		c.user, c.realName = event.Params[0], event.Params[3]
+		return b.register(c)
+	case girc.PING:
+		c.send(&girc.Event{Source: &girc.Source{Name: b.serverName}, Command: girc.PONG, Params: append([]string{b.serverName}, event.Params...)})
+		return true
+	case girc.PONG:
+		return true
+	case girc.QUIT:
+		b.quit(c, "Quit: "+strings.Join(event.Params, " "))
+		return false
+	}
+
+	if !c.registered {
+		b.reply(c, girc.ERR_NOTREGISTERED, "You have not registered")
+		return true
+	}
+
+	switch event.Command {
+	case girc.JOIN:
+		b.handleJoin(c, event)
+	case girc.PART:
+		b.handlePart(c, event)
+	case girc.PRIVMSG, girc.NOTICE:
+		b.handlePrivMsg(c, event)
+	case girc.NAMES:
+		b.handleNames(c, event)
+	case girc.TOPIC:
+		b.handleTopic(c, event)
+	case girc.LIST:
+		b.handleList(c)
+	case girc.MODE:
+		b.handleMode(c, event)
+	case girc.WHO:
+		mask := "*"
+		if len(event.Params) > 0 {
+			mask = event.Params[0]
+		}
+		b.reply(c, girc.RPL_ENDOFWHO, mask, "End of WHO list")
+	default:
+		b.reply(c, girc.ERR_UNKNOWNCOMMAND, event.Command, "Unknown command")
+	}
+	return true
+}
+
+// handleCap tells the client we don't support any capability.
+func (b *Bircd) handleCap(c *client, event *girc.Event) {
+	if len(event.Params) == 0 {
+		return
+	}
+	switch strings.ToUpper(event.Params[0]) {
+	case girc.CAP_LS, girc.CAP_LIST:
+		b.reply(c, girc.CAP, strings.ToUpper(event.Params[0]), "")
+	case girc.CAP_REQ:
+		b.reply(c, girc.CAP, girc.CAP_NAK, event.Last())
+	}
+}
+
+func (b *Bircd) handleNick(c *client, event *girc.Event) bool {
+	if len(event.Params) == 0 {
+		b.reply(c, girc.ERR_NONICKNAMEGIVEN, "No nickname given")
+		return true
+	}
+	nick := event.Params[0]
+	if !girc.IsValidNick(nick) {
+		b.reply(c, girc.ERR_ERRONEUSNICKNAME, nick, "Erroneous nickname")
+		return true
+	}
+	if !c.registered {
+		c.nick = nick
+		return b.register(c)
+	}
+	// the nick identifies the user, only allow changing its case
+	if !strings.EqualFold(nick, c.nick) {
+		b.reply(c, girc.ERR_ERRONEUSNICKNAME, nick, "Nick changes aren't allowed on this server")
+		return true
+	}
+
+	b.Lock()
+	defer b.Unlock()
+	change := &girc.Event{Source: c.source(), Command: girc.NICK, Params: []string{nick}}
+	c.send(change)
+	for ch := range c.channels {
+		b.broadcast(ch, c, change)
+	}
+	c.nick = nick
+	return true
+}
+
+func (b *Bircd) handleJoin(c *client, event *girc.Event) {
+	if len(event.Params) == 0 {
+		b.reply(c, girc.ERR_NEEDMOREPARAMS, event.Command, "Not enough parameters")
+		return
+	}
+	for _, name := range strings.Split(event.Params[0], ",") {
+		b.Lock()
+		ch, ok := b.channels[strings.ToLower(name)]
+		if !ok {
+			b.Unlock()
+			b.reply(c, girc.ERR_NOSUCHCHANNEL, name, "No such channel")
+			continue
+		}
+		if _, joined := ch.members[c]; joined {
+			b.Unlock()
+			continue
+		}
+		ch.members[c] = struct{}{}
+		c.channels[ch] = struct{}{}
+		join := &girc.Event{Source: c.source(), Command: girc.JOIN, Params: []string{ch.ircName}}
+		b.broadcast(ch, nil, join)
+		topic := ch.topic
+		names := b.names(ch)
+		b.Unlock()
+
+		b.sendTopic(c, ch.ircName, topic)
+		b.sendNames(c, ch.ircName, names)
+	}
+}
+
+func (b *Bircd) handlePart(c *client, event *girc.Event) {
+	if len(event.Params) == 0 {
+		b.reply(c, girc.ERR_NEEDMOREPARAMS, event.Command, "Not enough parameters")
+		return
+	}
+	reason := ""
+	if len(event.Params) > 1 {
+		reason = event.Params[1]
+	}
+	for _, name := range strings.Split(event.Params[0], ",") {
+		b.Lock()
+		ch, ok := b.channels[strings.ToLower(name)]
+		if !ok {
+			b.Unlock()
+			b.reply(c, girc.ERR_NOSUCHCHANNEL, name, "No such channel")
+			continue
+		}
+		if _, joined := ch.members[c]; !joined {
+			b.Unlock()
+			b.reply(c, girc.ERR_NOTONCHANNEL, ch.ircName, "You're not on that channel")
+			continue
+		}
+		b.broadcast(ch, nil, &girc.Event{Source: c.source(), Command: girc.PART, Params: []string{ch.ircName, reason}})
+		delete(ch.members, c)
+		delete(c.channels, ch)
+		b.Unlock()
+	}
+}
+
+func (b *Bircd) handlePrivMsg(c *client, event *girc.Event) {
+	if len(event.Params) < 2 {
+		b.reply(c, girc.ERR_NEEDMOREPARAMS, event.Command, "Not enough parameters")
+		return
+	}
+	target := event.Params[0]
+
+	b.Lock()
+	ch, ok := b.channels[strings.ToLower(target)]
+	if !ok {
+		b.Unlock()
+		if event.Command == girc.PRIVMSG {
+			b.reply(c, girc.ERR_NOSUCHNICK, target, "No such nick/channel, only bridged channels are supported")
+		}
+		return
+	}
+	if _, joined := ch.members[c]; !joined {
+		b.Unlock()
+		b.reply(c, girc.ERR_CANNOTSENDTOCHAN, target, "Cannot send to channel")
+		return
+	}
+	b.broadcast(ch, c, &girc.Event{Source: c.source(), Command: event.Command, Params: []string{ch.ircName, event.Last()}})
+	b.Unlock()
+
+	rmsg := config.Message{
+		Username: c.nick,
+		UserID:   c.nick,
+		Channel:  ch.name,
+		Account:  b.Account,
+		Text:     event.Last(),
+	}
+	if ok, ctcp := event.IsCTCP(); ok {
+		if ctcp.Command != girc.CTCP_ACTION {
+			return
+		}
+		rmsg.Event = config.EventUserAction
+		rmsg.Text = ctcp.Text
+	}
+	if event.Command == girc.NOTICE {
+		rmsg.Event = config.EventNoticeIRC
+	}
+	b.Log.Debugf("<= Sending message from %s on %s to gateway", c.nick, b.Account)
+	b.Remote <- rmsg
+}
+
+func (b *Bircd) handleNames(c *client, event *girc.Event) {
+	if len(event.Params) == 0 {
+		b.reply(c, girc.RPL_ENDOFNAMES, "*", "End of /NAMES list")
+		return
+	}
+	for _, name := range strings.Split(event.Params[0], ",") {
+		b.RLock()
+		ch, ok := b.channels[strings.ToLower(name)]
+		var names []string
+		if ok {
+			names = b.names(ch)
+		}
+		b.RUnlock()
+		if !ok {
+			b.reply(c, girc.RPL_ENDOFNAMES, name, "End of /NAMES list")
+			continue
+		}
+		b.sendNames(c, ch.ircName, names)
+	}
+}
+
+func (b *Bircd) handleTopic(c *client, event *girc.Event) {
+	if len(event.Params) == 0 {
+		b.reply(c, girc.ERR_NEEDMOREPARAMS, event.Command, "Not enough parameters")
+		return
+	}
+	b.Lock()
+	ch, ok := b.channels[strings.ToLower(event.Params[0])]
+	if !ok {
+		b.Unlock()
+		b.reply(c, girc.ERR_NOSUCHCHANNEL, event.Params[0], "No such channel")
+		return
+	}
+	if len(event.Params) == 1 {
+		topic := ch.topic
+		b.Unlock()
+		b.sendTopic(c, ch.ircName, topic)
+		return
+	}
+	if _, joined := ch.members[c]; !joined {
+		b.Unlock()
+		b.reply(c, girc.ERR_NOTONCHANNEL, ch.ircName, "You're not on that channel")
+		return
+	}
+	ch.topic = event.Params[1]
+	b.broadcast(ch, nil, &girc.Event{Source: c.source(), Command: girc.TOPIC, Params: []string{ch.ircName, ch.topic}})
+	b.Unlock()
+
+	b.Log.Debugf("<= Sending topic change from %s on %s to gateway", c.nick, b.Account)
+	b.Remote <- config.Message{
+		Username: c.nick,
+		UserID:   c.nick,
+		Channel:  ch.name,
+		Account:  b.Account,
+		Text:     "changed topic to: " + event.Params[1],
+		Event:    config.EventTopicChange,
+	}
+}
+
+func (b *Bircd) handleList(c *client) {
+	b.RLock()
+	var replies [][]string
+	for _, ch := range b.channels {
+		replies = append(replies, []string{ch.ircName, strconv.Itoa(len(ch.members) + len(ch.remote)), ch.topic})
+	}
+	b.RUnlock()
+	sort.Slice(replies, func(i, j int) bool { return replies[i][0] < replies[j][0] })
+	b.reply(c, girc.RPL_LISTSTART, "Channel", "Users  Name")
+	for _, r := range replies {
+		b.reply(c, girc.RPL_LIST, r...)
+	}
+	b.reply(c, girc.RPL_LISTEND, "End of /LIST")
+}
+
+// handleMode answers mode queries, modes can't be changed.
+func (b *Bircd) handleMode(c *client, event *girc.Event) {
+	if len(event.Params) == 0 {
+		b.reply(c, girc.ERR_NEEDMOREPARAMS, event.Command, "Not enough parameters")
+		return
+	}
+	target := event.Params[0]
+	if strings.EqualFold(target, c.nick) {
+		b.reply(c, girc.RPL_UMODEIS, "+i")
+		return
+	}
+	b.RLock()
+	ch, ok := b.channels[strings.ToLower(target)]
+	b.RUnlock()
+	if !ok {
+		b.reply(c, girc.ERR_NOSUCHCHANNEL, target, "No such channel")
+		return
+	}
+	if len(event.Params) == 1 {
+		b.reply(c, girc.RPL_CHANNELMODEIS, ch.ircName, "+nt")
+	}
+}
+
+// names returns the nicks of the local and remote users in the channel. The caller must hold the lock.
+func (b *Bircd) names(ch *channel) []string {
+	var names []string
+	for c := range ch.members {
+		names = append(names, c.nick)
+	}
+	for _, nick := range ch.remote {
+		names = append(names, nick)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (b *Bircd) sendNames(c *client, channel string, names []string) {
+	// keep the replies well below the maximum line length
+	const perLine = 20
+	for len(names) > 0 {
+		n := perLine
+		if len(names) < n {
+			n = len(names)
+		}
+		b.reply(c, girc.RPL_NAMREPLY, "=", channel, strings.Join(names[:n], " "))
+		names = names[n:]
+	}
+	b.reply(c, girc.RPL_ENDOFNAMES, channel, "End of /NAMES list")
+}
+
+func (b *Bircd) sendTopic(c *client, channel, topic string) {
+	if topic == "" {
+		b.reply(c, girc.RPL_NOTOPIC, channel, "No topic is set")
+		return
+	}
+	b.reply(c, girc.RPL_TOPIC, channel, topic)
+}
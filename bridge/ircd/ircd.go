@@ -0,0 +1,308 @@
+package bircd
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/42wim/matterbridge/bridge"
+	"github.com/42wim/matterbridge/bridge/config"
+	"github.com/42wim/matterbridge/bridge/helper"
+	"github.com/lrstanley/girc"
+)
+
+const (
+	defaultServerName = "matterbridge"
+	// lineLength is the maximum length of the text of a relayed line, the rest is split in new lines.
+	lineLength = 400
+)
+
+type Bircd struct {
+	*bridge.Config
+
+	serverName string
+	created    time.Time
+	users      map[string]config.IRCDUser
+	listener   net.Listener
+
+	sync.RWMutex
+	// clients are the connected IRC clients, keyed by their lowercased nick once registered.
+	clients  map[string]*client
+	pending  map[*client]struct{}
+	channels map[string]*channel
+}
+
+// channel is a bridged channel as seen by the IRC clients.
+type channel struct {
+	// name is the channel name of the gateway, ircName the name used on IRC.
+	name, ircName string
+	topic         string
+	members       map[*client]struct{}
+	// remote are the nicks of the remote users that talked in the channel, keyed by their protocol
+	// and lowercased username.
+	remote map[string]string
+}
+
+func New(cfg *bridge.Config) bridge.Bridger {
+	b := &Bircd{
+		Config:   cfg,
+		created:  time.Now(),
+		clients:  make(map[string]*client),
+		pending:  make(map[*client]struct{}),
+		channels: make(map[string]*channel),
+	}
+	// remote users get their own nick, don't add the protocol to it
+	if !b.IsKeySet("RemoteNickFormat") {
+		b.Config.Config.Viper().Set(b.GetConfigKey("RemoteNickFormat"), "{NICK}")
+	}
+	return b
+}
+
+func (b *Bircd) Connect() error {
+	b.serverName = b.GetString("ServerName")
+	if b.serverName == "" {
+		b.serverName = defaultServerName
+	}
+	if err := b.loadUsers(); err != nil {
+		return err
+	}
+
+	addr := b.GetString("BindAddress")
+	if addr == "" {
+		return errors.New("BindAddress is required")
+	}
+	var err error
+	if cert, key := b.GetString("TLSCertificate"), b.GetString("TLSKey"); cert != "" || key != "" {
+		pair, err := tls.LoadX509KeyPair(cert, key)
+		if err != nil {
+			return err
+		}
+		b.listener, err = tls.Listen("tcp", addr, &tls.Config{
+			Certificates: []tls.Certificate{pair},
+			// client certificates are only used for CertFP, they aren't verified against a CA
+			ClientAuth: tls.RequestClientCert,
+			MinVersion: tls.VersionTLS12,
+		})
+		if err != nil {
+			return err
+		}
+		b.Log.Infof("Listening on %s (TLS)", addr)
+	} else {
+		if b.listener, err = net.Listen("tcp", addr); err != nil {
+			return err
+		}
+		b.Log.Infof("Listening on %s", addr)
+	}
+	go b.accept()
+	return nil
+}
+
+// loadUsers reads the Users allowed to connect.
+func (b *Bircd) loadUsers() error {
+	var users []config.IRCDUser
+	if err := b.Config.Config.Viper().UnmarshalKey(b.GetConfigKey("Users"), &users); err != nil {
+		return err
+	}
+	if len(users) == 0 {
+		return errors.New("no Users configured, nobody would be able to connect")
+	}
+	b.users = make(map[string]config.IRCDUser)
+	for _, u := range users {
+		if !girc.IsValidNick(u.Nick) {
+			return fmt.Errorf("user %q has an invalid nick", u.Nick)
+		}
+		if u.Password == "" && u.CertFP == "" {
+			return fmt.Errorf("user %s needs a Password or CertFP", u.Nick)
+		}
+		u.CertFP = normalizeFingerprint(u.CertFP)
+		b.users[strings.ToLower(u.Nick)] = u
+	}
+	return nil
+}
+
+func (b *Bircd) accept() {
+	for {
+		conn, err := b.listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			b.Log.Errorf("accept failed: %s", err)
+			time.Sleep(time.Second)
+			continue
+		}
+		go b.serve(newClient(conn))
+	}
+}
+
+func (b *Bircd) Disconnect() error {
+	err := b.listener.Close()
+	b.Lock()
+	for c := range b.pending {
+		c.close()
+	}
+	for _, c := range b.clients {
+		c.close()
+	}
+	b.Unlock()
+	return err
+}
+
+func (b *Bircd) JoinChannel(channel config.ChannelInfo) error {
+	ircName := channel.Name
+	if !strings.HasPrefix(ircName, "#") {
+		ircName = "#" + ircName
+	}
+	b.Lock()
+	defer b.Unlock()
+	b.channels[strings.ToLower(ircName)] = newChannel(channel.Name, ircName)
+	return nil
+}
+
+func newChannel(name, ircName string) *channel {
+	return &channel{
+		name:    name,
+		ircName: ircName,
+		members: make(map[*client]struct{}),
+		remote:  make(map[string]string),
+	}
+}
+
+func (b *Bircd) Send(msg config.Message) (string, error) {
+	b.Log.Debugf("=> Receiving %#v", msg)
+
+	switch msg.Event {
+	case config.EventMsgDelete, config.EventUserTyping, config.EventAvatarDownload:
+		return "", nil
+	}
+
+	b.Lock()
+	defer b.Unlock()
+	ch := b.findChannel(msg.Channel)
+	if ch == nil {
+		return "", fmt.Errorf("channel %s isn't bridged", msg.Channel)
+	}
+
+	// files are sent as their URL
+	for _, rmsg := range helper.HandleExtra(&msg, b.General) {
+		b.sendRemote(ch, &rmsg)
+	}
+	for _, f := range msg.Extra["file"] {
+		fi, ok := f.(config.FileInfo)
+		if !ok {
+			continue
+		}
+		text := fi.Name
+		if fi.URL != "" {
+			text = fi.URL
+		}
+		if fi.Comment != "" {
+			text = fi.Comment + " : " + text
+		}
+		b.sendRemote(ch, &config.Message{Username: msg.Username, Protocol: msg.Protocol, Text: text, Event: msg.Event})
+	}
+	if msg.Text != "" {
+		b.sendRemote(ch, &msg)
+	}
+	return "", nil
+}
+
+// sendRemote sends the message of a remote user to the clients in the channel,
+// the remote user joins the channel first if needed. The caller must hold the lock.
+func (b *Bircd) sendRemote(ch *channel, msg *config.Message) {
+	source := b.joinRemote(ch, msg.Username, msg.Protocol)
+	for _, line := range helper.GetSubLines(msg.Text, lineLength, "") {
+		text := line
+		if msg.Event == config.EventUserAction {
+			text = girc.EncodeCTCPRaw(girc.CTCP_ACTION, line)
+		}
+		b.broadcast(ch, nil, &girc.Event{Source: source, Command: girc.PRIVMSG, Params: []string{ch.ircName, text}})
+	}
+}
+
+// joinRemote returns the source of the remote user, announcing it in the channel when it's new.
+// The caller must hold the lock.
+func (b *Bircd) joinRemote(ch *channel, username, protocol string) *girc.Source {
+	ident := sanitizeNick(protocol)
+	if ident == "" {
+		ident = "remote"
+	}
+	nick := sanitizeNick(username)
+	if nick == "" {
+		nick = "remote"
+	}
+	key := protocol + "/" + strings.ToLower(username)
+	if existing, ok := ch.remote[key]; ok {
+		return &girc.Source{Name: existing, Ident: ident, Host: b.serverName}
+	}
+	// local users keep their nick, even when they're offline
+	for b.nickTaken(ch, nick) {
+		nick += "_"
+	}
+	ch.remote[key] = nick
+	source := &girc.Source{Name: nick, Ident: ident, Host: b.serverName}
+	b.broadcast(ch, nil, &girc.Event{Source: source, Command: girc.JOIN, Params: []string{ch.ircName}})
+	return source
+}
+
+// nickTaken returns true if the nick belongs to a local user or a remote user in the channel.
+// The caller must hold the lock.
+func (b *Bircd) nickTaken(ch *channel, nick string) bool {
+	nick = strings.ToLower(nick)
+	if _, ok := b.users[nick]; ok {
+		return true
+	}
+	if _, ok := b.clients[nick]; ok {
+		return true
+	}
+	for _, remote := range ch.remote {
+		if strings.ToLower(remote) == nick {
+			return true
+		}
+	}
+	return false
+}
+
+// broadcast sends the event to the members of the channel, except skip. The caller must hold the lock.
+func (b *Bircd) broadcast(ch *channel, skip *client, event *girc.Event) {
+	for c := range ch.members {
+		if c != skip {
+			c.send(event)
+		}
+	}
+}
+
+// findChannel returns the channel with the gateway or IRC name. The caller must hold the lock.
+func (b *Bircd) findChannel(name string) *channel {
+	if ch, ok := b.channels[strings.ToLower(name)]; ok {
+		return ch
+	}
+	return b.channels["#"+strings.ToLower(name)]
+}
+
+// sanitizeNick turns a remote username into a valid IRC nick.
+func sanitizeNick(name string) string {
+	nick := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		case strings.ContainsRune("[]\\`_^{|}-", r):
+			return r
+		case r == ' ' || r == '.':
+			return '_'
+		}
+		return -1
+	}, name)
+	if nick != "" && strings.ContainsAny(nick[:1], "0123456789-") {
+		nick = "_" + nick
+	}
+	return nick
+}
+
+func normalizeFingerprint(fp string) string {
+	return strings.ToLower(strings.ReplaceAll(fp, ":", ""))
+}
@@ -0,0 +1,155 @@
+package bircd
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/42wim/matterbridge/bridge/bridgetest"
+	"github.com/42wim/matterbridge/bridge/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testConfig = `
+[ircd.test]
+BindAddress="127.0.0.1:0"
+ServerName="bridge.test"
+
+[[ircd.test.Users]]
+Nick="alice"
+Password="secret"
+
+[[ircd.test.Users]]
+Nick="bob"
+Password="hunter2"
+`
+
+func newTestBridge(t *testing.T) *Bircd {
+	b := New(bridgetest.Config("ircd.test", testConfig)).(*Bircd)
+	require.NoError(t, b.Connect())
+	require.NoError(t, b.JoinChannel(config.ChannelInfo{Name: "general"}))
+	t.Cleanup(func() { b.Disconnect() }) //nolint:errcheck
+	return b
+}
+
+type testClient struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func dial(t *testing.T, b *Bircd) *testClient {
+	conn, err := net.Dial("tcp", b.listener.Addr().String())
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return &testClient{t: t, conn: conn, r: bufio.NewReader(conn)}
+}
+
+func (c *testClient) send(line string) {
+	_, err := c.conn.Write([]byte(line + "\r\n"))
+	require.NoError(c.t, err)
+}
+
+// expect reads lines until one contains s.
+func (c *testClient) expect(s string) string {
+	require.NoError(c.t, c.conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	for {
+		line, err := c.r.ReadString('\n')
+		require.NoError(c.t, err, "waiting for %q", s)
+		if strings.Contains(line, s) {
+			return strings.TrimSpace(line)
+		}
+	}
+}
+
+func login(t *testing.T, b *Bircd, nick, pass string) *testClient {
+	c := dial(t, b)
+	c.send("PASS " + pass)
+	c.send("NICK " + nick)
+	c.send("USER " + nick + " 0 * :" + nick)
+	c.expect(" 001 " + nick + " ")
+	return c
+}
+
+func TestAuthentication(t *testing.T) {
+	b := newTestBridge(t)
+
+	c := dial(t, b)
+	c.send("PASS wrong")
+	c.send("NICK alice")
+	c.send("USER alice 0 * :Alice")
+	c.expect(" 464 alice ")
+
+	c = dial(t, b)
+	c.send("NICK mallory")
+	c.send("USER mallory 0 * :Mallory")
+	c.expect(" 464 mallory ")
+
+	login(t, b, "alice", "secret")
+}
+
+func TestRelay(t *testing.T) {
+	b := newTestBridge(t)
+	alice := login(t, b, "alice", "secret")
+	bob := login(t, b, "bob", "hunter2")
+
+	alice.send("JOIN #nonexistent")
+	alice.expect(" 403 alice #nonexistent ")
+
+	alice.send("JOIN #general")
+	alice.expect(":alice!alice@127.0.0.1 JOIN #general")
+	alice.expect(" 353 alice = #general alice")
+	bob.send("JOIN #general")
+	alice.expect(":bob!bob@127.0.0.1 JOIN #general")
+
+	// local messages go to the gateway and the other local users
+	bob.send("PRIVMSG #general :hello there")
+	alice.expect(":bob!bob@127.0.0.1 PRIVMSG #general :hello there")
+	msg := <-b.Remote
+	assert.Equal(t, "bob", msg.Username)
+	assert.Equal(t, "general", msg.Channel)
+	assert.Equal(t, "hello there", msg.Text)
+
+	// remote users join before talking
+	_, err := b.Send(config.Message{Username: "Carol Smith", Protocol: "slack", Channel: "general", Text: "hi\nall"})
+	require.NoError(t, err)
+	bob.expect(":Carol_Smith!slack@bridge.test JOIN #general")
+	bob.expect(":Carol_Smith!slack@bridge.test PRIVMSG #general hi")
+	bob.expect(":Carol_Smith!slack@bridge.test PRIVMSG #general all")
+
+	_, err = b.Send(config.Message{Username: "Carol Smith", Protocol: "slack", Channel: "general", Text: "waves", Event: config.EventUserAction})
+	require.NoError(t, err)
+	alice.expect(":Carol_Smith!slack@bridge.test PRIVMSG #general :\x01ACTION waves\x01")
+
+	alice.send("NAMES #general")
+	alice.expect(" 353 alice = #general :Carol_Smith alice bob")
+
+	bob.send("QUIT :bye")
+	alice.expect(":bob!bob@127.0.0.1 QUIT :Quit: bye")
+}
+
+func TestRemoteNicks(t *testing.T) {
+	b := newTestBridge(t)
+	bob := login(t, b, "bob", "hunter2")
+	bob.send("JOIN #general")
+	bob.expect(" 366 bob #general ")
+
+	// remote users don't get the nick of offline local users
+	_, err := b.Send(config.Message{Username: "alice", Protocol: "slack", Channel: "general", Text: "hi"})
+	require.NoError(t, err)
+	bob.expect(":alice_!slack@bridge.test PRIVMSG #general hi")
+
+	// users of other protocols with the same name are other users
+	_, err = b.Send(config.Message{Username: "alice", Protocol: "discord", Channel: "general", Text: "hello"})
+	require.NoError(t, err)
+	bob.expect(":alice__!discord@bridge.test PRIVMSG #general hello")
+	_, err = b.Send(config.Message{Username: "Alice", Protocol: "slack", Channel: "general", Text: "again"})
+	require.NoError(t, err)
+	bob.expect(":alice_!slack@bridge.test PRIVMSG #general again")
+
+	// the local user can still log in
+	login(t, b, "alice", "secret")
+}
@@ -0,0 +1,288 @@
+package bmatrix
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	matrix "github.com/matterbridge/gomatrix"
+)
+
+const (
+	defaultPuppetPrefix = "_"
+	// txnCacheSize is the number of transaction IDs we remember, the homeserver retries
+	// transactions until we acknowledge them.
+	txnCacheSize = 100
+)
+
+// transaction is a batch of events pushed by the homeserver to the application service.
+type transaction struct {
+	Events []*matrix.Event `json:"events"`
+}
+
+// connectAppService connects as an application service: the bot is the sender of the
+// registration, the messages are pushed by the homeserver and remote users get virtual users.
+func (b *Bmatrix) connectAppService() error {
+	_, domain, ok := splitMXID(b.GetString("MxID"))
+	if !ok {
+		return fmt.Errorf("MxID %q is not a valid user ID", b.GetString("MxID"))
+	}
+	if b.GetString("BindAddress") == "" {
+		return errors.New("BindAddress is required in appservice mode")
+	}
+	if err := b.loadRegistration(); err != nil {
+		return err
+	}
+	b.namespace = regexp.MustCompile("^@" + regexp.QuoteMeta(b.puppetPrefix()) + ".*:" + regexp.QuoteMeta(domain) + "$")
+
+	var err error
+	b.mc, err = matrix.NewClient(b.GetString("Server"), b.GetString("MxID"), b.asToken)
+	if err != nil {
+		return err
+	}
+	b.UserID = b.GetString("MxID")
+	if err := b.registerUser(b.UserID); err != nil {
+		return fmt.Errorf("registering %s failed: %w", b.UserID, err)
+	}
+	b.Log.Infof("Connected as application service %s", b.UserID)
+	return b.listen()
+}
+
+// loadRegistration takes the tokens from the config, or from the registration file, and writes
+// the registration file if it doesn't exist yet, generating the tokens that aren't configured.
+func (b *Bmatrix) loadRegistration() error {
+	b.asToken, b.hsToken = b.GetString("Token"), b.GetString("HSToken")
+	path := b.GetString("RegistrationFile")
+	if path == "" {
+		if b.asToken == "" || b.hsToken == "" {
+			return errors.New("Token and HSToken are required in appservice mode without RegistrationFile")
+		}
+		return nil
+	}
+
+	f, err := os.Open(path)
+	switch {
+	case err == nil:
+		defer f.Close()
+		asToken, hsToken := readRegistration(f)
+		if b.asToken == "" {
+			b.asToken = asToken
+		}
+		if b.hsToken == "" {
+			b.hsToken = hsToken
+		}
+		if b.asToken == "" || b.hsToken == "" {
+			return fmt.Errorf("%s doesn't contain as_token and hs_token", path)
+		}
+		return nil
+	case !errors.Is(err, os.ErrNotExist):
+		return err
+	}
+
+	if b.asToken == "" {
+		b.asToken = randomToken()
+	}
+	if b.hsToken == "" {
+		b.hsToken = randomToken()
+	}
+	if err := os.WriteFile(path, []byte(b.registration()), 0o600); err != nil {
+		return err
+	}
+	b.Log.Infof("Wrote the registration to %s, add it to the app_service_config_files of your homeserver and restart it", path)
+	return nil
+}
+
+// registration returns the registration file of the application service, in YAML.
+func (b *Bmatrix) registration() string {
+	localpart, domain, _ := splitMXID(b.GetString("MxID"))
+	url := b.GetString("AppServiceURL")
+	if url == "" {
+		url = "http://" + b.GetString("BindAddress")
+	}
+	return fmt.Sprintf(`id: %s
+url: %s
+as_token: %s
+hs_token: %s
+sender_localpart: %s
+rate_limited: false
+namespaces:
+  users:
+    - exclusive: true
+      regex: '@%s.*:%s'
+  aliases: []
+  rooms: []
+`, yamlQuote(b.Account), yamlQuote(url), b.asToken, b.hsToken, yamlQuote(localpart),
+		regexp.QuoteMeta(b.puppetPrefix()), regexp.QuoteMeta(domain))
+}
+
+// readRegistration returns the tokens of a registration file.
+func readRegistration(f *os.File) (string, string) {
+	var asToken, hsToken string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), ":")
+		if !ok {
+			continue
+		}
+		value = strings.Trim(strings.TrimSpace(value), `'"`)
+		switch strings.TrimSpace(key) {
+		case "as_token":
+			asToken = value
+		case "hs_token":
+			hsToken = value
+		}
+	}
+	return asToken, hsToken
+}
+
+func randomToken() string {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(buf)
+}
+
+func yamlQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
+
+// listen starts the server receiving the transactions of the homeserver.
+func (b *Bmatrix) listen() error {
+	b.server = &http.Server{
+		Addr:              b.GetString("BindAddress"),
+		Handler:           b.appServiceHandler(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		b.Log.Infof("Listening on %s", b.server.Addr)
+		if err := b.server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			b.Log.Fatal(err)
+		}
+	}()
+	return nil
+}
+
+func (b *Bmatrix) closeAppService() error {
+	if b.server == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return b.server.Shutdown(ctx)
+}
+
+// appServiceHandler serves the application service API, with and without the legacy unprefixed paths.
+func (b *Bmatrix) appServiceHandler() http.Handler {
+	mux := http.NewServeMux()
+	for _, prefix := range []string{"/_matrix/app/v1", ""} {
+		mux.HandleFunc("PUT "+prefix+"/transactions/{txnID}", b.handleTransaction)
+		mux.HandleFunc("GET "+prefix+"/users/{userID}", b.handleUserQuery)
+		mux.HandleFunc("GET "+prefix+"/rooms/{alias}", func(w http.ResponseWriter, r *http.Request) {
+			writeMatrixError(w, http.StatusNotFound, "M_NOT_FOUND", "we don't provide rooms")
+		})
+	}
+	mux.HandleFunc("POST /_matrix/app/v1/ping", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, struct{}{})
+	})
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := r.URL.Query().Get("access_token")
+		if header := r.Header.Get("Authorization"); header != "" {
+			token = strings.TrimPrefix(header, "Bearer ")
+		}
+		switch {
+		case token == "":
+			writeMatrixError(w, http.StatusUnauthorized, "M_UNAUTHORIZED", "missing token")
+		case subtle.ConstantTimeCompare([]byte(token), []byte(b.hsToken)) != 1:
+			b.Log.Warnf("Invalid homeserver token from %s", r.RemoteAddr)
+			writeMatrixError(w, http.StatusForbidden, "M_FORBIDDEN", "invalid token")
+		default:
+			mux.ServeHTTP(w, r)
+		}
+	})
+}
+
+func (b *Bmatrix) handleTransaction(w http.ResponseWriter, r *http.Request) {
+	txnID := r.PathValue("txnID")
+	// the homeserver retries transactions we didn't acknowledge
+	if b.txns.Contains(txnID) {
+		writeJSON(w, http.StatusOK, struct{}{})
+		return
+	}
+	var txn transaction
+	if err := json.NewDecoder(r.Body).Decode(&txn); err != nil {
+		writeMatrixError(w, http.StatusBadRequest, "M_NOT_JSON", err.Error())
+		return
+	}
+	for _, ev := range txn.Events {
+		switch ev.Type {
+		case "m.room.message", "m.room.redaction":
+			b.handleEvent(ev)
+		case "m.room.member":
+			b.handleMemberChange(ev)
+			b.handlePuppetMembership(ev)
+		case "m.space.child":
+			b.handleSpaceChild(ev)
+		case "m.room.name":
+			b.handleRoomName(ev)
+		}
+	}
+	b.txns.Add(txnID, true)
+	writeJSON(w, http.StatusOK, struct{}{})
+}
+
+// handleUserQuery tells the homeserver if a user of our namespace exists.
+func (b *Bmatrix) handleUserQuery(w http.ResponseWriter, r *http.Request) {
+	b.puppetsMutex.Lock()
+	_, ok := b.puppetMXIDs[r.PathValue("userID")]
+	b.puppetsMutex.Unlock()
+	if !ok {
+		writeMatrixError(w, http.StatusNotFound, "M_NOT_FOUND", "unknown user")
+		return
+	}
+	writeJSON(w, http.StatusOK, struct{}{})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeMatrixError(w http.ResponseWriter, status int, errcode, msg string) {
+	writeJSON(w, status, httpError{Errcode: errcode, Err: msg})
+}
+
+// registerUser registers a user of our namespace, which is fine if it already exists.
+func (b *Bmatrix) registerUser(mxid string) error {
+	localpart, _, _ := splitMXID(mxid)
+	req := struct {
+		Type     string `json:"type"`
+		Username string `json:"username"`
+	}{"m.login.application_service", localpart}
+	err := b.mc.MakeRequest("POST", b.mc.BuildURL("register"), &req, nil)
+	if err != nil && handleError(err).Errcode != "M_USER_IN_USE" {
+		return err
+	}
+	return nil
+}
+
+// splitMXID returns the localpart and domain of a user ID.
+func splitMXID(mxid string) (string, string, bool) {
+	if !strings.HasPrefix(mxid, "@") {
+		return "", "", false
+	}
+	localpart, domain, ok := strings.Cut(mxid[1:], ":")
+	return localpart, domain, ok && localpart != "" && domain != ""
+}
@@ -0,0 +1,197 @@
+package bmatrix
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/42wim/matterbridge/bridge/bridgetest"
+	"github.com/42wim/matterbridge/bridge/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeHomeserver answers the client API calls of the application service and records them.
+type fakeHomeserver struct {
+	sync.Mutex
+	requests []string
+	invited  map[string]bool
+	events   int
+}
+
+func (hs *fakeHomeserver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	hs.Lock()
+	defer hs.Unlock()
+	path := strings.TrimPrefix(r.URL.Path, "/_matrix/client/r0")
+	request := r.Method + " " + path
+	if userID := r.URL.Query().Get("user_id"); userID != "" {
+		request += " as " + userID
+	}
+	hs.requests = append(hs.requests, request)
+
+	switch {
+	case strings.HasPrefix(path, "/join/"):
+		// virtual users need an invite
+		if userID := r.URL.Query().Get("user_id"); userID != "" && !hs.invited[userID] {
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, `{"errcode":"M_FORBIDDEN","error":"not invited"}`)
+			return
+		}
+		fmt.Fprintf(w, `{"room_id":%q}`, strings.TrimPrefix(path, "/join/"))
+	case strings.HasSuffix(path, "/invite"):
+		hs.invited["@_discord_alice:example.com"] = true
+		fmt.Fprint(w, `{}`)
+	case strings.Contains(path, "/send/"):
+		hs.events++
+		fmt.Fprintf(w, `{"event_id":"$%d"}`, hs.events)
+	case strings.HasSuffix(path, "/displayname") && r.Method == http.MethodGet:
+		fmt.Fprint(w, `{"displayname":"Carol"}`)
+	default:
+		fmt.Fprint(w, `{}`)
+	}
+}
+
+func (hs *fakeHomeserver) log() []string {
+	hs.Lock()
+	defer hs.Unlock()
+	requests := hs.requests
+	hs.requests = nil
+	return requests
+}
+
+func newTestAppService(t *testing.T, hs *fakeHomeserver) *Bmatrix {
+	server := httptest.NewServer(hs)
+	t.Cleanup(server.Close)
+
+	cfg := fmt.Sprintf(`[matrix.test]
+Server=%q
+MxID="@bot:example.com"
+Token="astoken"
+HSToken="hstoken"
+AppService=true
+BindAddress="127.0.0.1:0"
+`, server.URL)
+	b := New(bridgetest.Config("matrix.test", cfg)).(*Bmatrix)
+	require.NoError(t, b.Connect())
+	t.Cleanup(func() { b.Disconnect() })
+	b.RoomMap["!room:example.com"] = "#room"
+	return b
+}
+
+func TestRegistration(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "registration.yaml")
+	cfg := fmt.Sprintf("[matrix.test]\nMxID=\"@bot:example.com\"\nBindAddress=\"127.0.0.1:9005\"\nRegistrationFile=%q\n", path)
+	b := New(bridgetest.Config("matrix.test", cfg)).(*Bmatrix)
+
+	require.NoError(t, b.loadRegistration())
+	assert.Len(t, b.asToken, 64)
+	assert.Len(t, b.hsToken, 64)
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Contains(t, string(data), "url: 'http://127.0.0.1:9005'\n")
+	assert.Contains(t, string(data), "sender_localpart: 'bot'\n")
+	assert.Contains(t, string(data), `regex: '@_.*:example\.com'`)
+
+	// the tokens are read back from the file
+	asToken, hsToken := b.asToken, b.hsToken
+	b.asToken, b.hsToken = "", ""
+	require.NoError(t, b.loadRegistration())
+	assert.Equal(t, asToken, b.asToken)
+	assert.Equal(t, hsToken, b.hsToken)
+}
+
+func TestAppServicePuppets(t *testing.T) {
+	hs := &fakeHomeserver{invited: make(map[string]bool)}
+	b := newTestAppService(t, hs)
+	assert.Equal(t, []string{"POST /register"}, hs.log())
+
+	msg := config.Message{
+		Username: "Alice",
+		Text:     "hello",
+		Channel:  "#room",
+		Account:  "discord.test",
+		Protocol: "discord",
+		UserID:   "1234",
+	}
+	id, err := b.Send(msg)
+	require.NoError(t, err)
+	assert.Equal(t, "$1", id)
+	requests := hs.log()
+	require.Len(t, requests, 6)
+	assert.Equal(t, []string{
+		"POST /register",
+		"PUT /profile/@_discord_alice:example.com/displayname as @_discord_alice:example.com",
+		"POST /join/!room:example.com as @_discord_alice:example.com",
+		"POST /rooms/!room:example.com/invite",
+		"POST /join/!room:example.com as @_discord_alice:example.com",
+	}, requests[:5])
+	assert.Regexp(t, `^PUT /rooms/!room:example.com/send/m.room.message/\S+ as @_discord_alice:example.com$`, requests[5])
+
+	// edits come from the virtual user, which already joined
+	msg.ID = id
+	msg.Text = "hello!"
+	_, err = b.Send(msg)
+	require.NoError(t, err)
+	requests = hs.log()
+	require.Len(t, requests, 1)
+	assert.True(t, strings.HasSuffix(requests[0], " as @_discord_alice:example.com"))
+
+	// join/leave messages are sent by the bot
+	_, err = b.Send(config.Message{Username: "system", Text: "bob joins", Channel: "#room", Event: config.EventJoinLeave})
+	require.NoError(t, err)
+	requests = hs.log()
+	require.Len(t, requests, 1)
+	assert.NotContains(t, requests[0], " as ")
+}
+
+func TestTransactions(t *testing.T) {
+	hs := &fakeHomeserver{invited: make(map[string]bool)}
+	b := newTestAppService(t, hs)
+	handler := b.appServiceHandler()
+
+	put := func(txnID, token, body string) int {
+		req := httptest.NewRequest(http.MethodPut, "/_matrix/app/v1/transactions/"+txnID, strings.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	txn := `{"events":[
+		{"type":"m.room.message","sender":"@carol:example.com","room_id":"!room:example.com","event_id":"$a","content":{"msgtype":"m.text","body":"hi"}},
+		{"type":"m.room.message","sender":"@_discord_alice:example.com","room_id":"!room:example.com","event_id":"$b","content":{"msgtype":"m.text","body":"echo"}}
+	]}`
+
+	assert.Equal(t, http.StatusUnauthorized, put("1", "", txn))
+	assert.Equal(t, http.StatusForbidden, put("1", "astoken", txn))
+	assert.Len(t, b.Remote, 0)
+
+	assert.Equal(t, http.StatusOK, put("1", "hstoken", txn))
+	require.Len(t, b.Remote, 1)
+	rmsg := <-b.Remote
+	assert.Equal(t, "hi", rmsg.Text)
+	assert.Equal(t, "Carol", rmsg.Username)
+	assert.Equal(t, "#room", rmsg.Channel)
+	assert.Equal(t, "$a", rmsg.ID)
+
+	// retried transactions are only acknowledged
+	assert.Equal(t, http.StatusOK, put("1", "hstoken", txn))
+	assert.Len(t, b.Remote, 0)
+
+	req := httptest.NewRequest(http.MethodGet, "/_matrix/app/v1/users/@_discord_bob:example.com?access_token=hstoken", nil)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestPuppetLocalpart(t *testing.T) {
+	assert.Equal(t, "discord_alice", puppetLocalpart("Alice", "discord"))
+	assert.Equal(t, "irc_jean-luc.p", puppetLocalpart("Jean-Luc.P!", "irc"))
+	assert.Equal(t, "telegram_user", puppetLocalpart("😀", "telegram"))
+}
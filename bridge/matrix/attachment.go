@@ -0,0 +1,90 @@
+package bmatrix
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"io"
+	"strings"
+)
+
+// encryptedFile is the key of an attachment of an encrypted room, the "file" of its message.
+type encryptedFile struct {
+	URL    string            `json:"url"`
+	Key    jsonWebKey        `json:"key"`
+	IV     string            `json:"iv"`
+	Hashes map[string]string `json:"hashes"`
+	V      string            `json:"v"`
+}
+
+type jsonWebKey struct {
+	Kty    string   `json:"kty"`
+	KeyOps []string `json:"key_ops"`
+	Alg    string   `json:"alg"`
+	K      string   `json:"k"`
+	Ext    bool     `json:"ext"`
+}
+
+// encryptAttachment encrypts the data with AES-CTR and a new key, the caller sets the URL of the upload.
+func encryptAttachment(data []byte) ([]byte, *encryptedFile, error) {
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, nil, err
+	}
+	// the counter half of the IV stays zero
+	iv := make([]byte, aes.BlockSize)
+	if _, err := io.ReadFull(rand.Reader, iv[:8]); err != nil {
+		return nil, nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	ciphertext := make([]byte, len(data))
+	cipher.NewCTR(block, iv).XORKeyStream(ciphertext, data)
+	hash := sha256.Sum256(ciphertext)
+	return ciphertext, &encryptedFile{
+		Key: jsonWebKey{
+			Kty:    "oct",
+			KeyOps: []string{"encrypt", "decrypt"},
+			Alg:    "A256CTR",
+			K:      base64.RawURLEncoding.EncodeToString(key),
+			Ext:    true,
+		},
+		IV:     b64.EncodeToString(iv),
+		Hashes: map[string]string{"sha256": b64.EncodeToString(hash[:])},
+		V:      "v2",
+	}, nil
+}
+
+// decryptAttachment checks the hash of the downloaded data and decrypts it.
+func decryptAttachment(data []byte, file *encryptedFile) ([]byte, error) {
+	hash := sha256.Sum256(data)
+	if strings.TrimRight(file.Hashes["sha256"], "=") != b64.EncodeToString(hash[:]) {
+		return nil, errors.New("the attachment doesn't match its hash")
+	}
+	if file.Key.Alg != "A256CTR" {
+		return nil, errors.New("unsupported attachment algorithm " + file.Key.Alg)
+	}
+	key, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(file.Key.K, "="))
+	if err != nil {
+		return nil, err
+	}
+	iv, err := b64.DecodeString(strings.TrimRight(file.IV, "="))
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(iv) != aes.BlockSize {
+		return nil, errors.New("invalid attachment IV")
+	}
+	plaintext := make([]byte, len(data))
+	cipher.NewCTR(block, iv).XORKeyStream(plaintext, data)
+	return plaintext, nil
+}
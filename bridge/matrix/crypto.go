@@ -0,0 +1,993 @@
+package bmatrix
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	matrix "github.com/matterbridge/gomatrix"
+	"github.com/rs/xid"
+)
+
+const (
+	olmAlgorithm    = "m.olm.v1.curve25519-aes-sha2"
+	megolmAlgorithm = "m.megolm.v1.aes-sha2"
+
+	// oneTimeKeyTarget is the number of one-time keys we keep on the server.
+	oneTimeKeyTarget = 50
+	// maxOlmSessions is the number of sessions we keep per device.
+	maxOlmSessions = 10
+
+	// the rotation of the Megolm sessions when the room doesn't say
+	defaultRotationPeriod   = 7 * 24 * time.Hour
+	defaultRotationMessages = 100
+
+	trustTOFU     = "tofu"
+	trustAll      = "all"
+	trustVerified = "verified"
+)
+
+// roomEncryption are the settings of the m.room.encryption event of a room.
+type roomEncryption struct {
+	rotationPeriod   time.Duration
+	rotationMessages uint32
+	// unsupported is the algorithm of rooms we can't encrypt messages for.
+	unsupported string
+}
+
+// encryptedContent is the content of m.room.encrypted events.
+type encryptedContent struct {
+	Algorithm string `json:"algorithm"`
+	SenderKey string `json:"sender_key"`
+	// Ciphertext is a string for Megolm and a map of olmCiphertext by Curve25519 key for Olm.
+	Ciphertext json.RawMessage `json:"ciphertext"`
+	SessionID  string          `json:"session_id,omitempty"`
+	DeviceID   string          `json:"device_id,omitempty"`
+	// RelatesTo stays unencrypted so that the server can aggregate relations.
+	RelatesTo interface{} `json:"m.relates_to,omitempty"`
+}
+
+type olmCiphertext struct {
+	Type int    `json:"type"`
+	Body string `json:"body"`
+}
+
+type ed25519Keys struct {
+	Ed25519 string `json:"ed25519"`
+}
+
+// olmPayload is the decrypted content of to-device m.room.encrypted events.
+type olmPayload struct {
+	Type          string          `json:"type"`
+	Content       json.RawMessage `json:"content"`
+	Sender        string          `json:"sender"`
+	SenderDevice  string          `json:"sender_device,omitempty"`
+	Recipient     string          `json:"recipient"`
+	RecipientKeys ed25519Keys     `json:"recipient_keys"`
+	Keys          ed25519Keys     `json:"keys"`
+}
+
+// megolmPayload is the decrypted content of room m.room.encrypted events.
+type megolmPayload struct {
+	Type    string                 `json:"type"`
+	Content map[string]interface{} `json:"content"`
+	RoomID  string                 `json:"room_id"`
+}
+
+type roomKey struct {
+	Algorithm  string `json:"algorithm"`
+	RoomID     string `json:"room_id"`
+	SessionID  string `json:"session_id"`
+	SessionKey string `json:"session_key"`
+}
+
+// loadCrypto reads the crypto store, before we log in with the device it belongs to.
+func (b *Bmatrix) loadCrypto() error {
+	path := b.GetString("CryptoStore")
+	if path == "" {
+		path = b.Account + "-crypto.json"
+	}
+	store, err := loadCryptoStore(path)
+	if err != nil {
+		return fmt.Errorf("loading the crypto store %s failed: %w", path, err)
+	}
+	switch b.trustPolicy() {
+	case trustTOFU, trustAll, trustVerified:
+	default:
+		return fmt.Errorf("unknown TrustPolicy %q", b.GetString("TrustPolicy"))
+	}
+	b.crypto = store
+	b.encryptedRooms = make(map[string]*roomEncryption)
+	b.roomMembers = make(map[string][]string)
+	b.trackedUsers = make(map[string]bool)
+	return nil
+}
+
+// cryptoDeviceID returns the device of the crypto store, to log in with it again.
+func (b *Bmatrix) cryptoDeviceID() string {
+	if b.crypto == nil {
+		return ""
+	}
+	return b.crypto.DeviceID
+}
+
+// startCrypto checks the crypto store belongs to our device and publishes its keys.
+func (b *Bmatrix) startCrypto(deviceID string) error {
+	if deviceID == "" {
+		var whoami struct {
+			DeviceID string `json:"device_id"`
+		}
+		if err := b.mc.MakeRequest("GET", b.mc.BuildURL("account", "whoami"), nil, &whoami); err != nil {
+			return err
+		}
+		if whoami.DeviceID == "" {
+			return errors.New("encryption needs a device, but the access token has none")
+		}
+		deviceID = whoami.DeviceID
+	}
+
+	b.cryptoMutex.Lock()
+	defer b.cryptoMutex.Unlock()
+	store := b.crypto
+	if store.Account == nil || store.UserID != b.UserID || store.DeviceID != deviceID {
+		if store.Account != nil {
+			b.Log.Warnf("The crypto store belongs to %s %s, starting over as %s %s",
+				store.UserID, store.DeviceID, b.UserID, deviceID)
+		}
+		if err := store.reset(b.UserID, deviceID); err != nil {
+			return err
+		}
+	}
+	if err := b.uploadKeys(-1); err != nil {
+		return fmt.Errorf("uploading the device keys failed: %w", err)
+	}
+	b.Log.Infof("Encryption enabled for device %s, its fingerprint is %s", deviceID, store.Account.fingerprintKey())
+	return nil
+}
+
+func (b *Bmatrix) trustPolicy() string {
+	if !b.IsKeySet("TrustPolicy") {
+		return trustTOFU
+	}
+	return b.GetString("TrustPolicy")
+}
+
+// trusted returns true if we share keys with the device and accept the keys it sends.
+func (b *Bmatrix) trusted(device *deviceInfo) bool {
+	switch b.trustPolicy() {
+	case trustAll:
+		return true
+	case trustVerified:
+		if device.KeysChanged {
+			return false
+		}
+		for _, trusted := range b.GetStringSlice("TrustedDevices") {
+			if trusted == device.UserID+"/"+device.DeviceID || trusted == device.Ed25519 {
+				return true
+			}
+		}
+		return false
+	default:
+		return !device.KeysChanged
+	}
+}
+
+// uploadKeys publishes the device keys if needed and tops up the one-time keys on the server,
+// serverCount is the number of one-time keys the server has or -1 if we don't know it.
+// The caller holds the cryptoMutex.
+func (b *Bmatrix) uploadKeys(serverCount int) error {
+	store := b.crypto
+	account := store.Account
+	unpublished := 0
+	for _, key := range account.OneTimeKeys {
+		if !key.Published {
+			unpublished++
+		}
+	}
+	if serverCount >= 0 && serverCount+unpublished < oneTimeKeyTarget {
+		if err := account.generateOneTimeKeys(oneTimeKeyTarget - serverCount - unpublished); err != nil {
+			return err
+		}
+		// the server handed out the oldest keys, forget them if nobody used them
+		if extra := len(account.OneTimeKeys) - 2*oneTimeKeyTarget; extra > 0 {
+			account.OneTimeKeys = account.OneTimeKeys[extra:]
+		}
+	}
+
+	req := make(map[string]interface{})
+	if !store.KeysUploaded {
+		deviceKeys := map[string]interface{}{
+			"user_id":    store.UserID,
+			"device_id":  store.DeviceID,
+			"algorithms": []string{olmAlgorithm, megolmAlgorithm},
+			"keys": map[string]string{
+				"curve25519:" + store.DeviceID: account.identityKey(),
+				"ed25519:" + store.DeviceID:    account.fingerprintKey(),
+			},
+		}
+		if err := b.signJSON(deviceKeys); err != nil {
+			return err
+		}
+		req["device_keys"] = deviceKeys
+	}
+	oneTimeKeys := make(map[string]interface{})
+	var published []*olmOneTimeKey
+	for _, key := range account.OneTimeKeys {
+		if key.Published {
+			continue
+		}
+		signed := map[string]interface{}{"key": b64.EncodeToString(key.Key.Public)}
+		if err := b.signJSON(signed); err != nil {
+			return err
+		}
+		oneTimeKeys["signed_curve25519:"+key.ID] = signed
+		published = append(published, key)
+	}
+	if len(req) == 0 && len(oneTimeKeys) == 0 {
+		return nil
+	}
+	req["one_time_keys"] = oneTimeKeys
+
+	var resp struct {
+		OneTimeKeyCounts map[string]int `json:"one_time_key_counts"`
+	}
+	if err := b.mc.MakeRequest("POST", b.mc.BuildURL("keys", "upload"), req, &resp); err != nil {
+		return err
+	}
+	store.KeysUploaded = true
+	for _, key := range published {
+		key.Published = true
+	}
+	if err := store.save(); err != nil {
+		return err
+	}
+	if serverCount < 0 {
+		return b.uploadKeys(resp.OneTimeKeyCounts["signed_curve25519"])
+	}
+	return nil
+}
+
+// signJSON adds the signature of our device to the object.
+func (b *Bmatrix) signJSON(obj map[string]interface{}) error {
+	data, err := canonicalJSON(obj)
+	if err != nil {
+		return err
+	}
+	obj["signatures"] = map[string]map[string]string{
+		b.crypto.UserID: {"ed25519:" + b.crypto.DeviceID: b.crypto.Account.sign(data)},
+	}
+	return nil
+}
+
+// verifyJSON checks the signature of the device on the object.
+func verifyJSON(raw json.RawMessage, userID, deviceID, key string) bool {
+	var obj struct {
+		Signatures map[string]map[string]string `json:"signatures"`
+	}
+	if err := json.Unmarshal(raw, &obj); err != nil {
+		return false
+	}
+	signature, err := b64.DecodeString(obj.Signatures[userID]["ed25519:"+deviceID])
+	if err != nil {
+		return false
+	}
+	public, err := b64.DecodeString(key)
+	if err != nil || len(public) != ed25519.PublicKeySize {
+		return false
+	}
+	data, err := canonicalJSON(raw)
+	if err != nil {
+		return false
+	}
+	return ed25519.Verify(public, data, signature)
+}
+
+// canonicalJSON returns the canonical JSON of the object without its signatures, which is what gets signed.
+func canonicalJSON(v interface{}) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var generic interface{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&generic); err != nil {
+		return nil, err
+	}
+	if obj, ok := generic.(map[string]interface{}); ok {
+		delete(obj, "signatures")
+		delete(obj, "unsigned")
+	}
+	// encoding/json sorts the keys of maps
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(generic); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+// queryDevices fetches the devices of the users we don't track yet.
+// The caller holds the cryptoMutex.
+func (b *Bmatrix) queryDevices(users []string) error {
+	query := make(map[string][]string)
+	for _, user := range users {
+		if !b.trackedUsers[user] {
+			query[user] = []string{}
+		}
+	}
+	if len(query) == 0 {
+		return nil
+	}
+	var resp struct {
+		DeviceKeys map[string]map[string]json.RawMessage `json:"device_keys"`
+	}
+	req := map[string]interface{}{"device_keys": query, "timeout": 10000}
+	if err := b.mc.MakeRequest("POST", b.mc.BuildURL("keys", "query"), req, &resp); err != nil {
+		return err
+	}
+
+	store := b.crypto
+	for user, devices := range resp.DeviceKeys {
+		if _, ok := query[user]; !ok {
+			continue
+		}
+		known := store.Devices[user]
+		if known == nil {
+			known = make(map[string]*deviceInfo)
+			store.Devices[user] = known
+		}
+		seen := make(map[string]bool)
+		for deviceID, raw := range devices {
+			var keys struct {
+				UserID   string            `json:"user_id"`
+				DeviceID string            `json:"device_id"`
+				Keys     map[string]string `json:"keys"`
+			}
+			if err := json.Unmarshal(raw, &keys); err != nil || keys.UserID != user || keys.DeviceID != deviceID {
+				continue
+			}
+			device := &deviceInfo{
+				UserID:     user,
+				DeviceID:   deviceID,
+				Curve25519: keys.Keys["curve25519:"+deviceID],
+				Ed25519:    keys.Keys["ed25519:"+deviceID],
+			}
+			if !verifyJSON(raw, user, deviceID, device.Ed25519) {
+				b.Log.Warnf("Ignoring device %s of %s, its keys aren't signed", deviceID, user)
+				continue
+			}
+			seen[deviceID] = true
+			old, ok := known[deviceID]
+			switch {
+			case !ok:
+				known[deviceID] = device
+			case old.Curve25519 != device.Curve25519 || old.Ed25519 != device.Ed25519:
+				if b.trustPolicy() == trustAll {
+					known[deviceID] = device
+					continue
+				}
+				b.Log.Warnf("Device %s of %s changed its keys, we don't trust it anymore", deviceID, user)
+				old.KeysChanged = true
+			}
+		}
+		for deviceID := range known {
+			if !seen[deviceID] {
+				delete(known, deviceID)
+			}
+		}
+		b.trackedUsers[user] = true
+	}
+	return store.save()
+}
+
+// deviceByKey returns the device of the user with the Curve25519 key, fetching the devices
+// of the user again if we don't know it. The caller holds the cryptoMutex.
+func (b *Bmatrix) deviceByKey(userID, senderKey string) *deviceInfo {
+	if device := b.crypto.deviceByKey(userID, senderKey); device != nil {
+		return device
+	}
+	delete(b.trackedUsers, userID)
+	if err := b.queryDevices([]string{userID}); err != nil {
+		b.Log.WithError(err).Warnf("Querying the devices of %s failed", userID)
+		return nil
+	}
+	return b.crypto.deviceByKey(userID, senderKey)
+}
+
+// claimSessions starts Olm sessions with the devices, using one of their one-time keys.
+// The caller holds the cryptoMutex.
+func (b *Bmatrix) claimSessions(devices []*deviceInfo) error {
+	query := make(map[string]map[string]string)
+	for _, device := range devices {
+		if query[device.UserID] == nil {
+			query[device.UserID] = make(map[string]string)
+		}
+		query[device.UserID][device.DeviceID] = "signed_curve25519"
+	}
+	var resp struct {
+		OneTimeKeys map[string]map[string]map[string]json.RawMessage `json:"one_time_keys"`
+	}
+	req := map[string]interface{}{"one_time_keys": query, "timeout": 10000}
+	if err := b.mc.MakeRequest("POST", b.mc.BuildURL("keys", "claim"), req, &resp); err != nil {
+		return err
+	}
+
+	store := b.crypto
+	for _, device := range devices {
+		for _, raw := range resp.OneTimeKeys[device.UserID][device.DeviceID] {
+			var key struct {
+				Key string `json:"key"`
+			}
+			if err := json.Unmarshal(raw, &key); err != nil || !verifyJSON(raw, device.UserID, device.DeviceID, device.Ed25519) {
+				b.Log.Warnf("Ignoring the one-time key of device %s of %s, it isn't signed", device.DeviceID, device.UserID)
+				continue
+			}
+			identityKey, err := b64.DecodeString(device.Curve25519)
+			if err != nil {
+				continue
+			}
+			oneTimeKey, err := b64.DecodeString(key.Key)
+			if err != nil {
+				continue
+			}
+			session, err := newOutboundOlmSession(store.Account, identityKey, oneTimeKey)
+			if err != nil {
+				return err
+			}
+			store.addOlmSession(device.Curve25519, session)
+		}
+	}
+	return nil
+}
+
+// addOlmSession makes the session the one we use with the device.
+func (s *cryptoStore) addOlmSession(senderKey string, session *olmSession) {
+	sessions := append([]*olmSession{session}, s.OlmSessions[senderKey]...)
+	if len(sessions) > maxOlmSessions {
+		sessions = sessions[:maxOlmSessions]
+	}
+	s.OlmSessions[senderKey] = sessions
+}
+
+// sendEncryptedToDevices sends the event to the devices encrypted with Olm and returns the
+// devices we could send it to. The caller holds the cryptoMutex.
+func (b *Bmatrix) sendEncryptedToDevices(devices []*deviceInfo, eventType string, content interface{}) ([]*deviceInfo, error) {
+	store := b.crypto
+	var missing []*deviceInfo
+	for _, device := range devices {
+		if len(store.OlmSessions[device.Curve25519]) == 0 {
+			missing = append(missing, device)
+		}
+	}
+	if len(missing) > 0 {
+		if err := b.claimSessions(missing); err != nil {
+			return nil, err
+		}
+	}
+
+	rawContent, err := json.Marshal(content)
+	if err != nil {
+		return nil, err
+	}
+	messages := make(map[string]map[string]interface{})
+	var sent []*deviceInfo
+	for _, device := range devices {
+		sessions := store.OlmSessions[device.Curve25519]
+		if len(sessions) == 0 {
+			b.Log.Debugf("No Olm session with device %s of %s, it has no one-time keys left", device.DeviceID, device.UserID)
+			continue
+		}
+		plaintext, err := json.Marshal(olmPayload{
+			Type:          eventType,
+			Content:       rawContent,
+			Sender:        store.UserID,
+			SenderDevice:  store.DeviceID,
+			Recipient:     device.UserID,
+			RecipientKeys: ed25519Keys{device.Ed25519},
+			Keys:          ed25519Keys{store.Account.fingerprintKey()},
+		})
+		if err != nil {
+			return nil, err
+		}
+		msgType, body, err := sessions[0].encrypt(plaintext)
+		if err != nil {
+			return nil, err
+		}
+		if messages[device.UserID] == nil {
+			messages[device.UserID] = make(map[string]interface{})
+		}
+		messages[device.UserID][device.DeviceID] = map[string]interface{}{
+			"algorithm":  olmAlgorithm,
+			"sender_key": store.Account.identityKey(),
+			"ciphertext": map[string]olmCiphertext{
+				device.Curve25519: {Type: msgType, Body: b64.EncodeToString(body)},
+			},
+		}
+		sent = append(sent, device)
+	}
+	if len(sent) == 0 {
+		return nil, nil
+	}
+	// the ratchets moved, they can't be used again after a restart
+	if err := store.save(); err != nil {
+		return nil, err
+	}
+	url := b.mc.BuildURL("sendToDevice", "m.room.encrypted", xid.New().String())
+	if err := b.mc.MakeRequest("PUT", url, map[string]interface{}{"messages": messages}, nil); err != nil {
+		return nil, err
+	}
+	return sent, nil
+}
+
+// decryptOlm decrypts a to-device event and returns the payload and the device that sent it.
+// The caller holds the cryptoMutex.
+func (b *Bmatrix) decryptOlm(ev *matrix.Event) (*olmPayload, *deviceInfo, error) {
+	store := b.crypto
+	var content encryptedContent
+	if err := interface2Struct(ev.Content, &content); err != nil {
+		return nil, nil, err
+	}
+	if content.Algorithm != olmAlgorithm {
+		return nil, nil, fmt.Errorf("unsupported algorithm %s", content.Algorithm)
+	}
+	var ciphertexts map[string]olmCiphertext
+	if err := json.Unmarshal(content.Ciphertext, &ciphertexts); err != nil {
+		return nil, nil, err
+	}
+	ciphertext, ok := ciphertexts[store.Account.identityKey()]
+	if !ok {
+		return nil, nil, errors.New("the message isn't encrypted for our device")
+	}
+	body, err := b64.DecodeString(ciphertext.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	plaintext, err := b.olmDecrypt(content.SenderKey, ciphertext.Type, body)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var payload olmPayload
+	if err := json.Unmarshal(plaintext, &payload); err != nil {
+		return nil, nil, err
+	}
+	if payload.Sender != ev.Sender || payload.Recipient != store.UserID ||
+		payload.RecipientKeys.Ed25519 != store.Account.fingerprintKey() {
+		return nil, nil, errors.New("the message was meant for someone else")
+	}
+	device := b.deviceByKey(ev.Sender, content.SenderKey)
+	if device == nil || device.Ed25519 != payload.Keys.Ed25519 {
+		return nil, nil, errors.New("the message comes from an unknown device")
+	}
+	if !b.trusted(device) {
+		return nil, nil, fmt.Errorf("we don't trust device %s", device.DeviceID)
+	}
+	return &payload, device, nil
+}
+
+// olmDecrypt decrypts an Olm message with the sessions we have with the sender, or a new
+// session for pre-key messages. The caller holds the cryptoMutex.
+func (b *Bmatrix) olmDecrypt(senderKey string, msgType int, body []byte) ([]byte, error) {
+	store := b.crypto
+	sessions := store.OlmSessions[senderKey]
+	if msgType == olmPreKeyMessage {
+		preKey, err := decodeOlmPreKey(body)
+		if err != nil {
+			return nil, err
+		}
+		if b64.EncodeToString(preKey.IdentityKey) != senderKey {
+			return nil, errors.New("the pre-key message has another identity key than its sender")
+		}
+		for i, session := range sessions {
+			if session.matches(preKey) {
+				plaintext, err := session.decrypt(preKey.Message)
+				if err != nil {
+					return nil, err
+				}
+				store.OlmSessions[senderKey] = append(append([]*olmSession{session}, sessions[:i]...), sessions[i+1:]...)
+				return plaintext, nil
+			}
+		}
+		session, err := newInboundOlmSession(store.Account, preKey)
+		if err != nil {
+			return nil, err
+		}
+		plaintext, err := session.decrypt(preKey.Message)
+		if err != nil {
+			return nil, err
+		}
+		store.Account.removeOneTimeKey(preKey.OneTimeKey)
+		store.addOlmSession(senderKey, session)
+		return plaintext, nil
+	}
+	for i, session := range sessions {
+		if plaintext, err := session.decrypt(body); err == nil {
+			store.OlmSessions[senderKey] = append(append([]*olmSession{session}, sessions[:i]...), sessions[i+1:]...)
+			return plaintext, nil
+		}
+	}
+	return nil, errors.New("no Olm session can decrypt the message")
+}
+
+// handleToDevice handles the encrypted to-device events, which bring us the room keys of the other devices.
+// The caller holds the cryptoMutex.
+func (b *Bmatrix) handleToDevice(ev *matrix.Event) bool {
+	if ev.Type != "m.room.encrypted" {
+		return false
+	}
+	payload, device, err := b.decryptOlm(ev)
+	if err != nil {
+		b.Log.WithError(err).Warnf("Unable to decrypt the to-device event from %s", ev.Sender)
+		return false
+	}
+	// the Olm session moved on
+	if payload.Type != "m.room_key" {
+		b.Log.Debugf("Ignoring to-device event %s from %s", payload.Type, ev.Sender)
+		return true
+	}
+
+	var key roomKey
+	if err := json.Unmarshal(payload.Content, &key); err != nil || key.Algorithm != megolmAlgorithm {
+		return true
+	}
+	session, err := newInboundGroupSession(key.SessionKey)
+	if err != nil {
+		b.Log.WithError(err).Warnf("Invalid room key from %s", ev.Sender)
+		return true
+	}
+	if session.ID() != key.SessionID {
+		b.Log.Warnf("Room key from %s has the wrong session ID", ev.Sender)
+		return true
+	}
+	session.SenderKey = device.Curve25519
+	session.RoomID = key.RoomID
+	id := groupSessionKey(key.RoomID, device.Curve25519, key.SessionID)
+	// keep the copy that decrypts the most messages
+	if old, ok := b.crypto.InboundGroupSessions[id]; ok && old.Initial.Counter <= session.Initial.Counter {
+		return true
+	}
+	b.crypto.InboundGroupSessions[id] = session
+	b.Log.Debugf("Received the keys of session %s in %s from %s", key.SessionID, key.RoomID, ev.Sender)
+	return true
+}
+
+// handleEncrypted decrypts the m.room.encrypted events of rooms and handles them like unencrypted ones.
+func (b *Bmatrix) handleEncrypted(ev *matrix.Event) {
+	if ev.Sender == b.UserID {
+		return
+	}
+	decrypted, err := b.decryptEvent(ev)
+	if err != nil {
+		b.Log.WithError(err).Warnf("Unable to decrypt %s in %s", ev.ID, ev.RoomID)
+		return
+	}
+	switch decrypted.Type {
+	case "m.room.message":
+		b.handleEvent(decrypted)
+	default:
+		b.Log.Debugf("Ignoring encrypted event %s", decrypted.Type)
+	}
+}
+
+func (b *Bmatrix) decryptEvent(ev *matrix.Event) (*matrix.Event, error) {
+	var content encryptedContent
+	if err := interface2Struct(ev.Content, &content); err != nil {
+		return nil, err
+	}
+	if content.Algorithm != megolmAlgorithm {
+		return nil, fmt.Errorf("unsupported algorithm %s", content.Algorithm)
+	}
+	var ciphertext string
+	if err := json.Unmarshal(content.Ciphertext, &ciphertext); err != nil {
+		return nil, err
+	}
+	data, err := b64.DecodeString(ciphertext)
+	if err != nil {
+		return nil, err
+	}
+
+	b.cryptoMutex.Lock()
+	defer b.cryptoMutex.Unlock()
+	session, ok := b.crypto.InboundGroupSessions[groupSessionKey(ev.RoomID, content.SenderKey, content.SessionID)]
+	if !ok {
+		return nil, fmt.Errorf("we don't have the keys of session %s", content.SessionID)
+	}
+	plaintext, index, err := session.decrypt(data)
+	if err != nil {
+		return nil, err
+	}
+	if eventID, ok := session.Indexes[index]; ok && eventID != ev.ID {
+		return nil, fmt.Errorf("message index %d was already used by %s", index, eventID)
+	}
+	device := b.deviceByKey(ev.Sender, session.SenderKey)
+	if device == nil || !b.trusted(device) {
+		return nil, fmt.Errorf("the session %s doesn't come from a trusted device of %s", content.SessionID, ev.Sender)
+	}
+	// the store only changes for the messages we didn't decrypt before
+	if _, ok := session.Indexes[index]; !ok {
+		session.Indexes[index] = ev.ID
+		b.cryptoDirty = true
+	}
+
+	var payload megolmPayload
+	if err := json.Unmarshal(plaintext, &payload); err != nil {
+		return nil, err
+	}
+	if payload.RoomID != ev.RoomID {
+		return nil, errors.New("the message was encrypted for another room")
+	}
+	if payload.Content == nil {
+		payload.Content = make(map[string]interface{})
+	}
+	if _, ok := payload.Content["m.relates_to"]; !ok && content.RelatesTo != nil {
+		payload.Content["m.relates_to"] = content.RelatesTo
+	}
+	decrypted := *ev
+	decrypted.Type = payload.Type
+	decrypted.Content = payload.Content
+	return &decrypted, nil
+}
+
+// handleEncryption remembers the rooms with an m.room.encryption event, which can't be disabled again.
+func (b *Bmatrix) handleEncryption(ev *matrix.Event) {
+	b.setEncryption(ev.RoomID, ev.Content)
+}
+
+func (b *Bmatrix) setEncryption(roomID string, content map[string]interface{}) {
+	if content["algorithm"] != megolmAlgorithm {
+		// the room stays encrypted, we can't send messages to it anymore
+		b.Log.Warnf("Room %s uses unsupported encryption %v", roomID, content["algorithm"])
+		b.cryptoMutex.Lock()
+		b.encryptedRooms[roomID] = &roomEncryption{unsupported: fmt.Sprint(content["algorithm"])}
+		b.cryptoMutex.Unlock()
+		return
+	}
+	enc := &roomEncryption{rotationPeriod: defaultRotationPeriod, rotationMessages: defaultRotationMessages}
+	if ms, ok := content["rotation_period_ms"].(float64); ok && ms > 0 {
+		enc.rotationPeriod = time.Duration(ms) * time.Millisecond
+	}
+	if msgs, ok := content["rotation_period_msgs"].(float64); ok && msgs > 0 {
+		enc.rotationMessages = uint32(msgs)
+	}
+	b.cryptoMutex.Lock()
+	b.encryptedRooms[roomID] = enc
+	b.cryptoMutex.Unlock()
+}
+
+// checkEncryption looks up if the room we joined is encrypted.
+func (b *Bmatrix) checkEncryption(roomID string) error {
+	var content map[string]interface{}
+	err := b.mc.StateEvent(roomID, "m.room.encryption", "", &content)
+	if err != nil {
+		if handleError(err).Errcode == "M_NOT_FOUND" {
+			return nil
+		}
+		return err
+	}
+	b.setEncryption(roomID, content)
+	return nil
+}
+
+func (b *Bmatrix) isEncrypted(roomID string) bool {
+	if b.crypto == nil {
+		return false
+	}
+	b.cryptoMutex.Lock()
+	defer b.cryptoMutex.Unlock()
+	return b.encryptedRooms[roomID] != nil
+}
+
+// checkSupportedEncryption returns an error when the room uses an encryption we don't support.
+func (b *Bmatrix) checkSupportedEncryption(roomID string) error {
+	if b.crypto == nil {
+		return nil
+	}
+	b.cryptoMutex.Lock()
+	defer b.cryptoMutex.Unlock()
+	return b.unsupportedEncryption(roomID)
+}
+
+// unsupportedEncryption is checkSupportedEncryption for callers holding the cryptoMutex.
+func (b *Bmatrix) unsupportedEncryption(roomID string) error {
+	if enc := b.encryptedRooms[roomID]; enc != nil && enc.unsupported != "" {
+		return fmt.Errorf("room %s uses unsupported encryption %s", roomID, enc.unsupported)
+	}
+	return nil
+}
+
+// cryptoMemberChange forgets the members of the room, the next message is shared with the new
+// members and uses a new session if someone left.
+func (b *Bmatrix) cryptoMemberChange(ev *matrix.Event) {
+	if b.crypto == nil {
+		return
+	}
+	b.cryptoMutex.Lock()
+	delete(b.roomMembers, ev.RoomID)
+	b.cryptoMutex.Unlock()
+}
+
+// joinedMembers returns the members of the room. The caller holds the cryptoMutex.
+func (b *Bmatrix) joinedMembers(roomID string) ([]string, error) {
+	if members, ok := b.roomMembers[roomID]; ok {
+		return members, nil
+	}
+	var resp struct {
+		Joined map[string]interface{} `json:"joined"`
+	}
+	if err := b.mc.MakeRequest("GET", b.mc.BuildURL("rooms", roomID, "joined_members"), nil, &resp); err != nil {
+		return nil, err
+	}
+	members := make([]string, 0, len(resp.Joined))
+	for member := range resp.Joined {
+		members = append(members, member)
+	}
+	b.roomMembers[roomID] = members
+	return members, nil
+}
+
+// encryptEvent encrypts the event for the room, sharing our session with the devices of the
+// members that don't have it yet.
+func (b *Bmatrix) encryptEvent(roomID, eventType string, content interface{}) (*encryptedContent, error) {
+	b.cryptoMutex.Lock()
+	defer b.cryptoMutex.Unlock()
+	store := b.crypto
+	if err := b.unsupportedEncryption(roomID); err != nil {
+		return nil, err
+	}
+
+	members, err := b.joinedMembers(roomID)
+	if err != nil {
+		return nil, err
+	}
+	if err := b.queryDevices(members); err != nil {
+		return nil, err
+	}
+	devices := make(map[string]*deviceInfo)
+	for _, member := range members {
+		for _, device := range store.Devices[member] {
+			if member == store.UserID && device.DeviceID == store.DeviceID || !b.trusted(device) {
+				continue
+			}
+			devices[device.UserID+" "+device.DeviceID] = device
+		}
+	}
+
+	session, err := b.outboundSession(roomID, devices)
+	if err != nil {
+		return nil, err
+	}
+	var share []*deviceInfo
+	for id, device := range devices {
+		if !session.SharedWith[id] {
+			share = append(share, device)
+		}
+	}
+	if len(share) > 0 {
+		key := roomKey{
+			Algorithm:  megolmAlgorithm,
+			RoomID:     roomID,
+			SessionID:  session.ID(),
+			SessionKey: session.sessionKey(),
+		}
+		sent, err := b.sendEncryptedToDevices(share, "m.room_key", key)
+		if err != nil {
+			return nil, fmt.Errorf("sharing the room key failed: %w", err)
+		}
+		for _, device := range sent {
+			session.SharedWith[device.UserID+" "+device.DeviceID] = true
+		}
+	}
+
+	plaintext, err := json.Marshal(map[string]interface{}{
+		"type":    eventType,
+		"content": content,
+		"room_id": roomID,
+	})
+	if err != nil {
+		return nil, err
+	}
+	ciphertext, err := json.Marshal(b64.EncodeToString(session.encrypt(plaintext)))
+	if err != nil {
+		return nil, err
+	}
+	// the message index can't be used again
+	if err := store.save(); err != nil {
+		return nil, err
+	}
+
+	encrypted := &encryptedContent{
+		Algorithm:  megolmAlgorithm,
+		SenderKey:  store.Account.identityKey(),
+		Ciphertext: ciphertext,
+		SessionID:  session.ID(),
+		DeviceID:   store.DeviceID,
+	}
+	var relation struct {
+		RelatesTo interface{} `json:"m.relates_to"`
+	}
+	if err := interface2Struct(content, &relation); err == nil {
+		encrypted.RelatesTo = relation.RelatesTo
+	}
+	return encrypted, nil
+}
+
+// outboundSession returns the session to encrypt the next message of the room with, a new one
+// when the old one is too old or a device it was shared with isn't in the room anymore.
+// The caller holds the cryptoMutex.
+func (b *Bmatrix) outboundSession(roomID string, devices map[string]*deviceInfo) (*outboundGroupSession, error) {
+	store := b.crypto
+	session := store.OutboundGroupSessions[roomID]
+	if session != nil {
+		enc := b.encryptedRooms[roomID]
+		if time.Since(session.Created) >= enc.rotationPeriod || session.Ratchet.Counter >= enc.rotationMessages {
+			session = nil
+		}
+	}
+	if session != nil {
+		for id := range session.SharedWith {
+			if devices[id] == nil {
+				b.Log.Debugf("Device %s left %s, using a new session", id, roomID)
+				session = nil
+				break
+			}
+		}
+	}
+	if session == nil {
+		var err error
+		if session, err = newOutboundGroupSession(); err != nil {
+			return nil, err
+		}
+		store.OutboundGroupSessions[roomID] = session
+	}
+	return session, nil
+}
+
+// sendMessageEvent sends the message event, encrypted if the room is.
+func (b *Bmatrix) sendMessageEvent(mc *matrix.Client, roomID string, content interface{}) (*matrix.RespSendEvent, error) {
+	if !b.isEncrypted(roomID) {
+		return mc.SendMessageEvent(roomID, "m.room.message", content)
+	}
+	encrypted, err := b.encryptEvent(roomID, "m.room.message", content)
+	if err != nil {
+		return nil, err
+	}
+	return mc.SendMessageEvent(roomID, "m.room.encrypted", encrypted)
+}
+
+// handleCryptoSync handles the to-device events and the device lists of a sync.
+func (b *Bmatrix) handleCryptoSync(resp *syncResponse) {
+	b.cryptoMutex.Lock()
+	defer b.cryptoMutex.Unlock()
+	for _, user := range append(resp.DeviceLists.Changed, resp.DeviceLists.Left...) {
+		delete(b.trackedUsers, user)
+	}
+	for _, ev := range resp.ToDevice.Events {
+		if b.handleToDevice(ev) {
+			b.cryptoDirty = true
+		}
+	}
+	if count, ok := resp.DeviceOneTimeKeysCount["signed_curve25519"]; ok && count < oneTimeKeyTarget/2 {
+		if err := b.uploadKeys(count); err != nil {
+			b.Log.WithError(err).Warn("Uploading one-time keys failed")
+		}
+	}
+}
+
+// saveCrypto saves the sessions the decrypted messages changed.
+func (b *Bmatrix) saveCrypto() {
+	b.cryptoMutex.Lock()
+	defer b.cryptoMutex.Unlock()
+	if !b.cryptoDirty {
+		return
+	}
+	if err := b.crypto.save(); err != nil {
+		b.Log.WithError(err).Error("Saving the crypto store failed")
+		return
+	}
+	b.cryptoDirty = false
+}
@@ -0,0 +1,234 @@
+package bmatrix
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/42wim/matterbridge/bridge/bridgetest"
+	matrix "github.com/matterbridge/gomatrix"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeKeyServer keeps the keys the devices upload and the events they send.
+type fakeKeyServer struct {
+	sync.Mutex
+	users       map[string]string // user by access token
+	deviceKeys  map[string]json.RawMessage
+	oneTimeKeys map[string]map[string]json.RawMessage
+	toDevice    map[string]map[string]map[string]interface{}
+	events      []map[string]interface{}
+}
+
+func (hs *fakeKeyServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	hs.Lock()
+	defer hs.Unlock()
+	user := hs.users[strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")]
+	path := strings.TrimPrefix(r.URL.Path, "/_matrix/client/r0")
+	var req map[string]json.RawMessage
+	json.NewDecoder(r.Body).Decode(&req)
+
+	switch {
+	case path == "/keys/upload":
+		if keys, ok := req["device_keys"]; ok {
+			hs.deviceKeys[user] = keys
+		}
+		var otks map[string]json.RawMessage
+		json.Unmarshal(req["one_time_keys"], &otks)
+		if hs.oneTimeKeys[user] == nil {
+			hs.oneTimeKeys[user] = make(map[string]json.RawMessage)
+		}
+		for id, key := range otks {
+			hs.oneTimeKeys[user][id] = key
+		}
+		fmt.Fprintf(w, `{"one_time_key_counts":{"signed_curve25519":%d}}`, len(hs.oneTimeKeys[user]))
+	case path == "/keys/query":
+		var query map[string][]string
+		json.Unmarshal(req["device_keys"], &query)
+		resp := make(map[string]map[string]json.RawMessage)
+		for user := range query {
+			var keys struct {
+				DeviceID string `json:"device_id"`
+			}
+			json.Unmarshal(hs.deviceKeys[user], &keys)
+			resp[user] = map[string]json.RawMessage{keys.DeviceID: hs.deviceKeys[user]}
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"device_keys": resp})
+	case path == "/keys/claim":
+		var query map[string]map[string]string
+		json.Unmarshal(req["one_time_keys"], &query)
+		resp := make(map[string]map[string]map[string]json.RawMessage)
+		for user, devices := range query {
+			resp[user] = make(map[string]map[string]json.RawMessage)
+			for device := range devices {
+				for id, key := range hs.oneTimeKeys[user] {
+					resp[user][device] = map[string]json.RawMessage{id: key}
+					delete(hs.oneTimeKeys[user], id)
+					break
+				}
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"one_time_keys": resp})
+	case strings.HasPrefix(path, "/sendToDevice/"):
+		var messages map[string]map[string]map[string]interface{}
+		json.Unmarshal(req["messages"], &messages)
+		hs.toDevice = messages
+		fmt.Fprint(w, `{}`)
+	case strings.HasSuffix(path, "/joined_members"):
+		fmt.Fprint(w, `{"joined":{"@alice:example.com":{},"@bob:example.com":{}}}`)
+	case strings.Contains(path, "/send/m.room.encrypted/"):
+		content := make(map[string]interface{})
+		for k, v := range req {
+			var value interface{}
+			json.Unmarshal(v, &value)
+			content[k] = value
+		}
+		hs.events = append(hs.events, content)
+		fmt.Fprintf(w, `{"event_id":"$%d"}`, len(hs.events))
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, `{"errcode":"M_NOT_FOUND"}`)
+	}
+}
+
+func newTestCrypto(t *testing.T, server, dir, user, device string) *Bmatrix {
+	cfg := fmt.Sprintf("[matrix.test]\nServer=%q\nMxID=%q\nToken=%q\nEncryption=true\nCryptoStore=%q\n",
+		server, user, user, filepath.Join(dir, user+".json"))
+	b := New(bridgetest.Config("matrix.test", cfg)).(*Bmatrix)
+	require.NoError(t, b.loadCrypto())
+	mc, err := matrix.NewClient(server, user, user)
+	require.NoError(t, err)
+	b.mc = mc
+	b.UserID = user
+	require.NoError(t, b.startCrypto(device))
+	b.setEncryption("!room:example.com", map[string]interface{}{"algorithm": megolmAlgorithm})
+	return b
+}
+
+func TestEncryptedRoom(t *testing.T) {
+	hs := &fakeKeyServer{
+		users:       map[string]string{"@alice:example.com": "@alice:example.com", "@bob:example.com": "@bob:example.com"},
+		deviceKeys:  make(map[string]json.RawMessage),
+		oneTimeKeys: make(map[string]map[string]json.RawMessage),
+	}
+	server := httptest.NewServer(hs)
+	defer server.Close()
+	dir := t.TempDir()
+
+	alice := newTestCrypto(t, server.URL, dir, "@alice:example.com", "ALICE")
+	bob := newTestCrypto(t, server.URL, dir, "@bob:example.com", "BOB")
+	assert.Len(t, hs.oneTimeKeys["@bob:example.com"], oneTimeKeyTarget)
+
+	resp, err := alice.sendMessageEvent(alice.mc, "!room:example.com", matrix.TextMessage{MsgType: "m.text", Body: "secret"})
+	require.NoError(t, err)
+	require.Len(t, hs.events, 1)
+	assert.Equal(t, megolmAlgorithm, hs.events[0]["algorithm"])
+	assert.NotContains(t, fmt.Sprint(hs.events[0]), "secret")
+
+	// bob gets the room key over Olm
+	toDevice := hs.toDevice["@bob:example.com"]["BOB"]
+	require.NotNil(t, toDevice)
+	bob.cryptoMutex.Lock()
+	bob.handleToDevice(&matrix.Event{Type: "m.room.encrypted", Sender: "@alice:example.com", Content: toDevice})
+	bob.cryptoMutex.Unlock()
+
+	ev := &matrix.Event{
+		Type:    "m.room.encrypted",
+		Sender:  "@alice:example.com",
+		RoomID:  "!room:example.com",
+		ID:      resp.EventID,
+		Content: hs.events[0],
+	}
+	// messages of untrusted devices don't use up their message index
+	device := bob.deviceByKey("@alice:example.com", hs.events[0]["sender_key"].(string))
+	require.NotNil(t, device)
+	device.KeysChanged = true
+	_, err = bob.decryptEvent(ev)
+	assert.Error(t, err)
+	for _, session := range bob.crypto.InboundGroupSessions {
+		assert.Empty(t, session.Indexes)
+	}
+	device.KeysChanged = false
+
+	decrypted, err := bob.decryptEvent(ev)
+	require.NoError(t, err)
+	assert.Equal(t, "m.room.message", decrypted.Type)
+	assert.Equal(t, "secret", decrypted.Content["body"])
+	bob.saveCrypto()
+	assert.False(t, bob.cryptoDirty)
+
+	// decrypting the same message again doesn't change the store
+	_, err = bob.decryptEvent(ev)
+	require.NoError(t, err)
+	assert.False(t, bob.cryptoDirty)
+
+	// the next message uses the same session, the keys survive a restart
+	hs.toDevice = nil
+	_, err = alice.sendMessageEvent(alice.mc, "!room:example.com", matrix.TextMessage{MsgType: "m.text", Body: "again"})
+	require.NoError(t, err)
+	assert.Nil(t, hs.toDevice)
+
+	bob = newTestCrypto(t, server.URL, dir, "@bob:example.com", "BOB")
+	ev.ID = "$2"
+	ev.Content = hs.events[1]
+	decrypted, err = bob.decryptEvent(ev)
+	require.NoError(t, err)
+	assert.Equal(t, "again", decrypted.Content["body"])
+
+	// a replayed message index is refused
+	ev.ID = "$3"
+	_, err = bob.decryptEvent(ev)
+	assert.Error(t, err)
+}
+
+func TestUnsupportedEncryption(t *testing.T) {
+	hs := &fakeKeyServer{
+		users:       map[string]string{"@alice:example.com": "@alice:example.com"},
+		deviceKeys:  make(map[string]json.RawMessage),
+		oneTimeKeys: make(map[string]map[string]json.RawMessage),
+	}
+	server := httptest.NewServer(hs)
+	defer server.Close()
+
+	alice := newTestCrypto(t, server.URL, t.TempDir(), "@alice:example.com", "ALICE")
+	alice.setEncryption("!other:example.com", map[string]interface{}{"algorithm": "m.unknown.v1"})
+	assert.True(t, alice.isEncrypted("!other:example.com"))
+	assert.Error(t, alice.checkSupportedEncryption("!other:example.com"))
+	assert.NoError(t, alice.checkSupportedEncryption("!room:example.com"))
+
+	// the messages aren't sent in the clear instead
+	_, err := alice.sendMessageEvent(alice.mc, "!other:example.com", matrix.TextMessage{MsgType: "m.text", Body: "secret"})
+	assert.Error(t, err)
+	assert.Empty(t, hs.events)
+}
+
+func TestCanonicalJSON(t *testing.T) {
+	data, err := canonicalJSON(map[string]interface{}{
+		"b":          "<é>",
+		"a":          json.Number("1"),
+		"signatures": map[string]string{"x": "y"},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, `{"a":1,"b":"<é>"}`, string(data))
+}
+
+func TestEncryptedAttachment(t *testing.T) {
+	data := []byte("a file in an encrypted room")
+	ciphertext, file, err := encryptAttachment(data)
+	require.NoError(t, err)
+	assert.NotEqual(t, data, ciphertext)
+
+	plaintext, err := decryptAttachment(ciphertext, file)
+	require.NoError(t, err)
+	assert.Equal(t, data, plaintext)
+
+	ciphertext[0] ^= 1
+	_, err = decryptAttachment(ciphertext, file)
+	assert.Error(t, err)
+}
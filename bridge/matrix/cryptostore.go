@@ -0,0 +1,119 @@
+package bmatrix
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+)
+
+// cryptoStore is the persistent state of end-to-end encryption, saved as JSON in the CryptoStore file.
+type cryptoStore struct {
+	path string
+
+	UserID   string      `json:"user_id"`
+	DeviceID string      `json:"device_id"`
+	Account  *olmAccount `json:"account"`
+	// KeysUploaded is true once the device keys are published.
+	KeysUploaded bool `json:"keys_uploaded"`
+	// OlmSessions are the Olm sessions by Curve25519 key of the other device, most recent first.
+	OlmSessions map[string][]*olmSession `json:"olm_sessions"`
+	// InboundGroupSessions are keyed by room, sender key and session ID.
+	InboundGroupSessions map[string]*inboundGroupSession `json:"inbound_group_sessions"`
+	// OutboundGroupSessions are keyed by room.
+	OutboundGroupSessions map[string]*outboundGroupSession `json:"outbound_group_sessions"`
+	// Devices are the devices of the users we share rooms with, by user and device ID.
+	Devices map[string]map[string]*deviceInfo `json:"devices"`
+}
+
+// deviceInfo is the identity of a device of another user.
+type deviceInfo struct {
+	UserID     string `json:"user_id"`
+	DeviceID   string `json:"device_id"`
+	Curve25519 string `json:"curve25519"`
+	Ed25519    string `json:"ed25519"`
+	// KeysChanged is set when the device announced other keys than the ones we first saw.
+	KeysChanged bool `json:"keys_changed,omitempty"`
+}
+
+// loadCryptoStore reads the store, or returns an empty store if the file doesn't exist yet.
+func loadCryptoStore(path string) (*cryptoStore, error) {
+	s := &cryptoStore{path: path}
+	data, err := os.ReadFile(path)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+	case err != nil:
+		return nil, err
+	default:
+		if err := json.Unmarshal(data, s); err != nil {
+			return nil, err
+		}
+	}
+	if s.OlmSessions == nil {
+		s.OlmSessions = make(map[string][]*olmSession)
+	}
+	if s.InboundGroupSessions == nil {
+		s.InboundGroupSessions = make(map[string]*inboundGroupSession)
+	}
+	if s.OutboundGroupSessions == nil {
+		s.OutboundGroupSessions = make(map[string]*outboundGroupSession)
+	}
+	if s.Devices == nil {
+		s.Devices = make(map[string]map[string]*deviceInfo)
+	}
+	return s, nil
+}
+
+// reset forgets everything, for a new device.
+func (s *cryptoStore) reset(userID, deviceID string) error {
+	account, err := newOlmAccount()
+	if err != nil {
+		return err
+	}
+	*s = cryptoStore{
+		path:                  s.path,
+		UserID:                userID,
+		DeviceID:              deviceID,
+		Account:               account,
+		OlmSessions:           make(map[string][]*olmSession),
+		InboundGroupSessions:  make(map[string]*inboundGroupSession),
+		OutboundGroupSessions: make(map[string]*outboundGroupSession),
+		Devices:               make(map[string]map[string]*deviceInfo),
+	}
+	return nil
+}
+
+// save writes the store atomically, it contains private keys so only we can read it.
+func (s *cryptoStore) save() error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
+
+func groupSessionKey(roomID, senderKey, sessionID string) string {
+	return roomID + "|" + senderKey + "|" + sessionID
+}
+
+// deviceByKey returns the device of the user with the Curve25519 key.
+func (s *cryptoStore) deviceByKey(userID, curve25519 string) *deviceInfo {
+	for _, device := range s.Devices[userID] {
+		if device.Curve25519 == curve25519 {
+			return device
+		}
+	}
+	return nil
+}
@@ -8,6 +8,8 @@ import (
 	"strings"
 	"time"
 
+	"github.com/42wim/matterbridge/bridge/config"
+
 	matrix "github.com/matterbridge/gomatrix"
 )
 
@@ -27,12 +29,17 @@ func newMatrixUsername(username string) *matrixUsername {
 	return mUsername
 }
 
-// getRoomID retrieves a matching room ID from the channel name.
-func (b *Bmatrix) getRoomID(channel string) string {
+// getRoomID retrieves a matching room ID from the channel name, and for spaces the room
+// with the name of the sub-channel.
+func (b *Bmatrix) getRoomID(channel, subChannel string) string {
 	b.RLock()
 	defer b.RUnlock()
 	for ID, name := range b.RoomMap {
-		if name == channel {
+		if name != channel {
+			continue
+		}
+		roomName, inSpace := b.spaceRooms[ID]
+		if !inSpace || subChannel != "" && config.SameChannelName(roomName, subChannel) {
 			return ID
 		}
 	}
@@ -213,3 +220,40 @@ func (b *Bmatrix) retry(f func() error) error {
 		}
 	}
 }
+
+// replyThread returns the root of the thread a reply to the event goes in, and false when
+// the reply isn't threaded. Replies only go in a thread when the event is in one we've seen,
+// or always with UseThreads, which can look up the event on the homeserver.
+func (b *Bmatrix) replyThread(roomID, eventID string) (string, bool) {
+	if b.GetBool("UseThreads") {
+		return b.threadRoot(roomID, eventID), true
+	}
+	if root, ok := b.threadRoots.Get(eventID); ok && root.(string) != eventID {
+		return root.(string), true
+	}
+
+	return "", false
+}
+
+// threadRoot returns the root of the thread of the event, which is the event itself when it
+// isn't in a thread. Matrix threads can't be started from events in a thread.
+func (b *Bmatrix) threadRoot(roomID, eventID string) string {
+	if root, ok := b.threadRoots.Get(eventID); ok {
+		return root.(string)
+	}
+
+	var ev matrix.Event
+	if err := b.mc.MakeRequest("GET", b.mc.BuildURL("rooms", roomID, "event", eventID), nil, &ev); err != nil {
+		b.Log.Debugf("couldn't get event %s: %s", eventID, err)
+		return eventID
+	}
+
+	root := eventID
+	var relation ThreadRelation
+	if err := interface2Struct(ev.Content["m.relates_to"], &relation); err == nil && relation.Type == "m.thread" {
+		root = relation.EventID
+	}
+	b.threadRoots.Add(eventID, root)
+
+	return root
+}
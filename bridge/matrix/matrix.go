@@ -2,8 +2,10 @@ package bmatrix
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"mime"
+	"net/http"
 	"regexp"
 	"strings"
 	"sync"
@@ -12,9 +14,17 @@ import (
 	"github.com/42wim/matterbridge/bridge"
 	"github.com/42wim/matterbridge/bridge/config"
 	"github.com/42wim/matterbridge/bridge/helper"
+	lru "github.com/hashicorp/golang-lru"
 	matrix "github.com/matterbridge/gomatrix"
 )
 
+const (
+	// sentCacheSize is the number of messages of virtual users we remember the sender of.
+	sentCacheSize = 5000
+	// threadCacheSize is the number of messages we remember the thread of.
+	threadCacheSize = 5000
+)
+
 var (
 	htmlTag            = regexp.MustCompile("</.*?>")
 	htmlReplacementTag = regexp.MustCompile("<[^>]*>")
@@ -33,6 +43,34 @@ type Bmatrix struct {
 	rateMutex   sync.RWMutex
 	sync.RWMutex
 	*bridge.Config
+
+	// application service mode
+	asToken   string
+	hsToken   string
+	namespace *regexp.Regexp
+	server    *http.Server
+	txns      *lru.Cache
+	// sentBy is the virtual user that sent a message, by event ID.
+	sentBy       *lru.Cache
+	puppetsMutex sync.Mutex
+	puppets      map[string]*puppet
+	puppetMXIDs  map[string]*puppet
+	// threadRoots is the root of the thread of a message, by event ID.
+	threadRoots *lru.Cache
+	// pendingInvites are the channels we need an invite for, by room ID.
+	pendingInvites map[string]config.ChannelInfo
+	// spaces are the channels of the spaces we bridge and spaceRooms the names of their rooms, by room ID.
+	spaces     map[string]string
+	spaceRooms map[string]string
+
+	// end-to-end encryption, the mutex guards the store and the maps
+	crypto         *cryptoStore
+	cryptoMutex    sync.Mutex
+	cryptoDirty    bool
+	encryptedRooms map[string]*roomEncryption
+	roomMembers    map[string][]string
+	// trackedUsers are the users whose devices we know are up to date.
+	trackedUsers map[string]bool
 }
 
 type httpError struct {
@@ -75,8 +113,18 @@ type InReplyToRelation struct {
 	InReplyTo InReplyToRelationContent `json:"m.in_reply_to"`
 }
 
-type ReplyMessage struct {
-	RelatedTo InReplyToRelation `json:"m.relates_to"`
+// ThreadRelation puts a message in the thread of its root event, with a reply to the
+// parent for clients that don't support threads.
+// Without Type and EventID it's a plain reply.
+type ThreadRelation struct {
+	Type          string                   `json:"rel_type,omitempty"`
+	EventID       string                   `json:"event_id,omitempty"`
+	IsFallingBack bool                     `json:"is_falling_back,omitempty"`
+	InReplyTo     InReplyToRelationContent `json:"m.in_reply_to"`
+}
+
+type ThreadMessage struct {
+	RelatedTo ThreadRelation `json:"m.relates_to"`
 	matrix.TextMessage
 }
 
@@ -84,12 +132,32 @@ func New(cfg *bridge.Config) bridge.Bridger {
 	b := &Bmatrix{Config: cfg}
 	b.RoomMap = make(map[string]string)
 	b.NicknameMap = make(map[string]NicknameCacheEntry)
+	b.txns, _ = lru.New(txnCacheSize)
+	b.sentBy, _ = lru.New(sentCacheSize)
+	b.threadRoots, _ = lru.New(threadCacheSize)
+	b.pendingInvites = make(map[string]config.ChannelInfo)
+	b.spaces = make(map[string]string)
+	b.spaceRooms = make(map[string]string)
+	b.puppets = make(map[string]*puppet)
+	b.puppetMXIDs = make(map[string]*puppet)
 	return b
 }
 
 func (b *Bmatrix) Connect() error {
 	var err error
 	b.Log.Infof("Connecting %s", b.GetString("Server"))
+	if b.GetBool("Encryption") {
+		if b.GetBool("AppService") {
+			return errors.New("encryption isn't supported in application service mode")
+		}
+		if err := b.loadCrypto(); err != nil {
+			return err
+		}
+	}
+	if b.GetBool("AppService") {
+		return b.connectAppService()
+	}
+	deviceID := ""
 	if b.GetString("MxID") != "" && b.GetString("Token") != "" {
 		b.mc, err = matrix.NewClient(
 			b.GetString("Server"), b.GetString("MxID"), b.GetString("Token"),
@@ -109,49 +177,74 @@ func (b *Bmatrix) Connect() error {
 			User:       b.GetString("Login"),
 			Password:   b.GetString("Password"),
 			Identifier: matrix.NewUserIdentifier(b.GetString("Login")),
+			DeviceID:   b.cryptoDeviceID(),
 		})
 		if err != nil {
 			return err
 		}
 		b.mc.SetCredentials(resp.UserID, resp.AccessToken)
 		b.UserID = resp.UserID
+		deviceID = resp.DeviceID
 		b.Log.Info("Connection succeeded")
 	}
+	if b.crypto != nil {
+		if err := b.startCrypto(deviceID); err != nil {
+			return err
+		}
+	}
 	go b.handlematrix()
 	return nil
 }
 
 func (b *Bmatrix) Disconnect() error {
-	return nil
+	return b.closeAppService()
 }
 
 func (b *Bmatrix) JoinChannel(channel config.ChannelInfo) error {
-	return b.retry(func() error {
-		resp, err := b.mc.JoinRoom(channel.Name, "", nil)
-		if err != nil {
-			return err
-		}
-
-		b.Lock()
-		b.RoomMap[resp.RoomID] = channel.Name
-		b.Unlock()
+	var resp *matrix.RespJoinRoom
+	err := b.retry(func() error {
+		var err error
+		resp, err = b.mc.JoinRoom(b.normalizeAlias(channel.Name), "", nil)
 
-		return nil
+		return err
 	})
+	if err != nil {
+		// invite-only rooms can be joined once we're invited
+		if handleError(err).Errcode == "M_FORBIDDEN" && len(b.GetStringSlice("AcceptInvitesFrom")) > 0 {
+			return b.waitForInvite(channel)
+		}
+		return err
+	}
+
+	return b.mapRoom(resp.RoomID, channel)
 }
 
 func (b *Bmatrix) Send(msg config.Message) (string, error) {
 	b.Log.Debugf("=> Receiving %#v", msg)
 
-	channel := b.getRoomID(msg.Channel)
+	channel := b.getRoomID(msg.Channel, msg.SubChannel)
 	b.Log.Debugf("Channel %s maps to channel id %s", msg.Channel, channel)
+	if channel == "" && (msg.SubChannel != "" || b.isSpace(msg.Channel)) {
+		b.Log.Debugf("No room named %q in %s", msg.SubChannel, msg.Channel)
+		return "", nil
+	}
+	if err := b.checkSupportedEncryption(channel); err != nil {
+		return "", err
+	}
 
 	username := newMatrixUsername(msg.Username)
 
 	body := username.plain + msg.Text
 	formattedBody := username.formatted + helper.ParseMarkdown(msg.Text)
 
-	if b.GetBool("SpoofUsername") {
+	// virtual users send the message themselves, without the username
+	mc := b.mc
+	p := b.puppetFor(&msg, channel)
+	if p != nil {
+		mc = p.mc
+		body = msg.Text
+		formattedBody = helper.ParseMarkdown(msg.Text)
+	} else if b.GetBool("SpoofUsername") {
 		// https://spec.matrix.org/v1.3/client-server-api/#mroommember
 		type stateMember struct {
 			AvatarURL   string `json:"avatar_url,omitempty"`
@@ -190,7 +283,7 @@ func (b *Bmatrix) Send(msg config.Message) (string, error) {
 		msgID := ""
 
 		err := b.retry(func() error {
-			resp, err := b.mc.SendMessageEvent(channel, "m.room.message", m)
+			resp, err := b.sendMessageEvent(mc, channel, m)
 			if err != nil {
 				return err
 			}
@@ -199,6 +292,7 @@ func (b *Bmatrix) Send(msg config.Message) (string, error) {
 
 			return err
 		})
+		b.rememberSender(p, msgID)
 
 		return msgID, err
 	}
@@ -212,7 +306,7 @@ func (b *Bmatrix) Send(msg config.Message) (string, error) {
 		msgID := ""
 
 		err := b.retry(func() error {
-			resp, err := b.mc.RedactEvent(channel, msg.ID, &matrix.ReqRedact{})
+			resp, err := mc.RedactEvent(channel, msg.ID, &matrix.ReqRedact{})
 			if err != nil {
 				return err
 			}
@@ -231,7 +325,10 @@ func (b *Bmatrix) Send(msg config.Message) (string, error) {
 			rmsg := rmsg
 
 			err := b.retry(func() error {
-				_, err := b.mc.SendText(channel, rmsg.Username+rmsg.Text)
+				_, err := b.sendMessageEvent(b.mc, channel, matrix.TextMessage{
+					MsgType: "m.text",
+					Body:    rmsg.Username + rmsg.Text,
+				})
 
 				return err
 			})
@@ -276,7 +373,7 @@ func (b *Bmatrix) Send(msg config.Message) (string, error) {
 		}
 
 		err := b.retry(func() error {
-			_, err := b.mc.SendMessageEvent(channel, "m.room.message", rmsg)
+			_, err := b.sendMessageEvent(mc, channel, rmsg)
 
 			return err
 		})
@@ -307,7 +404,7 @@ func (b *Bmatrix) Send(msg config.Message) (string, error) {
 		)
 
 		err = b.retry(func() error {
-			resp, err = b.mc.SendMessageEvent(channel, "m.room.message", m)
+			resp, err = b.sendMessageEvent(mc, channel, m)
 
 			return err
 		})
@@ -315,11 +412,14 @@ func (b *Bmatrix) Send(msg config.Message) (string, error) {
 			return "", err
 		}
 
+		b.rememberSender(p, resp.EventID)
+
 		return resp.EventID, err
 	}
 
+	// Messages with a parent are replies, in the thread of the parent if there is one
 	if msg.ParentValid() {
-		m := ReplyMessage{
+		m := ThreadMessage{
 			TextMessage: matrix.TextMessage{
 				MsgType:       "m.text",
 				Body:          body,
@@ -333,11 +433,19 @@ func (b *Bmatrix) Send(msg config.Message) (string, error) {
 			m.TextMessage.FormattedBody = ""
 		}
 
-		m.RelatedTo = InReplyToRelation{
+		m.RelatedTo = ThreadRelation{
 			InReplyTo: InReplyToRelationContent{
 				EventID: msg.ParentID,
 			},
 		}
+		root, threaded := b.replyThread(channel, msg.ParentID)
+		if threaded {
+			m.RelatedTo.Type = "m.thread"
+			m.RelatedTo.EventID = root
+			m.RelatedTo.IsFallingBack = true
+		} else {
+			root = ""
+		}
 
 		var (
 			resp *matrix.RespSendEvent
@@ -345,7 +453,7 @@ func (b *Bmatrix) Send(msg config.Message) (string, error) {
 		)
 
 		err = b.retry(func() error {
-			resp, err = b.mc.SendMessageEvent(channel, "m.room.message", m)
+			resp, err = b.sendMessageEvent(mc, channel, m)
 
 			return err
 		})
@@ -353,6 +461,12 @@ func (b *Bmatrix) Send(msg config.Message) (string, error) {
 			return "", err
 		}
 
+		b.rememberSender(p, resp.EventID)
+		if root == "" {
+			root = resp.EventID
+		}
+		b.threadRoots.Add(resp.EventID, root)
+
 		return resp.EventID, err
 	}
 
@@ -363,7 +477,10 @@ func (b *Bmatrix) Send(msg config.Message) (string, error) {
 		)
 
 		err = b.retry(func() error {
-			resp, err = b.mc.SendText(channel, body)
+			resp, err = b.sendMessageEvent(mc, channel, matrix.TextMessage{
+				MsgType: "m.text",
+				Body:    body,
+			})
 
 			return err
 		})
@@ -371,6 +488,8 @@ func (b *Bmatrix) Send(msg config.Message) (string, error) {
 			return "", err
 		}
 
+		b.rememberSender(p, resp.EventID)
+
 		return resp.EventID, err
 	}
 
@@ -381,7 +500,12 @@ func (b *Bmatrix) Send(msg config.Message) (string, error) {
 	)
 
 	err = b.retry(func() error {
-		resp, err = b.mc.SendFormattedText(channel, body, formattedBody)
+		resp, err = b.sendMessageEvent(mc, channel, matrix.TextMessage{
+			MsgType:       "m.text",
+			Body:          body,
+			FormattedBody: formattedBody,
+			Format:        "org.matrix.custom.html",
+		})
 
 		return err
 	})
@@ -389,6 +513,8 @@ func (b *Bmatrix) Send(msg config.Message) (string, error) {
 		return "", err
 	}
 
+	b.rememberSender(p, resp.EventID)
+
 	return resp.EventID, err
 }
 
@@ -397,16 +523,13 @@ func (b *Bmatrix) handlematrix() {
 	syncer.OnEventType("m.room.redaction", b.handleEvent)
 	syncer.OnEventType("m.room.message", b.handleEvent)
 	syncer.OnEventType("m.room.member", b.handleMemberChange)
-	go func() {
-		for {
-			if b == nil {
-				return
-			}
-			if err := b.mc.Sync(); err != nil {
-				b.Log.Println("Sync() returned ", err)
-			}
-		}
-	}()
+	syncer.OnEventType("m.space.child", b.handleSpaceChild)
+	syncer.OnEventType("m.room.name", b.handleRoomName)
+	if b.crypto != nil {
+		syncer.OnEventType("m.room.encrypted", b.handleEncrypted)
+		syncer.OnEventType("m.room.encryption", b.handleEncryption)
+	}
+	go b.sync()
 }
 
 func (b *Bmatrix) handleEdit(ev *matrix.Event, rmsg config.Message) bool {
@@ -445,12 +568,22 @@ func (b *Bmatrix) handleReply(ev *matrix.Event, rmsg config.Message) bool {
 		return false
 	}
 
-	var relation InReplyToRelation
+	var relation ThreadRelation
 	if err := interface2Struct(relationInterface, &relation); err != nil {
 		// probably fine
 		return false
 	}
 
+	// Messages in a thread have the root of the thread as parent
+	if relation.Type == "m.thread" && relation.EventID != "" {
+		b.threadRoots.Add(ev.ID, relation.EventID)
+		rmsg.ParentID = relation.EventID
+		b.Remote <- rmsg
+
+		return true
+	}
+
+	b.threadRoots.Add(ev.ID, ev.ID)
 	body := rmsg.Text
 
 	if !b.GetBool("keepquotedreply") {
@@ -478,13 +611,16 @@ func (b *Bmatrix) handleMemberChange(ev *matrix.Event) {
 			b.cacheDisplayName(ev.Sender, dn)
 		}
 	}
+	b.cryptoMemberChange(ev)
+	b.handleInvite(ev)
 }
 
 func (b *Bmatrix) handleEvent(ev *matrix.Event) {
 	b.Log.Debugf("== Receiving event: %#v", ev)
-	if ev.Sender != b.UserID {
+	if ev.Sender != b.UserID && !b.isPuppet(ev.Sender) {
 		b.RLock()
 		channel, ok := b.RoomMap[ev.RoomID]
+		subChannel := b.spaceRooms[ev.RoomID]
 		b.RUnlock()
 		if !ok {
 			b.Log.Debugf("Unknown room %s", ev.RoomID)
@@ -493,12 +629,14 @@ func (b *Bmatrix) handleEvent(ev *matrix.Event) {
 
 		// Create our message
 		rmsg := config.Message{
-			Username: b.getDisplayName(ev.Sender),
-			Channel:  channel,
-			Account:  b.Account,
-			UserID:   ev.Sender,
-			ID:       ev.ID,
-			Avatar:   b.getAvatarURL(ev.Sender),
+			Username:   b.getDisplayName(ev.Sender),
+			Channel:    channel,
+			Account:    b.Account,
+			UserID:     ev.Sender,
+			ID:         ev.ID,
+			Avatar:     b.getAvatarURL(ev.Sender),
+			Timestamp:  time.UnixMilli(ev.Timestamp),
+			SubChannel: subChannel,
 		}
 
 		// Remove homeserver suffix if configured
@@ -537,6 +675,7 @@ func (b *Bmatrix) handleEvent(ev *matrix.Event) {
 		if b.handleReply(ev, rmsg) {
 			return
 		}
+		b.threadRoots.Add(ev.ID, ev.ID)
 
 		// Do we have attachments
 		if b.containsAttachment(ev.Content) {
@@ -566,6 +705,14 @@ func (b *Bmatrix) handleDownloadFile(rmsg *config.Message, content map[string]in
 	)
 
 	rmsg.Extra = make(map[string][]interface{})
+	// attachments of encrypted rooms have a file with the url and the key instead of an url
+	var file *encryptedFile
+	if _, ok = content["file"]; ok {
+		if err := interface2Struct(content["file"], &file); err != nil {
+			return err
+		}
+		content["url"] = file.URL
+	}
 	if url, ok = content["url"].(string); !ok {
 		return fmt.Errorf("url isn't a %T", url)
 	}
@@ -610,6 +757,13 @@ func (b *Bmatrix) handleDownloadFile(rmsg *config.Message, content map[string]in
 	if err != nil {
 		return fmt.Errorf("download %s failed %#v", url, err)
 	}
+	if file != nil {
+		decrypted, err := decryptAttachment(*data, file)
+		if err != nil {
+			return fmt.Errorf("decrypting %s failed: %w", url, err)
+		}
+		data = &decrypted
+	}
 	// add the downloaded data to the message
 	helper.HandleDownloadData(b.Log, rmsg, name, "", url, data, b.General)
 	return nil
@@ -628,12 +782,17 @@ func (b *Bmatrix) handleUploadFiles(msg *config.Message, channel string) (string
 // handleUploadFile handles native upload of a file.
 func (b *Bmatrix) handleUploadFile(msg *config.Message, channel string, fi *config.FileInfo) {
 	username := newMatrixUsername(msg.Username)
-	content := bytes.NewReader(*fi.Data)
+	data := *fi.Data
 	sp := strings.Split(fi.Name, ".")
 	mtype := mime.TypeByExtension("." + sp[len(sp)-1])
 	// image and video uploads send no username, we have to do this ourself here #715
 	err := b.retry(func() error {
-		_, err := b.mc.SendFormattedText(channel, username.plain+fi.Comment, username.formatted+fi.Comment)
+		_, err := b.sendMessageEvent(b.mc, channel, matrix.TextMessage{
+			MsgType:       "m.text",
+			Body:          username.plain + fi.Comment,
+			FormattedBody: username.formatted + fi.Comment,
+			Format:        "org.matrix.custom.html",
+		})
 
 		return err
 	})
@@ -641,12 +800,23 @@ func (b *Bmatrix) handleUploadFile(msg *config.Message, channel string, fi *conf
 		b.Log.Errorf("file comment failed: %#v", err)
 	}
 
+	// attachments of encrypted rooms are encrypted too, the key goes in the message
+	var file *encryptedFile
+	uploadType := mtype
+	if b.isEncrypted(channel) {
+		if data, file, err = encryptAttachment(data); err != nil {
+			b.Log.Errorf("file encryption failed: %#v", err)
+			return
+		}
+		uploadType = "application/octet-stream"
+	}
+
 	b.Log.Debugf("uploading file: %s %s", fi.Name, mtype)
 
 	var res *matrix.RespMediaUpload
 
 	err = b.retry(func() error {
-		res, err = b.mc.UploadToContentRepo(content, mtype, int64(len(*fi.Data)))
+		res, err = b.mc.UploadToContentRepo(bytes.NewReader(data), uploadType, int64(len(data)))
 
 		return err
 	})
@@ -656,63 +826,38 @@ func (b *Bmatrix) handleUploadFile(msg *config.Message, channel string, fi *conf
 		return
 	}
 
+	msgtype := "m.file"
 	switch {
 	case strings.Contains(mtype, "video"):
-		b.Log.Debugf("sendVideo %s", res.ContentURI)
-		err = b.retry(func() error {
-			_, err = b.mc.SendVideo(channel, fi.Name, res.ContentURI)
-
-			return err
-		})
-		if err != nil {
-			b.Log.Errorf("sendVideo failed: %#v", err)
-		}
+		msgtype = "m.video"
 	case strings.Contains(mtype, "image"):
-		b.Log.Debugf("sendImage %s", res.ContentURI)
-		err = b.retry(func() error {
-			_, err = b.mc.SendImage(channel, fi.Name, res.ContentURI)
-
-			return err
-		})
-		if err != nil {
-			b.Log.Errorf("sendImage failed: %#v", err)
-		}
+		msgtype = "m.image"
 	case strings.Contains(mtype, "audio"):
-		b.Log.Debugf("sendAudio %s", res.ContentURI)
-		err = b.retry(func() error {
-			_, err = b.mc.SendMessageEvent(channel, "m.room.message", matrix.AudioMessage{
-				MsgType: "m.audio",
-				Body:    fi.Name,
-				URL:     res.ContentURI,
-				Info: matrix.AudioInfo{
-					Mimetype: mtype,
-					Size:     uint(len(*fi.Data)),
-				},
-			})
+		msgtype = "m.audio"
+	}
+	content := map[string]interface{}{
+		"msgtype": msgtype,
+		"body":    fi.Name,
+		"info": map[string]interface{}{
+			"mimetype": mtype,
+			"size":     len(*fi.Data),
+		},
+	}
+	if file != nil {
+		file.URL = res.ContentURI
+		content["file"] = file
+	} else {
+		content["url"] = res.ContentURI
+	}
 
-			return err
-		})
-		if err != nil {
-			b.Log.Errorf("sendAudio failed: %#v", err)
-		}
-	default:
-		b.Log.Debugf("sendFile %s", res.ContentURI)
-		err = b.retry(func() error {
-			_, err = b.mc.SendMessageEvent(channel, "m.room.message", matrix.FileMessage{
-				MsgType: "m.file",
-				Body:    fi.Name,
-				URL:     res.ContentURI,
-				Info: matrix.FileInfo{
-					Mimetype: mtype,
-					Size:     uint(len(*fi.Data)),
-				},
-			})
+	b.Log.Debugf("send %s %s", msgtype, res.ContentURI)
+	err = b.retry(func() error {
+		_, err = b.sendMessageEvent(b.mc, channel, content)
 
-			return err
-		})
-		if err != nil {
-			b.Log.Errorf("sendFile failed: %#v", err)
-		}
+		return err
+	})
+	if err != nil {
+		b.Log.Errorf("send %s failed: %#v", msgtype, err)
 	}
 	b.Log.Debugf("result: %#v", res)
 }
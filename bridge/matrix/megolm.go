@@ -0,0 +1,228 @@
+package bmatrix
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"io"
+	"time"
+)
+
+// This file implements the Megolm ratchet used to encrypt the messages of rooms,
+// see https://gitlab.matrix.org/matrix-org/olm/-/blob/master/docs/megolm.md
+
+const (
+	megolmRatchetParts      = 4
+	megolmRatchetPartLength = 32
+	megolmSessionKeyVersion = 2
+	megolmSignatureLength   = ed25519.SignatureSize
+)
+
+var (
+	megolmKeysInfo = []byte("MEGOLM_KEYS")
+
+	errBadSignature   = errors.New("bad message signature")
+	errUnknownIndex   = errors.New("message index is before the first known one")
+	errBadSessionKeys = errors.New("invalid session key")
+)
+
+// megolmRatchet is the state of a Megolm session at a message index.
+type megolmRatchet struct {
+	Data    []byte `json:"data"`
+	Counter uint32 `json:"counter"`
+}
+
+func (r *megolmRatchet) part(i int) []byte {
+	return r.Data[i*megolmRatchetPartLength : (i+1)*megolmRatchetPartLength]
+}
+
+// rehash sets the part to of the ratchet from the part from.
+func (r *megolmRatchet) rehash(from, to int) {
+	copy(r.part(to), hmacSHA256(r.part(from), []byte{byte(to)}))
+}
+
+// advance moves the ratchet to the next message index.
+func (r *megolmRatchet) advance() {
+	r.Counter++
+	// find the highest part that changes
+	h := 0
+	for mask := uint32(0x00FFFFFF); h < megolmRatchetParts; h++ {
+		if r.Counter&mask == 0 {
+			break
+		}
+		mask >>= 8
+	}
+	for i := megolmRatchetParts - 1; i >= h; i-- {
+		r.rehash(h, i)
+	}
+}
+
+// advanceTo moves the ratchet to the message index, which can't be before the current one.
+func (r *megolmRatchet) advanceTo(index uint32) {
+	for j := 0; j < megolmRatchetParts; j++ {
+		shift := uint((megolmRatchetParts - j - 1) * 8)
+		mask := ^uint32(0) << shift
+		steps := ((index >> shift) - (r.Counter >> shift)) & 0xff
+		if steps == 0 {
+			// index wrapped around, R(0) needs 256 steps
+			if index >= r.Counter {
+				continue
+			}
+			steps = 0x100
+		}
+		for ; steps > 1; steps-- {
+			r.rehash(j, j)
+		}
+		for k := megolmRatchetParts - 1; k >= j; k-- {
+			r.rehash(j, k)
+		}
+		r.Counter = index & mask
+	}
+}
+
+func (r *megolmRatchet) copy() megolmRatchet {
+	return megolmRatchet{Data: append([]byte{}, r.Data...), Counter: r.Counter}
+}
+
+// outboundGroupSession is the Megolm session we encrypt the messages of a room with.
+type outboundGroupSession struct {
+	Ratchet     megolmRatchet `json:"ratchet"`
+	SigningSeed []byte        `json:"signing_seed"`
+	Created     time.Time     `json:"created"`
+	// SharedWith are the devices we sent the session key to, as "user device".
+	SharedWith map[string]bool `json:"shared_with"`
+}
+
+func newOutboundGroupSession() (*outboundGroupSession, error) {
+	s := &outboundGroupSession{
+		Ratchet:     megolmRatchet{Data: make([]byte, megolmRatchetParts*megolmRatchetPartLength)},
+		SigningSeed: make([]byte, ed25519.SeedSize),
+		Created:     time.Now(),
+		SharedWith:  make(map[string]bool),
+	}
+	if _, err := io.ReadFull(rand.Reader, s.Ratchet.Data); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(rand.Reader, s.SigningSeed); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *outboundGroupSession) signingKey() ed25519.PrivateKey {
+	return ed25519.NewKeyFromSeed(s.SigningSeed)
+}
+
+// ID returns the session ID, its public signing key.
+func (s *outboundGroupSession) ID() string {
+	return b64.EncodeToString(s.signingKey().Public().(ed25519.PublicKey))
+}
+
+// sessionKey returns the key others need to decrypt the messages from the current index on.
+func (s *outboundGroupSession) sessionKey() string {
+	out := []byte{megolmSessionKeyVersion}
+	out = binary.BigEndian.AppendUint32(out, s.Ratchet.Counter)
+	out = append(out, s.Ratchet.Data...)
+	out = append(out, s.signingKey().Public().(ed25519.PublicKey)...)
+	out = append(out, ed25519.Sign(s.signingKey(), out)...)
+	return b64.EncodeToString(out)
+}
+
+// encrypt returns the Megolm message of the plaintext and moves to the next index.
+func (s *outboundGroupSession) encrypt(plaintext []byte) []byte {
+	aesKey, hmacKey, iv := messageKeys(s.Ratchet.Data, megolmKeysInfo)
+	out := []byte{olmVersion}
+	out = appendIntField(out, 1, uint64(s.Ratchet.Counter))
+	out = appendBytesField(out, 2, aesCBCEncrypt(aesKey, iv, plaintext))
+	out = append(out, hmacSHA256(hmacKey, out)[:olmMACLength]...)
+	out = append(out, ed25519.Sign(s.signingKey(), out)...)
+	s.Ratchet.advance()
+	return out
+}
+
+// inboundGroupSession decrypts the messages of a Megolm session of another device.
+type inboundGroupSession struct {
+	// Initial is the ratchet at the first index we can decrypt, Latest the one of the last message.
+	Initial    megolmRatchet `json:"initial"`
+	Latest     megolmRatchet `json:"latest"`
+	SigningKey []byte        `json:"signing_key"`
+	// SenderKey is the Curve25519 key of the device which sent us the session.
+	SenderKey string `json:"sender_key"`
+	RoomID    string `json:"room_id"`
+	// Indexes are the event IDs of the decrypted messages by index, to detect replays.
+	Indexes map[uint32]string `json:"indexes"`
+}
+
+func newInboundGroupSession(sessionKey string) (*inboundGroupSession, error) {
+	data, err := b64.DecodeString(sessionKey)
+	if err != nil {
+		return nil, err
+	}
+	ratchetLength := megolmRatchetParts * megolmRatchetPartLength
+	if len(data) != 1+4+ratchetLength+ed25519.PublicKeySize+megolmSignatureLength || data[0] != megolmSessionKeyVersion {
+		return nil, errBadSessionKeys
+	}
+	signed := data[:len(data)-megolmSignatureLength]
+	signingKey := ed25519.PublicKey(data[5+ratchetLength : 5+ratchetLength+ed25519.PublicKeySize])
+	if !ed25519.Verify(signingKey, signed, data[len(signed):]) {
+		return nil, errBadSignature
+	}
+	ratchet := megolmRatchet{
+		Data:    append([]byte{}, data[5:5+ratchetLength]...),
+		Counter: binary.BigEndian.Uint32(data[1:5]),
+	}
+	return &inboundGroupSession{
+		Initial:    ratchet,
+		Latest:     ratchet.copy(),
+		SigningKey: signingKey,
+		Indexes:    make(map[uint32]string),
+	}, nil
+}
+
+// ID returns the session ID, its public signing key.
+func (s *inboundGroupSession) ID() string {
+	return b64.EncodeToString(s.SigningKey)
+}
+
+// decrypt returns the plaintext and the index of a Megolm message.
+func (s *inboundGroupSession) decrypt(data []byte) ([]byte, uint32, error) {
+	if len(data) < 1+olmMACLength+megolmSignatureLength || data[0] != olmVersion {
+		return nil, 0, errBadMessage
+	}
+	signed := data[:len(data)-megolmSignatureLength]
+	if !ed25519.Verify(s.SigningKey, signed, data[len(signed):]) {
+		return nil, 0, errBadSignature
+	}
+	body := signed[:len(signed)-olmMACLength]
+	fields, err := decodeFields(body[1:])
+	if err != nil {
+		return nil, 0, err
+	}
+	index := uint32(fields[1].value)
+	ciphertext := fields[2].bytes
+
+	var ratchet megolmRatchet
+	switch {
+	case index < s.Initial.Counter:
+		return nil, 0, errUnknownIndex
+	case index >= s.Latest.Counter:
+		ratchet = s.Latest.copy()
+	default:
+		ratchet = s.Initial.copy()
+	}
+	ratchet.advanceTo(index)
+	aesKey, hmacKey, iv := messageKeys(ratchet.Data, megolmKeysInfo)
+	if subtle.ConstantTimeCompare(hmacSHA256(hmacKey, body)[:olmMACLength], signed[len(body):]) != 1 {
+		return nil, 0, errBadMAC
+	}
+	plaintext, err := aesCBCDecrypt(aesKey, iv, ciphertext)
+	if err != nil {
+		return nil, 0, err
+	}
+	if index >= s.Latest.Counter {
+		s.Latest = ratchet
+	}
+	return plaintext, index, nil
+}
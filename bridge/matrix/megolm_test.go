@@ -0,0 +1,155 @@
+package bmatrix
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMegolmRatchet(t *testing.T) {
+	session, err := newOutboundGroupSession()
+	require.NoError(t, err)
+
+	for _, index := range []uint32{1, 255, 256, 257, 0x10000 + 3} {
+		stepped := session.Ratchet.copy()
+		for stepped.Counter < index {
+			stepped.advance()
+		}
+		jumped := session.Ratchet.copy()
+		jumped.advanceTo(index)
+		assert.Equal(t, stepped, jumped, "index %d", index)
+	}
+}
+
+func TestMegolmSession(t *testing.T) {
+	outbound, err := newOutboundGroupSession()
+	require.NoError(t, err)
+	first := outbound.encrypt([]byte("before the key"))
+
+	inbound, err := newInboundGroupSession(outbound.sessionKey())
+	require.NoError(t, err)
+	assert.Equal(t, outbound.ID(), inbound.ID())
+
+	var messages [][]byte
+	for _, text := range []string{"zero", "one", "two"} {
+		messages = append(messages, outbound.encrypt([]byte(text)))
+	}
+
+	// out of order, and again
+	for _, i := range []int{2, 0, 1, 2} {
+		plaintext, index, err := inbound.decrypt(messages[i])
+		require.NoError(t, err)
+		assert.Equal(t, uint32(i+1), index)
+		assert.Equal(t, []string{"zero", "one", "two"}[i], string(plaintext))
+	}
+
+	// the session was shared after the first message
+	_, _, err = inbound.decrypt(first)
+	assert.ErrorIs(t, err, errUnknownIndex)
+
+	tampered := append([]byte{}, messages[0]...)
+	tampered[5] ^= 1
+	_, _, err = inbound.decrypt(tampered)
+	assert.ErrorIs(t, err, errBadSignature)
+}
+
+func TestMegolmSessionKey(t *testing.T) {
+	outbound, err := newOutboundGroupSession()
+	require.NoError(t, err)
+	key := []byte(outbound.sessionKey())
+	key[10] ^= 1
+	_, err = newInboundGroupSession(string(key))
+	assert.Error(t, err)
+}
+
+// megolmStartData is the initial ratchet of the libolm tests.
+func megolmStartData() []byte {
+	return bytes.Repeat([]byte("0123456789ABCDEF0123456789ABCDEF"), megolmRatchetParts)
+}
+
+// The ratchets after advancing from the libolm tests, see tests/test_megolm.cpp in libolm.
+func TestMegolmRatchetVectors(t *testing.T) {
+	start := megolmStartData()
+	ratchet := megolmRatchet{Data: append([]byte{}, start...)}
+	ratchet.advance()
+	expected := append(append([]byte{}, start[:96]...),
+		0xba, 0x9c, 0xd9, 0x55, 0x74, 0x1d, 0x1c, 0x16, 0x23, 0x23, 0xec, 0x82, 0x5e, 0x7c, 0x5c, 0xe8,
+		0x89, 0xbb, 0xb4, 0x23, 0xa1, 0x8f, 0x23, 0x82, 0x8f, 0xb2, 0x09, 0x0d, 0x6e, 0x2a, 0xf8, 0x6a)
+	assert.Equal(t, expected, ratchet.Data)
+
+	ratchet = megolmRatchet{Data: append([]byte{}, start...)}
+	ratchet.advanceTo(0x1000000)
+	assert.Equal(t, []byte{
+		0x54, 0x02, 0x2d, 0x7d, 0xc0, 0x29, 0x8e, 0x16, 0x37, 0xe2, 0x1c, 0x97, 0x15, 0x30, 0x92, 0xf9,
+		0x33, 0xc0, 0x56, 0xff, 0x74, 0xfe, 0x1b, 0x92, 0x2d, 0x97, 0x1f, 0x24, 0x82, 0xc2, 0x85, 0x9c,
+		0x70, 0x04, 0xc0, 0x1e, 0xe4, 0x9b, 0xd6, 0xef, 0xe0, 0x07, 0x35, 0x25, 0xaf, 0x9b, 0x16, 0x32,
+		0xc5, 0xbe, 0x72, 0x6d, 0x12, 0x34, 0x9c, 0xc5, 0xbd, 0x47, 0x2b, 0xdc, 0x2d, 0xf6, 0x54, 0x0f,
+		0x31, 0x12, 0x59, 0x11, 0x94, 0xfd, 0xa6, 0x17, 0xe5, 0x68, 0xc6, 0x83, 0x10, 0x1e, 0xae, 0xcd,
+		0x7e, 0xdd, 0xd6, 0xde, 0x1f, 0xbc, 0x07, 0x67, 0xae, 0x34, 0xda, 0x1a, 0x09, 0xa5, 0x4e, 0xab,
+		0xba, 0x9c, 0xd9, 0x55, 0x74, 0x1d, 0x1c, 0x16, 0x23, 0x23, 0xec, 0x82, 0x5e, 0x7c, 0x5c, 0xe8,
+		0x89, 0xbb, 0xb4, 0x23, 0xa1, 0x8f, 0x23, 0x82, 0x8f, 0xb2, 0x09, 0x0d, 0x6e, 0x2a, 0xf8, 0x6a,
+	}, ratchet.Data)
+
+	ratchet.advanceTo(0x1041506)
+	assert.Equal(t, []byte{
+		0x54, 0x02, 0x2d, 0x7d, 0xc0, 0x29, 0x8e, 0x16, 0x37, 0xe2, 0x1c, 0x97, 0x15, 0x30, 0x92, 0xf9,
+		0x33, 0xc0, 0x56, 0xff, 0x74, 0xfe, 0x1b, 0x92, 0x2d, 0x97, 0x1f, 0x24, 0x82, 0xc2, 0x85, 0x9c,
+		0x55, 0x58, 0x8d, 0xf5, 0xb7, 0xa4, 0x88, 0x78, 0x42, 0x89, 0x27, 0x86, 0x81, 0x64, 0x58, 0x9f,
+		0x36, 0x63, 0x44, 0x7b, 0x51, 0xed, 0xc3, 0x59, 0x5b, 0x03, 0x6c, 0xa6, 0x04, 0xc4, 0x6d, 0xcd,
+		0x5c, 0x54, 0x85, 0x0b, 0xfa, 0x98, 0xa1, 0xfd, 0x79, 0xa9, 0xdf, 0x1c, 0xbe, 0x8f, 0xc5, 0x68,
+		0x19, 0x37, 0xd3, 0x0c, 0x85, 0xc8, 0xc3, 0x1f, 0x7b, 0xb8, 0x28, 0x81, 0x6c, 0xf9, 0xff, 0x3b,
+		0x95, 0x6c, 0xbf, 0x80, 0x7e, 0x65, 0x12, 0x6a, 0x49, 0x55, 0x8d, 0x45, 0xc8, 0x4a, 0x2e, 0x4c,
+		0xd5, 0x6f, 0x03, 0xe2, 0x44, 0x16, 0xb9, 0x8e, 0x1c, 0xfd, 0x97, 0xc2, 0x06, 0xaa, 0x90, 0x7a,
+	}, ratchet.Data)
+}
+
+func TestMegolmRatchetWraparound(t *testing.T) {
+	wrapped := megolmRatchet{Data: megolmStartData(), Counter: 0xffffffff}
+	wrapped.advanceTo(0x1000000)
+	assert.EqualValues(t, 0x1000000, wrapped.Counter)
+
+	ratchet := megolmRatchet{Data: megolmStartData()}
+	ratchet.advanceTo(0x2000000)
+	assert.Equal(t, ratchet.Data, wrapped.Data)
+
+	stepped := megolmRatchet{Data: megolmStartData(), Counter: 0xffffffff}
+	stepped.advance()
+	jumped := megolmRatchet{Data: megolmStartData(), Counter: 0xffffffff}
+	jumped.advanceTo(0)
+	assert.Equal(t, stepped, jumped)
+}
+
+// The session key and messages of this vector are made by goolm (maunium.net/go/mautrix v0.24.0),
+// the Go port of libolm, with the same ratchet and signing key.
+func TestMegolmVectors(t *testing.T) {
+	session := &outboundGroupSession{
+		Ratchet:     megolmRatchet{Data: make([]byte, megolmRatchetParts*megolmRatchetPartLength)},
+		SigningSeed: bytes.Repeat([]byte{7}, 32),
+	}
+	for i := range session.Ratchet.Data {
+		session.Ratchet.Data[i] = byte(i)
+	}
+	sessionKey := "AgAAAAAAAQIDBAUGBwgJCgsMDQ4PEBESExQVFhcYGRobHB0eHyAhIiMkJSYnKCkqKywtLi8wMTIzNDU2Nzg5Ojs8PT4/QEFCQ0RFRkdISUpLTE1OT1BRUlNUVVZXWFlaW1xdXl9gYWJjZGVmZ2hpamtsbW5vcHFyc3R1dnd4eXp7fH1+f+pKbGPinFIKvvVQexMuxfmVR3auvr57kkIe6mkURtIsFUvUXeRITgNgUXW0rYiz4xQPjaLZXYiUR9v+wXwWJZ8jHjI4g+Bs1fWwedkiXf+JMIbec5H2/HZKx2rFpCX3Bg"
+	assert.Equal(t, sessionKey, session.sessionKey())
+	assert.Equal(t, "6kpsY+KcUgq+9VB7Ey7F+ZVHdq6+vnuSQh7qaRRG0iw", session.ID())
+
+	inbound, err := newInboundGroupSession(sessionKey)
+	require.NoError(t, err)
+	messages := map[string]string{
+		"zero": "AwgAEhCGGHMB2v0xw48ZR8lvcI4MncsFRS2v0QanLyijkAcqML2He++LxW+Rr89oWnwzxiAuO2rJiXru2o/l3RsJ0iri/SNDy5+keeDgLIqPIV59tl3sPshmIgcD",
+		"one":  "AwgBEhA91O5txOD0C0+FVLRT46oon59Afn4XwLLZPwxRn1jhZYjCZTFwqDzCoFHICf7+YnLOLIJK7v340m52W3o7UXPBj7pmVxa0KssegEG2sikWWum4wQeaTscN",
+		"two":  "AwgCEhB3rGCdhLNubbnPx7bhb3CiIWX0KWW9OKB/QN7dENZ58biGCO9T76moOYMhtx5Dtyo/+XYDSplKCrnCDQTEh846qQhUbbOkeaq+oBgebz4B+kQ+22XPBPwM",
+	}
+	for i, text := range []string{"zero", "one", "two"} {
+		expected, err := b64.DecodeString(messages[text])
+		require.NoError(t, err)
+		assert.Equal(t, expected, session.encrypt([]byte(text)), text)
+
+		plaintext, index, err := inbound.decrypt(expected)
+		require.NoError(t, err)
+		assert.Equal(t, uint32(i), index)
+		assert.Equal(t, text, string(plaintext))
+	}
+}
@@ -0,0 +1,569 @@
+package bmatrix
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// This file implements the Olm double ratchet used to exchange the room keys between devices,
+// see https://gitlab.matrix.org/matrix-org/olm/-/blob/master/docs/olm.md
+
+const (
+	olmVersion   = 3
+	olmMACLength = 8
+	// olmMaxReceiverChains and olmMaxSkippedKeys are the limits libolm uses.
+	olmMaxReceiverChains = 5
+	olmMaxSkippedKeys    = 40
+	olmMaxMessageGap     = 2000
+
+	olmPreKeyMessage = 0
+	olmMessage       = 1
+)
+
+var (
+	olmRootInfo    = []byte("OLM_ROOT")
+	olmRatchetInfo = []byte("OLM_RATCHET")
+	olmKeysInfo    = []byte("OLM_KEYS")
+
+	errBadMAC        = errors.New("bad message MAC")
+	errBadMessage    = errors.New("invalid message")
+	errUnknownOTK    = errors.New("unknown one-time key")
+	errMessageReused = errors.New("message key already used")
+)
+
+// b64 encodes like Matrix does, unpadded standard base64.
+var b64 = base64.RawStdEncoding
+
+// curveKeyPair is a Curve25519 key pair, only the public key is known for the keys of others.
+type curveKeyPair struct {
+	Private []byte `json:"private,omitempty"`
+	Public  []byte `json:"public"`
+}
+
+func newCurveKeyPair() (curveKeyPair, error) {
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return curveKeyPair{}, err
+	}
+	return curveKeyPair{Private: key.Bytes(), Public: key.PublicKey().Bytes()}, nil
+}
+
+func (k curveKeyPair) sharedSecret(public []byte) ([]byte, error) {
+	private, err := ecdh.X25519().NewPrivateKey(k.Private)
+	if err != nil {
+		return nil, err
+	}
+	remote, err := ecdh.X25519().NewPublicKey(public)
+	if err != nil {
+		return nil, err
+	}
+	return private.ECDH(remote)
+}
+
+// olmAccount holds the identity keys and the one-time keys of our device.
+type olmAccount struct {
+	Curve25519  curveKeyPair     `json:"curve25519"`
+	Ed25519Seed []byte           `json:"ed25519_seed"`
+	OneTimeKeys []*olmOneTimeKey `json:"one_time_keys"`
+	NextKeyID   uint32           `json:"next_key_id"`
+}
+
+type olmOneTimeKey struct {
+	ID        string       `json:"id"`
+	Key       curveKeyPair `json:"key"`
+	Published bool         `json:"published"`
+}
+
+func newOlmAccount() (*olmAccount, error) {
+	curve, err := newCurveKeyPair()
+	if err != nil {
+		return nil, err
+	}
+	seed := make([]byte, ed25519.SeedSize)
+	if _, err := io.ReadFull(rand.Reader, seed); err != nil {
+		return nil, err
+	}
+	return &olmAccount{Curve25519: curve, Ed25519Seed: seed}, nil
+}
+
+func (a *olmAccount) signingKey() ed25519.PrivateKey {
+	return ed25519.NewKeyFromSeed(a.Ed25519Seed)
+}
+
+// identityKey and fingerprintKey return the public Curve25519 and Ed25519 keys of the device.
+func (a *olmAccount) identityKey() string {
+	return b64.EncodeToString(a.Curve25519.Public)
+}
+
+func (a *olmAccount) fingerprintKey() string {
+	return b64.EncodeToString(a.signingKey().Public().(ed25519.PublicKey))
+}
+
+func (a *olmAccount) sign(message []byte) string {
+	return b64.EncodeToString(ed25519.Sign(a.signingKey(), message))
+}
+
+// generateOneTimeKeys adds count unpublished one-time keys.
+func (a *olmAccount) generateOneTimeKeys(count int) error {
+	for i := 0; i < count; i++ {
+		key, err := newCurveKeyPair()
+		if err != nil {
+			return err
+		}
+		a.NextKeyID++
+		id := make([]byte, 4)
+		binary.BigEndian.PutUint32(id, a.NextKeyID)
+		a.OneTimeKeys = append(a.OneTimeKeys, &olmOneTimeKey{ID: b64.EncodeToString(id), Key: key})
+	}
+	return nil
+}
+
+// removeOneTimeKey removes the one-time key used by a new session, it can't be used again.
+func (a *olmAccount) removeOneTimeKey(public []byte) *olmOneTimeKey {
+	for i, key := range a.OneTimeKeys {
+		if bytes.Equal(key.Key.Public, public) {
+			a.OneTimeKeys = append(a.OneTimeKeys[:i], a.OneTimeKeys[i+1:]...)
+			return key
+		}
+	}
+	return nil
+}
+
+// olmChain is a sending or receiving chain of the ratchet.
+type olmChain struct {
+	RatchetKey curveKeyPair `json:"ratchet_key"`
+	ChainKey   []byte       `json:"chain_key"`
+	Index      uint32       `json:"index"`
+}
+
+// next returns the message key of the chain and moves to the next one.
+func (c *olmChain) next() []byte {
+	messageKey := hmacSHA256(c.ChainKey, []byte{0x01})
+	c.ChainKey = hmacSHA256(c.ChainKey, []byte{0x02})
+	c.Index++
+	return messageKey
+}
+
+// olmSkippedKey is the message key of a message we didn't receive yet.
+type olmSkippedKey struct {
+	RatchetKey []byte `json:"ratchet_key"`
+	Index      uint32 `json:"index"`
+	MessageKey []byte `json:"message_key"`
+}
+
+// olmSession is an Olm session with a device of another user.
+type olmSession struct {
+	// the keys of the pre-key messages, used to find the session of incoming pre-key messages.
+	AliceIdentityKey []byte `json:"alice_identity_key"`
+	AliceBaseKey     []byte `json:"alice_base_key"`
+	BobOneTimeKey    []byte `json:"bob_one_time_key"`
+
+	RootKey        []byte          `json:"root_key"`
+	SenderChain    *olmChain       `json:"sender_chain,omitempty"`
+	ReceiverChains []olmChain      `json:"receiver_chains"`
+	SkippedKeys    []olmSkippedKey `json:"skipped_keys"`
+	// ReceivedMessage is false until the other device answers, we send pre-key messages until then.
+	ReceivedMessage bool `json:"received_message"`
+}
+
+// newOutboundOlmSession starts a session with the identity key and a one-time key of another device.
+func newOutboundOlmSession(account *olmAccount, theirIdentityKey, theirOneTimeKey []byte) (*olmSession, error) {
+	baseKey, err := newCurveKeyPair()
+	if err != nil {
+		return nil, err
+	}
+	ratchetKey, err := newCurveKeyPair()
+	if err != nil {
+		return nil, err
+	}
+	return startOlmSession(account, baseKey, ratchetKey, theirIdentityKey, theirOneTimeKey)
+}
+
+// startOlmSession starts a session with our base key and first ratchet key.
+func startOlmSession(account *olmAccount, baseKey, ratchetKey curveKeyPair, theirIdentityKey, theirOneTimeKey []byte) (*olmSession, error) {
+	secret, err := tripleDH(
+		[2]curveKeyPair{account.Curve25519, baseKey}, baseKey,
+		[2][]byte{theirOneTimeKey, theirIdentityKey}, theirOneTimeKey)
+	if err != nil {
+		return nil, err
+	}
+	rootKey, chainKey := kdf(nil, secret, olmRootInfo)
+	return &olmSession{
+		AliceIdentityKey: account.Curve25519.Public,
+		AliceBaseKey:     baseKey.Public,
+		BobOneTimeKey:    theirOneTimeKey,
+		RootKey:          rootKey,
+		SenderChain:      &olmChain{RatchetKey: ratchetKey, ChainKey: chainKey},
+	}, nil
+}
+
+// newInboundOlmSession creates the session of a pre-key message, the caller removes the
+// one-time key once the message is decrypted.
+func newInboundOlmSession(account *olmAccount, msg *olmPreKey) (*olmSession, error) {
+	var oneTimeKey *olmOneTimeKey
+	for _, key := range account.OneTimeKeys {
+		if bytes.Equal(key.Key.Public, msg.OneTimeKey) {
+			oneTimeKey = key
+		}
+	}
+	if oneTimeKey == nil {
+		return nil, errUnknownOTK
+	}
+	inner, _, err := decodeOlmMessage(msg.Message)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := tripleDH(
+		[2]curveKeyPair{oneTimeKey.Key, account.Curve25519}, oneTimeKey.Key,
+		[2][]byte{msg.IdentityKey, msg.BaseKey}, msg.BaseKey)
+	if err != nil {
+		return nil, err
+	}
+	rootKey, chainKey := kdf(nil, secret, olmRootInfo)
+	return &olmSession{
+		AliceIdentityKey: msg.IdentityKey,
+		AliceBaseKey:     msg.BaseKey,
+		BobOneTimeKey:    msg.OneTimeKey,
+		RootKey:          rootKey,
+		ReceiverChains:   []olmChain{{RatchetKey: curveKeyPair{Public: inner.RatchetKey}, ChainKey: chainKey}},
+	}, nil
+}
+
+// tripleDH concatenates the three shared secrets of the session setup.
+func tripleDH(ours [2]curveKeyPair, third curveKeyPair, theirs [2][]byte, thirdTheirs []byte) ([]byte, error) {
+	var secret []byte
+	for i := range ours {
+		s, err := ours[i].sharedSecret(theirs[i])
+		if err != nil {
+			return nil, err
+		}
+		secret = append(secret, s...)
+	}
+	s, err := third.sharedSecret(thirdTheirs)
+	if err != nil {
+		return nil, err
+	}
+	return append(secret, s...), nil
+}
+
+// matches returns true if the pre-key message belongs to this session.
+func (s *olmSession) matches(msg *olmPreKey) bool {
+	return bytes.Equal(s.AliceIdentityKey, msg.IdentityKey) &&
+		bytes.Equal(s.AliceBaseKey, msg.BaseKey) &&
+		bytes.Equal(s.BobOneTimeKey, msg.OneTimeKey)
+}
+
+// encrypt returns the type and the body of the Olm message.
+func (s *olmSession) encrypt(plaintext []byte) (int, []byte, error) {
+	if s.SenderChain == nil {
+		// the other device answered, start a new chain with a new ratchet key
+		ratchetKey, err := newCurveKeyPair()
+		if err != nil {
+			return 0, nil, err
+		}
+		secret, err := ratchetKey.sharedSecret(s.ReceiverChains[0].RatchetKey.Public)
+		if err != nil {
+			return 0, nil, err
+		}
+		rootKey, chainKey := kdf(s.RootKey, secret, olmRatchetInfo)
+		s.RootKey = rootKey
+		s.SenderChain = &olmChain{RatchetKey: ratchetKey, ChainKey: chainKey}
+	}
+
+	index := s.SenderChain.Index
+	aesKey, hmacKey, iv := messageKeys(s.SenderChain.next(), olmKeysInfo)
+	msg := encodeOlmMessage(&olmMsg{
+		RatchetKey: s.SenderChain.RatchetKey.Public,
+		ChainIndex: index,
+		Ciphertext: aesCBCEncrypt(aesKey, iv, plaintext),
+	})
+	msg = append(msg, hmacSHA256(hmacKey, msg)[:olmMACLength]...)
+
+	if s.ReceivedMessage {
+		return olmMessage, msg, nil
+	}
+	return olmPreKeyMessage, encodeOlmPreKey(&olmPreKey{
+		OneTimeKey:  s.BobOneTimeKey,
+		BaseKey:     s.AliceBaseKey,
+		IdentityKey: s.AliceIdentityKey,
+		Message:     msg,
+	}), nil
+}
+
+// decrypt decrypts an Olm message, the session is only updated if the message is valid.
+func (s *olmSession) decrypt(data []byte) ([]byte, error) {
+	msg, mac, err := decodeOlmMessage(data)
+	if err != nil {
+		return nil, err
+	}
+	signed := data[:len(data)-olmMACLength]
+
+	chainIdx := -1
+	for i := range s.ReceiverChains {
+		if bytes.Equal(s.ReceiverChains[i].RatchetKey.Public, msg.RatchetKey) {
+			chainIdx = i
+			break
+		}
+	}
+
+	if chainIdx < 0 {
+		// the other device started a new chain
+		if s.SenderChain == nil {
+			return nil, errBadMessage
+		}
+		secret, err := s.SenderChain.RatchetKey.sharedSecret(msg.RatchetKey)
+		if err != nil {
+			return nil, err
+		}
+		rootKey, chainKey := kdf(s.RootKey, secret, olmRatchetInfo)
+		chain := olmChain{RatchetKey: curveKeyPair{Public: msg.RatchetKey}, ChainKey: chainKey}
+		plaintext, skipped, err := decryptWithChain(&chain, msg, signed, mac)
+		if err != nil {
+			return nil, err
+		}
+		s.RootKey = rootKey
+		s.ReceiverChains = append([]olmChain{chain}, s.ReceiverChains...)
+		if len(s.ReceiverChains) > olmMaxReceiverChains {
+			s.ReceiverChains = s.ReceiverChains[:olmMaxReceiverChains]
+		}
+		s.SenderChain = nil
+		s.addSkippedKeys(skipped)
+		s.ReceivedMessage = true
+		return plaintext, nil
+	}
+
+	chain := s.ReceiverChains[chainIdx]
+	if msg.ChainIndex < chain.Index {
+		// a message we skipped before
+		for i, key := range s.SkippedKeys {
+			if key.Index != msg.ChainIndex || !bytes.Equal(key.RatchetKey, msg.RatchetKey) {
+				continue
+			}
+			plaintext, err := decryptOlmMsg(key.MessageKey, msg, signed, mac)
+			if err != nil {
+				return nil, err
+			}
+			s.SkippedKeys = append(s.SkippedKeys[:i], s.SkippedKeys[i+1:]...)
+			s.ReceivedMessage = true
+			return plaintext, nil
+		}
+		return nil, errMessageReused
+	}
+	plaintext, skipped, err := decryptWithChain(&chain, msg, signed, mac)
+	if err != nil {
+		return nil, err
+	}
+	s.ReceiverChains[chainIdx] = chain
+	s.addSkippedKeys(skipped)
+	s.ReceivedMessage = true
+	return plaintext, nil
+}
+
+// decryptWithChain advances the chain to the index of the message and decrypts it, returning
+// the message keys of the messages it skipped.
+func decryptWithChain(chain *olmChain, msg *olmMsg, signed, mac []byte) ([]byte, []olmSkippedKey, error) {
+	if msg.ChainIndex-chain.Index > olmMaxMessageGap {
+		return nil, nil, fmt.Errorf("%w: too many skipped messages", errBadMessage)
+	}
+	var skipped []olmSkippedKey
+	for chain.Index < msg.ChainIndex {
+		index := chain.Index
+		skipped = append(skipped, olmSkippedKey{RatchetKey: msg.RatchetKey, Index: index, MessageKey: chain.next()})
+	}
+	plaintext, err := decryptOlmMsg(chain.next(), msg, signed, mac)
+	if err != nil {
+		return nil, nil, err
+	}
+	return plaintext, skipped, nil
+}
+
+func decryptOlmMsg(messageKey []byte, msg *olmMsg, signed, mac []byte) ([]byte, error) {
+	aesKey, hmacKey, iv := messageKeys(messageKey, olmKeysInfo)
+	if subtle.ConstantTimeCompare(hmacSHA256(hmacKey, signed)[:olmMACLength], mac) != 1 {
+		return nil, errBadMAC
+	}
+	return aesCBCDecrypt(aesKey, iv, msg.Ciphertext)
+}
+
+func (s *olmSession) addSkippedKeys(keys []olmSkippedKey) {
+	s.SkippedKeys = append(s.SkippedKeys, keys...)
+	if len(s.SkippedKeys) > olmMaxSkippedKeys {
+		s.SkippedKeys = s.SkippedKeys[len(s.SkippedKeys)-olmMaxSkippedKeys:]
+	}
+}
+
+// olmMsg is a normal Olm message, olmPreKey the message starting a session.
+type olmMsg struct {
+	RatchetKey []byte
+	ChainIndex uint32
+	Ciphertext []byte
+}
+
+type olmPreKey struct {
+	OneTimeKey  []byte
+	BaseKey     []byte
+	IdentityKey []byte
+	Message     []byte
+}
+
+func encodeOlmMessage(msg *olmMsg) []byte {
+	out := []byte{olmVersion}
+	out = appendBytesField(out, 1, msg.RatchetKey)
+	out = appendIntField(out, 2, uint64(msg.ChainIndex))
+	return appendBytesField(out, 4, msg.Ciphertext)
+}
+
+// decodeOlmMessage returns the message and its MAC.
+func decodeOlmMessage(data []byte) (*olmMsg, []byte, error) {
+	if len(data) < 1+olmMACLength || data[0] != olmVersion {
+		return nil, nil, errBadMessage
+	}
+	fields, err := decodeFields(data[1 : len(data)-olmMACLength])
+	if err != nil {
+		return nil, nil, err
+	}
+	msg := &olmMsg{
+		RatchetKey: fields[1].bytes,
+		ChainIndex: uint32(fields[2].value),
+		Ciphertext: fields[4].bytes,
+	}
+	if len(msg.RatchetKey) != 32 || msg.Ciphertext == nil {
+		return nil, nil, errBadMessage
+	}
+	return msg, data[len(data)-olmMACLength:], nil
+}
+
+func encodeOlmPreKey(msg *olmPreKey) []byte {
+	out := []byte{olmVersion}
+	out = appendBytesField(out, 1, msg.OneTimeKey)
+	out = appendBytesField(out, 2, msg.BaseKey)
+	out = appendBytesField(out, 3, msg.IdentityKey)
+	return appendBytesField(out, 4, msg.Message)
+}
+
+func decodeOlmPreKey(data []byte) (*olmPreKey, error) {
+	if len(data) < 1 || data[0] != olmVersion {
+		return nil, errBadMessage
+	}
+	fields, err := decodeFields(data[1:])
+	if err != nil {
+		return nil, err
+	}
+	msg := &olmPreKey{
+		OneTimeKey:  fields[1].bytes,
+		BaseKey:     fields[2].bytes,
+		IdentityKey: fields[3].bytes,
+		Message:     fields[4].bytes,
+	}
+	if len(msg.OneTimeKey) != 32 || len(msg.BaseKey) != 32 || len(msg.IdentityKey) != 32 || msg.Message == nil {
+		return nil, errBadMessage
+	}
+	return msg, nil
+}
+
+// field is a field of the protobuf-like encoding of the Olm and Megolm messages.
+type field struct {
+	value uint64
+	bytes []byte
+}
+
+func appendIntField(out []byte, tag byte, value uint64) []byte {
+	out = append(out, tag<<3)
+	return binary.AppendUvarint(out, value)
+}
+
+func appendBytesField(out []byte, tag byte, value []byte) []byte {
+	out = append(out, tag<<3|2)
+	out = binary.AppendUvarint(out, uint64(len(value)))
+	return append(out, value...)
+}
+
+func decodeFields(data []byte) (map[byte]field, error) {
+	fields := make(map[byte]field)
+	for len(data) > 0 {
+		tag := data[0]
+		data = data[1:]
+		value, n := binary.Uvarint(data)
+		if n <= 0 {
+			return nil, errBadMessage
+		}
+		data = data[n:]
+		switch tag & 7 {
+		case 0:
+			fields[tag>>3] = field{value: value}
+		case 2:
+			if value > uint64(len(data)) {
+				return nil, errBadMessage
+			}
+			fields[tag>>3] = field{bytes: data[:value]}
+			data = data[value:]
+		default:
+			return nil, errBadMessage
+		}
+	}
+	return fields, nil
+}
+
+// kdf derives the root key and the chain key of a new chain.
+func kdf(salt, secret, info []byte) ([]byte, []byte) {
+	out := make([]byte, 64)
+	_, _ = io.ReadFull(hkdf.New(sha256.New, secret, salt, info), out)
+	return out[:32], out[32:]
+}
+
+// messageKeys derives the AES key, HMAC key and IV of a message key.
+func messageKeys(messageKey, info []byte) ([]byte, []byte, []byte) {
+	out := make([]byte, 80)
+	_, _ = io.ReadFull(hkdf.New(sha256.New, messageKey, nil, info), out)
+	return out[:32], out[32:64], out[64:]
+}
+
+func hmacSHA256(key, data []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+func aesCBCEncrypt(key, iv, plaintext []byte) []byte {
+	block, _ := aes.NewCipher(key)
+	padding := aes.BlockSize - len(plaintext)%aes.BlockSize
+	data := append(append([]byte{}, plaintext...), bytes.Repeat([]byte{byte(padding)}, padding)...)
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(data, data)
+	return data
+}
+
+func aesCBCDecrypt(key, iv, ciphertext []byte) ([]byte, error) {
+	if len(ciphertext) == 0 || len(ciphertext)%aes.BlockSize != 0 {
+		return nil, errBadMessage
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, len(ciphertext))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(data, ciphertext)
+	padding := int(data[len(data)-1])
+	if padding == 0 || padding > aes.BlockSize {
+		return nil, errBadMessage
+	}
+	for _, b := range data[len(data)-padding:] {
+		if int(b) != padding {
+			return nil, errBadMessage
+		}
+	}
+	return data[:len(data)-padding], nil
+}
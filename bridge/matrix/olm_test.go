@@ -0,0 +1,202 @@
+package bmatrix
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newOlmPair returns the sessions of alice, who starts the session, and bob after the first message.
+func newOlmPair(t *testing.T) (*olmSession, *olmSession) {
+	alice, err := newOlmAccount()
+	require.NoError(t, err)
+	bob, err := newOlmAccount()
+	require.NoError(t, err)
+	require.NoError(t, bob.generateOneTimeKeys(1))
+
+	aliceSession, err := newOutboundOlmSession(alice, bob.Curve25519.Public, bob.OneTimeKeys[0].Key.Public)
+	require.NoError(t, err)
+	msgType, body, err := aliceSession.encrypt([]byte("hello bob"))
+	require.NoError(t, err)
+	require.Equal(t, olmPreKeyMessage, msgType)
+
+	preKey, err := decodeOlmPreKey(body)
+	require.NoError(t, err)
+	assert.Equal(t, alice.Curve25519.Public, preKey.IdentityKey)
+	bobSession, err := newInboundOlmSession(bob, preKey)
+	require.NoError(t, err)
+	plaintext, err := bobSession.decrypt(preKey.Message)
+	require.NoError(t, err)
+	assert.Equal(t, "hello bob", string(plaintext))
+	assert.True(t, bobSession.matches(preKey))
+	return aliceSession, bobSession
+}
+
+func TestOlmSession(t *testing.T) {
+	alice, bob := newOlmPair(t)
+
+	send := func(from, to *olmSession, text string) int {
+		msgType, body, err := from.encrypt([]byte(text))
+		require.NoError(t, err)
+		if msgType == olmPreKeyMessage {
+			preKey, err := decodeOlmPreKey(body)
+			require.NoError(t, err)
+			body = preKey.Message
+		}
+		plaintext, err := to.decrypt(body)
+		require.NoError(t, err)
+		assert.Equal(t, text, string(plaintext))
+		return msgType
+	}
+
+	// alice sends pre-key messages until bob answers
+	assert.Equal(t, olmPreKeyMessage, send(alice, bob, "second"))
+	assert.Equal(t, olmMessage, send(bob, alice, "hi alice"))
+	assert.Equal(t, olmMessage, send(alice, bob, "ratchet turned"))
+	for i := 0; i < 3; i++ {
+		send(bob, alice, "again")
+		send(alice, bob, "and again")
+	}
+}
+
+func TestOlmOutOfOrder(t *testing.T) {
+	alice, bob := newOlmPair(t)
+	_, reply, err := bob.encrypt([]byte("reply"))
+	require.NoError(t, err)
+	_, err = alice.decrypt(reply)
+	require.NoError(t, err)
+
+	var bodies [][]byte
+	for _, text := range []string{"one", "two", "three"} {
+		msgType, body, err := alice.encrypt([]byte(text))
+		require.NoError(t, err)
+		require.Equal(t, olmMessage, msgType)
+		bodies = append(bodies, body)
+	}
+
+	plaintext, err := bob.decrypt(bodies[2])
+	require.NoError(t, err)
+	assert.Equal(t, "three", string(plaintext))
+	plaintext, err = bob.decrypt(bodies[0])
+	require.NoError(t, err)
+	assert.Equal(t, "one", string(plaintext))
+	plaintext, err = bob.decrypt(bodies[1])
+	require.NoError(t, err)
+	assert.Equal(t, "two", string(plaintext))
+
+	// the keys of a message can't be used twice
+	_, err = bob.decrypt(bodies[1])
+	assert.ErrorIs(t, err, errMessageReused)
+}
+
+func TestOlmTampered(t *testing.T) {
+	alice, bob := newOlmPair(t)
+	_, reply, err := bob.encrypt([]byte("reply"))
+	require.NoError(t, err)
+	_, err = alice.decrypt(reply)
+	require.NoError(t, err)
+
+	_, body, err := alice.encrypt([]byte("secret"))
+	require.NoError(t, err)
+	tampered := append([]byte{}, body...)
+	tampered[len(tampered)-olmMACLength-1] ^= 1
+	_, err = bob.decrypt(tampered)
+	assert.Error(t, err)
+
+	// the session didn't change, the real message still decrypts
+	plaintext, err := bob.decrypt(body)
+	require.NoError(t, err)
+	assert.Equal(t, "secret", string(plaintext))
+}
+
+func TestOneTimeKeys(t *testing.T) {
+	account, err := newOlmAccount()
+	require.NoError(t, err)
+	require.NoError(t, account.generateOneTimeKeys(3))
+	require.Len(t, account.OneTimeKeys, 3)
+	assert.NotEqual(t, account.OneTimeKeys[0].ID, account.OneTimeKeys[1].ID)
+
+	used := account.OneTimeKeys[1]
+	assert.Equal(t, used, account.removeOneTimeKey(used.Key.Public))
+	assert.Len(t, account.OneTimeKeys, 2)
+	assert.Nil(t, account.removeOneTimeKey(used.Key.Public))
+}
+
+// fixedKeyPair returns the Curve25519 key pair with 32 times b as private key.
+func fixedKeyPair(t *testing.T, b byte) curveKeyPair {
+	private, err := ecdh.X25519().NewPrivateKey(bytes.Repeat([]byte{b}, 32))
+	require.NoError(t, err)
+	return curveKeyPair{Private: private.Bytes(), Public: private.PublicKey().Bytes()}
+}
+
+func decodeVector(t *testing.T, s string) []byte {
+	data, err := b64.DecodeString(s)
+	require.NoError(t, err)
+	return data
+}
+
+// The messages of these vectors are made by goolm (maunium.net/go/mautrix v0.24.0), the Go port of
+// libolm, with the same keys.
+func TestOlmVectors(t *testing.T) {
+	alice := &olmAccount{Curve25519: fixedKeyPair(t, 1)}
+	bob := &olmAccount{
+		Curve25519:  fixedKeyPair(t, 2),
+		OneTimeKeys: []*olmOneTimeKey{{ID: "AAAAAQ", Key: fixedKeyPair(t, 3)}},
+	}
+	first := decodeVector(t, "AwogXf7dO2vUf2+ijuFdlp1bsOpTd01Ii9r53xxuASSz7yIaIKTgkpK2UcJ4uXcsVp9fqbsT2Qa0araMnfncK0QJ+KIJEiCsAbIgnoY1T7hTI3td4PT6sTx/y/QzphwBk2lhf+zxCyI/AwogUKYUCbHd0DJemxa3AOcZ6XcsBwALG9d4bpB8ZT0gSV0QACIQQRvAFYT7rmEMm0myJ9IDhEsYhkqAndGN")
+	second := decodeVector(t, "AwogXf7dO2vUf2+ijuFdlp1bsOpTd01Ii9r53xxuASSz7yIaIKTgkpK2UcJ4uXcsVp9fqbsT2Qa0araMnfncK0QJ+KIJEiCsAbIgnoY1T7hTI3td4PT6sTx/y/QzphwBk2lhf+zxCyI/AwogUKYUCbHd0DJemxa3AOcZ6XcsBwALG9d4bpB8ZT0gSV0QASIQ+PQOH0QJs+d0zsGlYbIK5OIFWct9+53y")
+	reply := decodeVector(t, "Awog9bLW5g+Ud+MQwpgtqqbJE2wQihd3xZR+RI+jfWgXRVcQACIQIyvIJxyv6k2X5WOgb8jCzCP2GDxVYFpb")
+
+	// we encrypt exactly like goolm
+	aliceSession, err := startOlmSession(alice, fixedKeyPair(t, 4), fixedKeyPair(t, 5), bob.Curve25519.Public, bob.OneTimeKeys[0].Key.Public)
+	require.NoError(t, err)
+	for _, tc := range []struct {
+		text     string
+		expected []byte
+	}{{"hello bob", first}, {"second message", second}} {
+		text, expected := tc.text, tc.expected
+		msgType, body, err := aliceSession.encrypt([]byte(text))
+		require.NoError(t, err)
+		assert.Equal(t, olmPreKeyMessage, msgType)
+		// the order of the fields isn't the same, only their content
+		ours, err := decodeOlmPreKey(body)
+		require.NoError(t, err)
+		theirs, err := decodeOlmPreKey(expected)
+		require.NoError(t, err)
+		assert.Equal(t, theirs, ours, text)
+	}
+
+	// and decrypt what goolm sends
+	preKey, err := decodeOlmPreKey(first)
+	require.NoError(t, err)
+	bobSession, err := newInboundOlmSession(bob, preKey)
+	require.NoError(t, err)
+	plaintext, err := bobSession.decrypt(preKey.Message)
+	require.NoError(t, err)
+	assert.Equal(t, "hello bob", string(plaintext))
+
+	plaintext, err = aliceSession.decrypt(reply)
+	require.NoError(t, err)
+	assert.Equal(t, "hello alice", string(plaintext))
+}
+
+func TestAESCBCPadding(t *testing.T) {
+	key, iv := bytes.Repeat([]byte{1}, 32), bytes.Repeat([]byte{2}, 16)
+	ciphertext := aesCBCEncrypt(key, iv, []byte("hello"))
+	plaintext, err := aesCBCDecrypt(key, iv, ciphertext)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(plaintext))
+
+	// the last byte is valid padding, the ones before it aren't
+	data := append([]byte("hello world"), 1, 1, 1, 2, 3)
+	block, err := aes.NewCipher(key)
+	require.NoError(t, err)
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(data, data)
+	_, err = aesCBCDecrypt(key, iv, data)
+	assert.ErrorIs(t, err, errBadMessage)
+}
@@ -0,0 +1,220 @@
+package bmatrix
+
+import (
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/42wim/matterbridge/bridge/config"
+	matrix "github.com/matterbridge/gomatrix"
+)
+
+// puppet is the virtual user of a remote user, in the namespace of the application service.
+type puppet struct {
+	key  string
+	mxid string
+	// mc is a client of the application service acting as the virtual user.
+	mc          *matrix.Client
+	displayName string
+	avatarURL   string
+	// rooms are the rooms the virtual user joined.
+	rooms map[string]bool
+}
+
+// puppetFor returns the virtual user sending the message to the room, or nil if the bot needs to send it.
+func (b *Bmatrix) puppetFor(msg *config.Message, roomID string) *puppet {
+	if b.namespace == nil {
+		return nil
+	}
+	// edits and deletes need to come from the author of the message
+	if msg.ID != "" {
+		if p, ok := b.sentBy.Get(msg.ID); ok {
+			return p.(*puppet)
+		}
+		return nil
+	}
+	if msg.Event != "" && msg.Event != config.EventUserAction {
+		return nil
+	}
+	p := b.getPuppet(msg)
+	if p == nil {
+		return nil
+	}
+	if err := b.joinPuppet(p, roomID); err != nil {
+		b.Log.WithError(err).Warnf("%s can't join %s, sending the message with the bot", p.mxid, roomID)
+		return nil
+	}
+	return p
+}
+
+// getPuppet returns the virtual user of the remote user, registering it and updating its profile if needed.
+func (b *Bmatrix) getPuppet(msg *config.Message) *puppet {
+	displayName := strings.TrimSpace(newMatrixUsername(msg.Username).plain)
+	if displayName == "" {
+		return nil
+	}
+	userID := msg.UserID
+	if userID == "" {
+		userID = displayName
+	}
+	key := msg.Account + "/" + userID
+
+	b.puppetsMutex.Lock()
+	defer b.puppetsMutex.Unlock()
+	p, ok := b.puppets[key]
+	if !ok {
+		_, domain, _ := splitMXID(b.UserID)
+		localpart := b.puppetPrefix() + puppetLocalpart(displayName, msg.Protocol)
+		mxid := "@" + localpart + ":" + domain
+		for i := 2; b.puppetMXIDs[mxid] != nil; i++ {
+			mxid = "@" + localpart + strconv.Itoa(i) + ":" + domain
+		}
+		if err := b.registerUser(mxid); err != nil {
+			b.Log.WithError(err).Errorf("Registering %s failed, sending the message with the bot", mxid)
+			return nil
+		}
+		mc, err := matrix.NewClient(b.GetString("Server"), mxid, b.asToken)
+		if err != nil {
+			return nil
+		}
+		mc.AppServiceUserID = mxid
+		p = &puppet{key: key, mxid: mxid, mc: mc, rooms: make(map[string]bool)}
+		b.puppets[key] = p
+		b.puppetMXIDs[mxid] = p
+		b.Log.Debugf("Registered %s for %s", mxid, key)
+	}
+
+	if displayName != p.displayName {
+		if err := p.mc.SetDisplayName(displayName); err != nil {
+			b.Log.WithError(err).Warnf("Setting the display name of %s failed", p.mxid)
+		} else {
+			p.displayName = displayName
+		}
+	}
+	if msg.Avatar != p.avatarURL {
+		p.avatarURL = msg.Avatar
+		go b.updatePuppetAvatar(p, msg.Avatar)
+	}
+	return p
+}
+
+// updatePuppetAvatar uploads the avatar of the remote user and sets it on the virtual user.
+func (b *Bmatrix) updatePuppetAvatar(p *puppet, url string) {
+	contentURI := ""
+	if url != "" {
+		res, err := b.mc.UploadLink(url)
+		if err != nil {
+			b.Log.WithError(err).Debugf("Uploading the avatar of %s failed", p.mxid)
+			return
+		}
+		contentURI = res.ContentURI
+	}
+	if err := p.mc.SetAvatarURL(contentURI); err != nil {
+		b.Log.WithError(err).Debugf("Setting the avatar of %s failed", p.mxid)
+	}
+}
+
+// joinPuppet makes the virtual user join the room if it didn't yet, the bot invites it to
+// rooms it can't join by itself.
+func (b *Bmatrix) joinPuppet(p *puppet, roomID string) error {
+	b.puppetsMutex.Lock()
+	joined := p.rooms[roomID]
+	b.puppetsMutex.Unlock()
+	if joined {
+		return nil
+	}
+
+	_, err := p.mc.JoinRoom(roomID, "", nil)
+	if err != nil && handleError(err).Errcode == "M_FORBIDDEN" {
+		b.Log.Debugf("Inviting %s to %s", p.mxid, roomID)
+		if _, err = b.mc.InviteUser(roomID, &matrix.ReqInviteUser{UserID: p.mxid}); err != nil {
+			return err
+		}
+		_, err = p.mc.JoinRoom(roomID, "", nil)
+	}
+	if err != nil {
+		return err
+	}
+
+	b.puppetsMutex.Lock()
+	p.rooms[roomID] = true
+	b.puppetsMutex.Unlock()
+	b.Log.Debugf("%s joined %s", p.mxid, roomID)
+	return nil
+}
+
+// handlePuppetMembership accepts the invites of the virtual users to our rooms and forgets
+// the rooms they were removed from, they join again on their next message.
+func (b *Bmatrix) handlePuppetMembership(ev *matrix.Event) {
+	if ev.StateKey == nil {
+		return
+	}
+	b.puppetsMutex.Lock()
+	defer b.puppetsMutex.Unlock()
+	p, ok := b.puppetMXIDs[*ev.StateKey]
+	if !ok {
+		return
+	}
+
+	switch ev.Content["membership"] {
+	case "invite":
+		b.RLock()
+		_, bridged := b.RoomMap[ev.RoomID]
+		b.RUnlock()
+		if bridged && !p.rooms[ev.RoomID] {
+			go func() {
+				if err := b.joinPuppet(p, ev.RoomID); err != nil {
+					b.Log.WithError(err).Warnf("%s can't accept the invite to %s", p.mxid, ev.RoomID)
+				}
+			}()
+		}
+	case "join":
+		p.rooms[ev.RoomID] = true
+	case "leave", "ban":
+		delete(p.rooms, ev.RoomID)
+	}
+}
+
+// isPuppet returns true if the user is in the namespace of our application service.
+func (b *Bmatrix) isPuppet(mxid string) bool {
+	return b.namespace != nil && b.namespace.MatchString(mxid)
+}
+
+func (b *Bmatrix) puppetPrefix() string {
+	if !b.IsKeySet("PuppetPrefix") {
+		return defaultPuppetPrefix
+	}
+	return b.GetString("PuppetPrefix")
+}
+
+// puppetLocalpart returns the localpart of the virtual user of a remote user, eg discord_alice.
+// Only the characters the spec allows in user IDs are kept.
+func puppetLocalpart(username, protocol string) string {
+	clean := func(s string) string {
+		return strings.Map(func(r rune) rune {
+			r = unicode.ToLower(r)
+			switch {
+			case r >= 'a' && r <= 'z', r >= '0' && r <= '9':
+				return r
+			case strings.ContainsRune("-_.=/", r):
+				return r
+			}
+			return -1
+		}, s)
+	}
+	localpart := strings.Trim(clean(username), "._-=/")
+	if localpart == "" {
+		localpart = "user"
+	}
+	if protocol = clean(protocol); protocol != "" {
+		localpart = protocol + "_" + localpart
+	}
+	return localpart
+}
+
+// rememberSender remembers the virtual user that sent the message, to edit and delete it later.
+func (b *Bmatrix) rememberSender(p *puppet, eventID string) {
+	if p != nil && eventID != "" {
+		b.sentBy.Add(eventID, p)
+	}
+}
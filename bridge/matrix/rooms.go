@@ -0,0 +1,236 @@
+package bmatrix
+
+import (
+	"strings"
+
+	"github.com/42wim/matterbridge/bridge/config"
+	matrix "github.com/matterbridge/gomatrix"
+)
+
+// normalizeAlias adds our homeserver to aliases without one, #room becomes #room:example.com.
+func (b *Bmatrix) normalizeAlias(name string) string {
+	if !strings.HasPrefix(name, "#") || strings.Contains(name, ":") {
+		return name
+	}
+	_, domain, _ := splitMXID(b.UserID)
+	return name + ":" + domain
+}
+
+// resolveRoom returns the room ID of the room ID or alias, aliases we joined are known from RoomMap.
+func (b *Bmatrix) resolveRoom(name string) (string, error) {
+	if !strings.HasPrefix(name, "#") {
+		return name, nil
+	}
+	if roomID := b.getRoomID(name, ""); roomID != "" {
+		return roomID, nil
+	}
+	var resp struct {
+		RoomID string `json:"room_id"`
+	}
+	if err := b.mc.MakeRequest("GET", b.mc.BuildURL("directory", "room", b.normalizeAlias(name)), nil, &resp); err != nil {
+		return "", err
+	}
+	return resp.RoomID, nil
+}
+
+// mapRoom bridges the room we joined to the channel.
+func (b *Bmatrix) mapRoom(roomID string, channel config.ChannelInfo) error {
+	if channel.Options.SubChannels {
+		return b.joinSpace(roomID, channel.Name)
+	}
+
+	b.Lock()
+	b.RoomMap[roomID] = channel.Name
+	b.Unlock()
+
+	if b.crypto != nil {
+		return b.checkEncryption(roomID)
+	}
+	return nil
+}
+
+// waitForInvite remembers the channel we need an invite for, we join it when an allowed user invites us.
+func (b *Bmatrix) waitForInvite(channel config.ChannelInfo) error {
+	roomID, err := b.resolveRoom(channel.Name)
+	if err != nil {
+		return err
+	}
+	b.Lock()
+	b.pendingInvites[roomID] = channel
+	b.Unlock()
+	b.Log.Infof("%s needs an invite, waiting for one", channel.Name)
+	return nil
+}
+
+// inviteAllowed returns true if we accept invites from the user, AcceptInvitesFrom has user IDs,
+// *:server for every user of a server or * for everyone.
+func (b *Bmatrix) inviteAllowed(inviter string) bool {
+	for _, allowed := range b.GetStringSlice("AcceptInvitesFrom") {
+		switch {
+		case allowed == "*", allowed == inviter:
+			return true
+		case strings.HasPrefix(allowed, "*:") && strings.HasSuffix(inviter, allowed[1:]):
+			return true
+		}
+	}
+	return false
+}
+
+// handleInvite joins the rooms allowed users invite us to.
+func (b *Bmatrix) handleInvite(ev *matrix.Event) {
+	if ev.StateKey == nil || *ev.StateKey != b.UserID || ev.Content["membership"] != "invite" {
+		return
+	}
+	if !b.inviteAllowed(ev.Sender) {
+		b.Log.Infof("Ignoring the invite of %s to %s", ev.Sender, ev.RoomID)
+		return
+	}
+
+	err := b.retry(func() error {
+		_, err := b.mc.JoinRoom(ev.RoomID, "", nil)
+		return err
+	})
+	if err != nil {
+		b.Log.WithError(err).Warnf("Accepting the invite of %s to %s failed", ev.Sender, ev.RoomID)
+		return
+	}
+	b.Log.Infof("Joined %s on the invite of %s", ev.RoomID, ev.Sender)
+
+	b.Lock()
+	channel, pending := b.pendingInvites[ev.RoomID]
+	delete(b.pendingInvites, ev.RoomID)
+	b.Unlock()
+	if pending {
+		if err := b.mapRoom(ev.RoomID, channel); err != nil {
+			b.Log.WithError(err).Warnf("Bridging %s failed", channel.Name)
+		}
+	}
+}
+
+// handleInitialInvites handles the invites we got while we weren't running, the first sync isn't
+// processed by gomatrix.
+func (b *Bmatrix) handleInitialInvites(resp *syncResponse) {
+	for roomID, room := range resp.Rooms.Invite {
+		for i := range room.State.Events {
+			ev := room.State.Events[i]
+			if ev.Type == "m.room.member" {
+				ev.RoomID = roomID
+				b.handleInvite(&ev)
+			}
+		}
+	}
+}
+
+// joinSpace bridges every room of the space as a sub-channel of the channel.
+func (b *Bmatrix) joinSpace(spaceID, channel string) error {
+	b.Lock()
+	b.spaces[spaceID] = channel
+	b.Unlock()
+
+	var state []*matrix.Event
+	if err := b.mc.MakeRequest("GET", b.mc.BuildURL("rooms", spaceID, "state"), nil, &state); err != nil {
+		return err
+	}
+	for _, ev := range state {
+		if ev.Type == "m.space.child" && ev.StateKey != nil {
+			b.updateSpaceChild(spaceID, *ev.StateKey, ev.Content)
+		}
+	}
+	return nil
+}
+
+// isSpace returns true if the channel is a space, its messages go to the rooms named after their sub-channel.
+func (b *Bmatrix) isSpace(channel string) bool {
+	b.RLock()
+	defer b.RUnlock()
+	for _, name := range b.spaces {
+		if name == channel {
+			return true
+		}
+	}
+	return false
+}
+
+// handleSpaceChild bridges the rooms added to our spaces and stops bridging the removed ones.
+func (b *Bmatrix) handleSpaceChild(ev *matrix.Event) {
+	b.RLock()
+	_, ok := b.spaces[ev.RoomID]
+	b.RUnlock()
+	if !ok || ev.StateKey == nil {
+		return
+	}
+	b.updateSpaceChild(ev.RoomID, *ev.StateKey, ev.Content)
+}
+
+func (b *Bmatrix) updateSpaceChild(spaceID, roomID string, content map[string]interface{}) {
+	b.RLock()
+	channel := b.spaces[spaceID]
+	b.RUnlock()
+
+	// children without via servers were removed from the space
+	via, _ := content["via"].([]interface{})
+	if len(via) == 0 {
+		b.Lock()
+		if _, ok := b.spaceRooms[roomID]; ok {
+			delete(b.spaceRooms, roomID)
+			delete(b.RoomMap, roomID)
+			b.Log.Infof("%s left space %s", roomID, channel)
+		}
+		b.Unlock()
+		return
+	}
+
+	server, _ := via[0].(string)
+	err := b.retry(func() error {
+		_, err := b.mc.JoinRoom(roomID, server, nil)
+		return err
+	})
+	if err != nil {
+		// we may get an invite later
+		b.Log.WithError(err).Warnf("Joining %s of space %s failed", roomID, channel)
+	}
+
+	name := b.roomName(roomID)
+	b.Lock()
+	b.RoomMap[roomID] = channel
+	b.spaceRooms[roomID] = name
+	b.Unlock()
+	b.Log.Infof("Bridging %s (%s) of space %s", name, roomID, channel)
+
+	if b.crypto != nil && err == nil {
+		if err := b.checkEncryption(roomID); err != nil {
+			b.Log.WithError(err).Warnf("Checking the encryption of %s failed", roomID)
+		}
+	}
+}
+
+// handleRoomName keeps the names of the rooms of our spaces up to date, they are the names of the sub-channels.
+func (b *Bmatrix) handleRoomName(ev *matrix.Event) {
+	name, ok := ev.Content["name"].(string)
+	if !ok || name == "" {
+		return
+	}
+	b.Lock()
+	defer b.Unlock()
+	if _, ok := b.spaceRooms[ev.RoomID]; ok {
+		b.spaceRooms[ev.RoomID] = name
+	}
+}
+
+// roomName returns the name of the room, or the localpart of its alias if it has no name.
+func (b *Bmatrix) roomName(roomID string) string {
+	var name struct {
+		Name string `json:"name"`
+	}
+	if err := b.mc.StateEvent(roomID, "m.room.name", "", &name); err == nil && name.Name != "" {
+		return name.Name
+	}
+	var alias struct {
+		Alias string `json:"alias"`
+	}
+	if err := b.mc.StateEvent(roomID, "m.room.canonical_alias", "", &alias); err == nil && alias.Alias != "" {
+		localpart, _, _ := strings.Cut(strings.TrimPrefix(alias.Alias, "#"), ":")
+		return localpart
+	}
+	return roomID
+}
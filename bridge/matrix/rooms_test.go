@@ -0,0 +1,137 @@
+package bmatrix
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/42wim/matterbridge/bridge/config"
+	matrix "github.com/matterbridge/gomatrix"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeRooms serves a space with two rooms and an invite-only room.
+type fakeRooms struct {
+	sync.Mutex
+	invited bool
+	joined  []string
+	sent    map[string][]string
+}
+
+func (hs *fakeRooms) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	hs.Lock()
+	defer hs.Unlock()
+	path := strings.TrimPrefix(r.URL.Path, "/_matrix/client/r0")
+	switch {
+	case strings.HasPrefix(path, "/join/"):
+		room := strings.TrimPrefix(path, "/join/")
+		if strings.Contains(room, "private") && !hs.invited {
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, `{"errcode":"M_FORBIDDEN","error":"You are not invited to this room."}`)
+			return
+		}
+		if strings.HasPrefix(room, "#") {
+			room = "!" + strings.TrimPrefix(strings.Split(room, ":")[0], "#") + ":example.com"
+		}
+		hs.joined = append(hs.joined, room)
+		fmt.Fprintf(w, `{"room_id":%q}`, room)
+	case path == "/directory/room/#private:example.com":
+		fmt.Fprint(w, `{"room_id":"!private:example.com"}`)
+	case path == "/rooms/!space:example.com/state":
+		fmt.Fprint(w, `[
+			{"type":"m.room.create","state_key":"","content":{"type":"m.space"}},
+			{"type":"m.space.child","state_key":"!general:example.com","content":{"via":["example.com"]}},
+			{"type":"m.space.child","state_key":"!random:example.com","content":{"via":["example.com"]}},
+			{"type":"m.space.child","state_key":"!old:example.com","content":{}}
+		]`)
+	case strings.Contains(path, "/state/m.room.name"):
+		room := strings.Split(path, "/")[2]
+		name := strings.TrimPrefix(strings.Split(room, ":")[0], "!")
+		fmt.Fprintf(w, `{"name":%q}`, strings.ToUpper(name[:1])+name[1:])
+	case strings.Contains(path, "/send/"):
+		var content map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&content)
+		room := strings.Split(path, "/")[2]
+		hs.sent[room] = append(hs.sent[room], content["body"].(string))
+		fmt.Fprint(w, `{"event_id":"$sent"}`)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, `{"errcode":"M_NOT_FOUND"}`)
+	}
+}
+
+func TestAcceptInvites(t *testing.T) {
+	hs := &fakeRooms{sent: make(map[string][]string)}
+	b := newTestMatrix(t, hs, "")
+	b.Bridge.Config = config.NewConfigFromString(logrus.New(), []byte("[matrix.test]\nAcceptInvitesFrom=[\"*:example.com\"]\n"))
+
+	assert.Equal(t, "#private:example.com", b.normalizeAlias("#private"))
+	assert.Equal(t, "#private:other.org", b.normalizeAlias("#private:other.org"))
+	assert.Equal(t, "!room:example.com", b.normalizeAlias("!room:example.com"))
+
+	require.NoError(t, b.JoinChannel(config.ChannelInfo{Name: "#private"}))
+	assert.Empty(t, b.getRoomID("#private", ""))
+
+	invite := func(sender string) *matrix.Event {
+		stateKey := b.UserID
+		return &matrix.Event{
+			Type:     "m.room.member",
+			Sender:   sender,
+			RoomID:   "!private:example.com",
+			StateKey: &stateKey,
+			Content:  map[string]interface{}{"membership": "invite"},
+		}
+	}
+	hs.invited = true
+	b.handleInvite(invite("@eve:evil.org"))
+	assert.Empty(t, hs.joined)
+	assert.Empty(t, b.getRoomID("#private", ""))
+
+	b.handleInvite(invite("@alice:example.com"))
+	assert.Equal(t, []string{"!private:example.com"}, hs.joined)
+	assert.Equal(t, "!private:example.com", b.getRoomID("#private", ""))
+	assert.Empty(t, b.pendingInvites)
+}
+
+func TestSpace(t *testing.T) {
+	hs := &fakeRooms{sent: make(map[string][]string)}
+	b := newTestMatrix(t, hs, "")
+
+	require.NoError(t, b.JoinChannel(config.ChannelInfo{Name: "#space", Options: config.ChannelOptions{SubChannels: true}}))
+	assert.Equal(t, []string{"!space:example.com", "!general:example.com", "!random:example.com"}, hs.joined)
+	assert.Equal(t, map[string]string{"!general:example.com": "General", "!random:example.com": "Random"}, b.spaceRooms)
+
+	b.handleEvent(&matrix.Event{
+		Type:    "m.room.message",
+		ID:      "$1",
+		Sender:  "@alice:example.com",
+		RoomID:  "!random:example.com",
+		Content: map[string]interface{}{"msgtype": "m.text", "body": "hello"},
+	})
+	require.Len(t, b.Remote, 1)
+	rmsg := <-b.Remote
+	assert.Equal(t, "#space", rmsg.Channel)
+	assert.Equal(t, "Random", rmsg.SubChannel)
+
+	for _, subChannel := range []string{"random", "#general", "unknown", ""} {
+		_, err := b.Send(config.Message{Text: "to " + subChannel, Channel: "#space", SubChannel: subChannel})
+		require.NoError(t, err)
+	}
+	assert.Equal(t, map[string][]string{
+		"!random:example.com":  {"to random"},
+		"!general:example.com": {"to #general"},
+	}, hs.sent)
+
+	// rooms renamed or removed from the space
+	b.handleRoomName(&matrix.Event{RoomID: "!general:example.com", Content: map[string]interface{}{"name": "Lobby"}})
+	assert.Equal(t, "!general:example.com", b.getRoomID("#space", "lobby"))
+	stateKey := "!random:example.com"
+	b.handleSpaceChild(&matrix.Event{RoomID: "!space:example.com", StateKey: &stateKey, Content: map[string]interface{}{}})
+	assert.Empty(t, b.getRoomID("#space", "random"))
+	assert.NotContains(t, b.RoomMap, "!random:example.com")
+}
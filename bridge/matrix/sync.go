@@ -0,0 +1,145 @@
+package bmatrix
+
+import (
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	matrix "github.com/matterbridge/gomatrix"
+)
+
+// maxMissedEvents is the number of events per room we fetch to fill the gap of a limited timeline.
+const maxMissedEvents = 500
+
+// syncResponse adds the parts of /sync encryption needs to the response gomatrix knows.
+type syncResponse struct {
+	matrix.RespSync
+	ToDevice struct {
+		Events []*matrix.Event `json:"events"`
+	} `json:"to_device"`
+	DeviceLists struct {
+		Changed []string `json:"changed"`
+		Left    []string `json:"left"`
+	} `json:"device_lists"`
+	DeviceOneTimeKeysCount map[string]int `json:"device_one_time_keys_count"`
+}
+
+// sync syncs like gomatrix does, resuming from the token of SyncTokenFile so that we relay
+// what was sent while we were down. It also handles what end-to-end encryption needs.
+func (b *Bmatrix) sync() {
+	syncer := b.mc.Syncer.(*matrix.DefaultSyncer)
+	filter := string(syncer.GetFilterJSON(b.UserID))
+	since := b.loadSyncToken()
+	for {
+		query := map[string]string{"timeout": "30000", "filter": filter}
+		if since != "" {
+			query["since"] = since
+		}
+		var resp syncResponse
+		if err := b.mc.MakeRequest("GET", b.mc.BuildURLWithQuery([]string{"sync"}, query), nil, &resp); err != nil {
+			b.Log.Println("Sync() returned ", err)
+			duration, _ := syncer.OnFailedSync(nil, err)
+			time.Sleep(duration)
+			continue
+		}
+		if b.crypto != nil {
+			// the room keys come before the messages they decrypt
+			b.handleCryptoSync(&resp)
+		}
+		if since != "" {
+			b.fillGaps(&resp, since)
+		} else {
+			b.handleInitialInvites(&resp)
+		}
+		if err := syncer.ProcessResponse(&resp.RespSync, since); err != nil {
+			b.Log.Println("Sync() returned ", err)
+		}
+		if b.crypto != nil {
+			b.saveCrypto()
+		}
+		since = resp.NextBatch
+		b.saveSyncToken(since)
+	}
+}
+
+// fillGaps adds the events the server left out of the limited timelines of our rooms.
+func (b *Bmatrix) fillGaps(resp *syncResponse, since string) {
+	for roomID, room := range resp.Rooms.Join {
+		if !room.Timeline.Limited || room.Timeline.PrevBatch == "" {
+			continue
+		}
+		b.RLock()
+		_, bridged := b.RoomMap[roomID]
+		b.RUnlock()
+		if !bridged {
+			continue
+		}
+		missed, err := b.missedEvents(roomID, room.Timeline.PrevBatch, since)
+		if err != nil {
+			b.Log.WithError(err).Warnf("Fetching the missed messages of %s failed", roomID)
+		}
+		b.Log.Debugf("Relaying %d missed events of %s", len(missed), roomID)
+		room.Timeline.Events = append(missed, room.Timeline.Events...)
+		resp.Rooms.Join[roomID] = room
+	}
+}
+
+// missedEvents returns the events of the room between the tokens, oldest first.
+func (b *Bmatrix) missedEvents(roomID, from, to string) ([]matrix.Event, error) {
+	var events []matrix.Event
+	for len(events) < maxMissedEvents {
+		query := map[string]string{"from": from, "to": to, "dir": "b", "limit": strconv.Itoa(100)}
+		var resp struct {
+			Chunk []matrix.Event `json:"chunk"`
+			End   string         `json:"end"`
+		}
+		if err := b.mc.MakeRequest("GET", b.mc.BuildURLWithQuery([]string{"rooms", roomID, "messages"}, query), nil, &resp); err != nil {
+			return reverseEvents(events), err
+		}
+		events = append(events, resp.Chunk...)
+		if len(resp.Chunk) == 0 || resp.End == "" || resp.End == to {
+			break
+		}
+		from = resp.End
+	}
+	return reverseEvents(events), nil
+}
+
+func reverseEvents(events []matrix.Event) []matrix.Event {
+	for i, j := 0, len(events)-1; i < j; i, j = i+1, j-1 {
+		events[i], events[j] = events[j], events[i]
+	}
+	return events
+}
+
+// loadSyncToken returns the token saved by the previous run, if any.
+func (b *Bmatrix) loadSyncToken() string {
+	path := b.GetString("SyncTokenFile")
+	if path == "" {
+		return ""
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			b.Log.WithError(err).Warnf("Reading the sync token from %s failed", path)
+		}
+		return ""
+	}
+	since := strings.TrimSpace(string(data))
+	if since != "" {
+		b.Log.Infof("Resuming the sync from %s", path)
+	}
+	return since
+}
+
+func (b *Bmatrix) saveSyncToken(since string) {
+	path := b.GetString("SyncTokenFile")
+	if path == "" || since == "" {
+		return
+	}
+	if err := os.WriteFile(path, []byte(since+"\n"), 0o600); err != nil {
+		b.Log.WithError(err).Warnf("Saving the sync token to %s failed", path)
+	}
+}
@@ -0,0 +1,176 @@
+package bmatrix
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/42wim/matterbridge/bridge/bridgetest"
+	"github.com/42wim/matterbridge/bridge/config"
+	matrix "github.com/matterbridge/gomatrix"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeTimeline serves the events of a room and records the messages we send and the events we get.
+type fakeTimeline struct {
+	sync.Mutex
+	sent    []map[string]interface{}
+	fetched []string
+}
+
+func (hs *fakeTimeline) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	hs.Lock()
+	defer hs.Unlock()
+	path := strings.TrimPrefix(r.URL.Path, "/_matrix/client/r0")
+	switch {
+	case strings.HasSuffix(path, "/messages"):
+		if r.URL.Query().Get("from") != "prev" || r.URL.Query().Get("to") != "since" {
+			fmt.Fprint(w, `{"chunk":[]}`)
+			return
+		}
+		fmt.Fprint(w, `{"end":"since","chunk":[
+			{"type":"m.room.message","event_id":"$2","sender":"@alice:example.com","origin_server_ts":2000,"content":{"msgtype":"m.text","body":"two"}},
+			{"type":"m.room.message","event_id":"$1","sender":"@alice:example.com","origin_server_ts":1000,"content":{"msgtype":"m.text","body":"one"}}
+		]}`)
+	case strings.Contains(path, "/event/"):
+		hs.fetched = append(hs.fetched, path[strings.LastIndex(path, "/")+1:])
+		hs.serveEvent(w, path)
+	case strings.Contains(path, "/send/"):
+		var content map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&content)
+		hs.sent = append(hs.sent, content)
+		fmt.Fprintf(w, `{"event_id":"$sent%d"}`, len(hs.sent))
+	default:
+		fmt.Fprint(w, `{}`)
+	}
+}
+
+func (hs *fakeTimeline) serveEvent(w http.ResponseWriter, path string) {
+	switch {
+	case strings.HasSuffix(path, "/event/$reply"):
+		fmt.Fprint(w, `{"type":"m.room.message","event_id":"$reply","content":{"body":"in thread","m.relates_to":{"rel_type":"m.thread","event_id":"$root"}}}`)
+	case strings.HasSuffix(path, "/event/$root"):
+		fmt.Fprint(w, `{"type":"m.room.message","event_id":"$root","content":{"body":"root"}}`)
+	default:
+		fmt.Fprint(w, `{}`)
+	}
+}
+
+// newTestMatrix returns a bridge using the homeserver, with the extra settings.
+func newTestMatrix(t *testing.T, hs http.Handler, extra string) *Bmatrix {
+	server := httptest.NewServer(hs)
+	t.Cleanup(server.Close)
+
+	cfg := fmt.Sprintf("[matrix.test]\nServer=%q\nSyncTokenFile=%q\n", server.URL, filepath.Join(t.TempDir(), "sync")) + extra
+	b := New(bridgetest.Config("matrix.test", cfg)).(*Bmatrix)
+	mc, err := matrix.NewClient(server.URL, "@bot:example.com", "token")
+	require.NoError(t, err)
+	b.mc = mc
+	b.UserID = "@bot:example.com"
+	b.RoomMap["!room:example.com"] = "#room"
+	return b
+}
+
+func TestMissedTimeline(t *testing.T) {
+	b := newTestMatrix(t, &fakeTimeline{}, "")
+	syncer := b.mc.Syncer.(*matrix.DefaultSyncer)
+	syncer.OnEventType("m.room.message", b.handleEvent)
+
+	assert.Equal(t, "", b.loadSyncToken())
+	b.saveSyncToken("since")
+	assert.Equal(t, "since", b.loadSyncToken())
+
+	var resp syncResponse
+	require.NoError(t, json.Unmarshal([]byte(`{"next_batch":"next","rooms":{"join":{"!room:example.com":{"timeline":{
+		"limited":true,"prev_batch":"prev","events":[
+			{"type":"m.room.message","event_id":"$3","sender":"@alice:example.com","origin_server_ts":3000,"content":{"msgtype":"m.text","body":"three"}}
+		]}}}}}`), &resp))
+	b.fillGaps(&resp, "since")
+	require.NoError(t, syncer.ProcessResponse(&resp.RespSync, "since"))
+
+	require.Len(t, b.Remote, 3)
+	for i, text := range []string{"one", "two", "three"} {
+		rmsg := <-b.Remote
+		assert.Equal(t, text, rmsg.Text)
+		assert.Equal(t, time.UnixMilli(int64(i+1)*1000), rmsg.Timestamp)
+	}
+
+	b.saveSyncToken(resp.NextBatch)
+	data, err := os.ReadFile(b.GetString("SyncTokenFile"))
+	require.NoError(t, err)
+	assert.Equal(t, "next\n", string(data))
+}
+
+func TestThreads(t *testing.T) {
+	hs := &fakeTimeline{}
+	b := newTestMatrix(t, hs, "")
+
+	b.handleEvent(&matrix.Event{
+		Type:   "m.room.message",
+		ID:     "$in",
+		Sender: "@alice:example.com",
+		RoomID: "!room:example.com",
+		Content: map[string]interface{}{
+			"msgtype": "m.text",
+			"body":    "in the thread",
+			"m.relates_to": map[string]interface{}{
+				"rel_type":        "m.thread",
+				"event_id":        "$root",
+				"is_falling_back": true,
+				"m.in_reply_to":   map[string]interface{}{"event_id": "$previous"},
+			},
+		},
+	})
+	require.Len(t, b.Remote, 1)
+	rmsg := <-b.Remote
+	assert.Equal(t, "$root", rmsg.ParentID)
+	assert.Equal(t, "in the thread", rmsg.Text)
+
+	// answers to a message in a thread go in the thread of its root, other answers are plain replies
+	for _, tc := range [][2]string{{"$in", "$root"}, {"$reply", ""}, {"$root", ""}, {"$new", ""}} {
+		parent, root := tc[0], tc[1]
+		_, err := b.Send(config.Message{Text: "answer", Channel: "#room", ParentID: parent})
+		require.NoError(t, err)
+		relation := hs.sent[len(hs.sent)-1]["m.relates_to"].(map[string]interface{})
+		assert.Equal(t, parent, relation["m.in_reply_to"].(map[string]interface{})["event_id"])
+		if root == "" {
+			assert.NotContains(t, relation, "rel_type", "answer to %s", parent)
+			assert.NotContains(t, relation, "event_id", "answer to %s", parent)
+			continue
+		}
+		assert.Equal(t, "m.thread", relation["rel_type"])
+		assert.Equal(t, root, relation["event_id"])
+	}
+	// events we haven't seen aren't looked up
+	assert.Empty(t, hs.fetched)
+
+	// answers to our answer in the thread stay in the thread
+	_, err := b.Send(config.Message{Text: "answer", Channel: "#room", ParentID: "$sent1"})
+	require.NoError(t, err)
+	relation := hs.sent[len(hs.sent)-1]["m.relates_to"].(map[string]interface{})
+	assert.Equal(t, "$root", relation["event_id"])
+}
+
+func TestUseThreads(t *testing.T) {
+	hs := &fakeTimeline{}
+	b := newTestMatrix(t, hs, "UseThreads=true\n")
+
+	// every answer goes in a thread, the events are looked up once
+	for _, tc := range [][2]string{{"$reply", "$root"}, {"$root", "$root"}, {"$reply", "$root"}, {"$other", "$other"}} {
+		_, err := b.Send(config.Message{Text: "answer", Channel: "#room", ParentID: tc[0]})
+		require.NoError(t, err)
+		relation := hs.sent[len(hs.sent)-1]["m.relates_to"].(map[string]interface{})
+		assert.Equal(t, "m.thread", relation["rel_type"])
+		assert.Equal(t, tc[1], relation["event_id"])
+		assert.Equal(t, tc[0], relation["m.in_reply_to"].(map[string]interface{})["event_id"])
+	}
+	assert.Equal(t, []string{"$reply", "$root", "$other"}, hs.fetched)
+}
@@ -0,0 +1,145 @@
+package btelegram
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/42wim/matterbridge/bridge/config"
+	tgbotapi "github.com/matterbridge/telegram-bot-api/v6"
+)
+
+const (
+	// mediaGroupDelay is how long we wait for the next message of an album before relaying it.
+	mediaGroupDelay = time.Second
+	// pollCacheSize is the number of polls we remember the message of, to relay their votes.
+	pollCacheSize = 1000
+)
+
+// mediaGroup is an album we're receiving, Telegram sends every file of it as a message.
+type mediaGroup struct {
+	msg config.Message
+	// texts are the texts of the messages of the album, which are joined without repeating them.
+	texts []string
+	timer *time.Timer
+}
+
+// bufferMediaGroup collects the messages of the album and relays them as one message when they stop coming.
+func (b *Btelegram) bufferMediaGroup(id string, rmsg config.Message) {
+	b.Lock()
+	defer b.Unlock()
+	group, ok := b.mediaGroups[id]
+	if !ok {
+		b.mediaGroups[id] = &mediaGroup{
+			msg:   rmsg,
+			texts: []string{rmsg.Text},
+			timer: time.AfterFunc(mediaGroupDelay, func() { b.flushMediaGroup(id) }),
+		}
+		return
+	}
+	group.timer.Reset(mediaGroupDelay)
+
+	// albums usually have one caption, join the others on their own line
+	newText := rmsg.Text != ""
+	for _, text := range group.texts {
+		if text == rmsg.Text {
+			newText = false
+			break
+		}
+	}
+	if newText {
+		group.texts = append(group.texts, rmsg.Text)
+		if group.msg.Text != "" {
+			group.msg.Text += "\n"
+		}
+		group.msg.Text += rmsg.Text
+	}
+	for _, f := range rmsg.Extra["file"] {
+		// don't repeat the caption of the album for every file
+		fi := f.(config.FileInfo)
+		for _, prev := range group.msg.Extra["file"] {
+			if prev.(config.FileInfo).Comment == fi.Comment {
+				fi.Comment = ""
+				break
+			}
+		}
+		group.msg.Extra["file"] = append(group.msg.Extra["file"], fi)
+	}
+	for key, values := range rmsg.Extra {
+		if key != "file" {
+			group.msg.Extra[key] = append(group.msg.Extra[key], values...)
+		}
+	}
+}
+
+func (b *Btelegram) flushMediaGroup(id string) {
+	b.Lock()
+	group, ok := b.mediaGroups[id]
+	delete(b.mediaGroups, id)
+	b.Unlock()
+	if !ok {
+		return
+	}
+	b.Log.Debugf("<= Sending album of %d files from %s on %s to gateway", len(group.msg.Extra["file"]), group.msg.Username, b.Account)
+	b.Remote <- group.msg
+}
+
+// handleContent converts the messages without text or files we can relay into text.
+func (b *Btelegram) handleContent(rmsg *config.Message, message *tgbotapi.Message) {
+	var text string
+	switch {
+	case message.Poll != nil:
+		text = pollText(message.Poll)
+	case message.Venue != nil:
+		text = fmt.Sprintf("Venue: %s, %s %s", message.Venue.Title, message.Venue.Address, mapURL(&message.Venue.Location))
+	case message.Location != nil:
+		text = "Location: " + mapURL(message.Location)
+	case message.Contact != nil:
+		name := strings.TrimSpace(message.Contact.FirstName + " " + message.Contact.LastName)
+		text = fmt.Sprintf("Contact: %s, %s", name, message.Contact.PhoneNumber)
+	case message.Dice != nil:
+		text = fmt.Sprintf("%s %d", message.Dice.Emoji, message.Dice.Value)
+	default:
+		return
+	}
+	// edits of live locations already have the edit suffix
+	rmsg.Text = text + rmsg.Text
+}
+
+// handlePollUpdate relays the new vote counts of a poll as an edit of its message.
+func (b *Btelegram) handlePollUpdate(poll *tgbotapi.Poll) {
+	cached, ok := b.polls.Get(poll.ID)
+	if !ok {
+		b.Log.Debugf("Ignoring the update of unknown poll %s", poll.ID)
+		return
+	}
+	rmsg := cached.(config.Message)
+	rmsg.Text = pollText(poll)
+	rmsg.Extra = make(map[string][]interface{})
+	b.Log.Debugf("<= Sending the votes of poll %s on %s to gateway", poll.ID, b.Account)
+	b.Remote <- rmsg
+}
+
+func pollText(poll *tgbotapi.Poll) string {
+	var sb strings.Builder
+	sb.WriteString("Poll: " + poll.Question)
+	for _, option := range poll.Options {
+		sb.WriteString("\n- " + option.Text + ": " + strconv.Itoa(option.VoterCount))
+	}
+	votes := "votes"
+	if poll.TotalVoterCount == 1 {
+		votes = "vote"
+	}
+	fmt.Fprintf(&sb, "\n%d %s", poll.TotalVoterCount, votes)
+	if poll.IsClosed {
+		sb.WriteString(", closed")
+	}
+	return sb.String()
+}
+
+func mapURL(location *tgbotapi.Location) string {
+	lat := strconv.FormatFloat(location.Latitude, 'f', -1, 64)
+	lon := strconv.FormatFloat(location.Longitude, 'f', -1, 64)
+	return fmt.Sprintf("https://www.openstreetmap.org/?mlat=%s&mlon=%s#map=16/%s/%s", lat, lon, lat, lon)
+}
@@ -0,0 +1,161 @@
+package btelegram
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/42wim/matterbridge/bridge/config"
+	tgbotapi "github.com/matterbridge/telegram-bot-api/v6"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandleContent(t *testing.T) {
+	b, _ := newTestTelegram(t, "[telegram.test]\n")
+	for _, tc := range []struct {
+		message *tgbotapi.Message
+		text    string
+	}{
+		{
+			&tgbotapi.Message{Poll: &tgbotapi.Poll{
+				Question:        "Lunch?",
+				Options:         []tgbotapi.PollOption{{Text: "Pizza", VoterCount: 1}, {Text: "Sushi"}},
+				TotalVoterCount: 1,
+				IsClosed:        true,
+			}},
+			"Poll: Lunch?\n- Pizza: 1\n- Sushi: 0\n1 vote, closed",
+		},
+		{
+			&tgbotapi.Message{Location: &tgbotapi.Location{Latitude: 52.3702, Longitude: 4.8952}},
+			"Location: https://www.openstreetmap.org/?mlat=52.3702&mlon=4.8952#map=16/52.3702/4.8952",
+		},
+		{
+			&tgbotapi.Message{
+				Location: &tgbotapi.Location{Latitude: 1.5, Longitude: -2},
+				Venue:    &tgbotapi.Venue{Location: tgbotapi.Location{Latitude: 1.5, Longitude: -2}, Title: "Cafe", Address: "Main street 1"},
+			},
+			"Venue: Cafe, Main street 1 https://www.openstreetmap.org/?mlat=1.5&mlon=-2#map=16/1.5/-2",
+		},
+		{
+			&tgbotapi.Message{Contact: &tgbotapi.Contact{FirstName: "Alice", LastName: "Smith", PhoneNumber: "+31612345678"}},
+			"Contact: Alice Smith, +31612345678",
+		},
+		{
+			&tgbotapi.Message{Dice: &tgbotapi.Dice{Emoji: "🎲", Value: 4}},
+			"🎲 4",
+		},
+		{
+			&tgbotapi.Message{Text: "plain"},
+			"",
+		},
+	} {
+		var rmsg config.Message
+		b.handleContent(&rmsg, tc.message)
+		assert.Equal(t, tc.text, rmsg.Text)
+	}
+}
+
+func TestPollVotes(t *testing.T) {
+	b, _ := newTestTelegram(t, "[telegram.test]\n")
+	updates := make(chan tgbotapi.Update, 2)
+	go b.handleRecv(updates)
+
+	var update tgbotapi.Update
+	require.NoError(t, json.Unmarshal([]byte(`{"update_id":1,"message":{"message_id":5,"date":0,
+		"chat":{"id":-100123,"type":"supergroup"},"from":{"id":7,"first_name":"Alice","username":"alice"},
+		"poll":{"id":"p1","question":"Lunch?","options":[{"text":"Pizza","voter_count":0}],"total_voter_count":0}}}`), &update))
+	updates <- update
+	rmsg := <-b.Remote
+	assert.Equal(t, "5", rmsg.ID)
+	assert.Equal(t, "Poll: Lunch?\n- Pizza: 0\n0 votes", rmsg.Text)
+
+	updates <- tgbotapi.Update{UpdateID: 2, Poll: &tgbotapi.Poll{
+		ID:              "p1",
+		Question:        "Lunch?",
+		Options:         []tgbotapi.PollOption{{Text: "Pizza", VoterCount: 2}},
+		TotalVoterCount: 2,
+	}}
+	rmsg = <-b.Remote
+	assert.Equal(t, "5", rmsg.ID)
+	assert.Equal(t, "-100123", rmsg.Channel)
+	assert.Equal(t, "alice", rmsg.Username)
+	assert.Equal(t, "Poll: Lunch?\n- Pizza: 2\n2 votes", rmsg.Text)
+	close(updates)
+}
+
+func TestMediaGroup(t *testing.T) {
+	b, _ := newTestTelegram(t, "[telegram.test]\n")
+	data := []byte("image")
+	for i, name := range []string{"1.jpg", "2.jpg", "3.jpg"} {
+		comment, text := "holiday", "holiday"
+		if i == 2 {
+			comment, text = "the beach", "day"
+		}
+		b.bufferMediaGroup("album", config.Message{
+			ID:      "1" + name[:1],
+			Text:    text,
+			Channel: "-100123",
+			Extra: map[string][]interface{}{
+				"file": {config.FileInfo{Name: name, Data: &data, Comment: comment}},
+			},
+		})
+	}
+	b.bufferMediaGroup("other", config.Message{ID: "20", Extra: map[string][]interface{}{}})
+
+	var album config.Message
+	for i := 0; i < 2; i++ {
+		select {
+		case rmsg := <-b.Remote:
+			if rmsg.ID == "11" {
+				album = rmsg
+			}
+		case <-time.After(3 * mediaGroupDelay):
+			t.Fatal("the albums weren't relayed")
+		}
+	}
+	require.Len(t, album.Extra["file"], 3)
+	var comments []string
+	for _, f := range album.Extra["file"] {
+		comments = append(comments, f.(config.FileInfo).Comment)
+	}
+	assert.Equal(t, []string{"holiday", "", "the beach"}, comments)
+	// every caption is kept once, even when it's part of another one
+	assert.Equal(t, "holiday\nday", album.Text)
+	assert.Empty(t, b.mediaGroups)
+}
+
+func TestUploadAlbum(t *testing.T) {
+	b, api := newTestTelegram(t, "[telegram.test]\n")
+	data := []byte("data")
+	var files []interface{}
+	for _, name := range []string{"1.jpg", "2.mp4", "3.png", "song.mp3", "notes.pdf", "more.pdf"} {
+		files = append(files, config.FileInfo{Name: name, Data: &data, Comment: "holiday"})
+	}
+	for i := 0; i < 10; i++ {
+		files = append(files, config.FileInfo{Name: "many.png", Data: &data})
+	}
+
+	id, err := b.Send(config.Message{Channel: "-100123", Username: "alice: ", Extra: map[string][]interface{}{"file": files}})
+	require.NoError(t, err)
+	assert.Equal(t, "101", id)
+
+	api.Lock()
+	defer api.Unlock()
+	// 13 photos and videos need two albums, the audio file is sent on its own
+	require.Len(t, api.calls["sendMediaGroup"], 3)
+	var sizes []int
+	for _, call := range api.calls["sendMediaGroup"] {
+		var media []map[string]interface{}
+		require.NoError(t, json.Unmarshal([]byte(call.Get("media")), &media))
+		sizes = append(sizes, len(media))
+	}
+	assert.Equal(t, []int{10, 3, 2}, sizes)
+	require.Len(t, api.calls["sendAudio"], 1)
+	assert.Empty(t, api.calls["sendAudio"][0].Get("caption"))
+
+	var album []map[string]interface{}
+	require.NoError(t, json.Unmarshal([]byte(api.calls["sendMediaGroup"][0].Get("media")), &album))
+	assert.Equal(t, "alice: holiday", album[0]["caption"])
+	assert.Nil(t, album[1]["caption"])
+}
@@ -189,6 +189,11 @@ func (b *Btelegram) handleRecv(updates <-chan tgbotapi.Update) {
 	for update := range updates {
 		b.Log.Debugf("== Receiving event: %#v", update.Message)
 
+		if update.Poll != nil {
+			b.handlePollUpdate(update.Poll)
+			continue
+		}
+
 		if update.Message == nil && update.ChannelPost == nil &&
 			update.EditedMessage == nil && update.EditedChannelPost == nil {
 			b.Log.Info("Received event without messages, skipping.")
@@ -222,6 +227,7 @@ func (b *Btelegram) handleRecv(updates <-chan tgbotapi.Update) {
 		if message.IsTopicMessage {
 			rmsg.Channel += "/" + strconv.Itoa(message.MessageThreadID)
 		}
+		b.handleTopic(&rmsg, message)
 
 		// preserve threading from telegram reply
 		if message.ReplyToMessage != nil &&
@@ -242,6 +248,9 @@ func (b *Btelegram) handleRecv(updates <-chan tgbotapi.Update) {
 			b.Log.Errorf("download failed: %s", err)
 		}
 
+		// handle polls, locations, contacts and dice
+		b.handleContent(&rmsg, message)
+
 		// handle forwarded messages
 		b.handleForwarded(&rmsg, message)
 
@@ -256,6 +265,15 @@ func (b *Btelegram) handleRecv(updates <-chan tgbotapi.Update) {
 				rmsg.Avatar = helper.GetAvatar(b.avatarMap, strconv.FormatInt(message.From.ID, 10), b.General)
 			}
 
+			if message.Poll != nil {
+				b.polls.Add(message.Poll.ID, rmsg)
+			}
+			// edits of a file of an album are relayed on their own
+			if message.MediaGroupID != "" && update.EditedMessage == nil && update.EditedChannelPost == nil {
+				b.bufferMediaGroup(message.MediaGroupID, rmsg)
+				continue
+			}
+
 			b.Log.Debugf("<= Sending message from %s on %s to gateway", rmsg.Username, b.Account)
 			b.Log.Debugf("<= Message is %#v", rmsg)
 			b.Remote <- rmsg
@@ -508,9 +526,13 @@ func (b *Btelegram) handleEdit(msg *config.Message, chatid int64) (string, error
 	return "", nil
 }
 
-// handleUploadFile handles native upload of files
+// handleUploadFile handles native upload of files, the files that can be grouped are sent as albums.
 func (b *Btelegram) handleUploadFile(msg *config.Message, chatid int64, threadid int, parentID int) (string, error) {
-	var media []interface{}
+	var (
+		firstID                  string
+		visual, audio, documents []interface{}
+		prevComment              string
+	)
 	for _, f := range msg.Extra["file"] {
 		fi := f.(config.FileInfo)
 		file := tgbotapi.FileBytes{
@@ -518,48 +540,76 @@ func (b *Btelegram) handleUploadFile(msg *config.Message, chatid int64, threadid
 			Bytes: *fi.Data,
 		}
 
-		if b.GetString("MessageFormat") == HTMLFormat {
-			fi.Comment = makeHTML(html.EscapeString(fi.Comment))
+		// albums show the caption of every file, don't repeat the same one
+		comment := fi.Comment
+		if comment == prevComment {
+			comment = ""
+		} else {
+			prevComment = comment
+		}
+		if comment != "" && b.GetString("MessageFormat") == HTMLFormat {
+			comment = makeHTML(html.EscapeString(comment))
 		}
 
 		switch filepath.Ext(fi.Name) {
 		case ".jpg", ".jpe", ".png":
 			pc := tgbotapi.NewInputMediaPhoto(file)
-			if fi.Comment != "" {
-				pc.Caption, pc.ParseMode = TGGetParseMode(b, msg.Username, fi.Comment)
+			if comment != "" {
+				pc.Caption, pc.ParseMode = TGGetParseMode(b, msg.Username, comment)
 			}
-			media = append(media, pc)
+			visual = append(visual, pc)
 		case ".mp4", ".m4v":
 			vc := tgbotapi.NewInputMediaVideo(file)
-			if fi.Comment != "" {
-				vc.Caption, vc.ParseMode = TGGetParseMode(b, msg.Username, fi.Comment)
+			if comment != "" {
+				vc.Caption, vc.ParseMode = TGGetParseMode(b, msg.Username, comment)
 			}
-			media = append(media, vc)
+			visual = append(visual, vc)
 		case ".mp3", ".oga":
 			ac := tgbotapi.NewInputMediaAudio(file)
-			if fi.Comment != "" {
-				ac.Caption, ac.ParseMode = TGGetParseMode(b, msg.Username, fi.Comment)
+			if comment != "" {
+				ac.Caption, ac.ParseMode = TGGetParseMode(b, msg.Username, comment)
 			}
-			media = append(media, ac)
+			audio = append(audio, ac)
 		case ".ogg":
 			voc := tgbotapi.NewVoice(chatid, file)
 			voc.Caption, voc.ParseMode = TGGetParseMode(b, msg.Username, fi.Comment)
+			voc.MessageThreadID = threadid
 			voc.ReplyToMessageID = parentID
 			res, err := b.c.Send(voc)
 			if err != nil {
 				return "", err
 			}
-			return strconv.Itoa(res.MessageID), nil
+			if firstID == "" {
+				firstID = strconv.Itoa(res.MessageID)
+			}
 		default:
 			dc := tgbotapi.NewInputMediaDocument(file)
-			if fi.Comment != "" {
-				dc.Caption, dc.ParseMode = TGGetParseMode(b, msg.Username, fi.Comment)
+			if comment != "" {
+				dc.Caption, dc.ParseMode = TGGetParseMode(b, msg.Username, comment)
+			}
+			documents = append(documents, dc)
+		}
+	}
+
+	// photos and videos can share an album, audio and documents can only be grouped with their own kind
+	for _, media := range [][]interface{}{visual, audio, documents} {
+		for len(media) > 0 {
+			n := len(media)
+			if n > maxAlbumSize {
+				n = maxAlbumSize
+			}
+			id, err := b.sendMediaFiles(msg, chatid, threadid, parentID, media[:n])
+			if err != nil {
+				return "", err
+			}
+			if firstID == "" {
+				firstID = id
 			}
-			media = append(media, dc)
+			media = media[n:]
 		}
 	}
 
-	return b.sendMediaFiles(msg, chatid, threadid, parentID, media)
+	return firstID, nil
 }
 
 func (b *Btelegram) handleQuote(message, quoteNick, quoteMessage string) string {
@@ -6,10 +6,12 @@ import (
 	"log"
 	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/42wim/matterbridge/bridge"
 	"github.com/42wim/matterbridge/bridge/config"
 	"github.com/42wim/matterbridge/bridge/helper"
+	lru "github.com/hashicorp/golang-lru"
 	tgbotapi "github.com/matterbridge/telegram-bot-api/v6"
 )
 
@@ -18,12 +20,22 @@ const (
 	HTMLFormat  = "HTML"
 	HTMLNick    = "htmlnick"
 	MarkdownV2  = "MarkdownV2"
+
+	// maxAlbumSize is the number of files Telegram allows in a media group.
+	maxAlbumSize = 10
 )
 
 type Btelegram struct {
 	c *tgbotapi.BotAPI
 	*bridge.Config
-	avatarMap map[string]string // keep cache of userid and avatar sha
+	avatarMap   map[string]string // keep cache of userid and avatar sha
+	webhook     *webhook          // receives the updates in webhook mode
+	mediaGroups map[string]*mediaGroup
+	polls       *lru.Cache // the relayed message of a poll, by poll ID
+	// forums are the chats we bridge with SubChannels and topics their topics, by topic ID.
+	forums map[int64]bool
+	topics map[int64]map[int]*forumTopic
+	sync.Mutex
 }
 
 func New(cfg *bridge.Config) bridge.Bridger {
@@ -37,7 +49,15 @@ func New(cfg *bridge.Config) bridge.Bridger {
 			log.Fatalf("Telegram bridge configured to convert .tgs files to '%s', but %s doesn't support it.", tgsConvertFormat, helper.LottieBackend())
 		}
 	}
-	return &Btelegram{Config: cfg, avatarMap: make(map[string]string)}
+	b := &Btelegram{
+		Config:      cfg,
+		avatarMap:   make(map[string]string),
+		mediaGroups: make(map[string]*mediaGroup),
+		forums:      make(map[int64]bool),
+		topics:      make(map[int64]map[int]*forumTopic),
+	}
+	b.polls, _ = lru.New(pollCacheSize)
+	return b
 }
 
 func (b *Btelegram) Connect() error {
@@ -48,19 +68,43 @@ func (b *Btelegram) Connect() error {
 		b.Log.Debugf("%#v", err)
 		return err
 	}
-	u := tgbotapi.NewUpdate(0)
-	u.Timeout = 60
-	updates := b.c.GetUpdatesChan(u)
+	if err := b.loadTopics(); err != nil {
+		return err
+	}
+	var updates tgbotapi.UpdatesChannel
+	if b.GetString("WebhookURL") != "" {
+		updates, err = b.listenWebhook()
+		if err != nil {
+			return err
+		}
+	} else {
+		u := tgbotapi.NewUpdate(0)
+		u.Timeout = 60
+		updates = b.c.GetUpdatesChan(u)
+	}
 	b.Log.Info("Connection succeeded")
 	go b.handleRecv(updates)
 	return nil
 }
 
 func (b *Btelegram) Disconnect() error {
-	return nil
+	return b.closeWebhook()
 }
 
 func (b *Btelegram) JoinChannel(channel config.ChannelInfo) error {
+	if !channel.Options.SubChannels {
+		return nil
+	}
+	chatid, topicid, err := b.getIds(channel.Name)
+	if err != nil {
+		return err
+	}
+	if topicid != 0 {
+		return fmt.Errorf("%s is a topic, use the forum for SubChannels", channel.Name)
+	}
+	b.Lock()
+	b.forums[chatid] = true
+	b.Unlock()
 	return nil
 }
 
@@ -139,6 +183,14 @@ func (b *Btelegram) Send(msg config.Message) (string, error) {
 		return b.handleDelete(&msg, chatid)
 	}
 
+	// messages of a sub-channel go to its topic
+	if msg.SubChannel != "" && topicid == 0 {
+		topicid, err = b.topicID(chatid, msg.SubChannel)
+		if err != nil {
+			return "", err
+		}
+	}
+
 	// Handle prefix hint for unthreaded messages.
 	if msg.ParentNotFound() {
 		msg.ParentID = ""
@@ -203,11 +255,14 @@ func (b *Btelegram) sendMessage(chatid int64, topicid int, username, text string
 	return strconv.Itoa(res.MessageID), nil
 }
 
-// sendMediaFiles native upload media files via media group
+// sendMediaFiles native upload media files via media group, a single file is sent on its own
 func (b *Btelegram) sendMediaFiles(msg *config.Message, chatid int64, threadid int, parentID int, media []interface{}) (string, error) {
 	if len(media) == 0 {
 		return "", nil
 	}
+	if len(media) == 1 {
+		return b.sendMediaFile(chatid, threadid, parentID, media[0])
+	}
 	mg := tgbotapi.MediaGroupConfig{
 		BaseChat: tgbotapi.BaseChat{
 			ChatID:           chatid,
@@ -225,6 +280,40 @@ func (b *Btelegram) sendMediaFiles(msg *config.Message, chatid int64, threadid i
 	return strconv.Itoa(messages[0].MessageID), nil
 }
 
+// sendMediaFile sends the file of a media group on its own, media groups need at least 2 files.
+func (b *Btelegram) sendMediaFile(chatid int64, threadid int, parentID int, media interface{}) (string, error) {
+	var c tgbotapi.Chattable
+	switch m := media.(type) {
+	case tgbotapi.InputMediaPhoto:
+		pc := tgbotapi.NewPhoto(chatid, m.Media)
+		pc.Caption, pc.ParseMode = m.Caption, m.ParseMode
+		pc.MessageThreadID, pc.ReplyToMessageID = threadid, parentID
+		c = pc
+	case tgbotapi.InputMediaVideo:
+		vc := tgbotapi.NewVideo(chatid, m.Media)
+		vc.Caption, vc.ParseMode = m.Caption, m.ParseMode
+		vc.MessageThreadID, vc.ReplyToMessageID = threadid, parentID
+		c = vc
+	case tgbotapi.InputMediaAudio:
+		ac := tgbotapi.NewAudio(chatid, m.Media)
+		ac.Caption, ac.ParseMode = m.Caption, m.ParseMode
+		ac.MessageThreadID, ac.ReplyToMessageID = threadid, parentID
+		c = ac
+	case tgbotapi.InputMediaDocument:
+		dc := tgbotapi.NewDocument(chatid, m.Media)
+		dc.Caption, dc.ParseMode = m.Caption, m.ParseMode
+		dc.MessageThreadID, dc.ReplyToMessageID = threadid, parentID
+		c = dc
+	default:
+		return "", fmt.Errorf("unsupported media %T", media)
+	}
+	res, err := b.c.Send(c)
+	if err != nil {
+		return "", err
+	}
+	return strconv.Itoa(res.MessageID), nil
+}
+
 // intParentID return integer parent id for telegram message
 func (b *Btelegram) intParentID(parentID string) (int, error) {
 	pid, err := strconv.Atoi(parentID)
@@ -0,0 +1,157 @@
+package btelegram
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/42wim/matterbridge/bridge/config"
+	tgbotapi "github.com/matterbridge/telegram-bot-api/v6"
+)
+
+// maxTopicName is the length Telegram allows for the name of a topic.
+const maxTopicName = 128
+
+// forumTopic is a topic of a forum we bridge with SubChannels, Remote is the sub-channel we created it for.
+type forumTopic struct {
+	Name   string `json:"name"`
+	Remote string `json:"remote,omitempty"`
+}
+
+// subChannel returns the sub-channel the topic is bridged as, the topics created in Telegram use their own name.
+func (t *forumTopic) subChannel() string {
+	if t.Remote != "" {
+		return t.Remote
+	}
+	return t.Name
+}
+
+// handleTopic relays the messages of the topics of our forums as sub-channels of the forum and
+// relays topic renames as topic changes.
+func (b *Btelegram) handleTopic(rmsg *config.Message, message *tgbotapi.Message) {
+	b.Lock()
+	defer b.Unlock()
+	chatid := message.Chat.ID
+	if !b.forums[chatid] || !message.IsTopicMessage {
+		return
+	}
+	topics := b.topics[chatid]
+	if topics == nil {
+		topics = make(map[int]*forumTopic)
+		b.topics[chatid] = topics
+	}
+
+	// messages in a topic answer the message that created it, unless they're replies
+	created := message.ForumTopicCreated
+	if created == nil && message.ReplyToMessage != nil {
+		created = message.ReplyToMessage.ForumTopicCreated
+	}
+	topic, ok := topics[message.MessageThreadID]
+	if !ok && created != nil {
+		topic = &forumTopic{Name: created.Name}
+		topics[message.MessageThreadID] = topic
+		b.saveTopics()
+	}
+	if topic == nil {
+		b.Log.Debugf("Relaying topic %d of %d as its own channel, we don't know its name", message.MessageThreadID, chatid)
+		return
+	}
+
+	rmsg.Channel = strconv.FormatInt(chatid, 10)
+	rmsg.SubChannel = topic.subChannel()
+	if message.ForumTopicEdited != nil && message.ForumTopicEdited.Name != "" && message.ForumTopicEdited.Name != topic.Name {
+		topic.Name = message.ForumTopicEdited.Name
+		b.saveTopics()
+		rmsg.Event = config.EventTopicChange
+		rmsg.Text = "renamed the topic to " + topic.Name
+	}
+}
+
+// topicID returns the topic of the forum bridged with the sub-channel, we create one if there is none yet.
+// The topic is created without holding the lock, the updates of the forums don't wait for Telegram.
+func (b *Btelegram) topicID(chatid int64, subChannel string) (int, error) {
+	b.Lock()
+	forum := b.forums[chatid]
+	id, ok := b.findTopic(chatid, subChannel)
+	b.Unlock()
+	if !forum || ok {
+		return id, nil
+	}
+
+	name := []rune(strings.TrimPrefix(subChannel, "#"))
+	if len(name) > maxTopicName {
+		name = name[:maxTopicName]
+	}
+	resp, err := b.c.Request(tgbotapi.CreateForumTopicConfig{
+		BaseForum: tgbotapi.BaseForum{ChatID: chatid},
+		Name:      string(name),
+	})
+	if err != nil {
+		return 0, err
+	}
+	var created tgbotapi.ForumTopic
+	if err := json.Unmarshal(resp.Result, &created); err != nil {
+		return 0, err
+	}
+
+	b.Lock()
+	defer b.Unlock()
+	// we may have learned about a topic for the sub-channel in the meantime
+	if id, ok := b.findTopic(chatid, subChannel); ok {
+		b.Log.Warnf("Created topic %s (%d) in %d but %s already has topic %d", created.Name, created.MessageThreadID, chatid, subChannel, id)
+		return id, nil
+	}
+	if b.topics[chatid] == nil {
+		b.topics[chatid] = make(map[int]*forumTopic)
+	}
+	b.topics[chatid][created.MessageThreadID] = &forumTopic{Name: created.Name, Remote: subChannel}
+	b.saveTopics()
+	b.Log.Infof("Created topic %s (%d) in %d for %s", created.Name, created.MessageThreadID, chatid, subChannel)
+	return created.MessageThreadID, nil
+}
+
+// findTopic returns the topic of the forum bridged with the sub-channel, the caller holds the lock.
+func (b *Btelegram) findTopic(chatid int64, subChannel string) (int, bool) {
+	for id, topic := range b.topics[chatid] {
+		if config.SameChannelName(topic.subChannel(), subChannel) {
+			return id, true
+		}
+	}
+	return 0, false
+}
+
+// loadTopics loads the topics of our forums saved in TopicsFile, Telegram doesn't list them.
+func (b *Btelegram) loadTopics() error {
+	path := b.GetString("TopicsFile")
+	if path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	b.Lock()
+	defer b.Unlock()
+	return json.Unmarshal(data, &b.topics)
+}
+
+// saveTopics saves the topics to TopicsFile, the caller holds the lock.
+func (b *Btelegram) saveTopics() {
+	path := b.GetString("TopicsFile")
+	if path == "" {
+		return
+	}
+	data, err := json.MarshalIndent(b.topics, "", "  ")
+	if err != nil {
+		b.Log.WithError(err).Warn("Encoding the topics failed")
+		return
+	}
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		b.Log.WithError(err).Warnf("Saving the topics to %s failed", path)
+	}
+}
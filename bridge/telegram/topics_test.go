@@ -0,0 +1,127 @@
+package btelegram
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/42wim/matterbridge/bridge/config"
+	tgbotapi "github.com/matterbridge/telegram-bot-api/v6"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestForumTopics(t *testing.T) {
+	cfg := fmt.Sprintf("[telegram.test]\nTopicsFile=%q\n", filepath.Join(t.TempDir(), "topics.json"))
+	b, api := newTestTelegram(t, cfg)
+	require.NoError(t, b.loadTopics())
+	require.NoError(t, b.JoinChannel(config.ChannelInfo{Name: "-100123", Options: config.ChannelOptions{SubChannels: true}}))
+	assert.Error(t, b.JoinChannel(config.ChannelInfo{Name: "-100123/5", Options: config.ChannelOptions{SubChannels: true}}))
+
+	sentTo := func() string {
+		api.Lock()
+		defer api.Unlock()
+		sent := api.calls["sendMessage"]
+		return sent[len(sent)-1].Get("message_thread_id")
+	}
+
+	// remote channels get a topic of their own
+	for i := 0; i < 2; i++ {
+		_, err := b.Send(config.Message{Channel: "-100123", SubChannel: "#general", Text: "hello"})
+		require.NoError(t, err)
+		assert.Equal(t, "77", sentTo())
+	}
+	api.Lock()
+	require.Len(t, api.calls["createForumTopic"], 1)
+	assert.Equal(t, "general", api.calls["createForumTopic"][0].Get("name"))
+	api.Unlock()
+
+	// messages of chats without SubChannels keep going to the chat
+	_, err := b.Send(config.Message{Channel: "-100456", SubChannel: "#general", Text: "hello"})
+	require.NoError(t, err)
+	assert.Equal(t, "", sentTo())
+
+	updates := make(chan tgbotapi.Update)
+	defer close(updates)
+	go b.handleRecv(updates)
+	receive := func(update string) config.Message {
+		var u tgbotapi.Update
+		require.NoError(t, json.Unmarshal([]byte(update), &u))
+		updates <- u
+		return <-b.Remote
+	}
+
+	rmsg := receive(`{"update_id":1,"message":{"message_id":80,"message_thread_id":77,"is_topic_message":true,"date":0,
+		"chat":{"id":-100123,"type":"supergroup","is_forum":true},"from":{"id":7,"first_name":"Alice"},"text":"hi"}}`)
+	assert.Equal(t, "-100123", rmsg.Channel)
+	assert.Equal(t, "#general", rmsg.SubChannel)
+
+	// topics created in Telegram are known from the message that created them
+	rmsg = receive(`{"update_id":2,"message":{"message_id":90,"message_thread_id":88,"is_topic_message":true,"date":0,
+		"chat":{"id":-100123,"type":"supergroup","is_forum":true},"from":{"id":7,"first_name":"Alice"},"text":"hi",
+		"reply_to_message":{"message_id":88,"date":0,"chat":{"id":-100123},"forum_topic_created":{"name":"Off topic"}}}}`)
+	assert.Equal(t, "Off topic", rmsg.SubChannel)
+	assert.Empty(t, rmsg.ParentID)
+
+	_, err = b.Send(config.Message{Channel: "-100123", SubChannel: "off-topic", Text: "hello"})
+	require.NoError(t, err)
+	assert.Equal(t, "88", sentTo())
+
+	rmsg = receive(`{"update_id":3,"message":{"message_id":91,"message_thread_id":88,"is_topic_message":true,"date":0,
+		"chat":{"id":-100123,"type":"supergroup","is_forum":true},"from":{"id":7,"first_name":"Alice"},
+		"forum_topic_edited":{"name":"Random"}}}`)
+	assert.Equal(t, config.EventTopicChange, rmsg.Event)
+	assert.Equal(t, "Off topic", rmsg.SubChannel)
+	assert.Equal(t, "renamed the topic to Random", rmsg.Text)
+
+	// renamed topics we created keep the sub-channel they were created for
+	rmsg = receive(`{"update_id":4,"message":{"message_id":92,"message_thread_id":77,"is_topic_message":true,"date":0,
+		"chat":{"id":-100123,"type":"supergroup","is_forum":true},"from":{"id":7,"first_name":"Alice"},
+		"forum_topic_edited":{"name":"Lobby"}}}`)
+	assert.Equal(t, "#general", rmsg.SubChannel)
+
+	// topics of unknown name stay channels of their own
+	rmsg = receive(`{"update_id":5,"message":{"message_id":93,"message_thread_id":99,"is_topic_message":true,"date":0,
+		"chat":{"id":-100123,"type":"supergroup","is_forum":true},"from":{"id":7,"first_name":"Alice"},"text":"hi"}}`)
+	assert.Equal(t, "-100123/99", rmsg.Channel)
+	assert.Empty(t, rmsg.SubChannel)
+
+	// the topics are known after a restart
+	b2, api2 := newTestTelegram(t, cfg)
+	require.NoError(t, b2.loadTopics())
+	require.NoError(t, b2.JoinChannel(config.ChannelInfo{Name: "-100123", Options: config.ChannelOptions{SubChannels: true}}))
+	for subChannel, topic := range map[string]string{"#general": "77", "random": "88"} {
+		_, err = b2.Send(config.Message{Channel: "-100123", SubChannel: subChannel, Text: "hello"})
+		require.NoError(t, err)
+		api2.Lock()
+		sent := api2.calls["sendMessage"]
+		assert.Equal(t, topic, sent[len(sent)-1].Get("message_thread_id"))
+		api2.Unlock()
+	}
+	assert.Empty(t, api2.calls["createForumTopic"])
+}
+
+func TestCreateTopicUnlocked(t *testing.T) {
+	b, api := newTestTelegram(t, "[telegram.test]\n")
+	require.NoError(t, b.JoinChannel(config.ChannelInfo{Name: "-100123", Options: config.ChannelOptions{SubChannels: true}}))
+
+	var locked bool
+	api.called = func(method string) {
+		if method != "createForumTopic" {
+			return
+		}
+		if locked = !b.TryLock(); locked {
+			return
+		}
+		// a message of the sub-channel's topic arrives while we create one
+		b.topics[-100123] = map[int]*forumTopic{5: {Name: "news"}}
+		b.Unlock()
+	}
+
+	id, err := b.topicID(-100123, "#news")
+	require.NoError(t, err)
+	assert.False(t, locked, "lock held while creating the topic")
+	assert.Equal(t, 5, id)
+	assert.Len(t, b.topics[-100123], 1)
+}
@@ -0,0 +1,157 @@
+package btelegram
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/42wim/matterbridge/bridge/config"
+
+	tgbotapi "github.com/matterbridge/telegram-bot-api/v6"
+)
+
+// webhook receives the updates Telegram posts in webhook mode and passes them to handleRecv.
+type webhook struct {
+	server  *http.Server
+	updates chan tgbotapi.Update
+	// done stops the requests waiting to pass their update, closed is set once updates is closed.
+	done chan struct{}
+	sync.RWMutex
+	closed bool
+}
+
+// pass passes the update to handleRecv, it returns false when the webhook is closing.
+func (wh *webhook) pass(update tgbotapi.Update) bool {
+	wh.RLock()
+	defer wh.RUnlock()
+	if wh.closed {
+		return false
+	}
+	select {
+	case wh.updates <- update:
+		return true
+	case <-wh.done:
+		return false
+	}
+}
+
+// close stops the server and closes the updates channel, which ends handleRecv.
+func (wh *webhook) close() error {
+	close(wh.done)
+	// wait for the requests passing an update
+	wh.Lock()
+	wh.closed = true
+	close(wh.updates)
+	wh.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return wh.server.Shutdown(ctx)
+}
+
+// listenWebhook serves the updates Telegram posts to WebhookURL on WebhookBindAddress and registers the webhook.
+func (b *Btelegram) listenWebhook() (tgbotapi.UpdatesChannel, error) {
+	wh, err := tgbotapi.NewWebhook(b.GetString("WebhookURL"))
+	if err != nil {
+		return nil, err
+	}
+	secret := b.GetString("WebhookSecret")
+	if secret == "" {
+		// we register the webhook on every start, a new secret is as good as a configured one
+		buf := make([]byte, 32)
+		if _, err := rand.Read(buf); err != nil {
+			return nil, err
+		}
+		secret = hex.EncodeToString(buf)
+	}
+	wh.SecretToken = secret
+
+	// an empty address would listen on a random port Telegram doesn't know about
+	if b.GetString("WebhookBindAddress") == "" {
+		return nil, errors.New("WebhookBindAddress is required with WebhookURL")
+	}
+	path := wh.URL.Path
+	if path == "" {
+		path = "/"
+	}
+	hook := &webhook{
+		updates: make(chan tgbotapi.Update, b.c.Buffer),
+		done:    make(chan struct{}),
+	}
+	mux := http.NewServeMux()
+	mux.Handle("POST "+path, b.webhookHandler(secret, hook))
+
+	// listen before registering, Telegram posts the pending updates right away
+	ln, err := net.Listen("tcp", b.GetString("WebhookBindAddress"))
+	if err != nil {
+		return nil, err
+	}
+	hook.server = &http.Server{
+		Addr:              ln.Addr().String(),
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	b.webhook = hook
+	go b.serveWebhook(hook, ln)
+
+	if _, err := b.c.Request(wh); err != nil {
+		b.closeWebhook()
+		return nil, err
+	}
+	b.Log.Infof("Registered webhook %s", wh.URL.Redacted())
+	return hook.updates, nil
+}
+
+// serveWebhook serves the webhook until it's closed, other errors make the gateway reconnect the bridge.
+func (b *Btelegram) serveWebhook(hook *webhook, ln net.Listener) {
+	var err error
+	if cert, key := b.GetString("TLSCertificate"), b.GetString("TLSKey"); cert != "" || key != "" {
+		b.Log.Infof("Listening for webhook updates on %s (TLS)", hook.server.Addr)
+		err = hook.server.ServeTLS(ln, cert, key)
+	} else {
+		b.Log.Infof("Listening for webhook updates on %s", hook.server.Addr)
+		err = hook.server.Serve(ln)
+	}
+	if err == nil || errors.Is(err, http.ErrServerClosed) {
+		return
+	}
+	b.Log.WithError(err).Error("Webhook server failed, reconnecting")
+	b.Remote <- config.Message{Username: "system", Text: "reconnect", Account: b.Account, Event: config.EventFailure}
+}
+
+// webhookHandler passes the updates with our secret token on to handleRecv.
+func (b *Btelegram) webhookHandler(secret string, hook *webhook) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := r.Header.Get("X-Telegram-Bot-Api-Secret-Token")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(secret)) != 1 {
+			b.Log.Warnf("Webhook request from %s without a valid secret token", r.RemoteAddr)
+			http.Error(w, "invalid secret token", http.StatusUnauthorized)
+			return
+		}
+		var update tgbotapi.Update
+		if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !hook.pass(update) {
+			// Telegram retries the update once we're back
+			http.Error(w, "shutting down", http.StatusServiceUnavailable)
+		}
+	})
+}
+
+func (b *Btelegram) closeWebhook() error {
+	if b.webhook == nil {
+		return nil
+	}
+	hook := b.webhook
+	b.webhook = nil
+	return hook.close()
+}
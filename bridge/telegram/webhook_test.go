@@ -0,0 +1,169 @@
+package btelegram
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/42wim/matterbridge/bridge/bridgetest"
+	"github.com/42wim/matterbridge/bridge/config"
+	tgbotapi "github.com/matterbridge/telegram-bot-api/v6"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeBotAPI answers the Bot API methods we call and records their parameters.
+type fakeBotAPI struct {
+	sync.Mutex
+	calls map[string][]url.Values
+	// called is called with the name of every method before answering it.
+	called func(method string)
+}
+
+func (api *fakeBotAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	api.Lock()
+	defer api.Unlock()
+	r.ParseMultipartForm(1 << 20)
+	method := r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]
+	api.calls[method] = append(api.calls[method], r.Form)
+	if api.called != nil {
+		api.called(method)
+	}
+	switch method {
+	case "getMe":
+		fmt.Fprint(w, `{"ok":true,"result":{"id":1,"is_bot":true,"first_name":"bridge","username":"bridgebot"}}`)
+	case "getUserProfilePhotos":
+		fmt.Fprint(w, `{"ok":true,"result":{"total_count":0,"photos":[]}}`)
+	case "createForumTopic":
+		fmt.Fprintf(w, `{"ok":true,"result":{"message_thread_id":%d,"name":%q,"icon_color":0}}`, 76+len(api.calls[method]), r.Form.Get("name"))
+	case "sendMediaGroup":
+		fmt.Fprintf(w, `{"ok":true,"result":[{"message_id":%d,"date":0,"chat":{"id":1}}]}`, 100+len(api.calls[method]))
+	case "sendPhoto", "sendVideo", "sendAudio", "sendDocument", "sendVoice", "sendMessage":
+		fmt.Fprintf(w, `{"ok":true,"result":{"message_id":%d,"date":0,"chat":{"id":1}}}`, 200+len(api.calls[method]))
+	default:
+		fmt.Fprint(w, `{"ok":true,"result":true}`)
+	}
+}
+
+func newTestTelegram(t *testing.T, cfg string) (*Btelegram, *fakeBotAPI) {
+	api := &fakeBotAPI{calls: make(map[string][]url.Values)}
+	server := httptest.NewServer(api)
+	t.Cleanup(server.Close)
+
+	b := New(bridgetest.Config("telegram.test", cfg)).(*Btelegram)
+	var err error
+	b.c, err = tgbotapi.NewBotAPIWithAPIEndpoint("token", server.URL+"/bot%s/%s")
+	require.NoError(t, err)
+	return b, api
+}
+
+func TestWebhook(t *testing.T) {
+	b, api := newTestTelegram(t, `[telegram.test]
+WebhookURL="https://bridge.example.com/telegram"
+WebhookBindAddress="127.0.0.1:0"
+WebhookSecret="s3cret"
+`)
+	updates, err := b.listenWebhook()
+	require.NoError(t, err)
+	t.Cleanup(func() { b.Disconnect() })
+	go b.handleRecv(updates)
+
+	api.Lock()
+	assert.Equal(t, "https://bridge.example.com/telegram", api.calls["setWebhook"][0].Get("url"))
+	assert.Equal(t, "s3cret", api.calls["setWebhook"][0].Get("secret_token"))
+	api.Unlock()
+
+	post := func(method, path, secret string) int {
+		update := `{"update_id":1,"message":{"message_id":42,"date":1700000000,
+			"from":{"id":7,"is_bot":false,"first_name":"Alice","username":"alice"},
+			"chat":{"id":-100123,"type":"supergroup","title":"test"},"text":"hello"}}`
+		req, err := http.NewRequest(method, "http://"+b.webhook.server.Addr+path, strings.NewReader(update))
+		require.NoError(t, err)
+		req.Header.Set("Content-Type", "application/json")
+		if secret != "" {
+			req.Header.Set("X-Telegram-Bot-Api-Secret-Token", secret)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	assert.Equal(t, http.StatusUnauthorized, post(http.MethodPost, "/telegram", ""))
+	assert.Equal(t, http.StatusUnauthorized, post(http.MethodPost, "/telegram", "wrong"))
+	assert.Equal(t, http.StatusMethodNotAllowed, post(http.MethodGet, "/telegram", "s3cret"))
+	assert.Equal(t, http.StatusNotFound, post(http.MethodPost, "/other", "s3cret"))
+	assert.Empty(t, b.Remote)
+
+	assert.Equal(t, http.StatusOK, post(http.MethodPost, "/telegram", "s3cret"))
+	rmsg := <-b.Remote
+	assert.Equal(t, "hello", rmsg.Text)
+	assert.Equal(t, "-100123", rmsg.Channel)
+	assert.Equal(t, "42", rmsg.ID)
+	assert.Equal(t, "alice", rmsg.Username)
+}
+
+func TestWebhookRandomSecret(t *testing.T) {
+	b, api := newTestTelegram(t, "[telegram.test]\nWebhookURL=\"https://bridge.example.com\"\nWebhookBindAddress=\"127.0.0.1:0\"\n")
+	_, err := b.listenWebhook()
+	require.NoError(t, err)
+	t.Cleanup(func() { b.Disconnect() })
+
+	api.Lock()
+	defer api.Unlock()
+	assert.Len(t, api.calls["setWebhook"][0].Get("secret_token"), 64)
+}
+
+func TestWebhookBindAddress(t *testing.T) {
+	b, api := newTestTelegram(t, "[telegram.test]\nWebhookURL=\"https://bridge.example.com\"\n")
+	_, err := b.listenWebhook()
+	assert.EqualError(t, err, "WebhookBindAddress is required with WebhookURL")
+
+	api.Lock()
+	defer api.Unlock()
+	assert.Empty(t, api.calls["setWebhook"])
+}
+
+func TestWebhookDisconnect(t *testing.T) {
+	b, _ := newTestTelegram(t, "[telegram.test]\nWebhookURL=\"https://bridge.example.com\"\nWebhookBindAddress=\"127.0.0.1:0\"\n")
+	updates, err := b.listenWebhook()
+	require.NoError(t, err)
+	done := make(chan struct{})
+	go func() {
+		b.handleRecv(updates)
+		close(done)
+	}()
+
+	require.NoError(t, b.Disconnect())
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("handleRecv didn't return after Disconnect")
+	}
+	assert.NoError(t, b.Disconnect())
+}
+
+func TestWebhookServeFailure(t *testing.T) {
+	b, _ := newTestTelegram(t, `[telegram.test]
+WebhookURL="https://bridge.example.com"
+WebhookBindAddress="127.0.0.1:0"
+TLSCertificate="missing.crt"
+TLSKey="missing.key"
+`)
+	_, err := b.listenWebhook()
+	require.NoError(t, err)
+	t.Cleanup(func() { b.Disconnect() })
+
+	// the gateway reconnects the bridge instead of the process exiting
+	select {
+	case rmsg := <-b.Remote:
+		assert.Equal(t, config.EventFailure, rmsg.Event)
+		assert.Equal(t, "telegram.test", rmsg.Account)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no failure event")
+	}
+}
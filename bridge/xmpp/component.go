@@ -0,0 +1,262 @@
+package bxmpp
+
+import (
+	"crypto/sha1" //nolint:gosec // the handshake of XEP-0114 uses SHA-1
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	nsComponent   = "jabber:component:accept"
+	nsStreams     = "http://etherx.jabber.org/streams"
+	nsStanzas     = "urn:ietf:params:xml:ns:xmpp-stanzas"
+	nsMUC         = "http://jabber.org/protocol/muc"
+	nsVCard       = "vcard-temp"
+	nsVCardUpdate = "vcard-temp:x:update"
+	nsPing        = "urn:xmpp:ping"
+
+	// componentTimeout is how long connecting the component and joining a room may take.
+	componentTimeout = 10 * time.Second
+)
+
+// component is an external component connection (XEP-0114), used to send the messages
+// of remote users from their own JID.
+type component struct {
+	domain     string
+	conn       net.Conn
+	dec        *xml.Decoder
+	writeMutex sync.Mutex
+}
+
+// stanza is a stanza received by the component.
+type stanza struct {
+	XMLName  xml.Name
+	From     string `xml:"from,attr"`
+	To       string `xml:"to,attr"`
+	ID       string `xml:"id,attr"`
+	Type     string `xml:"type,attr"`
+	InnerXML string `xml:",innerxml"`
+}
+
+func dialComponent(addr, domain, secret string) (*component, error) {
+	conn, err := net.DialTimeout("tcp", addr, componentTimeout)
+	if err != nil {
+		return nil, err
+	}
+	c := &component{domain: domain, conn: conn, dec: xml.NewDecoder(conn)}
+	if err := c.handshake(secret); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// handshake opens the stream and authenticates the component with the shared secret.
+func (c *component) handshake(secret string) error {
+	if err := c.conn.SetDeadline(time.Now().Add(componentTimeout)); err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(c.conn, "<?xml version='1.0'?><stream:stream xmlns='%s' xmlns:stream='%s' to='%s'>",
+		nsComponent, nsStreams, xmlEscape(c.domain)); err != nil {
+		return err
+	}
+
+	var streamID string
+	for streamID == "" {
+		tok, err := c.dec.Token()
+		if err != nil {
+			return err
+		}
+		se, ok := tok.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		if se.Name.Space != nsStreams || se.Name.Local != "stream" {
+			return fmt.Errorf("unexpected <%s/> instead of the stream", se.Name.Local)
+		}
+		for _, a := range se.Attr {
+			if a.Name.Local == "id" {
+				streamID = a.Value
+			}
+		}
+		if streamID == "" {
+			return errors.New("the server didn't send a stream id")
+		}
+	}
+
+	sum := sha1.Sum([]byte(streamID + secret)) //nolint:gosec
+	if err := c.send("<handshake>" + hex.EncodeToString(sum[:]) + "</handshake>"); err != nil {
+		return err
+	}
+	s, err := c.recv()
+	if err != nil {
+		return fmt.Errorf("component handshake failed: %w", err)
+	}
+	if s.XMLName.Local != "handshake" {
+		return fmt.Errorf("component handshake failed: unexpected <%s/>", s.XMLName.Local)
+	}
+	return c.conn.SetDeadline(time.Time{})
+}
+
+// recv returns the next stanza of the stream.
+func (c *component) recv() (*stanza, error) {
+	for {
+		tok, err := c.dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			var s stanza
+			if err := c.dec.DecodeElement(&s, &t); err != nil {
+				return nil, err
+			}
+			if s.XMLName.Space == nsStreams && s.XMLName.Local == "error" {
+				return nil, fmt.Errorf("stream error: %s", errorCondition(s.InnerXML))
+			}
+			return &s, nil
+		case xml.EndElement:
+			return nil, io.EOF
+		}
+	}
+}
+
+func (c *component) send(stanza string) error {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	if err := c.conn.SetWriteDeadline(time.Now().Add(componentTimeout)); err != nil {
+		return err
+	}
+	_, err := io.WriteString(c.conn, stanza)
+	return err
+}
+
+func (c *component) close() {
+	_ = c.send("</stream:stream>")
+	c.conn.Close()
+}
+
+// errorCondition returns the name of the first element of the error, which is its condition.
+func errorCondition(inner string) string {
+	dec := xml.NewDecoder(strings.NewReader(inner))
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return "unknown error"
+		}
+		if se, ok := tok.(xml.StartElement); ok {
+			if se.Name.Local == "error" {
+				continue
+			}
+			return se.Name.Local
+		}
+	}
+}
+
+// getComponent returns the component connection, connecting it if needed.
+// Returns nil if it can't connect, the caller must hold puppetsMutex.
+func (b *Bxmpp) getComponent() *component {
+	if b.component != nil {
+		return b.component
+	}
+	// don't retry connecting for every message
+	if time.Since(b.componentDialed) < time.Minute {
+		return nil
+	}
+	b.componentDialed = time.Now()
+	c, err := dialComponent(b.GetString("ComponentServer"), b.GetString("ComponentDomain"), b.GetString("ComponentSecret"))
+	if err != nil {
+		b.Log.WithError(err).Errorf("Unable to connect component %s, remote users are sent by the bot", b.GetString("ComponentDomain"))
+		return nil
+	}
+	b.Log.Infof("Component %s connected", c.domain)
+	b.component = c
+	go b.handleComponent(c)
+	return c
+}
+
+// handleComponent handles the stanzas sent to the component and its puppets until it disconnects.
+func (b *Bxmpp) handleComponent(c *component) {
+	for {
+		s, err := c.recv()
+		if err != nil {
+			b.puppetsMutex.Lock()
+			// the component isn't ours anymore if we closed it
+			if b.component == c {
+				b.Log.WithError(err).Warnf("Component %s disconnected", c.domain)
+				b.component = nil
+				// the server made our puppets leave their rooms
+				for occupant, p := range b.occupants {
+					delete(p.rooms, bareJID(occupant))
+				}
+				b.occupants = make(map[string]*puppet)
+			}
+			b.puppetsMutex.Unlock()
+			c.conn.Close()
+			return
+		}
+		switch s.XMLName.Local {
+		case "presence":
+			b.handlePuppetPresence(s)
+		case "iq":
+			b.handleComponentIQ(c, s)
+		}
+	}
+}
+
+// handleComponentIQ answers the queries of the vCards (XEP-0054), disco#info and pings of the puppets.
+func (b *Bxmpp) handleComponentIQ(c *component, s *stanza) {
+	if s.Type != "get" && s.Type != "set" {
+		return
+	}
+	var query struct {
+		XMLName xml.Name
+	}
+	_ = xml.Unmarshal([]byte(s.InnerXML), &query)
+
+	var result string
+	handled := true
+	b.puppetsMutex.Lock()
+	p := b.puppetJIDs[bareJID(s.To)]
+	switch {
+	case s.Type != "get":
+		handled = false
+	case query.XMLName.Space == nsPing:
+	case query.XMLName.Space == nsDiscoInfo && p == nil:
+		result = fmt.Sprintf("<query xmlns='%s'><identity category='gateway' type='matterbridge' name='matterbridge'/>"+
+			"<feature var='%s'/></query>", nsDiscoInfo, nsDiscoInfo)
+	case query.XMLName.Space == nsDiscoInfo:
+		result = fmt.Sprintf("<query xmlns='%s'><identity category='client' type='bot' name='%s'/>"+
+			"<feature var='%s'/><feature var='%s'/></query>", nsDiscoInfo, xmlEscape(p.nick), nsDiscoInfo, nsVCard)
+	case query.XMLName.Space == nsVCard && p != nil:
+		photo := ""
+		if p.avatar != nil {
+			photo = fmt.Sprintf("<PHOTO><TYPE>%s</TYPE><BINVAL>%s</BINVAL></PHOTO>",
+				xmlEscape(p.avatarType), base64.StdEncoding.EncodeToString(p.avatar))
+		}
+		result = fmt.Sprintf("<vCard xmlns='%s'><NICKNAME>%s</NICKNAME>%s</vCard>", nsVCard, xmlEscape(p.nick), photo)
+	default:
+		handled = false
+	}
+	b.puppetsMutex.Unlock()
+
+	var reply string
+	if handled {
+		reply = fmt.Sprintf("<iq type='result' from='%s' to='%s' id='%s'>%s</iq>",
+			xmlEscape(s.To), xmlEscape(s.From), xmlEscape(s.ID), result)
+	} else {
+		reply = fmt.Sprintf("<iq type='error' from='%s' to='%s' id='%s'><error type='cancel'><service-unavailable xmlns='%s'/></error></iq>",
+			xmlEscape(s.To), xmlEscape(s.From), xmlEscape(s.ID), nsStanzas)
+	}
+	if err := c.send(reply); err != nil {
+		b.Log.WithError(err).Debug("Unable to answer IQ")
+	}
+}
@@ -0,0 +1,133 @@
+package bxmpp
+
+import (
+	"crypto/sha1" //nolint:gosec
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/42wim/matterbridge/bridge/bridgetest"
+	"github.com/42wim/matterbridge/bridge/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeServer accepts a component connection like an XMPP server would.
+type fakeServer struct {
+	t    *testing.T
+	conn net.Conn
+	dec  *xml.Decoder
+}
+
+func newFakeServer(t *testing.T, secret string) (string, chan *fakeServer) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { ln.Close() })
+	servers := make(chan *fakeServer, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		s := &fakeServer{t: t, conn: conn, dec: xml.NewDecoder(conn)}
+		// the stream header of the component
+		for {
+			tok, err := s.dec.Token()
+			if err != nil {
+				return
+			}
+			if se, ok := tok.(xml.StartElement); ok && se.Name.Local == "stream" {
+				break
+			}
+		}
+		fmt.Fprintf(conn, "<stream:stream xmlns:stream='%s' xmlns='%s' from='bridge.test' id='stream-1'>", nsStreams, nsComponent)
+		handshake := s.recv()
+		sum := sha1.Sum([]byte("stream-1" + secret)) //nolint:gosec
+		if handshake.InnerXML != hex.EncodeToString(sum[:]) {
+			fmt.Fprintf(conn, "<stream:error><not-authorized xmlns='urn:ietf:params:xml:ns:xmpp-streams'/></stream:error>")
+			conn.Close()
+			return
+		}
+		fmt.Fprint(conn, "<handshake/>")
+		servers <- s
+	}()
+	return ln.Addr().String(), servers
+}
+
+func (s *fakeServer) recv() *stanza {
+	for {
+		tok, err := s.dec.Token()
+		if err != nil {
+			return &stanza{}
+		}
+		if se, ok := tok.(xml.StartElement); ok {
+			var st stanza
+			require.NoError(s.t, s.dec.DecodeElement(&st, &se))
+			return &st
+		}
+	}
+}
+
+func (s *fakeServer) send(stanza string) {
+	_, err := io.WriteString(s.conn, stanza)
+	require.NoError(s.t, err)
+}
+
+func newComponentBridge(t *testing.T, addr, secret string) *Bxmpp {
+	cfg := fmt.Sprintf("[xmpp.test]\nMuc=\"muc.test\"\nComponentDomain=\"bridge.test\"\nComponentServer=\"%s\"\nComponentSecret=\"%s\"\n", addr, secret)
+	return New(bridgetest.Config("xmpp.test", cfg)).(*Bxmpp)
+}
+
+func TestComponentHandshake(t *testing.T) {
+	addr, _ := newFakeServer(t, "secret")
+	_, err := dialComponent(addr, "bridge.test", "wrong")
+	assert.EqualError(t, err, "component handshake failed: stream error: not-authorized")
+}
+
+func TestPuppets(t *testing.T) {
+	addr, servers := newFakeServer(t, "secret")
+	b := newComponentBridge(t, addr, "secret")
+	t.Cleanup(b.closePuppets)
+
+	msg := &config.Message{Username: "Alice", UserID: "U1", Account: "discord.test", Protocol: "discord"}
+	joined := make(chan string)
+	go func() { joined <- b.puppetFor(msg, "room@muc.test") }()
+
+	server := <-servers
+	// the nick is used, the puppet retries with another one
+	presence := server.recv()
+	assert.Equal(t, "alice_discord@bridge.test", presence.From)
+	assert.Equal(t, "room@muc.test/Alice", presence.To)
+	server.send("<presence type='error' from='room@muc.test/Alice' to='alice_discord@bridge.test'><error type='cancel'>" +
+		"<conflict xmlns='urn:ietf:params:xml:ns:xmpp-stanzas'/></error></presence>")
+	presence = server.recv()
+	assert.Equal(t, "room@muc.test/Alice_", presence.To)
+	server.send("<presence from='room@muc.test/bob' to='alice_discord@bridge.test'/>")
+	server.send("<presence from='room@muc.test/Alice_' to='alice_discord@bridge.test'>" +
+		"<x xmlns='http://jabber.org/protocol/muc#user'><status code='110'/></x></presence>")
+	assert.Equal(t, "alice_discord@bridge.test", <-joined)
+	assert.True(t, b.isPuppet("room@muc.test/Alice_"))
+	assert.False(t, b.isPuppet("room@muc.test/bob"))
+
+	// the puppet has a vCard with its nick
+	server.send("<iq type='get' id='v1' from='carol@example.test/res' to='alice_discord@bridge.test'><vCard xmlns='vcard-temp'/></iq>")
+	iq := server.recv()
+	assert.Equal(t, "result", iq.Type)
+	assert.Equal(t, "v1", iq.ID)
+	assert.Contains(t, iq.InnerXML, "<NICKNAME>Alice</NICKNAME>")
+
+	// the room makes the puppet leave
+	server.send("<presence type='unavailable' from='room@muc.test/Alice_' to='alice_discord@bridge.test'/>")
+	server.send("<iq type='get' id='p1' from='carol@example.test/res' to='alice_discord@bridge.test'><ping xmlns='urn:xmpp:ping'/></iq>")
+	assert.Equal(t, "p1", server.recv().ID)
+	assert.False(t, b.isPuppet("room@muc.test/Alice_"))
+}
+
+func TestPuppetLocalpart(t *testing.T) {
+	assert.Equal(t, "alice_discord", puppetLocalpart("Alice", "discord"))
+	assert.Equal(t, "jean-luc.pjl_irc", puppetLocalpart(" Jean-Luc.P <@jl> ", "irc"))
+	assert.Equal(t, "user_slack", puppetLocalpart("@#!", "slack"))
+}
@@ -0,0 +1,169 @@
+package bxmpp
+
+import (
+	"encoding/xml"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/matterbridge/go-xmpp"
+	"github.com/rs/xid"
+)
+
+const (
+	nsMAM     = "urn:xmpp:mam:2"
+	nsRSM     = "http://jabber.org/protocol/rsm"
+	nsForward = "urn:xmpp:forward:0"
+
+	defaultBackfillLimit = 100
+	// backfillMargin is subtracted from the time we last saw a channel, in case the clock of the
+	// server differs. The messages we already relayed are skipped.
+	backfillMargin = time.Minute
+)
+
+// archivedMessage is a message forwarded in a MAM result.
+type archivedMessage struct {
+	From    string `xml:"from,attr"`
+	ID      string `xml:"id,attr"`
+	Type    string `xml:"type,attr"`
+	Body    string `xml:"body"`
+	Replace struct {
+		ID string `xml:"id,attr"`
+	} `xml:"urn:xmpp:message-correct:0 replace"`
+	Other []xmpp.XMLElement `xml:",any"`
+}
+
+// channelJID returns the JID and message type of a channel, channels with an @ are direct chats.
+func (b *Bxmpp) channelJID(channel string) (string, string) {
+	if strings.Contains(channel, "@") {
+		return channel, "chat"
+	}
+	return channel + "@" + b.GetString("Muc"), "groupchat"
+}
+
+// directChannel returns the channel of the direct chat with the JID, or "" if it isn't bridged.
+func (b *Bxmpp) directChannel(jid string) string {
+	b.RLock()
+	defer b.RUnlock()
+	return b.directs[strings.ToLower(bareJID(jid))]
+}
+
+// alreadySeen returns true if the message was already relayed, after a backfill the
+// messages of the archive can overlap with the ones we received.
+func (b *Bxmpp) alreadySeen(v xmpp.Chat) bool {
+	key := bareJID(v.Remote) + " " + originID(v)
+	if v.Type == "groupchat" {
+		if sid := stanzaID(v); sid != "" {
+			key = sid
+		}
+	}
+	seen, _ := b.seen.ContainsOrAdd(key, true)
+	return seen
+}
+
+// markSeen remembers when we last received a message in the channel.
+func (b *Bxmpp) markSeen(channel string, stamp time.Time) {
+	b.historyMutex.Lock()
+	defer b.historyMutex.Unlock()
+	if stamp.After(b.lastSeen[channel]) {
+		b.lastSeen[channel] = stamp
+	}
+}
+
+// backfill fetches the messages we missed in the channel from its Message Archive (XEP-0313).
+// Nothing is fetched when we join the channel for the first time.
+func (b *Bxmpp) backfill(channel string) {
+	b.historyMutex.Lock()
+	start, ok := b.lastSeen[channel]
+	if !ok {
+		b.lastSeen[channel] = time.Now()
+		b.historyMutex.Unlock()
+		return
+	}
+	queryID := xid.New().String()
+	archive, msgType := b.channelJID(channel)
+	with := ""
+	if msgType == "chat" {
+		// direct chats are in the archive of our account
+		archive, with = bareJID(b.xc.JID()), channel
+	}
+	b.mamQueries[queryID] = archive
+	b.historyMutex.Unlock()
+	defer func() {
+		b.historyMutex.Lock()
+		delete(b.mamQueries, queryID)
+		b.historyMutex.Unlock()
+	}()
+
+	limit := b.GetInt("BackfillLimit")
+	if limit <= 0 {
+		limit = defaultBackfillLimit
+	}
+	form := fmt.Sprintf("<field var='FORM_TYPE' type='hidden'><value>%s</value></field><field var='start'><value>%s</value></field>",
+		nsMAM, start.Add(-backfillMargin).UTC().Format(time.RFC3339))
+	if with != "" {
+		form += fmt.Sprintf("<field var='with'><value>%s</value></field>", xmlEscape(with))
+	}
+	// an empty before asks for the last page, so we get the latest messages
+	query := fmt.Sprintf("<query xmlns='%s' queryid='%s'><x xmlns='jabber:x:data' type='submit'>%s</x>"+
+		"<set xmlns='%s'><max>%d</max><before/></set></query>", nsMAM, queryID, form, nsRSM, limit)
+
+	b.Log.Debugf("Fetching the messages of %s since %s", channel, start)
+	if _, err := b.sendIQ(archive, "set", query); err != nil {
+		b.Log.WithError(err).Warnf("Unable to fetch the missed messages of %s", channel)
+	}
+}
+
+// handleArchived relays a message of the archive, returns false if the message isn't a MAM result.
+func (b *Bxmpp) handleArchived(v xmpp.Chat) bool {
+	elem := findElem(v, nsMAM, "result")
+	if elem == nil {
+		return false
+	}
+	b.historyMutex.Lock()
+	archive, ok := b.mamQueries[attr(*elem, "queryid")]
+	b.historyMutex.Unlock()
+	// results of our own archive may come without from
+	if !ok || (v.Remote != archive && !(v.Remote == "" && archive == bareJID(b.xc.JID()))) {
+		b.Log.Debugf("Ignoring unexpected archive result from %s", v.Remote)
+		return true
+	}
+
+	var result struct {
+		Forwarded struct {
+			Delay struct {
+				Stamp string `xml:"stamp,attr"`
+			} `xml:"urn:xmpp:delay delay"`
+			Message archivedMessage `xml:"message"`
+		} `xml:"urn:xmpp:forward:0 forwarded"`
+	}
+	if err := xml.Unmarshal([]byte("<result>"+elem.InnerXML+"</result>"), &result); err != nil {
+		b.Log.WithError(err).Debug("Invalid archive result")
+		return true
+	}
+	m := result.Forwarded.Message
+	chat := xmpp.Chat{
+		Remote:    m.From,
+		Type:      m.Type,
+		Text:      m.Body,
+		ID:        m.ID,
+		ReplaceID: m.Replace.ID,
+		OtherElem: m.Other,
+	}
+	// the id of the result is the stanza ID given by the archive
+	if chat.Type == "groupchat" && stanzaID(chat) == "" {
+		chat.OtherElem = append(chat.OtherElem, xmpp.XMLElement{
+			XMLName: xml.Name{Space: nsStanzaID, Local: "stanza-id"},
+			Attr: []xml.Attr{
+				{Name: xml.Name{Local: "id"}, Value: attr(*elem, "id")},
+				{Name: xml.Name{Local: "by"}, Value: archive},
+			},
+		})
+	}
+	stamp, err := time.Parse(time.RFC3339, result.Forwarded.Delay.Stamp)
+	if err != nil {
+		stamp = time.Now()
+	}
+	b.handleMessage(chat, stamp)
+	return true
+}
@@ -0,0 +1,68 @@
+package bxmpp
+
+import (
+	"testing"
+	"time"
+
+	"github.com/42wim/matterbridge/bridge/config"
+	"github.com/matterbridge/go-xmpp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func archiveResult(from, queryID, id, message string) xmpp.Chat {
+	return xmpp.Chat{
+		Remote: from,
+		OtherElem: []xmpp.XMLElement{
+			elem(nsMAM, "result", "<forwarded xmlns='urn:xmpp:forward:0'><delay xmlns='urn:xmpp:delay' stamp='2024-03-01T10:00:00Z'/>"+
+				message+"</forwarded>", "queryid", queryID, "id", id),
+		},
+	}
+}
+
+func TestHandleArchived(t *testing.T) {
+	b := newTestBridge()
+	b.mamQueries["q1"] = "room@muc.example.com"
+	b.avatarAvailability["room@muc.example.com/alice"] = false
+	msg := "<message xmlns='jabber:client' from='room@muc.example.com/alice' type='groupchat' id='m1'><body>hello</body></message>"
+
+	assert.False(t, b.handleArchived(xmpp.Chat{Remote: "room@muc.example.com/alice", Text: "hello"}))
+
+	require.True(t, b.handleArchived(archiveResult("room@muc.example.com", "q1", "sid1", msg)))
+	rmsg := <-b.Remote
+	assert.Equal(t, "hello", rmsg.Text)
+	assert.Equal(t, "alice", rmsg.Username)
+	assert.Equal(t, "room", rmsg.Channel)
+	assert.Equal(t, "sid1", rmsg.ID)
+	assert.Equal(t, time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC), rmsg.Timestamp.UTC())
+
+	// the same message again, or live after the backfill, is skipped
+	require.True(t, b.handleArchived(archiveResult("room@muc.example.com", "q1", "sid1", msg)))
+	b.handleMessage(xmpp.Chat{
+		Remote:    "room@muc.example.com/alice",
+		Type:      "groupchat",
+		Text:      "hello",
+		OtherElem: []xmpp.XMLElement{elem(nsStanzaID, "stanza-id", "", "id", "sid1", "by", "room@muc.example.com")},
+	}, time.Time{})
+
+	// results of unknown queries or from other rooms are ignored
+	require.True(t, b.handleArchived(archiveResult("room@muc.example.com", "q2", "sid2", msg)))
+	require.True(t, b.handleArchived(archiveResult("other@muc.example.com", "q1", "sid3", msg)))
+	assert.Len(t, b.Remote, 0)
+}
+
+func TestChannelJID(t *testing.T) {
+	b := newTestBridge()
+
+	jid, msgType := b.channelJID("room")
+	assert.Equal(t, "room@muc.example.com", jid)
+	assert.Equal(t, "groupchat", msgType)
+
+	jid, msgType = b.channelJID("alice@example.com")
+	assert.Equal(t, "alice@example.com", jid)
+	assert.Equal(t, "chat", msgType)
+
+	assert.NoError(t, b.JoinChannel(config.ChannelInfo{Name: "Alice@Example.com"}))
+	assert.Equal(t, "Alice@Example.com", b.directChannel("alice@example.com/phone"))
+	assert.Equal(t, "", b.directChannel("bob@example.com"))
+}
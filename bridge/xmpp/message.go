@@ -0,0 +1,268 @@
+package bxmpp
+
+import (
+	"encoding/xml"
+	"fmt"
+	"strings"
+
+	"github.com/42wim/matterbridge/bridge/config"
+	"github.com/matterbridge/go-xmpp"
+	"github.com/rs/xid"
+)
+
+const (
+	nsStanzaID      = "urn:xmpp:sid:0"
+	nsCorrect       = "urn:xmpp:message-correct:0"
+	nsRetract       = "urn:xmpp:message-retract:1"
+	nsFallback      = "urn:xmpp:fallback:0"
+	nsReply         = "urn:xmpp:reply:0"
+	nsHints         = "urn:xmpp:hints"
+	retractFallback = "This person attempted to retract a previous message, but it's unsupported by your client."
+
+	// messageCacheSize is the number of messages we remember the IDs of.
+	messageCacheSize = 5000
+)
+
+// messageInfo is what we remember of a message, keyed by its ID on the gateway and its stanza ID (XEP-0359).
+type messageInfo struct {
+	// originID is the id the sender gave the message, corrections refer to it.
+	originID string
+	// stanzaID is the id the room gave the message, replies and retractions refer to it.
+	stanzaID string
+	// gatewayID is the ID of the message on the gateway, the stanza ID or the origin id of our messages.
+	gatewayID string
+	// author is the full JID (room@muc/nick) of the sender.
+	author string
+}
+
+func newMessageInfo(v xmpp.Chat) *messageInfo {
+	return &messageInfo{originID: originID(v), stanzaID: stanzaID(v), author: v.Remote}
+}
+
+// sentBy returns true if the message was sent by the sender of v. In direct chats the
+// resource of the sender can change.
+func (info *messageInfo) sentBy(v xmpp.Chat) bool {
+	if v.Type == "groupchat" {
+		return info.author == v.Remote
+	}
+	return bareJID(info.author) == bareJID(v.Remote)
+}
+
+// stanzaID returns the stable stanza ID (XEP-0359) the room gave to the message, if any.
+func stanzaID(v xmpp.Chat) string {
+	room := bareJID(v.Remote)
+	for _, elem := range v.OtherElem {
+		// only trust IDs added by the room itself
+		if elem.XMLName.Space == nsStanzaID && elem.XMLName.Local == "stanza-id" && attr(elem, "by") == room {
+			return attr(elem, "id")
+		}
+	}
+	return ""
+}
+
+// originID returns the id the sender gave to the message.
+func originID(v xmpp.Chat) string {
+	if elem := findElem(v, nsStanzaID, "origin-id"); elem != nil && attr(*elem, "id") != "" {
+		return attr(*elem, "id")
+	}
+	return v.ID
+}
+
+// rememberMessage stores the IDs of the message and returns the ID used for it on the gateway.
+func (b *Bxmpp) rememberMessage(v xmpp.Chat) string {
+	info := newMessageInfo(v)
+	info.gatewayID = info.stanzaID
+	if info.gatewayID == "" {
+		info.gatewayID = info.originID
+	}
+	b.addMessage(info)
+	return info.gatewayID
+}
+
+func (b *Bxmpp) addMessage(info *messageInfo) {
+	if info.gatewayID != "" {
+		b.messages.Add(info.gatewayID, info)
+	}
+	if info.stanzaID == "" {
+		return
+	}
+	if info.stanzaID != info.gatewayID {
+		b.messages.Add(info.stanzaID, info)
+	}
+	if info.originID != "" {
+		b.stanzaIDs.Add(info.author+" "+info.originID, info.stanzaID)
+	}
+}
+
+// gatewayID returns the ID on the gateway of the message with the origin id sent by remote.
+func (b *Bxmpp) gatewayID(remote, origin string) string {
+	if sid, ok := b.stanzaIDs.Get(remote + " " + origin); ok {
+		return sid.(string)
+	}
+	return origin
+}
+
+func (b *Bxmpp) messageInfo(id string) *messageInfo {
+	if info, ok := b.messages.Get(id); ok {
+		return info.(*messageInfo)
+	}
+	return nil
+}
+
+// roomID returns the stanza ID of the message with the ID on the gateway, or the ID itself
+// if the room didn't give it one (yet).
+func (b *Bxmpp) roomID(id string) string {
+	if info := b.messageInfo(id); info != nil && info.stanzaID != "" {
+		return info.stanzaID
+	}
+	return id
+}
+
+// handleEcho remembers the IDs of our own messages reflected by the MUC.
+// Their ID on the gateway stays the origin id Send returned.
+func (b *Bxmpp) handleEcho(v xmpp.Chat) {
+	info := newMessageInfo(v)
+	info.gatewayID = info.originID
+	b.addMessage(info)
+}
+
+// sendMessage sends a message to the MUC and returns the origin id we gave it, the stanza ID is
+// mapped to it when the MUC reflects the message. The message is sent by the puppet with the
+// from JID if it's set.
+func (b *Bxmpp) sendMessage(from, to, msgType, text, replaceID, parentID string) (string, error) {
+	id := xid.New().String()
+
+	var extra strings.Builder
+	fmt.Fprintf(&extra, "<origin-id xmlns='%s' id='%s'/>", nsStanzaID, id)
+	if replaceID != "" {
+		fmt.Fprintf(&extra, "<replace xmlns='%s' id='%s'/>", nsCorrect, xmlEscape(replaceID))
+	}
+	if parentID != "" {
+		to := ""
+		if info := b.messageInfo(parentID); info != nil {
+			to = fmt.Sprintf(" to='%s'", xmlEscape(info.author))
+		}
+		fmt.Fprintf(&extra, "<reply xmlns='%s'%s id='%s'/>", nsReply, to, xmlEscape(b.roomID(parentID)))
+	}
+	if err := b.sendStanza(from, fmt.Sprintf("<message%s to='%s' type='%s' id='%s'><body>%s</body>%s</message>",
+		fromAttr(from), xmlEscape(to), msgType, id, xmlEscape(strings.ToValidUTF8(text, "\uFFFD")), extra.String())); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// retractMessage retracts (XEP-0424) a message we sent, from is the JID of the puppet that sent it.
+func (b *Bxmpp) retractMessage(from, to, msgType, id string) error {
+	return b.sendStanza(from, fmt.Sprintf("<message%s to='%s' type='%s' id='%s'>"+
+		"<retract xmlns='%s' id='%s'/><fallback xmlns='%s' for='%s'/><body>%s</body><store xmlns='%s'/></message>",
+		fromAttr(from), xmlEscape(to), msgType, xid.New().String(), nsRetract, xmlEscape(id), nsFallback, nsRetract, retractFallback, nsHints))
+}
+
+// sendStanza sends the stanza using the component if it's sent by a puppet, otherwise using the client.
+func (b *Bxmpp) sendStanza(from, stanza string) error {
+	if from != "" {
+		return b.sendComponent(stanza)
+	}
+	_, err := b.xc.SendOrg(stanza)
+	return err
+}
+
+func fromAttr(from string) string {
+	if from == "" {
+		return ""
+	}
+	return fmt.Sprintf(" from='%s'", xmlEscape(from))
+}
+
+// handleRetraction returns a delete event if the message retracts (XEP-0424) a previous one.
+// Retractions of messages we don't know or of other authors return an empty message.
+func (b *Bxmpp) handleRetraction(v xmpp.Chat) (config.Message, bool) {
+	elem := findElem(v, nsRetract, "retract")
+	if elem == nil || attr(*elem, "id") == "" {
+		return config.Message{}, false
+	}
+	id := attr(*elem, "id")
+	// retractions refer to the stanza ID, or the origin id when the room doesn't give them
+	info := b.messageInfo(b.gatewayID(v.Remote, id))
+	if info == nil {
+		b.Log.Debugf("%s retracted message %s we don't know", v.Remote, id)
+		return config.Message{}, true
+	}
+	// only the author can retract its message
+	if !info.sentBy(v) {
+		b.Log.Warnf("%s tried to retract message %s of %s", v.Remote, id, info.author)
+		return config.Message{}, true
+	}
+	return config.Message{
+		Username: b.parseNick(v.Remote),
+		Channel:  b.parseChannel(v.Remote),
+		Account:  b.Account,
+		UserID:   v.Remote,
+		ID:       info.gatewayID,
+		Event:    config.EventMsgDelete,
+	}, true
+}
+
+// replyTo returns the ID of the message replied to (XEP-0461) and the text without its fallback quote.
+func replyTo(v xmpp.Chat) (string, string) {
+	elem := findElem(v, nsReply, "reply")
+	if elem == nil {
+		return "", v.Text
+	}
+	return attr(*elem, "id"), stripFallback(v, nsReply)
+}
+
+// stripFallback removes the fallback (XEP-0428) for the feature from the text.
+func stripFallback(v xmpp.Chat, feature string) string {
+	for _, elem := range v.OtherElem {
+		if elem.XMLName.Space != nsFallback || elem.XMLName.Local != "fallback" || attr(elem, "for") != feature {
+			continue
+		}
+		var fallback struct {
+			Body []struct {
+				Start *int `xml:"start,attr"`
+				End   *int `xml:"end,attr"`
+			} `xml:"body"`
+		}
+		if err := xml.Unmarshal([]byte("<fallback>"+elem.InnerXML+"</fallback>"), &fallback); err != nil {
+			return v.Text
+		}
+		// the positions are in code points
+		text := []rune(v.Text)
+		for i := len(fallback.Body) - 1; i >= 0; i-- {
+			body := fallback.Body[i]
+			if body.Start == nil || body.End == nil || *body.Start < 0 || *body.Start > *body.End || *body.End > len(text) {
+				continue
+			}
+			text = append(text[:*body.Start], text[*body.End:]...)
+		}
+		return strings.TrimSpace(string(text))
+	}
+	return v.Text
+}
+
+func findElem(v xmpp.Chat, space, local string) *xmpp.XMLElement {
+	for i, elem := range v.OtherElem {
+		if elem.XMLName.Space == space && elem.XMLName.Local == local {
+			return &v.OtherElem[i]
+		}
+	}
+	return nil
+}
+
+func attr(elem xmpp.XMLElement, name string) string {
+	for _, a := range elem.Attr {
+		if a.Name.Local == name && a.Name.Space == "" {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+// bareJID returns the JID without its resource.
+func bareJID(jid string) string {
+	if i := strings.Index(jid, "/"); i >= 0 {
+		return jid[:i]
+	}
+	return jid
+}
@@ -0,0 +1,150 @@
+package bxmpp
+
+import (
+	"encoding/xml"
+	"testing"
+
+	"github.com/42wim/matterbridge/bridge/bridgetest"
+	"github.com/42wim/matterbridge/bridge/config"
+	"github.com/matterbridge/go-xmpp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestBridge() *Bxmpp {
+	return New(bridgetest.Config("xmpp.test", "[xmpp.test]\nMuc=\"muc.example.com\"\n")).(*Bxmpp)
+}
+
+func elem(space, local, inner string, attrs ...string) xmpp.XMLElement {
+	e := xmpp.XMLElement{XMLName: xml.Name{Space: space, Local: local}, InnerXML: inner}
+	for i := 0; i+1 < len(attrs); i += 2 {
+		e.Attr = append(e.Attr, xml.Attr{Name: xml.Name{Local: attrs[i]}, Value: attrs[i+1]})
+	}
+	return e
+}
+
+func TestStanzaIDs(t *testing.T) {
+	b := newTestBridge()
+	v := xmpp.Chat{
+		Remote: "room@muc.example.com/alice",
+		ID:     "client-id",
+		OtherElem: []xmpp.XMLElement{
+			elem(nsStanzaID, "stanza-id", "", "by", "alice@example.com", "id", "forged"),
+			elem(nsStanzaID, "stanza-id", "", "by", "room@muc.example.com", "id", "sid-1"),
+			elem(nsStanzaID, "origin-id", "", "id", "origin-1"),
+		},
+	}
+	assert.Equal(t, "sid-1", b.rememberMessage(v))
+	assert.Equal(t, "sid-1", b.gatewayID(v.Remote, "origin-1"))
+	assert.Equal(t, "unknown", b.gatewayID(v.Remote, "unknown"))
+	assert.Equal(t, &messageInfo{originID: "origin-1", stanzaID: "sid-1", gatewayID: "sid-1", author: v.Remote}, b.messageInfo("sid-1"))
+}
+
+func TestRetraction(t *testing.T) {
+	b := newTestBridge()
+	b.rememberMessage(xmpp.Chat{
+		Remote: "room@muc.example.com/alice",
+		Type:   "groupchat",
+		OtherElem: []xmpp.XMLElement{
+			elem(nsStanzaID, "stanza-id", "", "by", "room@muc.example.com", "id", "sid-1"),
+			elem(nsStanzaID, "origin-id", "", "id", "origin-1"),
+		},
+	})
+	retract := func(remote, id string) (config.Message, bool) {
+		return b.handleRetraction(xmpp.Chat{
+			Remote:    remote,
+			Type:      "groupchat",
+			OtherElem: []xmpp.XMLElement{elem(nsRetract, "retract", "", "id", id)},
+		})
+	}
+
+	// only the author can retract the message, retractions of unknown messages are ignored
+	for _, tc := range [][2]string{
+		{"room@muc.example.com/mallory", "sid-1"},
+		{"room@muc.example.com/mallory", "origin-1"},
+		{"room@muc.example.com/alice", "unknown"},
+	} {
+		rmsg, ok := retract(tc[0], tc[1])
+		assert.True(t, ok)
+		assert.Empty(t, rmsg.Event, "%s retracting %s", tc[0], tc[1])
+	}
+	_, ok := b.handleRetraction(xmpp.Chat{Remote: "room@muc.example.com/alice", Text: "hello"})
+	assert.False(t, ok)
+
+	// by stanza ID and by origin id
+	for _, id := range []string{"sid-1", "origin-1"} {
+		rmsg, ok := retract("room@muc.example.com/alice", id)
+		assert.True(t, ok)
+		assert.Equal(t, config.EventMsgDelete, rmsg.Event)
+		assert.Equal(t, "sid-1", rmsg.ID)
+		assert.Equal(t, "room", rmsg.Channel)
+	}
+
+	// the resource of direct chats can change
+	b.rememberMessage(xmpp.Chat{Remote: "alice@example.com/phone", Type: "chat", ID: "direct-1"})
+	rmsg, ok := b.handleRetraction(xmpp.Chat{
+		Remote:    "alice@example.com/laptop",
+		Type:      "chat",
+		OtherElem: []xmpp.XMLElement{elem(nsRetract, "retract", "", "id", "direct-1")},
+	})
+	assert.True(t, ok)
+	assert.Equal(t, "direct-1", rmsg.ID)
+	rmsg, _ = b.handleRetraction(xmpp.Chat{
+		Remote:    "mallory@example.com/phone",
+		Type:      "chat",
+		OtherElem: []xmpp.XMLElement{elem(nsRetract, "retract", "", "id", "direct-1")},
+	})
+	assert.Empty(t, rmsg.Event)
+}
+
+func TestSendMessage(t *testing.T) {
+	addr, servers := newFakeServer(t, "secret")
+	b := newComponentBridge(t, addr, "secret")
+	c, err := dialComponent(addr, "bridge.test", "secret")
+	require.NoError(t, err)
+	b.component = c
+	server := <-servers
+	const puppet = "alice_discord@bridge.test"
+
+	// the message is sent without waiting for the room to reflect it
+	id, err := b.sendMessage(puppet, "room@muc.test", "groupchat", "hello", "", "")
+	require.NoError(t, err)
+	sent := server.recv()
+	assert.Equal(t, id, sent.ID)
+	assert.Contains(t, sent.InnerXML, "<origin-id xmlns='"+nsStanzaID+"' id='"+id+"'/>")
+
+	// the reflection maps the stanza ID to the origin id, which stays the gateway ID
+	b.handleEcho(xmpp.Chat{
+		Remote: "room@muc.test/Alice",
+		Type:   "groupchat",
+		OtherElem: []xmpp.XMLElement{
+			elem(nsStanzaID, "stanza-id", "", "by", "room@muc.test", "id", "sid-1"),
+			elem(nsStanzaID, "origin-id", "", "id", id),
+		},
+	})
+	assert.Equal(t, "sid-1", b.roomID(id))
+	assert.Equal(t, id, b.messageInfo("sid-1").gatewayID)
+	assert.Equal(t, "room@muc.test/Alice", b.messageInfo(id).author)
+
+	// replies refer to the stanza ID
+	_, err = b.sendMessage(puppet, "room@muc.test", "groupchat", "answer", "", id)
+	require.NoError(t, err)
+	assert.Contains(t, server.recv().InnerXML, "<reply xmlns='"+nsReply+"' to='room@muc.test/Alice' id='sid-1'/>")
+}
+
+func TestReplyTo(t *testing.T) {
+	v := xmpp.Chat{
+		Text: "> alice: hello\nhi alice",
+		OtherElem: []xmpp.XMLElement{
+			elem(nsReply, "reply", "", "to", "room@muc.example.com/alice", "id", "sid-1"),
+			elem(nsFallback, "fallback", "<body start='0' end='15'/>", "for", nsReply),
+		},
+	}
+	parentID, text := replyTo(v)
+	assert.Equal(t, "sid-1", parentID)
+	assert.Equal(t, "hi alice", text)
+
+	parentID, text = replyTo(xmpp.Chat{Text: "hello"})
+	assert.Equal(t, "", parentID)
+	assert.Equal(t, "hello", text)
+}
@@ -0,0 +1,392 @@
+package bxmpp
+
+import (
+	"crypto/sha1" //nolint:gosec // XEP-0153 uses SHA-1 to identify avatars
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/42wim/matterbridge/bridge/config"
+	"github.com/42wim/matterbridge/bridge/helper"
+)
+
+const (
+	defaultPuppetIdleTimeout = 30 * time.Minute
+	// puppetJoinAttempts is how many nicks we try when the nick of a puppet is already used in a room.
+	puppetJoinAttempts = 3
+)
+
+var errNickConflict = errors.New("nick is already used in the room")
+
+// puppet is the JID of a remote user on the component.
+type puppet struct {
+	key  string
+	jid  string
+	nick string
+	// avatarURL is the avatar of the remote user, avatar its data once downloaded.
+	avatarURL  string
+	avatar     []byte
+	avatarType string
+	avatarHash string
+	// rooms are the rooms the puppet joined, with the nick it got there.
+	rooms    map[string]string
+	lastUsed time.Time
+}
+
+// puppetFor returns the JID of the puppet sending the message to the room, or "" if the bot needs to send it.
+func (b *Bxmpp) puppetFor(msg *config.Message, room string) string {
+	if b.GetString("ComponentDomain") == "" {
+		return ""
+	}
+	// corrections and retractions need to come from the author of the message
+	if msg.ID != "" {
+		if info := b.messageInfo(msg.ID); info != nil {
+			b.puppetsMutex.Lock()
+			defer b.puppetsMutex.Unlock()
+			if p, ok := b.occupants[info.author]; ok {
+				p.lastUsed = time.Now()
+				return p.jid
+			}
+		}
+		return ""
+	}
+	if msg.Event != "" && msg.Event != config.EventUserAction {
+		return ""
+	}
+	p := b.getPuppet(msg)
+	if p == nil {
+		return ""
+	}
+	if err := b.joinPuppet(p, room); err != nil {
+		b.Log.WithError(err).Warnf("%s can't join %s, sending the message with the bot", p.jid, room)
+		return ""
+	}
+	return p.jid
+}
+
+// getPuppet returns the puppet of the remote user, creating it if needed.
+func (b *Bxmpp) getPuppet(msg *config.Message) *puppet {
+	nick := strings.TrimSpace(msg.Username)
+	if nick == "" {
+		return nil
+	}
+	userID := msg.UserID
+	if userID == "" {
+		userID = nick
+	}
+	key := msg.Account + "/" + userID
+
+	b.puppetsMutex.Lock()
+	defer b.puppetsMutex.Unlock()
+	if b.getComponent() == nil {
+		return nil
+	}
+	p, ok := b.puppets[key]
+	if !ok {
+		localpart := puppetLocalpart(nick, msg.Protocol)
+		jid := localpart + "@" + b.GetString("ComponentDomain")
+		for i := 2; b.puppetJIDs[jid] != nil; i++ {
+			jid = localpart + strconv.Itoa(i) + "@" + b.GetString("ComponentDomain")
+		}
+		p = &puppet{key: key, jid: jid, nick: nick, rooms: make(map[string]string)}
+		b.puppets[key] = p
+		b.puppetJIDs[jid] = p
+		b.Log.Debugf("Created puppet %s for %s", jid, key)
+	}
+	p.lastUsed = time.Now()
+	if msg.Avatar != p.avatarURL {
+		p.avatarURL = msg.Avatar
+		go b.updatePuppetAvatar(p, msg.Avatar)
+	}
+	return p
+}
+
+// joinPuppet makes the puppet join the room if it didn't yet, adding "_" to its nick if it's used.
+func (b *Bxmpp) joinPuppet(p *puppet, room string) error {
+	b.puppetsMutex.Lock()
+	if _, ok := p.rooms[room]; ok {
+		b.puppetsMutex.Unlock()
+		return nil
+	}
+	b.puppetsMutex.Unlock()
+
+	key := p.jid + " " + room
+	presences := make(chan *stanza, 100)
+	b.iqMutex.Lock()
+	b.presences[key] = presences
+	b.iqMutex.Unlock()
+	defer func() {
+		b.iqMutex.Lock()
+		delete(b.presences, key)
+		b.iqMutex.Unlock()
+	}()
+
+	nick := p.nick
+	for attempt := 0; attempt < puppetJoinAttempts; attempt++ {
+		if err := b.sendComponent(b.puppetPresence(p, room+"/"+nick, true)); err != nil {
+			return err
+		}
+		joined, err := waitJoined(presences, room+"/"+nick)
+		if errors.Is(err, errNickConflict) {
+			nick += "_"
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		b.puppetsMutex.Lock()
+		p.rooms[room] = joined
+		b.occupants[room+"/"+joined] = p
+		b.puppetsMutex.Unlock()
+		b.Log.Debugf("%s joined %s as %s", p.jid, room, joined)
+		return nil
+	}
+	return errNickConflict
+}
+
+// waitJoined waits for the self-presence of the occupant and returns its nick, which the room can change.
+func waitJoined(presences chan *stanza, occupant string) (string, error) {
+	timeout := time.After(componentTimeout)
+	for {
+		select {
+		case s := <-presences:
+			var presence struct {
+				X struct {
+					Status []struct {
+						Code string `xml:"code,attr"`
+					} `xml:"status"`
+				} `xml:"http://jabber.org/protocol/muc#user x"`
+				Error struct {
+					InnerXML string `xml:",innerxml"`
+				} `xml:"error"`
+			}
+			if err := xml.Unmarshal([]byte("<presence>"+s.InnerXML+"</presence>"), &presence); err != nil {
+				continue
+			}
+			if s.Type == "error" {
+				if s.From != occupant {
+					continue
+				}
+				if condition := errorCondition(presence.Error.InnerXML); condition != "conflict" {
+					return "", fmt.Errorf("joining failed: %s", condition)
+				}
+				return "", errNickConflict
+			}
+			if s.Type != "" {
+				continue
+			}
+			self := s.From == occupant
+			for _, status := range presence.X.Status {
+				self = self || status.Code == "110"
+			}
+			if self {
+				return resource(s.From), nil
+			}
+		case <-timeout:
+			return "", errors.New("timeout waiting for the room")
+		}
+	}
+}
+
+// handlePuppetPresence passes the presences of the rooms to joinPuppet and forgets
+// the rooms puppets have left.
+func (b *Bxmpp) handlePuppetPresence(s *stanza) {
+	b.iqMutex.Lock()
+	presences, ok := b.presences[bareJID(s.To)+" "+bareJID(s.From)]
+	b.iqMutex.Unlock()
+	if ok {
+		select {
+		case presences <- s:
+		default:
+		}
+	}
+
+	if s.Type != "unavailable" && s.Type != "error" {
+		return
+	}
+	b.puppetsMutex.Lock()
+	defer b.puppetsMutex.Unlock()
+	if p, ok := b.occupants[s.From]; ok && p.jid == bareJID(s.To) {
+		b.Log.Debugf("%s left %s", p.jid, s.From)
+		delete(b.occupants, s.From)
+		delete(p.rooms, bareJID(s.From))
+	}
+}
+
+// puppetPresence returns the presence of the puppet in the room, join adds the MUC element to join it.
+func (b *Bxmpp) puppetPresence(p *puppet, occupant string, join bool) string {
+	var extra string
+	if join {
+		extra = fmt.Sprintf("<x xmlns='%s'><history maxstanzas='0'/></x>", nsMUC)
+	}
+	// tells clients to fetch the avatar in the vCard (XEP-0153)
+	b.puppetsMutex.Lock()
+	extra += fmt.Sprintf("<x xmlns='%s'><photo>%s</photo></x>", nsVCardUpdate, p.avatarHash)
+	b.puppetsMutex.Unlock()
+	return fmt.Sprintf("<presence from='%s' to='%s'>%s</presence>", xmlEscape(p.jid), xmlEscape(occupant), extra)
+}
+
+// updatePuppetAvatar downloads the avatar and updates the presence of the puppet in its rooms.
+func (b *Bxmpp) updatePuppetAvatar(p *puppet, url string) {
+	var data []byte
+	if url != "" {
+		d, err := helper.DownloadFile(url)
+		if err != nil {
+			b.Log.WithError(err).Debugf("Unable to download avatar of %s", p.jid)
+			return
+		}
+		if len(*d) > b.General.MediaDownloadSize {
+			b.Log.Debugf("Avatar of %s is too big (%d bytes)", p.jid, len(*d))
+			return
+		}
+		data = *d
+	}
+
+	b.puppetsMutex.Lock()
+	if p.avatarURL != url {
+		// changed again in the meantime
+		b.puppetsMutex.Unlock()
+		return
+	}
+	p.avatar, p.avatarType, p.avatarHash = nil, "", ""
+	if data != nil {
+		sum := sha1.Sum(data) //nolint:gosec
+		p.avatar, p.avatarType, p.avatarHash = data, http.DetectContentType(data), hex.EncodeToString(sum[:])
+	}
+	var occupants []string
+	for room, nick := range p.rooms {
+		occupants = append(occupants, room+"/"+nick)
+	}
+	b.puppetsMutex.Unlock()
+
+	for _, occupant := range occupants {
+		if err := b.sendComponent(b.puppetPresence(p, occupant, false)); err != nil {
+			b.Log.WithError(err).Debugf("Unable to update presence of %s", p.jid)
+		}
+	}
+}
+
+// isPuppet returns true if the occupant of a room is one of our puppets.
+func (b *Bxmpp) isPuppet(occupant string) bool {
+	b.puppetsMutex.Lock()
+	defer b.puppetsMutex.Unlock()
+	_, ok := b.occupants[occupant]
+	return ok
+}
+
+// sendComponent sends the stanza using the component connection.
+func (b *Bxmpp) sendComponent(stanza string) error {
+	b.puppetsMutex.Lock()
+	c := b.component
+	b.puppetsMutex.Unlock()
+	if c == nil {
+		return errors.New("component not connected")
+	}
+	return c.send(stanza)
+}
+
+// expirePuppets makes the puppets that didn't send messages for PuppetIdleTimeout leave their rooms.
+func (b *Bxmpp) expirePuppets() {
+	timeout := defaultPuppetIdleTimeout
+	if b.GetString("PuppetIdleTimeout") != "" {
+		d, err := time.ParseDuration(b.GetString("PuppetIdleTimeout"))
+		if err != nil {
+			b.Log.WithError(err).Errorf("Invalid PuppetIdleTimeout, using %s", timeout)
+		} else {
+			timeout = d
+		}
+	}
+
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for range ticker.C {
+		b.puppetsMutex.Lock()
+		var leave []string
+		for key, p := range b.puppets {
+			if time.Since(p.lastUsed) < timeout {
+				continue
+			}
+			for room, nick := range p.rooms {
+				leave = append(leave, b.leavePresence(p, room, nick))
+			}
+			b.removePuppet(key, p)
+		}
+		b.puppetsMutex.Unlock()
+		for _, presence := range leave {
+			if err := b.sendComponent(presence); err != nil {
+				b.Log.WithError(err).Debug("Unable to remove idle puppet")
+			}
+		}
+	}
+}
+
+// closePuppets makes all puppets leave their rooms and disconnects the component.
+func (b *Bxmpp) closePuppets() {
+	b.puppetsMutex.Lock()
+	defer b.puppetsMutex.Unlock()
+	c := b.component
+	for key, p := range b.puppets {
+		for room, nick := range p.rooms {
+			if c != nil {
+				_ = c.send(b.leavePresence(p, room, nick))
+			}
+		}
+		b.removePuppet(key, p)
+	}
+	if c != nil {
+		c.close()
+		b.component = nil
+	}
+}
+
+// leavePresence returns the presence making the puppet leave the room. The caller must hold puppetsMutex.
+func (b *Bxmpp) leavePresence(p *puppet, room, nick string) string {
+	return fmt.Sprintf("<presence from='%s' to='%s' type='unavailable'/>", xmlEscape(p.jid), xmlEscape(room+"/"+nick))
+}
+
+// removePuppet forgets the puppet. The caller must hold puppetsMutex.
+func (b *Bxmpp) removePuppet(key string, p *puppet) {
+	for room, nick := range p.rooms {
+		delete(b.occupants, room+"/"+nick)
+	}
+	delete(b.puppets, key)
+	delete(b.puppetJIDs, p.jid)
+}
+
+// puppetLocalpart returns the localpart of the JID of a remote user, eg alice_discord.
+func puppetLocalpart(username, protocol string) string {
+	clean := func(s string) string {
+		return strings.Map(func(r rune) rune {
+			switch {
+			case unicode.IsLetter(r), unicode.IsDigit(r):
+				return unicode.ToLower(r)
+			case r == '-', r == '_', r == '.':
+				return r
+			}
+			return -1
+		}, s)
+	}
+	localpart := strings.Trim(clean(username), "._-")
+	if localpart == "" {
+		localpart = "user"
+	}
+	if protocol = clean(protocol); protocol != "" {
+		localpart += "_" + protocol
+	}
+	return localpart
+}
+
+// resource returns the resource of a JID, which is the nick for occupants of a room.
+func resource(jid string) string {
+	if i := strings.Index(jid, "/"); i >= 0 {
+		return jid[i+1:]
+	}
+	return ""
+}
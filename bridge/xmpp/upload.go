@@ -0,0 +1,408 @@
+package bxmpp
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/42wim/matterbridge/bridge/config"
+	"github.com/42wim/matterbridge/bridge/helper"
+	"github.com/matterbridge/go-xmpp"
+	"github.com/rs/xid"
+)
+
+const (
+	nsDiscoInfo  = "http://jabber.org/protocol/disco#info"
+	nsDiscoItems = "http://jabber.org/protocol/disco#items"
+	nsHTTPUpload = "urn:xmpp:http:upload:0"
+	nsOOB        = "jabber:x:oob"
+
+	// iqTimeout is how long we wait for the server to answer an IQ.
+	iqTimeout = 30 * time.Second
+	// transferTimeout is how long an upload or download of a file may take.
+	transferTimeout = 2 * time.Minute
+)
+
+// uploadService is the XEP-0363 HTTP File Upload service of the server.
+type uploadService struct {
+	jid     string
+	maxSize int64 // 0 if the server doesn't announce a limit
+}
+
+type discoItems struct {
+	Items []struct {
+		JID string `xml:"jid,attr"`
+	} `xml:"item"`
+}
+
+type discoInfo struct {
+	Features []struct {
+		Var string `xml:"var,attr"`
+	} `xml:"feature"`
+	Forms []struct {
+		Fields []struct {
+			Var    string   `xml:"var,attr"`
+			Values []string `xml:"value"`
+		} `xml:"field"`
+	} `xml:"jabber:x:data x"`
+}
+
+type uploadSlot struct {
+	Put struct {
+		URL     string `xml:"url,attr"`
+		Headers []struct {
+			Name  string `xml:"name,attr"`
+			Value string `xml:",chardata"`
+		} `xml:"header"`
+	} `xml:"put"`
+	Get struct {
+		URL string `xml:"url,attr"`
+	} `xml:"get"`
+}
+
+// sendIQ sends an IQ to the server and waits for its answer, which is received by handleXMPP.
+func (b *Bxmpp) sendIQ(to, iqType, body string) (xmpp.IQ, error) {
+	id := "mb-" + xid.New().String()
+	answer := make(chan xmpp.IQ, 1)
+	b.iqMutex.Lock()
+	b.iqs[id] = answer
+	b.iqMutex.Unlock()
+	defer func() {
+		b.iqMutex.Lock()
+		delete(b.iqs, id)
+		b.iqMutex.Unlock()
+	}()
+
+	if _, err := b.xc.RawInformation(b.xc.JID(), to, id, iqType, body); err != nil {
+		return xmpp.IQ{}, err
+	}
+	select {
+	case iq := <-answer:
+		if iq.Type == "error" {
+			return iq, fmt.Errorf("%s returned an error for IQ %s", to, id)
+		}
+		return iq, nil
+	case <-time.After(iqTimeout):
+		return xmpp.IQ{}, fmt.Errorf("timeout waiting for an answer of %s", to)
+	}
+}
+
+// handleIQ passes an IQ answer to sendIQ, returns false if nobody is waiting for it.
+func (b *Bxmpp) handleIQ(iq xmpp.IQ) bool {
+	b.iqMutex.Lock()
+	answer, ok := b.iqs[iq.ID]
+	b.iqMutex.Unlock()
+	if ok {
+		answer <- iq
+	}
+	return ok
+}
+
+// discoverUploadService looks for the HTTP File Upload service in the items of our server.
+func (b *Bxmpp) discoverUploadService() {
+	b.setUploadService(nil)
+	if b.GetBool("NoHTTPUpload") {
+		return
+	}
+
+	domain := jidDomain(b.xc.JID())
+	iq, err := b.sendIQ(domain, "get", "<query xmlns='"+nsDiscoItems+"'/>")
+	if err != nil {
+		b.Log.WithError(err).Warn("Unable to discover the services of the server, files can't be uploaded.")
+		return
+	}
+	var items discoItems
+	if err := xml.Unmarshal(iq.Query, &items); err != nil {
+		b.Log.WithError(err).Warn("Unable to parse the services of the server.")
+		return
+	}
+
+	// some servers offer the service on their own domain
+	jids := []string{domain}
+	for _, item := range items.Items {
+		jids = append(jids, item.JID)
+	}
+	for _, jid := range jids {
+		iq, err := b.sendIQ(jid, "get", "<query xmlns='"+nsDiscoInfo+"'/>")
+		if err != nil {
+			b.Log.Debugf("disco#info of %s failed: %s", jid, err)
+			continue
+		}
+		var info discoInfo
+		if err := xml.Unmarshal(iq.Query, &info); err != nil {
+			b.Log.Debugf("disco#info of %s is invalid: %s", jid, err)
+			continue
+		}
+		if service := info.uploadService(jid); service != nil {
+			b.Log.Infof("Using %s to upload files (maximum size %d)", jid, service.maxSize)
+			b.setUploadService(service)
+			return
+		}
+	}
+	b.Log.Info("The server doesn't offer HTTP File Upload, files without a URL can't be sent.")
+}
+
+// uploadService returns the upload service if the entity supports it.
+func (info *discoInfo) uploadService(jid string) *uploadService {
+	supported := false
+	for _, f := range info.Features {
+		if f.Var == nsHTTPUpload {
+			supported = true
+		}
+	}
+	if !supported {
+		return nil
+	}
+	service := &uploadService{jid: jid}
+	for _, form := range info.Forms {
+		isUpload, maxSize := false, ""
+		for _, field := range form.Fields {
+			if len(field.Values) == 0 {
+				continue
+			}
+			switch field.Var {
+			case "FORM_TYPE":
+				isUpload = field.Values[0] == nsHTTPUpload
+			case "max-file-size":
+				maxSize = field.Values[0]
+			}
+		}
+		if isUpload && maxSize != "" {
+			service.maxSize, _ = strconv.ParseInt(maxSize, 10, 64)
+		}
+	}
+	return service
+}
+
+func (b *Bxmpp) setUploadService(service *uploadService) {
+	b.iqMutex.Lock()
+	defer b.iqMutex.Unlock()
+	b.upload = service
+}
+
+func (b *Bxmpp) getUploadService() *uploadService {
+	b.iqMutex.Lock()
+	defer b.iqMutex.Unlock()
+	return b.upload
+}
+
+// uploadFile uploads the file using HTTP File Upload (XEP-0363) and returns its URL.
+func (b *Bxmpp) uploadFile(fi *config.FileInfo) (string, error) {
+	service := b.getUploadService()
+	if service == nil {
+		return "", errors.New("no HTTP File Upload service available")
+	}
+	if fi.Data == nil {
+		return "", fmt.Errorf("no data for file %s", fi.Name)
+	}
+	size := int64(len(*fi.Data))
+	if service.maxSize > 0 && size > service.maxSize {
+		return "", fmt.Errorf("file %s is too big to upload (%d > %d)", fi.Name, size, service.maxSize)
+	}
+	contentType := mime.TypeByExtension(filepath.Ext(fi.Name))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	iq, err := b.sendIQ(service.jid, "get", fmt.Sprintf("<request xmlns='%s' filename='%s' size='%d' content-type='%s'/>",
+		nsHTTPUpload, xmlEscape(fi.Name), size, xmlEscape(contentType)))
+	if err != nil {
+		return "", fmt.Errorf("requesting an upload slot failed: %w", err)
+	}
+	var slot uploadSlot
+	if err := xml.Unmarshal(iq.Query, &slot); err != nil {
+		return "", fmt.Errorf("invalid upload slot: %w", err)
+	}
+	if slot.Put.URL == "" || slot.Get.URL == "" {
+		return "", errors.New("invalid upload slot: missing URL")
+	}
+
+	req, err := http.NewRequest(http.MethodPut, slot.Put.URL, bytes.NewReader(*fi.Data))
+	if err != nil {
+		return "", err
+	}
+	req.ContentLength = size
+	req.Header.Set("Content-Type", contentType)
+	for _, h := range slot.Put.Headers {
+		// only these headers are allowed by the XEP, without newlines
+		switch http.CanonicalHeaderKey(h.Name) {
+		case "Authorization", "Cookie", "Expires":
+			req.Header.Set(h.Name, strings.NewReplacer("\r", "", "\n", "").Replace(h.Value))
+		}
+	}
+	client := &http.Client{Timeout: transferTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		return "", fmt.Errorf("uploading %s failed: %s", fi.Name, resp.Status)
+	}
+	return slot.Get.URL, nil
+}
+
+// sharedFile returns the URL and description of the file shared in the message
+// with OOB data (XEP-0066) or as an encrypted aesgcm:// link.
+func sharedFile(rmsg *config.Message, v xmpp.Chat) (string, string) {
+	fileURL, desc := oobData(v)
+	text := strings.TrimSpace(rmsg.Text)
+	if fileURL == "" && strings.HasPrefix(text, "aesgcm://") && !strings.ContainsAny(text, " \n") {
+		fileURL = text
+	}
+	return fileURL, desc
+}
+
+// handleDownloadFile downloads the file at fileURL and adds it to the message.
+// The text is cleared if it only contained the link and the download succeeded.
+func (b *Bxmpp) handleDownloadFile(rmsg *config.Message, fileURL, desc string) {
+	u, err := url.Parse(fileURL)
+	if err != nil {
+		b.Log.WithError(err).Warnf("Invalid file URL %s", fileURL)
+		return
+	}
+	// aesgcm:// links are fetched over https
+	switch u.Scheme {
+	case "http", "https", "aesgcm":
+	default:
+		b.Log.Warnf("Not downloading %s: unsupported scheme %q", fileURL, u.Scheme)
+		return
+	}
+	if u.Host == "" {
+		b.Log.Warnf("Not downloading %s: missing host", fileURL)
+		return
+	}
+	name, _ := url.PathUnescape(path.Base(u.Path))
+	if name == "" || name == "/" || name == "." {
+		name = "file"
+	}
+	comment := desc
+	if strings.TrimSpace(rmsg.Text) != fileURL {
+		comment = rmsg.Text
+	}
+
+	if rmsg.Extra == nil {
+		rmsg.Extra = make(map[string][]interface{})
+	}
+	data, err := b.downloadFile(rmsg, u, name)
+	if err != nil {
+		b.Log.WithError(err).Warnf("Unable to download %s", name)
+		return
+	}
+	// encrypted links are useless for the other bridges
+	shareURL := fileURL
+	if u.Scheme == "aesgcm" {
+		shareURL = ""
+	}
+	helper.HandleDownloadData(b.Log, rmsg, name, comment, shareURL, data, b.General)
+	rmsg.Text = ""
+}
+
+// downloadFile downloads the file within MediaDownloadSize, decrypting aesgcm:// links.
+func (b *Bxmpp) downloadFile(rmsg *config.Message, u *url.URL, name string) (*[]byte, error) {
+	var key []byte
+	get := *u
+	if u.Scheme == "aesgcm" {
+		var err error
+		if key, err = hex.DecodeString(u.Fragment); err != nil {
+			return nil, fmt.Errorf("invalid aesgcm key: %w", err)
+		}
+		get.Scheme, get.Fragment = "https", ""
+	}
+
+	client := &http.Client{Timeout: transferTimeout}
+	resp, err := client.Get(get.String())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("download failed: %s", resp.Status)
+	}
+	if resp.ContentLength >= 0 {
+		if err := helper.HandleDownloadSize(b.Log, rmsg, name, resp.ContentLength, b.General); err != nil {
+			return nil, err
+		}
+	}
+	maxSize := int64(b.General.MediaDownloadSize)
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if err := helper.HandleDownloadSize(b.Log, rmsg, name, int64(len(data)), b.General); err != nil {
+		return nil, err
+	}
+	if key != nil {
+		if data, err = decryptAESGCM(data, key); err != nil {
+			return nil, err
+		}
+	}
+	return &data, nil
+}
+
+// decryptAESGCM decrypts the data of an aesgcm:// link, the key of the link is
+// the hex encoded IV (12 or 16 bytes) followed by the 32 bytes key.
+func decryptAESGCM(data, fragment []byte) ([]byte, error) {
+	const keySize = 32
+	ivSize := len(fragment) - keySize
+	if ivSize != 12 && ivSize != 16 {
+		return nil, fmt.Errorf("invalid aesgcm key length %d", len(fragment))
+	}
+	block, err := aes.NewCipher(fragment[ivSize:])
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCMWithNonceSize(block, ivSize)
+	if err != nil {
+		return nil, err
+	}
+	return gcm.Open(nil, fragment[:ivSize], data, nil)
+}
+
+// oobData returns the URL and description of the OOB data (XEP-0066) of the message.
+func oobData(v xmpp.Chat) (string, string) {
+	for _, elem := range v.OtherElem {
+		if elem.XMLName.Space != nsOOB || elem.XMLName.Local != "x" {
+			continue
+		}
+		var oob struct {
+			URL  string `xml:"url"`
+			Desc string `xml:"desc"`
+		}
+		if err := xml.Unmarshal([]byte("<x>"+elem.InnerXML+"</x>"), &oob); err != nil {
+			continue
+		}
+		return strings.TrimSpace(oob.URL), strings.TrimSpace(oob.Desc)
+	}
+	return "", ""
+}
+
+// jidDomain returns the domain of a JID.
+func jidDomain(jid string) string {
+	if i := strings.Index(jid, "@"); i >= 0 {
+		jid = jid[i+1:]
+	}
+	if i := strings.Index(jid, "/"); i >= 0 {
+		jid = jid[:i]
+	}
+	return jid
+}
+
+func xmlEscape(s string) string {
+	var buf bytes.Buffer
+	_ = xml.EscapeText(&buf, []byte(s))
+	return buf.String()
+}
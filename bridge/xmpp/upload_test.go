@@ -0,0 +1,95 @@
+package bxmpp
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/42wim/matterbridge/bridge/config"
+	"github.com/matterbridge/go-xmpp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiscoInfoUploadService(t *testing.T) {
+	query := `<query xmlns='http://jabber.org/protocol/disco#info'>
+		<identity category='store' type='file' name='HTTP File Upload'/>
+		<feature var='urn:xmpp:http:upload:0'/>
+		<x type='result' xmlns='jabber:x:data'>
+			<field var='FORM_TYPE' type='hidden'><value>urn:xmpp:http:upload:0</value></field>
+			<field var='max-file-size'><value>5242880</value></field>
+		</x>
+	</query>`
+	var info discoInfo
+	require.NoError(t, xml.Unmarshal([]byte(query), &info))
+	assert.Equal(t, &uploadService{jid: "upload.example.com", maxSize: 5242880}, info.uploadService("upload.example.com"))
+
+	var other discoInfo
+	require.NoError(t, xml.Unmarshal([]byte(`<query xmlns='http://jabber.org/protocol/disco#info'><feature var='http://jabber.org/protocol/muc'/></query>`), &other))
+	assert.Nil(t, other.uploadService("conference.example.com"))
+}
+
+func TestDecryptAESGCM(t *testing.T) {
+	key := make([]byte, 32)
+	for _, ivSize := range []int{12, 16} {
+		iv := make([]byte, ivSize)
+		block, err := aes.NewCipher(key)
+		require.NoError(t, err)
+		gcm, err := cipher.NewGCMWithNonceSize(block, ivSize)
+		require.NoError(t, err)
+
+		data, err := decryptAESGCM(gcm.Seal(nil, iv, []byte("secret file"), nil), append(iv, key...))
+		require.NoError(t, err)
+		assert.Equal(t, "secret file", string(data))
+	}
+
+	_, err := decryptAESGCM([]byte("data"), key)
+	assert.Error(t, err)
+}
+
+func TestOOBData(t *testing.T) {
+	v := xmpp.Chat{OtherElem: []xmpp.XMLElement{{
+		XMLName:  xml.Name{Space: nsOOB, Local: "x"},
+		InnerXML: "<url>https://example.com/a.png</url><desc>a picture</desc>",
+	}}}
+	fileURL, desc := oobData(v)
+	assert.Equal(t, "https://example.com/a.png", fileURL)
+	assert.Equal(t, "a picture", desc)
+}
+
+func TestHandleDownloadFile(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/big.png" {
+			_, _ = w.Write(make([]byte, 64))
+			return
+		}
+		_, _ = w.Write([]byte("png"))
+	}))
+	defer srv.Close()
+	b := newTestBridge()
+	b.General = &config.Protocol{MediaDownloadSize: 16}
+
+	rmsg := config.Message{Text: srv.URL + "/a.png"}
+	b.handleDownloadFile(&rmsg, srv.URL+"/a.png", "a picture")
+	require.Len(t, rmsg.Extra["file"], 1)
+	file := rmsg.Extra["file"][0].(config.FileInfo)
+	assert.Equal(t, "a.png", file.Name)
+	assert.Equal(t, "png", string(*file.Data))
+	assert.Equal(t, "a picture", file.Comment)
+	assert.Empty(t, rmsg.Text)
+
+	// files over MediaDownloadSize are refused
+	rmsg = config.Message{Text: srv.URL + "/big.png"}
+	b.handleDownloadFile(&rmsg, srv.URL+"/big.png", "")
+	assert.Empty(t, rmsg.Extra["file"])
+	assert.Equal(t, config.EventFileFailureSize, rmsg.Event)
+
+	// only http(s) links are fetched
+	rmsg = config.Message{Text: "file:///etc/passwd"}
+	b.handleDownloadFile(&rmsg, "file:///etc/passwd", "")
+	assert.Empty(t, rmsg.Extra["file"])
+	assert.Equal(t, "file:///etc/passwd", rmsg.Text)
+}
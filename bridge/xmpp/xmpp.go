@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/url"
@@ -14,9 +15,9 @@ import (
 	"github.com/42wim/matterbridge/bridge"
 	"github.com/42wim/matterbridge/bridge/config"
 	"github.com/42wim/matterbridge/bridge/helper"
+	lru "github.com/hashicorp/golang-lru"
 	"github.com/jpillora/backoff"
 	"github.com/matterbridge/go-xmpp"
-	"github.com/rs/xid"
 )
 
 type Bxmpp struct {
@@ -30,14 +31,59 @@ type Bxmpp struct {
 
 	avatarAvailability map[string]bool
 	avatarMap          map[string]string
+
+	// iqs and presences are the answers and room presences we're waiting for,
+	// keyed by their id (or puppet and room for presences).
+	iqMutex   sync.Mutex
+	iqs       map[string]chan xmpp.IQ
+	presences map[string]chan *stanza
+	upload    *uploadService
+
+	// messages are the messages keyed by their ID on the gateway and their stanza ID,
+	// stanzaIDs maps the ids given by their senders to the stanza ID.
+	messages  *lru.Cache
+	stanzaIDs *lru.Cache
+	// seen are the messages we relayed, to skip them when they're also in the archive.
+	seen *lru.Cache
+
+	// lastSeen is when we last received a message in a channel, mamQueries the archives
+	// of our backfill queries keyed by their id.
+	historyMutex sync.Mutex
+	lastSeen     map[string]time.Time
+	mamQueries   map[string]string
+	// directs are the channel names of the direct chats, keyed by their lowercased JID.
+	directs map[string]string
+
+	// puppets are the JIDs of remote users on the component, keyed by account and user ID,
+	// puppetJIDs by JID and occupants by their full JID in the rooms.
+	puppetsMutex    sync.Mutex
+	component       *component
+	componentDialed time.Time
+	puppets         map[string]*puppet
+	puppetJIDs      map[string]*puppet
+	occupants       map[string]*puppet
 }
 
 func New(cfg *bridge.Config) bridge.Bridger {
+	messages, _ := lru.New(messageCacheSize)
+	stanzaIDs, _ := lru.New(messageCacheSize)
+	seen, _ := lru.New(messageCacheSize)
 	return &Bxmpp{
 		Config:             cfg,
 		xmppMap:            make(map[string]string),
 		avatarAvailability: make(map[string]bool),
 		avatarMap:          make(map[string]string),
+		iqs:                make(map[string]chan xmpp.IQ),
+		presences:          make(map[string]chan *stanza),
+		puppets:            make(map[string]*puppet),
+		puppetJIDs:         make(map[string]*puppet),
+		occupants:          make(map[string]*puppet),
+		messages:           messages,
+		stanzaIDs:          stanzaIDs,
+		seen:               seen,
+		lastSeen:           make(map[string]time.Time),
+		mamQueries:         make(map[string]string),
+		directs:            make(map[string]string),
 	}
 }
 
@@ -49,21 +95,45 @@ func (b *Bxmpp) Connect() error {
 	}
 
 	b.Log.Info("Connection succeeded")
+
+	if b.GetString("ComponentDomain") != "" {
+		if b.GetString("ComponentServer") == "" || b.GetString("ComponentSecret") == "" {
+			return errors.New("ComponentServer and ComponentSecret are required to use ComponentDomain")
+		}
+		b.puppetsMutex.Lock()
+		c := b.getComponent()
+		b.puppetsMutex.Unlock()
+		if c == nil {
+			return fmt.Errorf("unable to connect component %s", b.GetString("ComponentDomain"))
+		}
+		go b.expirePuppets()
+	}
+
 	go b.manageConnection()
 	return nil
 }
 
 func (b *Bxmpp) Disconnect() error {
+	b.closePuppets()
 	return nil
 }
 
 func (b *Bxmpp) JoinChannel(channel config.ChannelInfo) error {
-	if channel.Options.Key != "" {
+	switch {
+	case strings.Contains(channel.Name, "@"):
+		// channels with an @ are direct chats with the JID
+		b.Lock()
+		b.directs[strings.ToLower(bareJID(channel.Name))] = channel.Name
+		b.Unlock()
+	case channel.Options.Key != "":
 		b.Log.Debugf("using key %s for channel %s", channel.Options.Key, channel.Name)
 		b.xc.JoinProtectedMUC(channel.Name+"@"+b.GetString("Muc"), b.GetString("Nick"), channel.Options.Key, xmpp.NoHistory, 0, nil)
-	} else {
+	default:
 		b.xc.JoinMUCNoHistory(channel.Name+"@"+b.GetString("Muc"), b.GetString("Nick"))
 	}
+	if b.GetBool("Backfill") {
+		go b.backfill(channel.Name)
+	}
 	return nil
 }
 
@@ -72,24 +142,33 @@ func (b *Bxmpp) Send(msg config.Message) (string, error) {
 	if !b.Connected() {
 		return "", fmt.Errorf("bridge %s not connected, dropping message %#v to bridge", b.Account, msg)
 	}
-	// ignore delete messages
+	b.Log.Debugf("=> Receiving %#v", msg)
+
+	// Retract deleted messages, the webhook can't delete them.
 	if msg.Event == config.EventMsgDelete {
-		return "", nil
+		if msg.ID == "" || b.GetString("WebhookURL") != "" {
+			return "", nil
+		}
+		to, msgType := b.channelJID(msg.Channel)
+		from := ""
+		if msgType == "groupchat" {
+			from = b.puppetFor(&msg, to)
+		}
+		return "", b.retractMessage(from, to, msgType, b.roomID(msg.ID))
 	}
 
-	b.Log.Debugf("=> Receiving %#v", msg)
-
 	if msg.Event == config.EventAvatarDownload {
 		return b.cacheAvatar(&msg), nil
 	}
 
 	// Make a action /me of the message, prepend the username with it.
 	// https://xmpp.org/extensions/xep-0245.html
-	if msg.Event == config.EventUserAction {
+	action := msg.Event == config.EventUserAction
+	if action {
 		msg.Username = "/me " + msg.Username
 	}
 
-	// Upload a file (in XMPP case send the upload URL because XMPP has no native upload support).
+	// Upload a file (files without a URL are uploaded using HTTP File Upload if the server supports it).
 	var err error
 	if msg.Extra != nil {
 		for _, rmsg := range helper.HandleExtra(&msg, b.General) {
@@ -97,9 +176,10 @@ func (b *Bxmpp) Send(msg config.Message) (string, error) {
 			if b.GetString("WebhookURL") != "" {
 				err = b.postSlackCompatibleWebhook(msg)
 			} else {
+				to, msgType := b.channelJID(rmsg.Channel)
 				_, err = b.xc.Send(xmpp.Chat{
-					Type:   "groupchat",
-					Remote: rmsg.Channel + "@" + b.GetString("Muc"),
+					Type:   msgType,
+					Remote: to,
 					Text:   rmsg.Username + rmsg.Text,
 				})
 			}
@@ -124,22 +204,39 @@ func (b *Bxmpp) Send(msg config.Message) (string, error) {
 		return "", nil
 	}
 
-	// Post normal message.
-	var msgReplaceID string
-	msgID := xid.New().String()
+	// Post normal message, edits are corrections of the original message.
+	var msgReplaceID, parentID string
 	if msg.ID != "" {
 		msgReplaceID = msg.ID
+		if info := b.messageInfo(msg.ID); info != nil && info.originID != "" {
+			msgReplaceID = info.originID
+		}
+	}
+	if msg.ParentValid() {
+		parentID = msg.ParentID
+	}
+	// Remote users send their messages to rooms with their own JID in component mode.
+	to, msgType := b.channelJID(msg.Channel)
+	text := msg.Username + msg.Text
+	from := ""
+	if msgType == "groupchat" {
+		from = b.puppetFor(&msg, to)
+	}
+	if from != "" {
+		text = msg.Text
+		if action {
+			text = "/me " + text
+		}
 	}
 	b.Log.Debugf("=> Sending message %#v", msg)
-	if _, err := b.xc.Send(xmpp.Chat{
-		Type:      "groupchat",
-		Remote:    msg.Channel + "@" + b.GetString("Muc"),
-		Text:      msg.Username + msg.Text,
-		ID:        msgID,
-		ReplaceID: msgReplaceID,
-	}); err != nil {
+	msgID, err := b.sendMessage(from, to, msgType, text, msgReplaceID, parentID)
+	if err != nil {
 		return "", err
 	}
+	// keep the ID of the original message for further edits
+	if msg.ID != "" {
+		return msg.ID, nil
+	}
 	return msgID, nil
 }
 
@@ -280,6 +377,8 @@ func (b *Bxmpp) handleXMPP() error {
 	done := b.xmppKeepAlive()
 	defer close(done)
 
+	go b.discoverUploadService()
+
 	for {
 		m, err := b.xc.Recv()
 		if err != nil {
@@ -294,65 +393,134 @@ func (b *Bxmpp) handleXMPP() error {
 
 		switch v := m.(type) {
 		case xmpp.Chat:
-			if v.Type == "groupchat" {
-				b.Log.Debugf("== Receiving %#v", v)
-
-				// Skip invalid messages.
-				if b.skipMessage(v) {
-					continue
-				}
-
-				var event string
-				if strings.Contains(v.Text, "has set the subject to:") {
-					event = config.EventTopicChange
-				}
-
-				available, sok := b.avatarAvailability[v.Remote]
-				avatar := ""
-				if !sok {
-					b.Log.Debugf("Requesting avatar data")
-					b.avatarAvailability[v.Remote] = false
-					b.xc.AvatarRequestData(v.Remote)
-				} else if available {
-					avatar = getAvatar(b.avatarMap, v.Remote, b.General)
-				}
-
-				msgID := v.ID
-				if v.ReplaceID != "" {
-					msgID = v.ReplaceID
-				}
-				rmsg := config.Message{
-					Username: b.parseNick(v.Remote),
-					Text:     v.Text,
-					Channel:  b.parseChannel(v.Remote),
-					Account:  b.Account,
-					Avatar:   avatar,
-					UserID:   v.Remote,
-					ID:       msgID,
-					Event:    event,
-				}
-
-				// Check if we have an action event.
-				var ok bool
-				rmsg.Text, ok = b.replaceAction(rmsg.Text)
-				if ok {
-					rmsg.Event = config.EventUserAction
-				}
-
-				b.Log.Debugf("<= Sending message from %s on %s to gateway", rmsg.Username, b.Account)
-				b.Log.Debugf("<= Message is %#v", rmsg)
-				b.Remote <- rmsg
+			if b.handleArchived(v) {
+				continue
+			}
+			if v.Type == "groupchat" || (v.Type == "chat" && b.directChannel(v.Remote) != "") {
+				b.handleMessage(v, time.Time{})
 			}
 		case xmpp.AvatarData:
 			b.handleDownloadAvatar(v)
 			b.avatarAvailability[v.From] = true
 			b.Log.Debugf("Avatar for %s is now available", v.From)
+		case xmpp.IQ:
+			if !b.handleIQ(v) {
+				b.Log.Debugf("Ignoring IQ %#v", v)
+			}
 		case xmpp.Presence:
 			// Do nothing.
 		}
 	}
 }
 
+// handleMessage relays a message of a room or direct chat, stamp is the time of archived messages.
+func (b *Bxmpp) handleMessage(v xmpp.Chat, stamp time.Time) {
+	b.Log.Debugf("== Receiving %#v", v)
+	direct := v.Type == "chat"
+
+	if direct {
+		if bareJID(v.Remote) == bareJID(b.xc.JID()) {
+			return
+		}
+	} else if b.parseNick(v.Remote) == b.GetString("Nick") || b.isPuppet(v.Remote) {
+		b.handleEcho(v)
+		return
+	}
+
+	if b.alreadySeen(v) {
+		b.Log.Debugf("Skipping message %s, already relayed", v.ID)
+		return
+	}
+	channel := b.parseChannel(v.Remote)
+	if direct {
+		channel = b.directChannel(v.Remote)
+	}
+	if stamp.IsZero() {
+		b.markSeen(channel, time.Now())
+	} else {
+		b.markSeen(channel, stamp)
+	}
+
+	if rmsg, ok := b.handleRetraction(v); ok {
+		// ignored retractions aren't relayed as messages either
+		if rmsg.Event == config.EventMsgDelete {
+			rmsg.Channel = channel
+			b.Log.Debugf("<= Sending message from %s on %s to gateway", rmsg.Username, b.Account)
+			b.Remote <- rmsg
+		}
+		return
+	}
+
+	// Skip invalid messages.
+	if b.skipMessage(v) {
+		return
+	}
+
+	var event string
+	if strings.Contains(v.Text, "has set the subject to:") {
+		event = config.EventTopicChange
+	}
+
+	available, sok := b.avatarAvailability[v.Remote]
+	avatar := ""
+	if !sok {
+		b.Log.Debugf("Requesting avatar data")
+		b.avatarAvailability[v.Remote] = false
+		b.xc.AvatarRequestData(v.Remote)
+	} else if available {
+		avatar = getAvatar(b.avatarMap, v.Remote, b.General)
+	}
+
+	// corrections are edits of the original message
+	msgID := b.rememberMessage(v)
+	if v.ReplaceID != "" {
+		msgID = b.gatewayID(v.Remote, v.ReplaceID)
+	}
+	parentID, text := replyTo(v)
+	if info := b.messageInfo(parentID); info != nil {
+		parentID = info.gatewayID
+	}
+	rmsg := config.Message{
+		Username:  b.parseNick(v.Remote),
+		Text:      text,
+		Channel:   channel,
+		Account:   b.Account,
+		Avatar:    avatar,
+		UserID:    v.Remote,
+		ID:        msgID,
+		ParentID:  parentID,
+		Event:     event,
+		Timestamp: stamp,
+	}
+	if direct {
+		rmsg.Username = b.parseChannel(v.Remote)
+		rmsg.UserID = bareJID(v.Remote)
+	}
+
+	// Check if we have an action event.
+	var ok bool
+	rmsg.Text, ok = b.replaceAction(rmsg.Text)
+	if ok {
+		rmsg.Event = config.EventUserAction
+	}
+
+	if fileURL, desc := sharedFile(&rmsg, v); fileURL != "" {
+		// downloads can take a while, don't block the receive loop
+		go func() {
+			b.handleDownloadFile(&rmsg, fileURL, desc)
+			b.sendRemote(rmsg)
+		}()
+		return
+	}
+	b.sendRemote(rmsg)
+}
+
+func (b *Bxmpp) sendRemote(rmsg config.Message) {
+	b.Log.Debugf("<= Sending message from %s on %s to gateway", rmsg.Username, b.Account)
+	b.Log.Debugf("<= Message is %#v", rmsg)
+	b.Remote <- rmsg
+}
+
 func (b *Bxmpp) replaceAction(text string) (string, bool) {
 	if strings.HasPrefix(text, "/me ") {
 		return strings.Replace(text, "/me ", "", -1), true
@@ -363,9 +531,17 @@ func (b *Bxmpp) replaceAction(text string) (string, bool) {
 // handleUploadFile handles native upload of files
 func (b *Bxmpp) handleUploadFile(msg *config.Message) error {
 	var urlDesc string
+	to, msgType := b.channelJID(msg.Channel)
 
 	for _, file := range msg.Extra["file"] {
 		fileInfo := file.(config.FileInfo)
+		if fileInfo.URL == "" {
+			uploadURL, err := b.uploadFile(&fileInfo)
+			if err != nil {
+				b.Log.WithError(err).Warnf("Unable to upload %s.", fileInfo.Name)
+			}
+			fileInfo.URL = uploadURL
+		}
 		if fileInfo.Comment != "" {
 			msg.Text += fileInfo.Comment + ": "
 		}
@@ -377,8 +553,8 @@ func (b *Bxmpp) handleUploadFile(msg *config.Message) error {
 			}
 		}
 		if _, err := b.xc.Send(xmpp.Chat{
-			Type:   "groupchat",
-			Remote: msg.Channel + "@" + b.GetString("Muc"),
+			Type:   msgType,
+			Remote: to,
 			Text:   msg.Username + msg.Text,
 		}); err != nil {
 			return err
@@ -386,8 +562,8 @@ func (b *Bxmpp) handleUploadFile(msg *config.Message) error {
 
 		if fileInfo.URL != "" {
 			if _, err := b.xc.SendOOB(xmpp.Chat{
-				Type:    "groupchat",
-				Remote:  msg.Channel + "@" + b.GetString("Muc"),
+				Type:    msgType,
+				Remote:  to,
 				Ooburl:  fileInfo.URL,
 				Oobdesc: urlDesc,
 			}); err != nil {
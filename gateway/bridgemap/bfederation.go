@@ -0,0 +1,11 @@
+// +build !nofederation
+
+package bridgemap
+
+import (
+	bfederation "github.com/42wim/matterbridge/bridge/federation"
+)
+
+func init() {
+	FullMap["federation"] = bfederation.New
+}
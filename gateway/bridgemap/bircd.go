@@ -0,0 +1,11 @@
+// +build !noircd
+
+package bridgemap
+
+import (
+	bircd "github.com/42wim/matterbridge/bridge/ircd"
+)
+
+func init() {
+	FullMap["ircd"] = bircd.New
+}
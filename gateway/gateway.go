@@ -30,6 +30,9 @@ type Gateway struct {
 	Name           string
 	Messages       *lru.Cache
 
+	// paused is set by EventPauseRelay, a paused gateway doesn't relay messages
+	paused bool
+
 	logger *logrus.Entry
 }
 
@@ -252,6 +255,10 @@ func (gw *Gateway) getDestChannel(msg *config.Message, dest bridge.Bridge) []con
 			continue
 		}
 		if strings.Contains(channel.Direction, "out") && channel.Account == dest.Account && gw.validGatewayDest(msg) {
+			// messages from a sub-channel only go to the channels with the same name
+			if msg.SubChannel != "" && !channel.Options.SubChannels && !config.SameChannelName(msg.SubChannel, channel.Name) {
+				continue
+			}
 			channels = append(channels, *channel)
 		}
 	}
@@ -297,6 +304,11 @@ func (gw *Gateway) ignoreMessage(msg *config.Message) bool {
 		return true
 	}
 
+	if gw.paused {
+		gw.logger.Debugf("ignoring message %#v from %s, relaying is paused", msg, msg.Account)
+		return true
+	}
+
 	igNicks := strings.Fields(gw.Bridges[msg.Account].GetString("IgnoreNicks"))
 	igMessages := strings.Fields(gw.Bridges[msg.Account].GetString("IgnoreMessages"))
 	if gw.ignoreTextEmpty(msg) || gw.ignoreText(msg.Username, igNicks) || gw.ignoreText(msg.Text, igMessages) || gw.ignoreFilesComment(msg.Extra, igMessages) {
@@ -461,6 +473,14 @@ func (gw *Gateway) SendMessage(
 	}
 
 	msg.Channel = channel.Name
+	// channels with sub-channels send the message to the one with the name of the source
+	msg.SubChannel = ""
+	if channel.Options.SubChannels {
+		msg.SubChannel = rmsg.SubChannel
+		if msg.SubChannel == "" {
+			msg.SubChannel = rmsg.Channel
+		}
+	}
 	msg.Avatar = gw.modifyAvatar(rmsg, dest)
 	msg.Username = gw.modifyUsername(rmsg, dest)
 
@@ -5,6 +5,7 @@ import (
 	"io/ioutil"
 	"strconv"
 	"testing"
+	"time"
 
 	"github.com/42wim/matterbridge/bridge/config"
 	"github.com/42wim/matterbridge/gateway/bridgemap"
@@ -217,6 +218,89 @@ func TestGetDestChannel(t *testing.T) {
 	}
 }
 
+var testconfigSubChannels = []byte(`
+[irc.freenode]
+server=""
+[matrix.test]
+server=""
+[slack.test]
+server=""
+
+[[gateway]]
+    name = "bridge1"
+    enable=true
+
+    [[gateway.inout]]
+    account = "matrix.test"
+    channel = "#space:example.com"
+
+        [gateway.inout.options]
+        subchannels = true
+
+    [[gateway.inout]]
+    account = "irc.freenode"
+    channel = "#general"
+
+    [[gateway.inout]]
+    account="slack.test"
+    channel="off-topic"
+	`)
+
+func TestGetDestChannelSubChannels(t *testing.T) {
+	r := maketestRouter(testconfigSubChannels)
+	gw := r.Gateways["bridge1"]
+	names := func(msg *config.Message, account string) []string {
+		var names []string
+		for _, channel := range gw.getDestChannel(msg, *gw.Bridges[account]) {
+			names = append(names, channel.Name)
+		}
+		return names
+	}
+
+	// the rooms of the space only go to the channels with their name
+	msg := &config.Message{Text: "test", Channel: "#space:example.com", SubChannel: "General", Account: "matrix.test", Gateway: "bridge1"}
+	assert.Equal(t, []string{"#general"}, names(msg, "irc.freenode"))
+	assert.Nil(t, names(msg, "slack.test"))
+	msg.SubChannel = "Off Topic"
+	assert.Equal(t, []string{"off-topic"}, names(msg, "slack.test"))
+
+	// every channel goes to the space
+	msg = &config.Message{Text: "test", Channel: "off-topic", Account: "slack.test", Gateway: "bridge1"}
+	assert.Equal(t, []string{"#space:example.com"}, names(msg, "matrix.test"))
+	assert.True(t, config.SameChannelName("#general", "GENERAL"))
+	assert.False(t, config.SameChannelName("general", "generalized"))
+}
+
+func TestGatewayStatus(t *testing.T) {
+	r := maketestRouter(testconfig)
+	gw := r.Gateways["bridge1"]
+	gw.Bridges["irc.freenode"].Joined["#wimtestingirc.freenode"] = true
+	gw.Bridges["slack.test"].SetChannelMembers(&config.ChannelMembers{
+		{Nick: "alice", ChannelName: "testing"},
+		{Nick: "bob", ChannelName: "random"},
+	})
+
+	assert.Equal(t, config.GatewayStatus{
+		Name: "bridge1",
+		Bridges: []config.BridgeStatus{
+			{Account: "discord.test", Channels: []string{"general"}},
+			{Account: "irc.freenode", Connected: true, Channels: []string{"#wimtesting"}},
+			{Account: "slack.test", Channels: []string{"testing"}, Members: config.ChannelMembers{{Nick: "alice", ChannelName: "testing"}}},
+		},
+	}, gw.status())
+
+	msg := &config.Message{Text: "test", Channel: "general", Account: "discord.test"}
+	r.handleEventPauseRelay(&config.Message{Event: config.EventPauseRelay, Channel: "general", Account: "discord.test"})
+	assert.True(t, gw.status().Paused)
+	assert.True(t, gw.ignoreMessage(msg))
+	r.handleEventPauseRelay(&config.Message{Event: config.EventResumeRelay, Channel: "general", Account: "discord.test"})
+	assert.False(t, gw.ignoreMessage(msg))
+
+	// other channels don't pause the gateway
+	r.handleEventPauseRelay(&config.Message{Event: config.EventPauseRelay, Channel: "random", Account: "discord.test"})
+	assert.False(t, gw.ignoreMessage(msg))
+}
+
 func TestGetDestChannelAdvanced(t *testing.T) {
 	r := maketestRouter(testconfig3)
 	var msgs []*config.Message
@@ -507,3 +591,43 @@ func BenchmarkTengo(b *testing.B) {
 		}
 	}
 }
+
+// recordBridger is a bridge recording the messages it sends.
+type recordBridger struct {
+	sent chan config.Message
+}
+
+func (b *recordBridger) Send(msg config.Message) (string, error) {
+	b.sent <- msg
+	return "", nil
+}
+
+func (b *recordBridger) Connect() error                       { return nil }
+func (b *recordBridger) JoinChannel(config.ChannelInfo) error { return nil }
+func (b *recordBridger) Disconnect() error                    { return nil }
+
+func TestRouterTimestamp(t *testing.T) {
+	r := maketestRouter(testconfig)
+	dest := &recordBridger{sent: make(chan config.Message, 1)}
+	r.Gateways["bridge1"].Bridges["discord.test"].Bridger = dest
+	r.Gateways["bridge1"].Bridges["slack.test"].Bridger = &recordBridger{sent: make(chan config.Message, 2)}
+	done := make(chan struct{})
+	go func() {
+		r.handleReceive()
+		close(done)
+	}()
+	defer func() {
+		close(r.Message)
+		<-done
+	}()
+
+	// backfilled messages keep the time they were sent
+	sent := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	r.Message <- config.Message{Text: "missed", Username: "alice", Channel: "#wimtesting", Account: "irc.freenode", Timestamp: sent}
+	msg := <-dest.sent
+	assert.Equal(t, sent, msg.Timestamp)
+
+	r.Message <- config.Message{Text: "live", Username: "alice", Channel: "#wimtesting", Account: "irc.freenode"}
+	msg = <-dest.sent
+	assert.WithinDuration(t, time.Now(), msg.Timestamp, time.Minute)
+}
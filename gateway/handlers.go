@@ -9,6 +9,7 @@ import (
 	"os"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strings"
 	"time"
 
@@ -66,6 +67,81 @@ func (r *Router) handleEventRejoinChannels(msg *config.Message) {
 	}
 }
 
+// handleEventGetStatus answers the bridge with the status of the gateways of its channel.
+func (r *Router) handleEventGetStatus(msg *config.Message) {
+	if msg.Event != config.EventGetStatus {
+		return
+	}
+	br := r.getBridge(msg.Account)
+	if br == nil {
+		return
+	}
+	answer := config.Message{
+		Account: msg.Account,
+		Channel: msg.Channel,
+		Event:   config.EventGetStatus,
+		ID:      msg.ID,
+		Extra:   make(map[string][]interface{}),
+	}
+	for _, gw := range r.Gateways {
+		if _, ok := gw.Channels[getChannelID(msg)]; ok {
+			answer.Extra[config.EventGetStatus] = append(answer.Extra[config.EventGetStatus], gw.status())
+		}
+	}
+	if _, err := br.Send(answer); err != nil {
+		r.logger.Errorf("sending the status to %s failed: %s", msg.Account, err)
+	}
+}
+
+// handleEventPauseRelay pauses or resumes relaying on the gateways of the channel.
+func (r *Router) handleEventPauseRelay(msg *config.Message) {
+	if msg.Event != config.EventPauseRelay && msg.Event != config.EventResumeRelay {
+		return
+	}
+	for _, gw := range r.Gateways {
+		if _, ok := gw.Channels[getChannelID(msg)]; ok {
+			gw.paused = msg.Event == config.EventPauseRelay
+			if gw.paused {
+				r.logger.Infof("%s paused relaying on gateway %s", msg.Account, gw.Name)
+			} else {
+				r.logger.Infof("%s resumed relaying on gateway %s", msg.Account, gw.Name)
+			}
+		}
+	}
+}
+
+// status returns the status of the gateway and its bridges.
+func (gw *Gateway) status() config.GatewayStatus {
+	status := config.GatewayStatus{Name: gw.Name, Paused: gw.paused}
+	for _, br := range gw.Bridges {
+		bs := config.BridgeStatus{Account: br.Account}
+		for _, channel := range gw.Channels {
+			if channel.Account != br.Account {
+				continue
+			}
+			bs.Channels = append(bs.Channels, channel.Name)
+			bs.Connected = bs.Connected || (br.Bridger != nil && br.Joined[channel.ID])
+		}
+		sort.Strings(bs.Channels)
+		br.RLock()
+		if br.ChannelMembers != nil {
+			for _, member := range *br.ChannelMembers {
+				for _, name := range bs.Channels {
+					if member.ChannelName == name {
+						bs.Members = append(bs.Members, member)
+					}
+				}
+			}
+		}
+		br.RUnlock()
+		status.Bridges = append(status.Bridges, bs)
+	}
+	sort.Slice(status.Bridges, func(i, j int) bool {
+		return status.Bridges[i].Account < status.Bridges[j].Account
+	})
+	return status
+}
+
 // handleFiles uploads or places all files on the given msg to the MediaServer and
 // adds the new URL of the file on the MediaServer onto the given msg.
 func (gw *Gateway) handleFiles(msg *config.Message) {
@@ -133,6 +133,8 @@ func (r *Router) handleReceive() {
 		r.handleEventGetChannelMembers(&msg)
 		r.handleEventFailure(&msg)
 		r.handleEventRejoinChannels(&msg)
+		r.handleEventGetStatus(&msg)
+		r.handleEventPauseRelay(&msg)
 
 		// Set message protocol based on the account it came from
 		msg.Protocol = r.getBridge(msg.Account).Protocol
@@ -144,7 +146,10 @@ func (r *Router) handleReceive() {
 			if gw.ignoreMessage(&msg) {
 				continue
 			}
-			msg.Timestamp = time.Now()
+			// bridges set the time of backfilled messages and the time the server gives, keep it
+			if msg.Timestamp.IsZero() {
+				msg.Timestamp = time.Now()
+			}
 			gw.modifyMessage(&msg)
 			if !filesHandled {
 				gw.handleFiles(&msg)